@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// skipReasonStale is the skip reason of the repositories -active-since leaves out of the run
+const skipReasonStale = "stale"
+
+// parseActiveSince reads the cutoff of -active-since: a date like 2024-01-31, an RFC 3339
+// time, or a duration before now in the units of Go or in whole days or weeks like 90d or 12w
+func parseActiveSince(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	var d time.Duration
+	unit := value[len(value)-1:]
+	if n, err := strconv.Atoi(value[:len(value)-1]); err == nil && (unit == "d" || unit == "w") {
+		d = time.Duration(n) * 24 * time.Hour
+		if unit == "w" {
+			d *= 7
+		}
+	} else if d, err = time.ParseDuration(value); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid -active-since '%s', use a date like 2024-01-31 or a duration like 90d", value)
+	}
+	if d < 0 {
+		return time.Time{}, fmt.Errorf("Invalid -active-since '%s', the duration cannot be negative", value)
+	}
+	return now.Add(-d), nil
+}
+
+// lastActivity is when repo was last pushed to: the pushed_at of GitHub or the
+// last_activity_at of GitLab, the newest commit of the tips of a local repository, or
+// no later than the parent manifest when the references the remote advertises are still
+// those it recorded. It fails when none of them tells
+func lastActivity(ctx context.Context, repo Repository, auth *http.BasicAuth, parent *Manifest) (time.Time, error) {
+	if _, _, ok := archiveSource(repo.URL); ok {
+		return time.Time{}, fmt.Errorf("an archive source has no activity")
+	}
+	if dir, ok := localSourcePath(repo.URL); ok {
+		return localActivity(dir)
+	}
+	var apiErr error
+	if u, err := url.Parse(repo.URL); err == nil && (u.Scheme == "https" || u.Scheme == "http") && hostAPI(repo, u) != "" {
+		t, err := apiActivity(ctx, repo, u, auth)
+		if err == nil {
+			return t, nil
+		}
+		apiErr = err
+	}
+	var prev ManifestRepo
+	ok := false
+	if parent != nil {
+		prev, ok = parent.Find(repo)
+	}
+	if !ok || prev.Skipped != "" || prev.URL != sanitizeURL(repo.URL) {
+		if apiErr != nil {
+			return time.Time{}, apiErr
+		}
+		return time.Time{}, fmt.Errorf("the host has no known API and the parent manifest does not hold it")
+	}
+	refs, err := remoteRefs(repo.URL, auth)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for name := range refs {
+		_, captured := prev.Refs[name]
+		if repo.excluded(name) || repo.PinOnly && !captured {
+			delete(refs, name)
+		}
+	}
+	created, err := time.Parse(time.RFC3339, parent.Created)
+	if err != nil || !sameRefs(refs, prev.Refs) {
+		return time.Time{}, fmt.Errorf("the references changed since the parent manifest")
+	}
+	return created, nil
+}
+
+// apiActivity asks the GitHub or GitLab API of u when the project was last pushed to
+func apiActivity(ctx context.Context, repo Repository, u *url.URL, auth *http.BasicAuth) (time.Time, error) {
+	token := ""
+	if auth != nil {
+		token = auth.Password
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var project struct {
+		PushedAt       time.Time `json:"pushed_at"`
+		LastActivityAt time.Time `json:"last_activity_at"`
+	}
+	if hostAPI(repo, u) == "github" {
+		bearer := ""
+		if token != "" {
+			bearer = "Bearer " + token
+		}
+		if err := getJSON(ctx, githubAPIBase(u)+"/repos/"+projectPath(u), "Authorization", bearer, &project); err != nil {
+			return time.Time{}, err
+		}
+		if project.PushedAt.IsZero() {
+			return time.Time{}, fmt.Errorf("the GitHub API did not return pushed_at")
+		}
+		return project.PushedAt, nil
+	}
+	if err := getJSON(ctx, gitlabProjectAPI(u), "PRIVATE-TOKEN", token, &project); err != nil {
+		return time.Time{}, err
+	}
+	if project.LastActivityAt.IsZero() {
+		return time.Time{}, fmt.Errorf("the GitLab API did not return last_activity_at")
+	}
+	return project.LastActivityAt, nil
+}
+
+// localActivity is the newest committer time of the branches and tags of the repository at dir
+func localActivity(dir string) (time.Time, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	refs, err := r.References()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var newest time.Time
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !ref.Name().IsBranch() && !ref.Name().IsTag() {
+			return nil
+		}
+		commit, err := r.CommitObject(ref.Hash())
+		if err != nil {
+			tag, tagErr := r.TagObject(ref.Hash())
+			if tagErr != nil {
+				return nil
+			}
+			if commit, err = tag.Commit(); err != nil {
+				return nil
+			}
+		}
+		if commit.Committer.When.After(newest) {
+			newest = commit.Committer.When
+		}
+		return nil
+	})
+	if err == nil && newest.IsZero() {
+		err = fmt.Errorf("no branch or tag holds a commit")
+	}
+	return newest, err
+}
+
+// splitStale leaves the repositories of config without activity since cutoff out of it and
+// returns them with the stale skip reason. The activity of every repository is read in
+// parallel without cloning it, one whose activity cannot be told is kept in the run
+func splitStale(config *Config, cutoff time.Time, opts CloneOptions, parent *Manifest) (*Config, []Repository) {
+	last := make([]time.Time, len(config.Repos))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i := range config.Repos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, repo Repository) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t, err := lastActivity(context.Background(), repo, repoAuth(repo, opts), parent)
+			if err != nil {
+				log.Printf("Cannot tell the last activity of %s, it is included: %v", sanitizeURL(repo.URL), err)
+				return
+			}
+			last[i] = t
+		}(i, config.Repos[i])
+	}
+	wg.Wait()
+
+	active := *config
+	active.Repos = nil
+	var stale []Repository
+	for i, repo := range config.Repos {
+		if last[i].IsZero() || !last[i].Before(cutoff) {
+			active.Repos = append(active.Repos, repo)
+			continue
+		}
+		log.Printf("Skipping stale repository %s: last activity %s, before %s", sanitizeURL(repo.URL), last[i].UTC().Format(time.RFC3339), cutoff.UTC().Format(time.RFC3339))
+		repo.SkipReason = skipReasonStale
+		stale = append(stale, repo)
+	}
+	log.Printf("-active-since: %d of %d repositories active since %s", len(active.Repos), len(config.Repos), cutoff.UTC().Format(time.RFC3339))
+	return &active, stale
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// clonedRepo is sent by the clone workers to the archiver when a clone finishes
+type clonedRepo struct {
+	index int
+	path  string
+	err   error
+}
+
+// archiver appends staged repositories to a single tar stream compressed in its format,
+// it is not safe for concurrent use and must be fed by a single goroutine
+type archiver struct {
+	src  billy.Filesystem
+	zr   io.WriteCloser
+	tw   *tar.Writer
+	opts archiveOptions
+	// repoPaths are the clone paths of every configured repository, used to skip
+	// nested repositories while walking their parent
+	repoPaths map[string]bool
+	written   map[string]bool
+	// renamed maps the entries renamed by RenameInvalid to their staged names
+	renamed map[string]string
+	out     *countingWriter
+	stats   archiveStats
+}
+
+// archiveOptions are the settings of the archive written by an archiver
+type archiveOptions struct {
+	// Reproducible writes fixed timestamps and owner, and normalized modes
+	Reproducible bool
+	// NormalizeModes writes the modes of normalizedMode instead of those of the staged files
+	NormalizeModes bool
+	Format         archiveFormat
+	// Level is the compression level, 0 is the default of the format
+	Level int
+	// Owner and Group replace the owner of every entry when set, ModeMask clears mode bits
+	Owner    *tarIdentity
+	Group    *tarIdentity
+	ModeMask int64
+	// RenameInvalid percent-encodes the bytes of names that are not valid UTF-8
+	RenameInvalid bool
+}
+
+// tarIdentity is the owner or group written to the tar headers, Name may be empty
+type tarIdentity struct {
+	Name string
+	ID   int
+}
+
+// rootIdentity is the owner and group of reproducible archives
+var rootIdentity = &tarIdentity{Name: "root", ID: 0}
+
+// parseTarIdentity parses a -tar-owner or -tar-group of name, id or name:id, lookup
+// resolves a name without an id on this host, unknown names get id 0
+func parseTarIdentity(value string, lookup func(name string) (string, error)) (*tarIdentity, error) {
+	if value == "" {
+		return nil, nil
+	}
+	name, idText, hasID := strings.Cut(value, ":")
+	if !hasID {
+		if _, err := strconv.Atoi(value); err == nil {
+			name, idText, hasID = "", value, true
+		}
+	}
+	if hasID {
+		id, err := strconv.Atoi(idText)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("Invalid id '%s', expected name, id or name:id", idText)
+		}
+		return &tarIdentity{Name: name, ID: id}, nil
+	}
+	identity := &tarIdentity{Name: name}
+	if id, err := lookup(name); err == nil {
+		identity.ID, _ = strconv.Atoi(id)
+	}
+	return identity, nil
+}
+
+// archiveStats are the bytes of the files written to an archive and of the compressed
+// stream, with the file bytes of every top level directory of the archive
+type archiveStats struct {
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Ratio is BytesIn divided by BytesOut
+	Ratio       float64          `json:"ratio"`
+	Directories map[string]int64 `json:"directories"`
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newArchiver(src billy.Filesystem, w io.Writer, repoPaths map[string]bool, opts archiveOptions) (*archiver, error) {
+	if opts.Format.compress == nil {
+		opts.Format = archiveFormats[formatGzip]
+	}
+	if opts.Reproducible {
+		opts.NormalizeModes = true
+		if opts.Owner == nil {
+			opts.Owner = rootIdentity
+		}
+		if opts.Group == nil {
+			opts.Group = rootIdentity
+		}
+	}
+	out := &countingWriter{w: w}
+	zr, err := opts.Format.compress(out, opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	return &archiver{
+		src:       src,
+		zr:        zr,
+		tw:        tar.NewWriter(zr),
+		opts:      opts,
+		repoPaths: repoPaths,
+		written:   make(map[string]bool),
+		renamed:   make(map[string]string),
+		out:       out,
+		stats:     archiveStats{Directories: make(map[string]int64)},
+	}, nil
+}
+
+// Add writes the file or repository at name and any parent directories not yet in the archive
+func (a *archiver) Add(name string) error {
+	var parents []string
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+		if dir == "." || dir == "/" {
+			break
+		}
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		info, err := a.src.Lstat(parents[i])
+		if err != nil {
+			return err
+		}
+		if err := a.writeEntry(parents[i], info); err != nil {
+			return err
+		}
+	}
+
+	return util.Walk(a.src, name, func(entry string, info fs.FileInfo, err error) error {
+		// nested repositories still cloning are left out, they may be gone by the time they are read
+		if stagedClone(filepath.ToSlash(entry), a.repoPaths) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && entry != name && a.repoPaths[filepath.ToSlash(entry)] {
+			return filepath.SkipDir
+		}
+		return a.writeEntry(entry, info)
+	})
+}
+
+func (a *archiver) writeEntry(name string, info fs.FileInfo) error {
+	name = filepath.ToSlash(name)
+	if a.written[name] {
+		return nil
+	}
+	a.written[name] = true
+
+	var link string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = a.src.Readlink(name); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	entryName := name
+	if a.opts.RenameInvalid && !utf8.ValidString(name) {
+		entryName = encodeInvalidName(name)
+		if _, err := a.src.Lstat(entryName); err == nil {
+			return fmt.Errorf("Cannot rename '%s' to '%s', a file of that name exists", displayName(name), entryName)
+		}
+		a.renamed[entryName] = name
+	}
+	header.Name = path.Join("codepack", entryName)
+	if !utf8.ValidString(header.Name) || !utf8.ValidString(header.Linkname) {
+		// PAX records hold the name bytes unchanged, extractors are left to
+		// decide how to show them instead of guessing at a GNU or ustar header
+		header.Format = tar.FormatPAX
+	}
+	if a.opts.Reproducible {
+		header.ModTime = time.Unix(0, 0)
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+	}
+	if owner := a.opts.Owner; owner != nil {
+		header.Uid, header.Uname = owner.ID, owner.Name
+	}
+	if group := a.opts.Group; group != nil {
+		header.Gid, header.Gname = group.ID, group.Name
+	}
+	if a.opts.NormalizeModes {
+		header.Mode = normalizedMode(info)
+	}
+	header.Mode &^= a.opts.ModeMask
+
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := a.src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(a.tw, f)
+	a.stats.BytesIn += n
+	if top, _, nested := strings.Cut(name, "/"); nested {
+		a.stats.Directories[top] += n
+	}
+	return err
+}
+
+// encodeInvalidName replaces every byte of name that is not part of a valid UTF-8
+// sequence with %XX, % itself is encoded as %25 so the original name can be recovered
+func encodeInvalidName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if (r == utf8.RuneError && size == 1) || name[i] == '%' {
+			fmt.Fprintf(&b, "%%%02X", name[i])
+		} else {
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// escapeName writes name with the escapes of a Go string literal, without the quotes
+func escapeName(name string) string {
+	quoted := strconv.Quote(name)
+	return quoted[1 : len(quoted)-1]
+}
+
+func unescapeName(escaped string) (string, error) {
+	return strconv.Unquote(`"` + escaped + `"`)
+}
+
+// displayName is name safe to print, names that are not valid UTF-8 or hold control
+// characters are escaped so they cannot garble the terminal or the log
+func displayName(name string) string {
+	if utf8.ValidString(name) && strings.IndexFunc(name, func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		return name
+	}
+	return escapeName(name)
+}
+
+// Close ends the archive, the stats are complete once it returns
+func (a *archiver) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	err := a.zr.Close()
+	a.stats.BytesOut = a.out.n
+	if a.stats.BytesOut > 0 {
+		a.stats.Ratio = math.Round(float64(a.stats.BytesIn)/float64(a.stats.BytesOut)*100) / 100
+	}
+	return err
+}
+
+// table lists the sizes of the archive and of its top level directories, largest first
+func (s archiveStats) table() string {
+	dirs := make([]string, 0, len(s.Directories))
+	width := 0
+	for dir := range s.Directories {
+		dirs = append(dirs, dir)
+		if len(dir) > width {
+			width = len(dir)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if s.Directories[dirs[i]] != s.Directories[dirs[j]] {
+			return s.Directories[dirs[i]] > s.Directories[dirs[j]]
+		}
+		return dirs[i] < dirs[j]
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s uncompressed, %s compressed, ratio %.2f", formatBytes(s.BytesIn), formatBytes(s.BytesOut), s.Ratio)
+	for _, dir := range dirs {
+		fmt.Fprintf(&b, "\n  %-*s  %10s", width, dir, formatBytes(s.Directories[dir]))
+	}
+	return b.String()
+}
+
+// archiveRepos appends repositories to the archive as they arrive on cloned until it is closed,
+// the archive is left open for the caller to add the manifest.
+// With Reproducible set the repositories are written in configuration order, buffering
+// any that finish early, otherwise they are written in completion order
+func archiveRepos(a *archiver, cloned <-chan clonedRepo) (first time.Time, err error) {
+	// Keep receiving after a failure so the clone workers never block on a full queue
+	defer func() {
+		for range cloned {
+		}
+	}()
+
+	pending := make(map[int]clonedRepo)
+	next := 0
+	for repo := range cloned {
+		if !a.opts.Reproducible {
+			if repo.err != nil {
+				continue
+			}
+			if first.IsZero() {
+				first = time.Now()
+			}
+			if err := a.Add(repo.path); err != nil {
+				return first, err
+			}
+			continue
+		}
+
+		pending[repo.index] = repo
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if ready.err != nil {
+				continue
+			}
+			if first.IsZero() {
+				first = time.Now()
+			}
+			if err := a.Add(ready.path); err != nil {
+				return first, err
+			}
+		}
+	}
+
+	return first, nil
+}
+
+// cloneAndArchive clones every repository into staging and writes each one to
+// the archive as soon as its clone completes, overlapping the network bound
+// cloning with the CPU bound compression. A failure writing the archive
+// cancels the remaining clones
+//
+// The cloned repositories are added to manifest, which is written to the end of the archive
+func cloneAndArchive(config *Config, staging billy.Filesystem, opts CloneOptions, w io.Writer, archiveOpts archiveOptions, manifest *Manifest) error {
+	ctx, cancel := context.WithCancel(runContext)
+	defer cancel()
+
+	repoPaths := make(map[string]bool)
+	for _, repo := range config.Repos {
+		repoPaths[path.Join(repo.Path, repo.Name)] = true
+	}
+
+	log.Println("Compressing files as repositories are cloned...")
+	a, err := newArchiver(staging, w, repoPaths, archiveOpts)
+	if err != nil {
+		return err
+	}
+	if archiveOpts.Reproducible {
+		manifest.Created = ""
+		manifest.RunID = ""
+	}
+	cloned := make(chan clonedRepo, workers)
+
+	type archiveResult struct {
+		first time.Time
+		err   error
+	}
+	archiveDone := make(chan archiveResult, 1)
+	go func() {
+		first, err := archiveRepos(a, cloned)
+		if err != nil {
+			cancel()
+		}
+		archiveDone <- archiveResult{first: first, err: err}
+	}()
+
+	start := time.Now()
+	cloneErr := cloneRepos(ctx, config, staging, opts, cloned)
+	cloneEnd := time.Now()
+	close(cloned)
+
+	result := <-archiveDone
+	archiveEnd := time.Now()
+	if result.err != nil {
+		return result.err
+	}
+	if cloneErr != nil {
+		return cloneErr
+	}
+
+	config = opts.Missing.resolve(config, manifest, opts.Report)
+	if config, err = opts.Secrets.resolve(config, manifest, staging); err != nil {
+		return err
+	}
+	if err := closeArchive(a, manifest, config, staging, opts.Report); err != nil {
+		return err
+	}
+
+	var overlap time.Duration
+	if !result.first.IsZero() {
+		overlap = cloneEnd.Sub(result.first)
+	}
+	log.Printf("Cloning took %s, archiving took %s after the last clone, %s of archiving overlapped with cloning",
+		cloneEnd.Sub(start).Round(time.Millisecond),
+		archiveEnd.Sub(cloneEnd).Round(time.Millisecond),
+		overlap.Round(time.Millisecond))
+	return nil
+}
+
+// closeArchive adds the manifest of the repositories of config in staging to the archive
+// of a and writes the end of the archive, the sizes are logged and recorded in report
+func closeArchive(a *archiver, manifest *Manifest, config *Config, staging billy.Filesystem, report *runReport) error {
+	if err := completeManifest(manifest, config, staging, a.renamed, report); err != nil {
+		return err
+	}
+	if err := a.Add(manifestName); err != nil {
+		return err
+	}
+	if err := a.Close(); err != nil {
+		return err
+	}
+
+	report.RecordArchive(a.stats)
+	for _, line := range strings.Split(a.stats.table(), "\n") {
+		log.Println(line)
+	}
+	return nil
+}
+
+// completeManifest adds the cloned repositories of config to manifest and writes
+// it to the root of staging, with the entries of each repository in renamed and the
+// status report recorded for it
+func completeManifest(manifest *Manifest, config *Config, staging billy.Filesystem, renamed map[string]string, report *runReport) error {
+	renames := make(map[string][]ManifestRename)
+	for _, repo := range config.Repos {
+		renames[path.Join(repo.Path, repo.Name)] = nil
+	}
+	for entry, original := range renamed {
+		for p := entry; p != "."; p = path.Dir(p) {
+			if _, ok := renames[p]; ok {
+				renames[p] = append(renames[p], ManifestRename{Entry: entry, Original: escapeName(original)})
+				break
+			}
+		}
+	}
+
+	for _, repo := range config.Repos {
+		repoFS, err := staging.Chroot(path.Join(repo.Path, repo.Name))
+		if err != nil {
+			return err
+		}
+		var entry ManifestRepo
+		if repo.exported() {
+			entry, err = exportedManifestRepo(staging, path.Join(repo.Path, repo.Name), repoFS, manifest.Archive)
+		} else {
+			entry, err = newManifestRepo(repo, repoFS, manifest.Archive)
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read references of %s: %w", repo.URL, err)
+		}
+		entry.Renamed = renames[entry.ClonePath()]
+		sort.Slice(entry.Renamed, func(i, j int) bool { return entry.Renamed[i].Entry < entry.Renamed[j].Entry })
+		manifest.Repos = append(manifest.Repos, entry)
+	}
+	report.RecordManifest(manifest)
+	return writeStagingManifest(staging, manifest)
+}
+
+func lookupUserID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroupID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+func TestParseTarIdentity(t *testing.T) {
+	lookup := func(name string) (string, error) {
+		if name == "backup" {
+			return "1001", nil
+		}
+		return "", errors.New("unknown user")
+	}
+	for _, tc := range []struct {
+		value    string
+		expected *tarIdentity
+		invalid  bool
+	}{
+		{value: ""},
+		{value: "backup", expected: &tarIdentity{Name: "backup", ID: 1001}},
+		{value: "nobody", expected: &tarIdentity{Name: "nobody", ID: 0}},
+		{value: "2000", expected: &tarIdentity{ID: 2000}},
+		{value: "builder:2000", expected: &tarIdentity{Name: "builder", ID: 2000}},
+		{value: "builder:x", invalid: true},
+		{value: "-1", invalid: true},
+	} {
+		identity, err := parseTarIdentity(tc.value, lookup)
+		if (err != nil) != tc.invalid {
+			t.Errorf("parseTarIdentity(%q) failed with %v", tc.value, err)
+			continue
+		}
+		if tc.invalid {
+			continue
+		}
+		if (identity == nil) != (tc.expected == nil) || identity != nil && *identity != *tc.expected {
+			t.Errorf("parseTarIdentity(%q) = %+v, expected %+v", tc.value, identity, tc.expected)
+		}
+	}
+}
+
+// archiveHeaders archives the repository team/app of dir with opts and returns the headers
+// of the archive
+func archiveHeaders(t *testing.T, dir string, opts archiveOptions) []*tar.Header {
+	t.Helper()
+	var buf bytes.Buffer
+	a, err := newArchiver(osfs.New(dir), &buf, map[string]bool{"team/app": true}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add("team/app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := openArchive(&buf, int64(buf.Len()), archiveLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	var headers []*tar.Header
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+	}
+}
+
+func TestArchiveOwnerAndModes(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "team", "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	head := filepath.Join(dir, "team", "app", "HEAD")
+	if err := os.WriteFile(head, []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the umask may have cleared the write bits of group and other
+	if err := os.Chmod(head, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "team", "app"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		opts         archiveOptions
+		owner, group tarIdentity
+		fileMode     int64
+		dirMode      int64
+	}{
+		{
+			name:     "owner, group and mask",
+			opts:     archiveOptions{Owner: &tarIdentity{Name: "backup", ID: 1001}, Group: &tarIdentity{Name: "backup", ID: 1002}, ModeMask: 0022},
+			owner:    tarIdentity{Name: "backup", ID: 1001},
+			group:    tarIdentity{Name: "backup", ID: 1002},
+			fileMode: 0644,
+			dirMode:  0755,
+		},
+		{
+			name:     "reproducible",
+			opts:     archiveOptions{Reproducible: true},
+			owner:    *rootIdentity,
+			group:    *rootIdentity,
+			fileMode: 0644,
+			dirMode:  0755,
+		},
+		{
+			name:     "reproducible with an owner",
+			opts:     archiveOptions{Reproducible: true, Owner: &tarIdentity{ID: 1001}, ModeMask: 0002},
+			owner:    tarIdentity{ID: 1001},
+			group:    *rootIdentity,
+			fileMode: 0644,
+			dirMode:  0755,
+		},
+	} {
+		checked := 0
+		for _, header := range archiveHeaders(t, dir, tc.opts) {
+			if header.Uid != tc.owner.ID || header.Uname != tc.owner.Name || header.Gid != tc.group.ID || header.Gname != tc.group.Name {
+				t.Errorf("%s: %s is owned by %s:%s (%d:%d)", tc.name, header.Name, header.Uname, header.Gname, header.Uid, header.Gid)
+			}
+			switch header.Name {
+			case "codepack/team/app/HEAD":
+				checked++
+				if header.Mode != tc.fileMode {
+					t.Errorf("%s: %s has mode %o, expected %o", tc.name, header.Name, header.Mode, tc.fileMode)
+				}
+			case "codepack/team/app":
+				checked++
+				if header.Mode != tc.dirMode {
+					t.Errorf("%s: %s has mode %o, expected %o", tc.name, header.Name, header.Mode, tc.dirMode)
+				}
+			}
+		}
+		if checked != 2 {
+			t.Errorf("%s: the archive is missing the repository or its HEAD", tc.name)
+		}
+	}
+}
+
+func TestNormalizeModes(t *testing.T) {
+	dir := t.TempDir()
+	app := filepath.Join(dir, "team", "app")
+	for _, entry := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"hooks", os.ModeDir | 0700},
+		{"hooks/pre-receive", 0700},
+		{"HEAD", 0600},
+		{"config", 0664},
+	} {
+		var err error
+		if entry.mode.IsDir() {
+			err = os.MkdirAll(filepath.Join(app, entry.name), 0755)
+		} else {
+			err = os.WriteFile(filepath.Join(app, entry.name), []byte(entry.name), 0644)
+		}
+		if err == nil {
+			err = os.Chmod(filepath.Join(app, entry.name), entry.mode.Perm())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("HEAD", filepath.Join(app, "ORIG_HEAD")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	expected := map[string]int64{
+		"codepack/team/app/hooks":             0755,
+		"codepack/team/app/HEAD":              0644,
+		"codepack/team/app/hooks/pre-receive": 0755,
+		"codepack/team/app/config":            0644,
+		"codepack/team/app/ORIG_HEAD":         0777,
+	}
+	for _, opts := range []archiveOptions{{NormalizeModes: true}, {Reproducible: true}} {
+		checked := 0
+		for _, header := range archiveHeaders(t, dir, opts) {
+			mode, ok := expected[header.Name]
+			if !ok {
+				continue
+			}
+			checked++
+			if header.Mode != mode {
+				t.Errorf("%+v: %s has mode %o, expected %o", opts, header.Name, header.Mode, mode)
+			}
+		}
+		if checked != len(expected) {
+			t.Errorf("%+v: %d of the %d entries archived", opts, checked, len(expected))
+		}
+	}
+	for _, header := range archiveHeaders(t, dir, archiveOptions{}) {
+		if header.Name == "codepack/team/app/HEAD" && header.Mode != 0600 {
+			t.Errorf("without -normalize-modes HEAD has mode %o, expected the staged 0600", header.Mode)
+		}
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	for _, tc := range []struct {
+		name, encoded, display string
+	}{
+		{name: "README.md", encoded: "README.md", display: "README.md"},
+		{name: "caf\xe9.txt", encoded: "caf%E9.txt", display: `caf\xe9.txt`},
+		{name: "100%\xff", encoded: "100%25%FF", display: `100%\xff`},
+		{name: "café.txt", encoded: "café.txt", display: "café.txt"},
+		{name: "bell\a\x1b[2J", encoded: "bell\a\x1b[2J", display: `bell\a\x1b[2J`},
+	} {
+		if encoded := encodeInvalidName(tc.name); encoded != tc.encoded {
+			t.Errorf("encodeInvalidName(%q) = %q, expected %q", tc.name, encoded, tc.encoded)
+		}
+		if display := displayName(tc.name); display != tc.display {
+			t.Errorf("displayName(%q) = %q, expected %q", tc.name, display, tc.display)
+		}
+		if original, err := unescapeName(escapeName(tc.name)); err != nil || original != tc.name {
+			t.Errorf("%q was escaped and unescaped to %q, %v", tc.name, original, err)
+		}
+	}
+}
+
+func TestArchiveInvalidUTF8Names(t *testing.T) {
+	// generated here, invalid names cannot be committed on every platform
+	latin1 := "caf\xe9.txt"
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "team", "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "team", "app", latin1), []byte("menu\n"), 0644); err != nil {
+		t.Skipf("the file system does not accept invalid UTF-8 names: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		rename    bool
+		entryName string
+	}{
+		{name: "pax", entryName: "codepack/team/app/" + latin1},
+		{name: "renamed", rename: true, entryName: "codepack/team/app/caf%E9.txt"},
+	} {
+		var buf bytes.Buffer
+		a, err := newArchiver(osfs.New(dir), &buf, map[string]bool{"team/app": true}, archiveOptions{RenameInvalid: tc.rename})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Add("team/app"); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+		if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := openArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()), archiveLimits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for {
+			header, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Name == tc.entryName {
+				found = true
+				if !tc.rename && header.Format != tar.FormatPAX {
+					t.Errorf("%s: the invalid name was written as %v instead of PAX", tc.name, header.Format)
+				}
+			}
+		}
+		r.Close()
+		if !found {
+			t.Errorf("%s: the archive has no entry %q", tc.name, tc.entryName)
+		}
+		if tc.rename && a.renamed["team/app/caf%E9.txt"] != "team/app/"+latin1 {
+			t.Errorf("%s: the rename was not recorded: %q", tc.name, a.renamed)
+		}
+
+		dest := filepath.Join(t.TempDir(), "restored")
+		if err := extractArchive(archive, dest, archiveLimits{}, a.renamed, func(string) bool { return true }); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dest, "team", "app", latin1)); err != nil || string(data) != "menu\n" {
+			t.Errorf("%s: the file was not restored to its original name: %v", tc.name, err)
+		}
+	}
+}
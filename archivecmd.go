@@ -0,0 +1,270 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// runKindArchive is a run of the archive command, archiving mirrors that were not cloned by it
+const runKindArchive = "archive"
+
+// mirrorEntries are the entries of a bare repository that hold no nested repositories
+var mirrorEntries = map[string]bool{"objects": true, "refs": true, "hooks": true, "info": true, "logs": true}
+
+// archiveCommand archives a directory of bare mirrors, like the output of -skiptar, without
+// cloning: the repositories are those of -config or the bare repositories found in the
+// directory, and the archive is written, verified and notified like a backup
+func archiveCommand(args []string) error {
+	flags := flag.NewFlagSet("archive", flag.ExitOnError)
+	outFiles := newStringsFlag("")
+	flags.Var(outFiles, "out", "Output filename or destination URL for the tarball, repeat it to write the tarball to several destinations at once (default <dir> and the extension of -format)")
+	configFilePtr := flags.String("config", "", "configuration listing the repositories of the directory, they are detected when not set")
+	formatPtr := flags.String("format", formatGzip, "archive format: gzip, xz, bzip2, zstd, or tar for an uncompressed tarball")
+	compressionLevelPtr := flags.Int("compression-level", 0, "compression level from 1 (fastest) to 9 (smallest), 0 is the default of the format")
+	reproduciblePtr := flags.Bool("reproducible", false, "write repositories to the tarball in configuration order with fixed timestamps, root:root ownership and normalized modes")
+	normalizeModesPtr := flags.Bool("normalize-modes", false, "write tarball entries with mode 0755 for directories and executable files and 0644 for other files, implied by -reproducible")
+	noCatalogPtr := flags.Bool("no-catalog", false, "do not record the run in the catalog.json next to the manifest")
+	manifestPtr := flags.String("manifest", "", "Output filename for the manifest (default <out>.manifest.json)")
+	inventoryCSV := &optionalPathFlag{}
+	flags.Var(inventoryCSV, "inventory-csv", inventoryUsage)
+	verifyArchivePtr := flags.Bool("verify-archive", false, "read local tarballs back after writing them and compare them with the directory and the manifest checksum")
+	verifyLimits := archiveLimitFlags(flags)
+	destFlags := destinationFlags(flags)
+	recipients := &stringsFlag{}
+	flags.Var(recipients, "recipient", recipientUsage)
+	loadIdentities := identityFlags(flags)
+	// the directory may come before the flags, like codepack archive mirrors -out mirrors.tar.gz
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append(append([]string{}, args[1:]...), args[0])
+	}
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("archive requires the directory to archive, like codepack archive <dir> -out backup.tar.gz")
+	}
+	dir := flags.Arg(0)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("Cannot archive '%s', it is not a directory", dir)
+	}
+	format, err := lookupFormat(*formatPtr)
+	if err != nil {
+		return err
+	}
+	if err := validCompressionLevel(*compressionLevelPtr); err != nil {
+		return err
+	}
+	encryptTo, err := parseRecipients(recipients.values)
+	if err != nil {
+		return fmt.Errorf("Invalid -recipient: %w", err)
+	}
+	if err := loadIdentities(); err != nil {
+		return err
+	}
+	if encryptTo != nil && *verifyArchivePtr && identities == nil {
+		return fmt.Errorf("-verify-archive of an archive encrypted to -recipient needs the -identity of one of them")
+	}
+	staging := osfs.New(dir)
+
+	config := &Config{}
+	var disabled []Repository
+	var configSource *ConfigSource
+	if *configFilePtr != "" {
+		if config, configSource, err = loadConfig(*configFilePtr, "", envAuth()); err != nil {
+			return fmt.Errorf("Failed to open Configuration file '%s': %w", *configFilePtr, err)
+		}
+		config, disabled = splitDisabled(config, false, 1)
+		if err := checkOutputFormats(config.Repos, false); err != nil {
+			return err
+		}
+		if err := checkStagedMirrors(staging, config); err != nil {
+			return err
+		}
+	} else if config.Repos, err = detectMirrors(staging); err != nil {
+		return err
+	}
+	if len(config.Repos) == 0 {
+		return fmt.Errorf("No repositories found in '%s'", dir)
+	}
+	log.Printf("Archiving %d repositories from '%s'", len(config.Repos), dir)
+
+	if !outFiles.set {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		outFiles.values = []string{filepath.Base(abs) + format.extension + encryptTo.extension()}
+	}
+	dests := outputDestinations(outFiles, config)
+	out := dests[0].URL
+	for _, dest := range dests {
+		log.Println("Output File:", sanitizeURL(dest.URL))
+	}
+
+	report := newRunReport(dests, runKindArchive, len(config.Repos))
+	if config.Notify != nil {
+		onExit(func(err error) {
+			report.Finish(err)
+			notifyRun(config.Notify, report)
+		})
+	}
+	for _, repo := range config.Repos {
+		report.Record(repo, path.Join(repo.Path, repo.Name), nil)
+	}
+
+	// a codepack-info.json left by -skiptar is replaced, one written here is removed again
+	_, statErr := staging.Lstat(manifestName)
+	if os.IsNotExist(statErr) {
+		defer staging.Remove(manifestName)
+	}
+
+	manifest := newManifest(archiveName(out))
+	manifest.ConfigSource = configSource
+	manifest.Encryption = encryptTo.manifest()
+	for _, repo := range disabled {
+		manifest.Repos = append(manifest.Repos, newSkippedManifestRepo(repo))
+	}
+	archiveOpts := archiveOptions{Reproducible: *reproduciblePtr, NormalizeModes: *normalizeModesPtr, Format: format, Level: *compressionLevelPtr}
+	if archiveOpts.Reproducible {
+		manifest.Created = ""
+		manifest.RunID = ""
+	}
+	destOpts := destFlags()
+	destOpts.Format = format
+	destOpts.Plugins = config.Plugins
+	destOpts.Recipients = encryptTo
+	destOpts.Annotations = map[string]string{
+		"version":    VERSION,
+		"repo-count": fmt.Sprint(len(config.Repos)),
+	}
+
+	results, err := writeArchive(dests, destOpts, manifest, report, func(w io.Writer) error {
+		return archiveMirrors(config, staging, w, archiveOpts, manifest, report)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create '%s' from '%s': %w", report.Output, dir, err)
+	}
+	if *verifyArchivePtr {
+		if err := verifyArchives(results, dests, destOpts, staging, config, manifest, verifyLimits()); err != nil {
+			return err
+		}
+	}
+	if err := writeInventory(inventoryCSV, report, out); err != nil {
+		return err
+	}
+	return finishArchive(manifest, *manifestPtr, out, results, !*noCatalogPtr)
+}
+
+// archiveMirrors writes the repositories of config in staging and their manifest to w
+func archiveMirrors(config *Config, staging billy.Filesystem, w io.Writer, archiveOpts archiveOptions, manifest *Manifest, report *runReport) error {
+	repoPaths := make(map[string]bool)
+	for _, repo := range config.Repos {
+		repoPaths[path.Join(repo.Path, repo.Name)] = true
+	}
+	log.Println("Compressing files...")
+	a, err := newArchiver(staging, w, repoPaths, archiveOpts)
+	if err != nil {
+		return err
+	}
+	for _, repo := range config.Repos {
+		if err := a.Add(path.Join(repo.Path, repo.Name)); err != nil {
+			return err
+		}
+	}
+	return closeArchive(a, manifest, config, staging, report)
+}
+
+// checkStagedMirrors fails when a repository of config is not a bare repository in staging
+func checkStagedMirrors(staging billy.Filesystem, config *Config) error {
+	for _, repo := range config.Repos {
+		clonePath := path.Join(repo.Path, repo.Name)
+		if repo.exported() {
+			return fmt.Errorf("Repository '%s' is exported as %s, archive only reads bare mirrors", repo.URL, repo.Export)
+		}
+		entries, err := staging.ReadDir(clonePath)
+		if err != nil || !isMirror(entries) {
+			return fmt.Errorf("Repository '%s' has no bare mirror at '%s'", repo.URL, clonePath)
+		}
+	}
+	return nil
+}
+
+// detectMirrors finds the bare repositories in staging, directories holding HEAD, objects
+// and refs. The directories next to the git entries of a repository are searched too, they
+// hold the repositories nested below it
+func detectMirrors(staging billy.Filesystem) ([]Repository, error) {
+	var repos []Repository
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := staging.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		mirror := isMirror(entries)
+		if mirror {
+			if dir == "" {
+				return fmt.Errorf("'%s' is a repository itself, archive the directory holding it", staging.Root())
+			}
+			repo := Repository{Name: path.Base(dir), Path: path.Dir(dir), URL: mirrorURL(staging, dir), Export: exportMirror}
+			if repo.Path == "." {
+				repo.Path = ""
+			}
+			log.Printf("Found %s at '%s'", sanitizeURL(repo.URL), dir)
+			repos = append(repos, repo)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || mirror && mirrorEntries[entry.Name()] || dir == "" && entry.Name() == exportScratch {
+				continue
+			}
+			if err := walk(path.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return repos, validateClonePaths(repos)
+}
+
+func isMirror(entries []os.FileInfo) bool {
+	var head, objects, refs bool
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "HEAD":
+			head = !entry.IsDir()
+		case "objects":
+			objects = entry.IsDir()
+		case "refs":
+			refs = entry.IsDir()
+		}
+	}
+	return head && objects && refs
+}
+
+// mirrorURL is the origin remote of the bare repository at dir, dir itself when it has none
+func mirrorURL(staging billy.Filesystem, dir string) string {
+	repoFS, err := staging.Chroot(dir)
+	if err != nil {
+		return dir
+	}
+	cfg, err := filesystem.NewStorage(repoFS, cache.NewObjectLRUDefault()).Config()
+	if err != nil {
+		return dir
+	}
+	if origin, ok := cfg.Remotes["origin"]; ok && len(origin.URLs) > 0 {
+		return origin.URLs[0]
+	}
+	return dir
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// kinds of credentials auth-check reports
+const (
+	authBasic    = "basic"
+	authToken    = "token"
+	authAWS      = "aws-sigv4"
+	authSSHAgent = "ssh-agent"
+	authURL      = "url"
+	authNone     = "none"
+)
+
+// authSource describes the credential a repository is cloned with the way repoAuth picks
+// it, naming the variables or settings it is read from and never the secret itself
+type authSource struct {
+	Kind   string
+	Source string
+	// Missing is why the source selected for the repository resolved to no credential
+	Missing string
+	// Required is set for a host that never allows cloning without credentials
+	Required bool
+}
+
+func (s authSource) String() string {
+	if s.Missing != "" {
+		return fmt.Sprintf("no credential, %s", s.Missing)
+	}
+	if s.Kind == authNone {
+		return "none, " + s.Source
+	}
+	return fmt.Sprintf("%s from %s", s.Kind, s.Source)
+}
+
+// resolveAuthSource follows the choices of repoAuth without a terminal to prompt on
+func resolveAuthSource(repo Repository) authSource {
+	if _, ok := localSourcePath(repo.URL); ok {
+		return authSource{Kind: authNone, Source: "read from the local filesystem"}
+	}
+	if u, err := url.Parse(repo.URL); err == nil && (u.Scheme == "ssh" || u.Scheme == "git+ssh") || !strings.Contains(repo.URL, "://") {
+		if os.Getenv("SSH_AUTH_SOCK") == "" {
+			return authSource{Kind: authSSHAgent, Missing: "SSH_AUTH_SOCK is not set for the ssh agent", Required: true}
+		}
+		return authSource{Kind: authSSHAgent, Source: "the keys of the ssh agent at SSH_AUTH_SOCK"}
+	}
+
+	userEnv, passEnv, source := "CODEPACK_GIT_USER", "CODEPACK_GIT_PASS", "the global"
+	switch {
+	case repo.HostAuth != "":
+		userEnv, passEnv, source = repo.Auth.UsernameEnv, repo.Auth.PasswordEnv, fmt.Sprintf("the host_auth entry '%s',", repo.HostAuth)
+	case repo.Auth != nil:
+		userEnv, passEnv, source = repo.Auth.UsernameEnv, repo.Auth.PasswordEnv, "the auth of the repository,"
+	}
+	if os.Getenv(userEnv) != "" && os.Getenv(passEnv) != "" {
+		return authSource{Kind: authBasic, Source: fmt.Sprintf("%s %s and %s", source, userEnv, passEnv)}
+	}
+	missing := fmt.Sprintf("%s %s and %s are not both set", source, userEnv, passEnv)
+
+	switch {
+	case isAzureDevOps(repo.URL):
+		env := "CODEPACK_GIT_PASS"
+		if repo.Auth != nil && repo.Auth.PasswordEnv != "" {
+			env = repo.Auth.PasswordEnv
+		}
+		if os.Getenv(env) == "" {
+			return authSource{Kind: authToken, Missing: fmt.Sprintf("the personal access token %s is not set", env), Required: true}
+		}
+		return authSource{Kind: authToken, Source: "the personal access token " + env}
+	case isCodeCommit(repo.URL):
+		return authSource{Kind: authAWS, Source: "the AWS default credential chain", Required: true}
+	}
+	if u, err := url.Parse(repo.URL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return authSource{Kind: authURL, Source: "the user and password of the URL"}
+		}
+	}
+	return authSource{Kind: authNone, Missing: missing, Required: repo.Flavor == flavorGerrit && strings.Contains(repo.URL, "/a/")}
+}
+
+// authCheck is the outcome of auth-check for a repository
+type authCheck struct {
+	repo   Repository
+	source authSource
+	refs   int
+	err    error
+}
+
+func authCheckCommand(args []string) error {
+	flags := flag.NewFlagSet("auth-check", flag.ExitOnError)
+	configFilePtr := flags.String("config", "codepack.yaml", "Configuration file")
+	configFormatPtr := flags.String("config-format", "", "format of the configuration file: yaml, toml or json (default detected from the extension)")
+	lsRemotePtr := flags.Bool("ls-remote", false, "also list the references of every repository with its credential to confirm it works")
+	useGitConfigPtr := flags.Bool("use-gitconfig", false, "rewrite repository urls with the url.<base>.insteadOf rules of the system and global git config")
+	includeDisabledPtr := flags.Bool("include-disabled", false, "also check repositories with enabled: false")
+	workersPtr := flags.Int("workers", 10, "Number of concurrent remote listings")
+	parseFlags(flags, args)
+
+	cfg, _, err := loadConfig(*configFilePtr, *configFormatPtr, envAuth())
+	if err != nil {
+		return fmt.Errorf("Failed to open Configuration file '%s': %w", *configFilePtr, err)
+	}
+	if err := installHostTransports(cfg.Hosts); err != nil {
+		return err
+	}
+	cfg, _ = splitDisabled(cfg, *includeDisabledPtr, 1)
+	if *useGitConfigPtr {
+		if err := applyInsteadOf(cfg); err != nil {
+			return fmt.Errorf("Cannot read the git config: %w", err)
+		}
+	}
+	gerritAuthURLs(cfg, envAuth())
+	enableAzureDevOps(cfg)
+	workers = *workersPtr
+
+	checks := make([]authCheck, len(cfg.Repos))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i, repo := range cfg.Repos {
+		checks[i] = authCheck{repo: repo, source: resolveAuthSource(repo)}
+		if !*lsRemotePtr {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(check *authCheck) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			check.refs, check.err = lsRemote(check.repo, envAuth())
+		}(&checks[i])
+	}
+	wg.Wait()
+	return reportAuthChecks(checks)
+}
+
+// transportAuth is the credential of repoAuth as the auth method of the transport of repo.
+// Basic credentials only apply to http and https, ssh is left to the keys of the ssh agent
+// and git:// and local sources take none, go-git rejects any auth method they do not know
+func transportAuth(repo Repository, opts CloneOptions) transport.AuthMethod {
+	u, err := url.Parse(repo.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	if auth := repoAuth(repo, opts); auth != nil {
+		return auth
+	}
+	return nil
+}
+
+// lsRemote lists the references of repo with the credential it is cloned with
+func lsRemote(repo Repository, global *http.BasicAuth) (int, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{repo.URL}})
+	refs, err := remote.ListContext(context.Background(), &git.ListOptions{Auth: transportAuth(repo, CloneOptions{Auth: global})})
+	return len(refs), err
+}
+
+// reportAuthChecks prints the checks grouped by host and fails when a repository has no
+// credential for a host requiring one or its listing failed
+func reportAuthChecks(checks []authCheck) error {
+	byHost := make(map[string][]authCheck)
+	for _, check := range checks {
+		host := repoHost(check.repo.URL)
+		byHost[host] = append(byHost[host], check)
+	}
+	hosts := make([]string, 0, len(byHost))
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var unresolved, failed int
+	for _, host := range hosts {
+		fmt.Printf("%s (%d repos)\n", host, len(byHost[host]))
+		for _, check := range byHost[host] {
+			line := fmt.Sprintf("  %s: %s", path.Join(check.repo.Path, check.repo.Name), check.source)
+			if check.repo.HostAuthUnmatched {
+				line += ", no host_auth entry of the host matches"
+			}
+			if check.source.Missing != "" && check.source.Required {
+				line += ", the host requires authentication"
+				unresolved++
+			}
+			switch {
+			case check.err != nil:
+				line += fmt.Sprintf(", ls-remote failed (%s): %v", classifyCloneError(check.err), check.err)
+				failed++
+			case check.refs > 0:
+				line += fmt.Sprintf(", ls-remote listed %d references", check.refs)
+			}
+			fmt.Println(line)
+		}
+	}
+
+	var problems []string
+	if unresolved > 0 {
+		problems = append(problems, fmt.Sprintf("%d repositories have no credential for a host requiring authentication", unresolved))
+	}
+	if failed > 0 {
+		problems = append(problems, fmt.Sprintf("%d repositories failed ls-remote", failed))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
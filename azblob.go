@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+)
+
+// azureMaxBlocks is the number of blocks a block blob can be committed from
+const azureMaxBlocks = 50000
+
+// azureBlobUploader streams the archive to an azblob://container/blob destination
+//
+// AZURE_STORAGE_CONNECTION_STRING is used when set, otherwise the account in
+// AZURE_STORAGE_ACCOUNT is accessed with the default azure credential chain
+type azureBlobUploader struct {
+	container   string
+	blob        string
+	accessTier  string
+	chunkSize   int
+	contentType string
+	// concurrency and chunkRetries are the chunks sent at once and the retries of each by UploadFile
+	concurrency  int
+	chunkRetries int
+}
+
+func newAzureBlobUploader(u *url.URL, opts DestinationOptions) (*azureBlobUploader, error) {
+	blobName := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || blobName == "" {
+		return nil, fmt.Errorf("azure destination must be azblob://container/blob, got '%s'", u.String())
+	}
+	return &azureBlobUploader{
+		container:   u.Host,
+		blob:        blobName,
+		accessTier:  opts.StorageClass,
+		chunkSize:   opts.ChunkSize,
+		contentType: opts.archiveFormat().contentType,
+
+		concurrency:  opts.UploadConcurrency,
+		chunkRetries: opts.ChunkRetries,
+	}, nil
+}
+
+func (a *azureBlobUploader) client() (*azblob.Client, error) {
+	if connStr := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connStr != "" {
+		return azblob.NewClientFromConnectionString(connStr, nil)
+	}
+
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	if account == "" {
+		return nil, fmt.Errorf("Set AZURE_STORAGE_CONNECTION_STRING or AZURE_STORAGE_ACCOUNT for azblob:// destinations")
+	}
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+	return azblob.NewClient(fmt.Sprintf("https://%s.blob.core.windows.net/", account), cred, nil)
+}
+
+// Probe reads the properties of the container
+func (a *azureBlobUploader) Probe() error {
+	client, err := a.client()
+	if err != nil {
+		return fmt.Errorf("Cannot create azure blob client: %w", err)
+	}
+	if _, err := client.ServiceClient().NewContainerClient(a.container).GetProperties(context.Background(), nil); err != nil {
+		return fmt.Errorf("Cannot access container '%s': %w", a.container, err)
+	}
+	return nil
+}
+
+func (a *azureBlobUploader) Upload(r io.Reader) error {
+	client, err := a.client()
+	if err != nil {
+		return fmt.Errorf("Cannot create azure blob client: %w", err)
+	}
+
+	contentType := a.contentType
+	opts := &azblob.UploadStreamOptions{
+		BlockSize:   int64(a.chunkSize),
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	}
+	if a.accessTier != "" {
+		tier := blob.AccessTier(a.accessTier)
+		opts.AccessTier = &tier
+	}
+
+	_, err = client.UploadStream(context.Background(), a.container, a.blob, r, opts)
+	return err
+}
+
+// azureBlockID is the ID of the block of chunk i, every ID of a blob has the same length
+func azureBlockID(i int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("codepack-%08d", i)))
+}
+
+// UploadFile stages every chunk of f as a block, concurrency at once, and commits the blob
+// from them. The blocks of state that the blob still holds uncommitted are not sent again
+func (a *azureBlobUploader) UploadFile(f *os.File, state *uploadState) error {
+	n := state.chunks()
+	if n > azureMaxBlocks {
+		return fmt.Errorf("the archive needs %d blocks of -chunk-size, a blob holds at most %d", n, azureMaxBlocks)
+	}
+	client, err := a.client()
+	if err != nil {
+		return fmt.Errorf("Cannot create azure blob client: %w", err)
+	}
+	ctx := runContext
+	blockBlob := client.ServiceClient().NewContainerClient(a.container).NewBlockBlobClient(a.blob)
+
+	staged := make(map[string]bool)
+	if len(state.Blocks) > 0 {
+		list, err := blockBlob.GetBlockList(ctx, blockblob.BlockListTypeUncommitted, nil)
+		if err == nil {
+			for _, block := range list.UncommittedBlocks {
+				if block.Name != nil {
+					staged[*block.Name] = true
+				}
+			}
+		}
+	}
+	var pending []int
+	for i := 0; i < n; i++ {
+		if !staged[azureBlockID(i)] {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) < n {
+		log.Printf("Blob '%s' holds %d of %d blocks, staging the others", a.blob, n-len(pending), n)
+	}
+
+	concurrency := a.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	chunks := make(chan int)
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range chunks {
+				offset, length := state.chunk(i)
+				err := retryChunk(a.chunkRetries, fmt.Sprintf("block %d of %d", i+1, n), func() error {
+					body := streaming.NopCloser(io.NewSectionReader(f, offset, length))
+					_, err := blockBlob.StageBlock(ctx, azureBlockID(i), body, nil)
+					return err
+				})
+				if err == nil {
+					err = state.markBlock(i)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	var stageErr error
+send:
+	for _, i := range pending {
+		select {
+		case chunks <- i:
+		case stageErr = <-errs:
+			break send
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	if stageErr == nil && len(errs) > 0 {
+		stageErr = <-errs
+	}
+	if stageErr != nil {
+		return stageErr
+	}
+
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = azureBlockID(i)
+	}
+	contentType := a.contentType
+	opts := &blockblob.CommitBlockListOptions{HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType}}
+	if a.accessTier != "" {
+		tier := blob.AccessTier(a.accessTier)
+		opts.Tier = &tier
+	}
+	_, err = blockBlob.CommitBlockList(ctx, ids, opts)
+	return err
+}
+
+// Verify compares the size of the blob with the bytes uploaded, a blob uploaded in blocks
+// has no MD5 of its content to compare
+func (a *azureBlobUploader) Verify(d *streamDigest) (string, error) {
+	client, err := a.client()
+	if err != nil {
+		return "", fmt.Errorf("Cannot create azure blob client: %w", err)
+	}
+	props, err := client.ServiceClient().NewContainerClient(a.container).NewBlobClient(a.blob).GetProperties(context.Background(), nil)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read the properties of the blob: %w", err)
+	}
+	if props.ContentLength == nil {
+		return "", fmt.Errorf("azure returned no size of the blob")
+	}
+	if err := d.checkSize(*props.ContentLength); err != nil {
+		return "", err
+	}
+	return "size matches", nil
+}
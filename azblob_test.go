@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// azuriteAccount and azuriteKey are the well known development account of Azurite
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeAzurite emulates the parts of the blob service of Azurite the azblob:// destination
+// talks to: staging and committing blocks, putting blobs and reading properties. A blob
+// only exists once its block list was committed
+type fakeAzurite struct {
+	mu         sync.Mutex
+	containers map[string]bool
+	blobs      map[string]fakeAzureBlob
+	// staged are the uncommitted blocks of every blob by block ID
+	staged map[string]map[string][]byte
+}
+
+type fakeAzureBlob struct {
+	data        []byte
+	contentType string
+	tier        string
+	blocks      int
+}
+
+func newFakeAzurite(t *testing.T, containers ...string) *fakeAzurite {
+	t.Helper()
+	f := &fakeAzurite{containers: map[string]bool{}, blobs: map[string]fakeAzureBlob{}, staged: map[string]map[string][]byte{}}
+	for _, container := range containers {
+		f.containers[container] = true
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	t.Setenv("AZURE_STORAGE_CONNECTION_STRING", fmt.Sprintf("DefaultEndpointsProtocol=http;AccountName=%s;AccountKey=%s;BlobEndpoint=%s/%s;", azuriteAccount, azuriteKey, server.URL, azuriteAccount))
+	return f
+}
+
+func (f *fakeAzurite) blob(container string, name string) (fakeAzureBlob, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.blobs[container+"/"+name]
+	return b, ok
+}
+
+func azureError(w nethttp.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeAzurite) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	container, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"+azuriteAccount+"/"), "/")
+	if !f.containers[container] {
+		azureError(w, nethttp.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	query := r.URL.Query()
+	key := container + "/" + name
+	switch {
+	case name == "" && query.Get("restype") == "container":
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		w.Header().Set("ETag", `"0x1"`)
+		w.WriteHeader(nethttp.StatusOK)
+	case r.Method == nethttp.MethodPut && query.Get("comp") == "block":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		if f.staged[key] == nil {
+			f.staged[key] = map[string][]byte{}
+		}
+		f.staged[key][query.Get("blockid")] = data
+		w.WriteHeader(nethttp.StatusCreated)
+	case r.Method == nethttp.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			IDs []string `xml:",any"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			azureError(w, nethttp.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, id := range list.IDs {
+			block, ok := f.staged[key][id]
+			if !ok {
+				azureError(w, nethttp.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		delete(f.staged, key)
+		f.blobs[key] = fakeAzureBlob{data: data, contentType: r.Header.Get("x-ms-blob-content-type"), tier: r.Header.Get("x-ms-access-tier"), blocks: len(list.IDs)}
+		w.Header().Set("ETag", `"0x2"`)
+		w.WriteHeader(nethttp.StatusCreated)
+	case r.Method == nethttp.MethodPut && query.Get("comp") == "":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		f.blobs[key] = fakeAzureBlob{data: data, contentType: r.Header.Get("x-ms-blob-content-type"), tier: r.Header.Get("x-ms-access-tier"), blocks: 1}
+		w.WriteHeader(nethttp.StatusCreated)
+	case r.Method == nethttp.MethodGet && query.Get("comp") == "blocklist":
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><BlockList><CommittedBlocks></CommittedBlocks><UncommittedBlocks>`)
+		for id, block := range f.staged[key] {
+			fmt.Fprintf(w, "<Block><Name>%s</Name><Size>%d</Size></Block>", id, len(block))
+		}
+		fmt.Fprint(w, `</UncommittedBlocks></BlockList>`)
+	case r.Method == nethttp.MethodHead:
+		blob, ok := f.blobs[key]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(nethttp.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob.data)))
+		w.Header().Set("Content-Type", blob.contentType)
+		w.WriteHeader(nethttp.StatusOK)
+	default:
+		azureError(w, nethttp.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func testAzureBlobUploader(t *testing.T, target string, opts DestinationOptions) *azureBlobUploader {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAzureBlobUploader(u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAzureBlobUpload(t *testing.T) {
+	fake := newFakeAzurite(t, "backups")
+	a := testAzureBlobUploader(t, "azblob://backups/nightly/codepack.tar.gz", DestinationOptions{StorageClass: "Cool", ChunkSize: 1024 * 1024})
+	data := testArchive(2*1024*1024 + 512*1024)
+	if err := a.Upload(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	blob, ok := fake.blob("backups", "nightly/codepack.tar.gz")
+	if !ok {
+		t.Fatal("no blob was committed")
+	}
+	if !bytes.Equal(blob.data, data) {
+		t.Errorf("blob holds %d bytes, %d were uploaded", len(blob.data), len(data))
+	}
+	if blob.blocks != 3 {
+		t.Errorf("blob was committed from %d blocks, expected 3", blob.blocks)
+	}
+	if blob.tier != "Cool" || blob.contentType != "application/gzip" {
+		t.Errorf("blob has access tier %q and content type %q", blob.tier, blob.contentType)
+	}
+
+	digest := newStreamDigest()
+	digest.Write(data)
+	if _, err := a.Verify(digest); err != nil {
+		t.Errorf("Verify of the upload failed: %v", err)
+	}
+}
+
+func TestAzureBlobUploadFailureLeavesNoBlob(t *testing.T) {
+	fake := newFakeAzurite(t, "backups")
+	a := testAzureBlobUploader(t, "azblob://backups/codepack.tar.gz", DestinationOptions{ChunkSize: 1024 * 1024})
+	archiveErr := errors.New("archive failed")
+	err := a.Upload(&failingReader{data: bytes.NewReader(testArchive(2*1024*1024 + 512*1024)), err: archiveErr})
+	if !errors.Is(err, archiveErr) {
+		t.Fatalf("Upload returned %v, expected the error of the archive", err)
+	}
+	if _, ok := fake.blob("backups", "codepack.tar.gz"); ok {
+		t.Error("a truncated blob was committed")
+	}
+}
+
+func TestAzureBlobUploaderURL(t *testing.T) {
+	for _, target := range []string{"azblob://backups", "azblob://backups/", "azblob:///blob"} {
+		u, _ := url.Parse(target)
+		if _, err := newAzureBlobUploader(u, DestinationOptions{}); err == nil {
+			t.Errorf("%s was accepted", target)
+		}
+	}
+	uploader, err := newUploader("azblob://backups/a/b.tar.gz", DestinationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, ok := uploader.(*azureBlobUploader)
+	if !ok || a.container != "backups" || a.blob != "a/b.tar.gz" {
+		t.Errorf("azblob:// selected %#v", uploader)
+	}
+}
+
+func TestAzureBlobProbe(t *testing.T) {
+	newFakeAzurite(t, "backups")
+	if err := testAzureBlobUploader(t, "azblob://backups/codepack.tar.gz", DestinationOptions{}).Probe(); err != nil {
+		t.Errorf("Probe of an existing container failed: %v", err)
+	}
+	if err := testAzureBlobUploader(t, "azblob://missing/codepack.tar.gz", DestinationOptions{}).Probe(); err == nil {
+		t.Error("Probe of a missing container succeeded")
+	}
+}
+
+func TestAzureBlobCredentials(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_CONNECTION_STRING", "")
+	t.Setenv("AZURE_STORAGE_ACCOUNT", "")
+	a := testAzureBlobUploader(t, "azblob://backups/codepack.tar.gz", DestinationOptions{})
+	if _, err := a.client(); err == nil || !strings.Contains(err.Error(), "AZURE_STORAGE_ACCOUNT") {
+		t.Errorf("client without credentials returned %v", err)
+	}
+}
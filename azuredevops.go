@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// azureDevOpsRepo splits an Azure DevOps clone URL in to its organization, project and
+// repository, accepting https://dev.azure.com/org/project/_git/repo and the legacy
+// https://org.visualstudio.com/[DefaultCollection/]project/_git/repo
+func azureDevOpsRepo(rawURL string) (org, project, repo string, ok bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "dev.azure.com" || host == "ssh.dev.azure.com":
+		if len(parts) != 4 || parts[2] != "_git" {
+			return "", "", "", false
+		}
+		org, project, repo = parts[0], parts[1], parts[3]
+	case strings.HasSuffix(host, ".visualstudio.com"):
+		if len(parts) > 0 && strings.EqualFold(parts[0], "DefaultCollection") {
+			parts = parts[1:]
+		}
+		if len(parts) != 3 || parts[1] != "_git" {
+			return "", "", "", false
+		}
+		org, project, repo = strings.TrimSuffix(host, ".visualstudio.com"), parts[0], parts[2]
+	default:
+		return "", "", "", false
+	}
+	return org, project, strings.TrimSuffix(repo, ".git"), true
+}
+
+func isAzureDevOps(rawURL string) bool {
+	_, _, _, ok := azureDevOpsRepo(rawURL)
+	return ok
+}
+
+// deriveAzureDevOpsPath names repositories with an Azure DevOps URL after the repository
+// and places them under org/project when the configuration leaves name or path empty
+func (repo *Repository) deriveAzureDevOpsPath() {
+	org, project, name, ok := azureDevOpsRepo(repo.URL)
+	if !ok {
+		return
+	}
+	if repo.Name == "" {
+		repo.Name = name
+	}
+	if repo.Path == "" {
+		repo.Path = path.Join(org, project)
+	}
+}
+
+// azureDevOpsAuth authenticates with a personal access token alone, Azure DevOps accepts
+// any username with it. The token is read from the password variable of the repository
+// auth or CODEPACK_GIT_PASS
+func azureDevOpsAuth(repo Repository) *http.BasicAuth {
+	env := "CODEPACK_GIT_PASS"
+	if repo.Auth != nil && repo.Auth.PasswordEnv != "" {
+		env = repo.Auth.PasswordEnv
+	}
+	pat := os.Getenv(env)
+	if pat == "" {
+		return nil
+	}
+	return &http.BasicAuth{Username: "codepack", Password: pat}
+}
+
+// enableAzureDevOps lets go-git clone from Azure DevOps, which requires the
+// multi_ack capabilities that go-git only offers without thin packs
+func enableAzureDevOps(cfg *Config) {
+	for _, repo := range cfg.Repos {
+		if isAzureDevOps(repo.URL) {
+			transport.UnsupportedCapabilities = []capability.Capability{capability.ThinPack}
+			return
+		}
+	}
+}
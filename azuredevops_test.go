@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAzureDevOpsRepo(t *testing.T) {
+	for _, tc := range []struct {
+		url                string
+		org, project, repo string
+		ok                 bool
+	}{
+		{url: "https://dev.azure.com/acme/platform/_git/api", org: "acme", project: "platform", repo: "api", ok: true},
+		{url: "https://user@dev.azure.com/acme/platform/_git/api.git", org: "acme", project: "platform", repo: "api", ok: true},
+		{url: "https://acme.visualstudio.com/platform/_git/api", org: "acme", project: "platform", repo: "api", ok: true},
+		{url: "https://acme.visualstudio.com/DefaultCollection/platform/_git/api", org: "acme", project: "platform", repo: "api", ok: true},
+		{url: "https://ACME.VisualStudio.com/defaultcollection/platform/_git/api/", org: "acme", project: "platform", repo: "api", ok: true},
+		{url: "https://dev.azure.com/acme/platform/_git", ok: false},
+		{url: "https://dev.azure.com/acme/platform/api", ok: false},
+		{url: "https://acme.visualstudio.com/platform/api", ok: false},
+		{url: "https://github.com/acme/platform/_git/api", ok: false},
+	} {
+		org, project, repo, ok := azureDevOpsRepo(tc.url)
+		if ok != tc.ok || org != tc.org || project != tc.project || repo != tc.repo {
+			t.Errorf("azureDevOpsRepo(%q) = %q, %q, %q, %v, expected %q, %q, %q, %v", tc.url, org, project, repo, ok, tc.org, tc.project, tc.repo, tc.ok)
+		}
+	}
+}
+
+func TestDeriveAzureDevOpsPath(t *testing.T) {
+	for _, tc := range []struct {
+		repo       Repository
+		name, path string
+	}{
+		{repo: Repository{URL: "https://dev.azure.com/acme/platform/_git/api"}, name: "api", path: "acme/platform"},
+		{repo: Repository{URL: "https://acme.visualstudio.com/DefaultCollection/platform/_git/api"}, name: "api", path: "acme/platform"},
+		{repo: Repository{URL: "https://dev.azure.com/acme/platform/_git/api", Name: "backend", Path: "azure"}, name: "backend", path: "azure"},
+		{repo: Repository{URL: "https://github.com/acme/api.git"}},
+	} {
+		repo := tc.repo
+		repo.deriveAzureDevOpsPath()
+		if repo.Name != tc.name || repo.Path != tc.path {
+			t.Errorf("%s: derived name %q and path %q, expected %q and %q", tc.repo.URL, repo.Name, repo.Path, tc.name, tc.path)
+		}
+	}
+}
+
+func TestAzureDevOpsAuth(t *testing.T) {
+	t.Setenv("CODEPACK_GIT_PASS", "global-pat")
+	t.Setenv("API_PAT", "api-pat")
+	t.Setenv("EMPTY_PAT", "")
+	for _, tc := range []struct {
+		name     string
+		auth     *RepoAuth
+		password string
+	}{
+		{name: "global", password: "global-pat"},
+		{name: "repository auth", auth: &RepoAuth{PasswordEnv: "API_PAT"}, password: "api-pat"},
+		{name: "unset token", auth: &RepoAuth{PasswordEnv: "EMPTY_PAT"}},
+	} {
+		auth := azureDevOpsAuth(Repository{URL: "https://dev.azure.com/acme/platform/_git/api", Auth: tc.auth})
+		switch {
+		case tc.password == "" && auth != nil:
+			t.Errorf("%s: expected no credentials, got %+v", tc.name, auth)
+		case tc.password != "" && (auth == nil || auth.Password != tc.password || auth.Username == ""):
+			t.Errorf("%s: expected the token %q with a username, got %+v", tc.name, tc.password, auth)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+const (
+	// cacheStateName is the file of -cache-dir counting its runs
+	cacheStateName = "codepack-cache.json"
+	// cacheSnapshotName is the directory of -cache-dir an archive is written from
+	cacheSnapshotName = ".codepack-snapshot"
+)
+
+// immutableObjectPattern matches the loose objects and packs of a mirror, which git and
+// go-git never change once written, only remove, so a snapshot can link them
+var immutableObjectPattern = regexp.MustCompile(`^objects/([0-9a-f]{2}|pack)/[^/]+$`)
+
+// cacheState is the state of -cache-dir between runs
+type cacheState struct {
+	FormatVersion int `json:"format_version"`
+	// Runs is the number of runs that updated the cache
+	Runs int `json:"runs"`
+	// LastArchiveRun is the run that wrote the last archive, LastArchive its name
+	LastArchiveRun int    `json:"last_archive_run,omitempty"`
+	LastArchive    string `json:"last_archive,omitempty"`
+	LastArchived   string `json:"last_archived,omitempty"`
+}
+
+// mirrorCache is the -cache-dir of a run, the mirrors of the earlier runs are fetched in to
+// instead of cloned again and an archive is written on every runs-th run. The cache is
+// locked until the run exits
+type mirrorCache struct {
+	dir     string
+	every   int
+	reflink bool
+	state   cacheState
+	unlock  func()
+}
+
+// openMirrorCache locks and reads the cache at dir, created when missing, waiting for a run
+// updating it already
+func openMirrorCache(dir string, every int, reflink bool) (*mirrorCache, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create the cache directory '%s': %w", dir, err)
+	}
+	unlock, err := lockFile(filepath.Join(dir, cacheStateName+".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot lock the cache directory '%s': %w", dir, err)
+	}
+	c := &mirrorCache{dir: dir, every: every, reflink: reflink, state: cacheState{FormatVersion: 1}, unlock: unlock}
+	data, err := os.ReadFile(filepath.Join(dir, cacheStateName))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &c.state); err != nil {
+			unlock()
+			return nil, fmt.Errorf("Invalid cache state '%s': %w", filepath.Join(dir, cacheStateName), err)
+		}
+	case !os.IsNotExist(err):
+		unlock()
+		return nil, err
+	}
+	// left behind by a run that did not finish its archive
+	if err := os.RemoveAll(filepath.Join(dir, cacheSnapshotName)); err != nil {
+		unlock()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close unlocks the cache
+func (c *mirrorCache) Close(error) {
+	c.unlock()
+}
+
+// run is the number of the current run of the cache, counting from 1
+func (c *mirrorCache) run() int {
+	return c.state.Runs + 1
+}
+
+// archives reports whether the run writes an archive, the first run of the cache always does
+func (c *mirrorCache) archives() bool {
+	return c.state.LastArchive == "" || c.run()-c.state.LastArchiveRun >= c.every
+}
+
+// nextArchive is the run writing the next archive, once finish recorded the current one
+func (c *mirrorCache) nextArchive() int {
+	return c.state.LastArchiveRun + c.every
+}
+
+// finish records the run that wrote manifest to the cache, which keeps the manifest of its
+// last run for verify-restore -cache-dir. A run writing no archive has no Archive. A nil
+// cache records nothing
+func (c *mirrorCache) finish(manifest *Manifest) error {
+	if c == nil {
+		return nil
+	}
+	if err := manifest.WriteFile(filepath.Join(c.dir, manifestName)); err != nil {
+		return fmt.Errorf("Failed to write the manifest of the cache: %w", err)
+	}
+	c.state.Runs++
+	if manifest.Archive != "" {
+		c.state.LastArchiveRun = c.state.Runs
+		c.state.LastArchive = manifest.Archive
+		c.state.LastArchived = manifest.Created
+	}
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(c.dir, cacheStateName)
+	if err := os.WriteFile(filename+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// checkCacheRepos fails for repositories the cache cannot hold, a worktree or fast-export
+// stream cannot be fetched in to
+func checkCacheRepos(repos []Repository) error {
+	for _, repo := range repos {
+		if repo.exported() {
+			return fmt.Errorf("Repository '%s' is exported as %s, -cache-dir only keeps bare mirrors", sanitizeURL(repo.URL), repo.Export)
+		}
+	}
+	return nil
+}
+
+// cachedMirror reports whether fs holds the mirror of an earlier run of the cache
+func cachedMirror(fs billy.Filesystem) bool {
+	entries, err := fs.ReadDir("")
+	return err == nil && isMirror(entries)
+}
+
+// updateCachedMirror fetches the references of repo in to the mirror an earlier run cloned
+// to clonePath of the cache, retried like a clone. A failed fetch leaves the mirror as the
+// earlier run left it. A mirror taken out of an archive is replaced, there is nothing to
+// fetch from
+func updateCachedMirror(ctx context.Context, staging billy.Filesystem, repo Repository, clonePath string, fs billy.Filesystem, cacheSize int64, opts CloneOptions) error {
+	if _, _, ok := archiveSource(repo.URL); ok {
+		if err := removePartialClone(fs); err != nil {
+			return fmt.Errorf("Cannot remove the cached mirror at '%s': %w", clonePath, err)
+		}
+		return cloneStaged(staging, clonePath, opts.RepoSizeLimit, func(tmp billy.Filesystem) error {
+			return cloneWithRetries(ctx, repo, tmp, cacheSize, opts, nil)
+		})
+	}
+	log.Printf("Fetching %s in to the mirror already at path %s", repo.URL, clonePath)
+	var err error
+	for attempt := 0; attempt <= repo.retries(); attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying %s (%d/%d) after: %v", repo.URL, attempt, repo.retries(), err)
+		}
+		err = fetchAttempt(ctx, repo, clonePath, fs, cacheSize, opts)
+		if err == nil || ctx.Err() != nil || errors.Is(err, errFilterUnsupported) {
+			return err
+		}
+		if category := classifyCloneError(err); !retryable(category) {
+			return err
+		}
+	}
+	return err
+}
+
+func fetchAttempt(ctx context.Context, repo Repository, clonePath string, fs billy.Filesystem, cacheSize int64, opts CloneOptions) error {
+	if timeout := repo.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return withHostOverrides(fetchMirror(ctx, repo, clonePath, fs, cacheSize, opts), repo.URL)
+}
+
+// fetchMirror fetches every reference of the remote in to the mirror in fs and removes those
+// the remote no longer has, as git remote update --prune of a mirror does, then applies
+// exclude_refs and pin like a clone
+func fetchMirror(ctx context.Context, repo Repository, clonePath string, fs billy.Filesystem, cacheSize int64, opts CloneOptions) error {
+	if repo.Filter != "" {
+		return fmt.Errorf("filter '%s' %w", repo.Filter, errFilterUnsupported)
+	}
+	storage := filesystem.NewStorageWithOptions(fs, cache.NewObjectLRU(cache.FileSize(cacheSize)), filesystem.Options{
+		LargeObjectThreshold: opts.LargeObjectThreshold,
+	})
+	remote := git.NewRemote(storage, &config.RemoteConfig{Name: originRemote, URLs: []string{repo.URL}})
+	auth := transportAuth(repo, opts)
+	advertised, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return err
+	}
+	progress := opts.startProgress(clonePath, fs)
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{mirrorRefSpec},
+		Auth:     auth,
+		Depth:    repo.depth(),
+		Force:    true,
+		Progress: progress.sideband(),
+	})
+	progress.Stop()
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+	if err := pruneMirror(storage, advertised); err != nil {
+		return err
+	}
+	if len(repo.ExcludeRefs) > 0 {
+		if err := removeExcludedRefs(storage, repo); err != nil {
+			return err
+		}
+	}
+	if repo.Pin != "" {
+		return applyPin(storage, repo)
+	}
+	return nil
+}
+
+// pruneMirror removes the references of the mirror missing from advertised and points HEAD
+// at the default branch the remote advertises
+func pruneMirror(s *filesystem.Storage, advertised []*plumbing.Reference) error {
+	remote := make(map[plumbing.ReferenceName]bool)
+	var head *plumbing.Reference
+	for _, ref := range advertised {
+		remote[ref.Name()] = true
+		if ref.Name() == plumbing.HEAD {
+			head = ref
+		}
+	}
+	refs, err := s.IterReferences()
+	if err != nil {
+		return err
+	}
+	var stale []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD && !remote[ref.Name()] {
+			stale = append(stale, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		log.Printf("Removing %s from the cached mirror, the remote no longer has it", name)
+		if err := s.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	if head != nil && head.Type() == plumbing.SymbolicReference && remote[head.Target()] {
+		return s.SetReference(head)
+	}
+	return nil
+}
+
+// snapshot links the mirrors of config in to a directory of the cache the archive is written
+// from, the next runs fetching in to the cache never change what was archived. The objects
+// are hard linked, or reflinked with -reflink, the other files of a mirror are copied as
+// go-git rewrites them in place. Only the entries of git are taken, the directories of
+// repositories nested below a mirror are taken for their own repository
+func (c *mirrorCache) snapshot(config *Config) (string, error) {
+	dir := filepath.Join(c.dir, cacheSnapshotName)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	var linked, copied int
+	var walk func(src string, dst string, rel string) error
+	walk = func(src string, dst string, rel string) error {
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+			entries, err := os.ReadDir(src)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := walk(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), path.Join(rel, entry.Name())); err != nil {
+					return err
+				}
+			}
+			return nil
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dst)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		if c.linkFile(src, dst, immutableObjectPattern.MatchString(rel)) {
+			linked++
+			return nil
+		}
+		copied++
+		return copyFile(src, dst, info.Mode().Perm())
+	}
+	for _, repo := range config.Repos {
+		clonePath := path.Join(repo.Path, repo.Name)
+		src, dst := filepath.Join(c.dir, filepath.FromSlash(clonePath)), filepath.Join(dir, filepath.FromSlash(clonePath))
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return "", err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !mirrorEntries[entry.Name()] {
+				continue
+			}
+			if err := walk(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), entry.Name()); err != nil {
+				return "", fmt.Errorf("Cannot snapshot '%s' of the cache: %w", clonePath, err)
+			}
+		}
+	}
+	how := "hard linked"
+	if c.reflink {
+		how = "reflinked"
+	}
+	log.Printf("Snapshot of the cache in '%s': %d files %s, %d copied", dir, linked, how, copied)
+	return dir, nil
+}
+
+// linkFile reflinks src to dst with -reflink, or hard links it when immutable is set,
+// reporting whether it did. The first failing reflink turns -reflink off with a warning,
+// as the filesystem of the cache does not support it
+func (c *mirrorCache) linkFile(src string, dst string, immutable bool) bool {
+	if c.reflink {
+		err := reflinkFile(src, dst)
+		if err == nil {
+			return true
+		}
+		log.Printf("WARNING: cannot reflink the files of the cache, hard linking them instead: %v", err)
+		c.reflink = false
+	}
+	return immutable && os.Link(src, dst) == nil
+}
+
+// copyFile copies the regular file src to dst, created with perm
+func copyFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// cacheRefs reads the references of the cached mirror at dir, after checking HEAD and every
+// reference resolve to stored objects
+func cacheRefs(dir string) (map[string]string, error) {
+	fs := osfs.New(dir)
+	if !cachedMirror(fs) {
+		return nil, fmt.Errorf("no mirror at '%s'", dir)
+	}
+	if err := verifyClone(fs); err != nil {
+		return nil, err
+	}
+	iter, err := filesystem.NewStorage(fs, cache.NewObjectLRUDefault()).IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), "refs/") {
+			refs[ref.Name().String()] = ref.Hash().String()
+		}
+		return nil
+	})
+	return refs, err
+}
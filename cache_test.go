@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheKeptOnEarlyExit(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	config := "repos:\n  - name: app\n    path: team\n    url: " + filepath.Join(dir, "src") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-config", "codepack.yaml", "-cache-dir", "cache", "-out", "backup.tar.gz", "-no-catalog"}
+	if out, code := runCodePack(t, dir, nil, args...); code != 0 {
+		t.Fatalf("first run exited with %d:\n%s", code, out)
+	}
+	mirror := filepath.Join(dir, "cache", "team", "app", "HEAD")
+	if _, err := os.Stat(mirror); err != nil {
+		t.Fatalf("the first run left no mirror in the cache: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "backup guard", args: []string{"-min-repos", "5"}, code: exitCodeBackupGuard},
+		{name: "staging space", args: []string{"-min-free-space", "1000000000"}, code: exitCodeInfrastructure},
+		{name: "fail-on", args: []string{"-fail-on", "failed,cloned,updated,unchanged"}, code: exitCodeFailOn},
+	} {
+		out, code := runCodePack(t, dir, nil, append(append([]string{}, args...), tc.args...)...)
+		if code != tc.code {
+			t.Errorf("%s: exited with %d, expected %d:\n%s", tc.name, code, tc.code, out)
+		}
+		if _, err := os.Stat(mirror); err != nil {
+			t.Fatalf("%s: the mirror of the cache was removed: %v", tc.name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "cache", cacheSnapshotName)); !os.IsNotExist(err) {
+			t.Errorf("%s: the snapshot of the run was left in the cache", tc.name)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// catalogName is the file next to the manifests listing every run written to the directory
+const catalogName = "catalog.json"
+
+// Catalog is the index of the runs of an output directory, one entry appended by each run
+type Catalog struct {
+	FormatVersion int            `json:"format_version"`
+	Runs          []CatalogEntry `json:"runs"`
+}
+
+type CatalogEntry struct {
+	RunID   string `json:"run_id"`
+	Created string `json:"created"`
+	Archive string `json:"archive"`
+	// Manifest is the file name of the manifest of the run in the directory of the catalog
+	Manifest     string   `json:"manifest"`
+	Destinations []string `json:"destinations,omitempty"`
+	Size         int64    `json:"size"`
+	SHA256       string   `json:"sha256"`
+	RepoCount    int      `json:"repo_count"`
+	Failed       int      `json:"failed"`
+	// ConfigSHA256 is the checksum of the effective configuration of the run
+	ConfigSHA256 string   `json:"config_sha256,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	// CacheOnly is set for a run of -cache-dir that only updated the cache, without an
+	// archive or a manifest in the directory of the catalog
+	CacheOnly bool `json:"cache_only,omitempty"`
+	// CacheDir is the -cache-dir of the run
+	CacheDir string        `json:"cache_dir,omitempty"`
+	Repos    []CatalogRepo `json:"repos"`
+}
+
+// CatalogRepo is a repository captured by a run and the commit its HEAD pointed at
+type CatalogRepo struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Head   string `json:"head,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Archive is set when the repository is restored from an earlier archive of the chain
+	Archive string `json:"archive,omitempty"`
+}
+
+// newCatalogEntry is the catalog entry of the run that wrote manifest to manifestPath
+func newCatalogEntry(manifest *Manifest, manifestPath string, results []destinationResult) CatalogEntry {
+	entry := CatalogEntry{
+		RunID:    manifest.RunID,
+		Created:  manifest.Created,
+		Archive:  manifest.Archive,
+		Manifest: filepath.Base(manifestPath),
+		SHA256:   manifest.SHA256,
+		Tags:     manifest.Tags,
+		CacheDir: manifest.CacheDir,
+	}
+	if manifest.CacheDir != "" && manifest.Archive == "" {
+		entry.CacheOnly, entry.Manifest = true, ""
+	}
+	for _, result := range results {
+		if result.Status != "SUCCESS" {
+			continue
+		}
+		if entry.Size == 0 {
+			entry.Size = result.Bytes
+		}
+		entry.Destinations = append(entry.Destinations, sanitizeURL(result.URL))
+	}
+	if manifest.Config != nil {
+		if data, err := json.Marshal(manifest.Config); err == nil {
+			sum := sha256.Sum256(data)
+			entry.ConfigSHA256 = hex.EncodeToString(sum[:])
+		}
+	}
+	for _, repo := range manifest.Repos {
+		if repo.Status == statusFailed {
+			entry.Failed++
+			continue
+		}
+		if repo.Skipped != "" {
+			continue
+		}
+		entry.RepoCount++
+		r := CatalogRepo{Name: repo.Name, Path: repo.Path, Head: repo.Head, Commit: repo.Refs[repo.Head]}
+		if repo.Archive != manifest.Archive {
+			r.Archive = repo.Archive
+		}
+		entry.Repos = append(entry.Repos, r)
+	}
+	return entry
+}
+
+// readCatalog reads the catalog at filename, an empty catalog when it does not exist
+func readCatalog(filename string) (*Catalog, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &Catalog{FormatVersion: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c Catalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("Invalid catalog '%s': %w", filename, err)
+	}
+	return &c, nil
+}
+
+// updateCatalog changes the catalog of dir with update while holding its lock, so runs of
+// several hosts sharing dir do not lose each other's entries. The catalog is replaced by a
+// rename, a reader never sees it half written. The empty lock file is left in dir, removing
+// it while another run waits for its lock would let both update the catalog
+func updateCatalog(dir string, update func(c *Catalog)) error {
+	filename := filepath.Join(dir, catalogName)
+	unlock, err := lockFile(filename + ".lock")
+	if err != nil {
+		return fmt.Errorf("Cannot lock catalog '%s': %w", filename, err)
+	}
+	defer unlock()
+	c, err := readCatalog(filename)
+	if err != nil {
+		return err
+	}
+	update(c)
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+catalogName+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// recordCatalog appends the run that wrote manifest to manifestPath to the catalog next to it
+func recordCatalog(manifest *Manifest, manifestPath string, results []destinationResult) error {
+	dir := filepath.Dir(manifestPath)
+	entry := newCatalogEntry(manifest, manifestPath, results)
+	log.Printf("Recording run %s in catalog '%s'", entry.RunID, filepath.Join(dir, catalogName))
+	return updateCatalog(dir, func(c *Catalog) {
+		c.Runs = append(c.Runs, entry)
+	})
+}
+
+// catalogCommand lists and searches the catalog of an output directory
+func catalogCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: codepack catalog list|find|prune")
+	}
+	switch args[0] {
+	case "list":
+		return catalogListCommand(args[1:])
+	case "find":
+		return catalogFindCommand(args[1:])
+	case "prune":
+		return catalogPruneCommand(args[1:])
+	}
+	return fmt.Errorf("Unknown catalog command '%s', use list, find or prune", args[0])
+}
+
+// archiveMissing reports whether the local archive of entry was removed from dir
+func (e CatalogEntry) archiveMissing(dir string) bool {
+	if e.CacheOnly || strings.Contains(e.Archive, "://") {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dir, e.Archive))
+	return os.IsNotExist(err)
+}
+
+func catalogListCommand(args []string) error {
+	flags := flag.NewFlagSet("catalog_list", flag.ExitOnError)
+	dirPtr := flags.String("dir", ".", "output directory holding the catalog")
+	parseFlags(flags, args)
+
+	c, err := readCatalog(filepath.Join(*dirPtr, catalogName))
+	if err != nil {
+		return err
+	}
+	for _, e := range c.Runs {
+		line := fmt.Sprintf("%-20s  %-24s  %10s  %4d repos  %3d failed  %s", e.Created, e.RunID, formatBytes(e.Size), e.RepoCount, e.Failed, e.archiveLabel())
+		if len(e.Tags) > 0 {
+			line += " [" + strings.Join(e.Tags, ",") + "]"
+		}
+		if e.archiveMissing(*dirPtr) {
+			line += " (missing)"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// catalogFindCommand prints the runs holding a repository, matched by its name or clone
+// path, with the branch and commit of its HEAD
+func catalogFindCommand(args []string) error {
+	flags := flag.NewFlagSet("catalog_find", flag.ExitOnError)
+	dirPtr := flags.String("dir", ".", "output directory holding the catalog")
+	repoPtr := flags.String("repo", "", "name or clone path of the repository")
+	parseFlags(flags, args)
+
+	if *repoPtr == "" {
+		return fmt.Errorf("catalog find requires -repo")
+	}
+	c, err := readCatalog(filepath.Join(*dirPtr, catalogName))
+	if err != nil {
+		return err
+	}
+	found := 0
+	for _, e := range c.Runs {
+		for _, r := range e.Repos {
+			clonePath := filepath.ToSlash(filepath.Join(r.Path, r.Name))
+			if r.Name != *repoPtr && clonePath != *repoPtr {
+				continue
+			}
+			found++
+			archive := e.archiveLabel()
+			if r.Archive != "" {
+				archive = r.Archive + " (unchanged)"
+			}
+			head := strings.TrimPrefix(r.Head, "refs/heads/")
+			if head == "" {
+				head = "-"
+			}
+			line := fmt.Sprintf("%-20s  %-24s  %-30s  %-16s  %s  %s", e.Created, e.RunID, clonePath, head, shortHash(r.Commit), archive)
+			if e.archiveMissing(*dirPtr) {
+				line += " (missing)"
+			}
+			fmt.Println(line)
+		}
+	}
+	if found == 0 {
+		return fmt.Errorf("No run of the catalog holds '%s'", *repoPtr)
+	}
+	return nil
+}
+
+// catalogPruneCommand removes the runs whose local archive is gone from the catalog, for
+// archives deleted by a retention job
+func catalogPruneCommand(args []string) error {
+	flags := flag.NewFlagSet("catalog_prune", flag.ExitOnError)
+	dirPtr := flags.String("dir", ".", "output directory holding the catalog")
+	parseFlags(flags, args)
+
+	return updateCatalog(*dirPtr, func(c *Catalog) {
+		kept := c.Runs[:0]
+		for _, e := range c.Runs {
+			if e.archiveMissing(*dirPtr) {
+				log.Printf("Removing run %s from the catalog, '%s' is gone", e.RunID, e.Archive)
+				continue
+			}
+			kept = append(kept, e)
+		}
+		c.Runs = kept
+	})
+}
+
+// archiveLabel is the archive of entry as listed, or the cache it updated
+func (e CatalogEntry) archiveLabel() string {
+	if e.CacheOnly {
+		return "(cache only) " + e.CacheDir
+	}
+	return e.Archive
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	if hash == "" {
+		return "-"
+	}
+	return hash
+}
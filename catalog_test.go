@@ -0,0 +1,51 @@
+//go:build linux || darwin || windows
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestUpdateCatalogConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- updateCatalog(dir, func(c *Catalog) {
+				c.Runs = append(c.Runs, CatalogEntry{RunID: fmt.Sprintf("run-%02d", i)})
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := readCatalog(filepath.Join(dir, catalogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, run := range c.Runs {
+		ids = append(ids, run.RunID)
+	}
+	sort.Strings(ids)
+	if len(ids) != writers {
+		t.Fatalf("the catalog lists %d of %d runs: %v", len(ids), writers, ids)
+	}
+	for i, id := range ids {
+		if expected := fmt.Sprintf("run-%02d", i); id != expected {
+			t.Errorf("run %d is %s, expected %s", i, id, expected)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// refDiff lists how the references of a remote differ from those captured in a manifest
+type refDiff struct {
+	Added   []string
+	Changed []string
+	Deleted []string
+}
+
+func diffRefs(captured, live map[string]string) refDiff {
+	var d refDiff
+	for name, hash := range live {
+		old, ok := captured[name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, name)
+		case old != hash:
+			d.Changed = append(d.Changed, name)
+		}
+	}
+	for name := range captured {
+		if _, ok := live[name]; !ok {
+			d.Deleted = append(d.Deleted, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Changed)
+	sort.Strings(d.Deleted)
+	return d
+}
+
+func (d refDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Deleted) == 0
+}
+
+func (d refDiff) String() string {
+	return fmt.Sprintf("%d new, %d changed, %d deleted", len(d.Added), len(d.Changed), len(d.Deleted))
+}
+
+// remoteRefsResult is the outcome of listing the references of one manifest repository
+type remoteRefsResult struct {
+	repo ManifestRepo
+	url  string
+	diff refDiff
+	err  error
+}
+
+// compareRemotes lists the references of every captured repository of m at the URL
+// returned by remoteURL with listRefs, using up to workers concurrent calls, and diffs
+// them against the manifest. Skipped repositories are left out
+func compareRemotes(m *Manifest, remoteURL func(ManifestRepo) (string, error), listRefs func(url string) (map[string]string, error)) []remoteRefsResult {
+	var repos []ManifestRepo
+	for _, repo := range m.Repos {
+		if repo.Skipped == "" {
+			repos = append(repos, repo)
+		}
+	}
+
+	results := make([]remoteRefsResult, len(repos))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i, repo := range repos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, repo ManifestRepo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i].repo = repo
+			url, err := remoteURL(repo)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			results[i].url = url
+			refs, err := listRefs(url)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			var excludes Repository
+			if repo.Settings != nil {
+				excludes.ExcludeRefs = repo.Settings.ExcludeRefs
+			}
+			for name := range refs {
+				if excludes.excluded(name) {
+					delete(refs, name)
+				}
+			}
+			results[i].diff = diffRefs(repo.Refs, refs)
+		}(i, repo)
+	}
+	wg.Wait()
+	return results
+}
+
+// logRefDiffs logs the outcome of compareRemotes and returns the number of repositories
+// that differ or could not be listed
+func logRefDiffs(results []remoteRefsResult) int {
+	differing := 0
+	for _, result := range results {
+		switch {
+		case result.err != nil:
+			differing++
+			log.Printf("%s: cannot list references of %s: %v", result.repo.ClonePath(), sanitizeURL(result.url), result.err)
+		case !result.diff.Empty():
+			differing++
+			log.Printf("%s: %s", result.repo.ClonePath(), result.diff)
+			for _, name := range result.diff.Added {
+				log.Printf("  new %s", name)
+			}
+			for _, name := range result.diff.Changed {
+				log.Printf("  changed %s", name)
+			}
+			for _, name := range result.diff.Deleted {
+				log.Printf("  deleted %s", name)
+			}
+		}
+	}
+	return differing
+}
+
+func checkCommand(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	manifestPtr := flags.String("manifest", "", "manifest of the backup to compare against the remotes")
+	maxDivergedPtr := flags.Int("max-diverged", 0, "number of diverged repositories tolerated before exiting with an error")
+	workersPtr := flags.Int("workers", 10, "Number of concurrent remote listings")
+	parseFlags(flags, args)
+
+	if *manifestPtr == "" {
+		return fmt.Errorf("check requires -manifest")
+	}
+	m, err := ManifestFromFile(*manifestPtr)
+	if err != nil {
+		return err
+	}
+	workers = *workersPtr
+
+	results := compareRemotes(m, func(repo ManifestRepo) (string, error) { return repo.URL, nil }, listRemoteRefs(envAuth()))
+	diverged := logRefDiffs(results)
+
+	age := "unknown"
+	if created, err := time.Parse(time.RFC3339, m.Created); err == nil {
+		age = time.Since(created).Round(time.Minute).String()
+	}
+	log.Printf("%d of %d repositories have diverged from '%s', the backup is %s old", diverged, len(results), m.Archive, age)
+	if diverged > *maxDivergedPtr {
+		return fmt.Errorf("%d repositories diverged from the backup, more than the %d allowed", diverged, *maxDivergedPtr)
+	}
+	return nil
+}
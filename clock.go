@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// clock is the time of the run, the default file names, the run ID, the manifest and the
+// report read it. -now replaces it
+var clock = time.Now
+
+// buildDate is the time the binary was built in RFC 3339, set with
+// -ldflags "-X main.buildDate=...". Without it the commit time go build embeds is used
+var buildDate string
+
+// releaseDate is the earliest time a run of any release can plausibly happen, for a build
+// without a build date
+var releaseDate = time.Date(2023, 6, 14, 0, 0, 0, 0, time.UTC)
+
+// builtAt is the time the binary was built, or releaseDate when it is not known
+func builtAt() time.Time {
+	if t, err := time.Parse(time.RFC3339, buildDate); err == nil {
+		return t
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key != "vcs.time" {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, setting.Value); err == nil {
+				return t
+			}
+		}
+	}
+	return releaseDate
+}
+
+// setNow replaces the clock with one starting at value, an RFC 3339 time or a date, and
+// running on from there
+func setNow(value string) error {
+	start, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		start, err = time.ParseInLocation("2006-01-02", value, time.Local)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid -now '%s', expected a time like 2024-01-31T12:00:00Z or a date like 2024-01-31", value)
+	}
+	started := time.Now()
+	clock = func() time.Time {
+		return start.Add(time.Since(started))
+	}
+	return nil
+}
+
+// checkClock warns when now is before the binary was built, a day of slack allowing for
+// time zones, as the file names and times the run records would be wrong
+func checkClock(now time.Time) {
+	built := builtAt()
+	if !now.Before(built.Add(-24 * time.Hour)) {
+		return
+	}
+	log.Printf("WARNING: the clock reads %s, before this build of CodePack from %s. The default file names, the run ID and the times of the manifest use it, fix the system clock or set -now",
+		now.UTC().Format(time.RFC3339), built.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetNow(t *testing.T) {
+	saved := clock
+	defer func() { clock = saved }()
+	for _, tc := range []struct {
+		value    string
+		expected time.Time
+		err      bool
+	}{
+		{value: "2024-01-31T12:00:00Z", expected: time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)},
+		{value: "2024-01-31T12:00:00+02:00", expected: time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)},
+		{value: "1970-01-01", expected: time.Date(1970, 1, 1, 0, 0, 0, 0, time.Local)},
+		{value: "31.01.2024", err: true},
+		{value: "yesterday", err: true},
+	} {
+		clock = saved
+		err := setNow(tc.value)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v, expected one %v", tc.value, err, tc.err)
+			continue
+		}
+		if tc.err {
+			continue
+		}
+		// the clock runs on from the time set
+		if now := clock(); now.Before(tc.expected) || now.After(tc.expected.Add(time.Minute)) {
+			t.Errorf("%q: clock reads %s, expected %s", tc.value, now, tc.expected)
+		}
+		first := clock()
+		time.Sleep(2 * time.Millisecond)
+		if !clock().After(first) {
+			t.Errorf("%q: the clock stands still", tc.value)
+		}
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	savedDate := buildDate
+	savedOutput := log.Writer()
+	defer func() {
+		buildDate = savedDate
+		log.SetOutput(savedOutput)
+	}()
+	built := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name      string
+		buildDate string
+		now       time.Time
+		warns     bool
+	}{
+		{name: "after the build", buildDate: built.Format(time.RFC3339), now: built.Add(30 * 24 * time.Hour)},
+		{name: "within a day", buildDate: built.Format(time.RFC3339), now: built.Add(-20 * time.Hour)},
+		{name: "before the build", buildDate: built.Format(time.RFC3339), now: built.Add(-48 * time.Hour), warns: true},
+		{name: "epoch", buildDate: built.Format(time.RFC3339), now: time.Unix(0, 0), warns: true},
+		{name: "epoch without a build date", now: time.Unix(0, 0), warns: true},
+		{name: "invalid build date", buildDate: "June 2024", now: time.Unix(0, 0), warns: true},
+	} {
+		buildDate = tc.buildDate
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		checkClock(tc.now)
+		if warns := strings.Contains(buf.String(), "WARNING: the clock reads"); warns != tc.warns {
+			t.Errorf("%s: warned %v, expected %v:\n%s", tc.name, warns, tc.warns, buf.String())
+		}
+	}
+
+	buildDate = built.Format(time.RFC3339)
+	if !builtAt().Equal(built) {
+		t.Errorf("built at %s, expected the build date %s", builtAt(), built)
+	}
+	buildDate = ""
+	if builtAt().Before(releaseDate) {
+		t.Errorf("built at %s without a build date, before the release date %s", builtAt(), releaseDate)
+	}
+}
+
+func TestNowFlag(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	config := "repos:\n  - name: app\n    path: team\n    url: " + filepath.Join(dir, "src") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runCodePack(t, dir, nil, "-config", "codepack.yaml", "-no-catalog", "-now", "1970-01-01T00:00:00Z")
+	if code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "WARNING: the clock reads 1970-01-01T00:00:") {
+		t.Errorf("no warning of the clock in:\n%s", out)
+	}
+	if !strings.Contains(out, "DEBUG [19700101T0000") {
+		t.Errorf("the run ID does not use -now:\n%s", out)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "1970-01-01-git-backup.tar.gz.manifest.json"))
+	if err != nil {
+		t.Fatalf("the default file names do not use -now: %v", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(manifest.Created, "1970-01-01T00:00:") {
+		t.Errorf("manifest created %q", manifest.Created)
+	}
+
+	out, code = runCodePack(t, dir, nil, "-config", "codepack.yaml", "-now", "yesterday")
+	if code != exitCodeConfig || !strings.Contains(out, "Invalid -now 'yesterday'") {
+		t.Errorf("an invalid -now exited with %d:\n%s", code, out)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// categories of clone failures, recorded in the run report and deciding whether a clone is retried
+const (
+	categoryAuth     = "auth"
+	categoryNotFound = "not_found"
+	categoryNetwork  = "network"
+	categoryDiskFull = "disk_full"
+	categoryProtocol = "protocol"
+	categoryConflict = "conflict"
+	categoryEmpty    = "empty"
+	categoryOther    = "other"
+)
+
+// categoryHints explain the likely cause of a group of failures in the run report
+var categoryHints = map[string]string{
+	categoryAuth:     "credentials are missing, lack access or likely expired",
+	categoryNotFound: "repositories were deleted, renamed or are not visible to the credentials",
+	categoryNetwork:  "the host was unreachable, timed out or failed with a server error",
+	categoryDiskFull: "the staging directory or the -secure-staging-max limit is full",
+	categoryProtocol: "the server sent data that could not be read, or a setting go-git does not support",
+	categoryConflict: "the clone path already held a repository, run with -force-reclone to replace it",
+	categoryEmpty:    "the remotes have no commits yet, push to them or leave them out of the configuration",
+}
+
+// statusCode matches the HTTP status in error messages of go-git and of git hosts
+var statusCode = regexp.MustCompile(`status code: (\d{3})`)
+
+// classifyCloneError returns the category of a clone failure, matching the errors of the
+// go-git transports first and the HTTP status or wording of the message second
+func classifyCloneError(err error) string {
+	if err == nil {
+		return ""
+	}
+	var httpErr *githttp.Err
+	var netErr net.Error
+	switch {
+	case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod):
+		return categoryAuth
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return categoryNotFound
+	case errors.Is(err, git.ErrRepositoryAlreadyExists):
+		return categoryConflict
+	case errors.Is(err, transport.ErrEmptyRemoteRepository):
+		return categoryEmpty
+	case errors.Is(err, errRepoSizeLimit), errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return categoryDiskFull
+	case errors.Is(err, errFilterUnsupported), errors.Is(err, packp.ErrEmptyAdvRefs), errors.Is(err, packp.ErrEmptyInput),
+		errors.Is(err, pktline.ErrInvalidPktLen), errors.Is(err, packfile.ErrInvalidDelta), errors.Is(err, packfile.ErrReferenceDeltaNotFound):
+		return categoryProtocol
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr):
+		return categoryNetwork
+	case asGitError(err, &httpErr):
+		return statusCategory(httpErr.Response.StatusCode)
+	}
+
+	msg := strings.ToLower(err.Error())
+	if m := statusCode.FindStringSubmatch(msg); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return statusCategory(code)
+	}
+	switch {
+	case strings.Contains(msg, "unable to authenticate"), strings.Contains(msg, "permission denied"):
+		return categoryAuth
+	case strings.Contains(msg, "no space left on device"), strings.Contains(msg, "disk quota exceeded"):
+		return categoryDiskFull
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "connection refused"), strings.Contains(msg, "no such host"):
+		return categoryNetwork
+	}
+	return categoryOther
+}
+
+// asGitError is errors.As unwrapping the error types of go-git, which have no Unwrap method
+func asGitError(err error, target **githttp.Err) bool {
+	for err != nil {
+		if errors.As(err, target) {
+			return true
+		}
+		switch e := err.(type) {
+		case *plumbing.UnexpectedError:
+			err = e.Err
+		case *plumbing.PermanentError:
+			err = e.Err
+		default:
+			err = errors.Unwrap(err)
+		}
+	}
+	return false
+}
+
+func statusCategory(code int) string {
+	switch {
+	case code == 401 || code == 403:
+		return categoryAuth
+	case code == 404:
+		return categoryNotFound
+	case code == 408 || code == 429 || code >= 500:
+		return categoryNetwork
+	}
+	return categoryProtocol
+}
+
+// retryable reports whether a failure of category may succeed when the clone is tried
+// again, credentials, missing or empty repositories and full disks do not change between attempts
+func retryable(category string) bool {
+	switch category {
+	case categoryAuth, categoryNotFound, categoryDiskFull, categoryConflict, categoryEmpty:
+		return false
+	}
+	return true
+}
+
+// failureGroups summarizes failed clones by category and host, largest group first,
+// like "7 auth failures on gitlab.internal, credentials are missing, lack access or likely expired".
+// Repositories missing from the remote that did not fail the run are left out
+func failureGroups(entries []runReportEntry) []string {
+	type group struct {
+		category string
+		host     string
+	}
+	counts := make(map[group]int)
+	var groups []group
+	for _, entry := range entries {
+		if entry.Error == "" || entry.Missing {
+			continue
+		}
+		g := group{category: entry.Category, host: repoHost(entry.URL)}
+		if counts[g] == 0 {
+			groups = append(groups, g)
+		}
+		counts[g]++
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return counts[groups[i]] > counts[groups[j]] })
+
+	lines := make([]string, len(groups))
+	for i, g := range groups {
+		noun := "failures"
+		if counts[g] == 1 {
+			noun = "failure"
+		}
+		lines[i] = fmt.Sprintf("%d %s %s on %s", counts[g], g.category, noun, g.host)
+		if hint := categoryHints[g.category]; hint != "" {
+			lines[i] += ", " + hint
+		}
+	}
+	return lines
+}
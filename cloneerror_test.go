@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+func TestClassifyCloneError(t *testing.T) {
+	httpErr := func(code int) error {
+		return plumbing.NewUnexpectedError(&githttp.Err{Response: &nethttp.Response{StatusCode: code}})
+	}
+	for _, tc := range []struct {
+		name     string
+		err      error
+		category string
+	}{
+		{"no error", nil, ""},
+		{"authentication required", fmt.Errorf("clone: %w", transport.ErrAuthenticationRequired), categoryAuth},
+		{"authorization failed", transport.ErrAuthorizationFailed, categoryAuth},
+		{"http 401", httpErr(401), categoryAuth},
+		{"http 403", httpErr(403), categoryAuth},
+		{"ssh permission denied", errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]"), categoryAuth},
+		{"repository not found", transport.ErrRepositoryNotFound, categoryNotFound},
+		{"http 404", httpErr(404), categoryNotFound},
+		{"status in message", errors.New("unexpected client error: unexpected requesting \"https://example.com/a.git/info/refs\" status code: 404"), categoryNotFound},
+		{"deadline", fmt.Errorf("attempt 2: %w", context.DeadlineExceeded), categoryNetwork},
+		{"connection refused", &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}, categoryNetwork},
+		{"unexpected eof", io.ErrUnexpectedEOF, categoryNetwork},
+		{"http 502", httpErr(502), categoryNetwork},
+		{"http 429", httpErr(429), categoryNetwork},
+		{"no such host", errors.New("dial tcp: lookup git.example.com: no such host"), categoryNetwork},
+		{"disk full", &os.PathError{Op: "write", Path: "objects/pack/tmp", Err: syscall.ENOSPC}, categoryDiskFull},
+		{"size limit", fmt.Errorf("write: %w", errRepoSizeLimit), categoryDiskFull},
+		{"empty remote", transport.ErrEmptyRemoteRepository, categoryEmpty},
+		{"empty remote wrapped", fmt.Errorf("clone: %w", transport.ErrEmptyRemoteRepository), categoryEmpty},
+		{"empty advertisement", packp.ErrEmptyAdvRefs, categoryProtocol},
+		{"filter", errFilterUnsupported, categoryProtocol},
+		{"http 400", httpErr(400), categoryProtocol},
+		{"staging conflict", &stagingConflictError{path: "team/app", err: errIncompleteMirror}, categoryConflict},
+		{"already exists", git.ErrRepositoryAlreadyExists, categoryConflict},
+		{"unknown", errors.New("something else"), categoryOther},
+	} {
+		if category := classifyCloneError(tc.err); category != tc.category {
+			t.Errorf("%s: classified as %q, expected %q", tc.name, category, tc.category)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for category, expected := range map[string]bool{
+		categoryAuth:     false,
+		categoryNotFound: false,
+		categoryDiskFull: false,
+		categoryConflict: false,
+		categoryEmpty:    false,
+		categoryNetwork:  true,
+		categoryProtocol: true,
+		categoryOther:    true,
+	} {
+		if retryable(category) != expected {
+			t.Errorf("retryable(%q) = %v, expected %v", category, !expected, expected)
+		}
+	}
+}
+
+func TestFailureGroups(t *testing.T) {
+	entries := []runReportEntry{
+		{URL: "https://gitlab.internal/a.git", Error: "401", Category: categoryAuth},
+		{URL: "https://gitlab.internal/b.git", Error: "401", Category: categoryAuth},
+		{URL: "https://github.com/c.git", Error: "timeout", Category: categoryNetwork},
+		{URL: "https://github.com/d.git", Error: "gone", Category: categoryNotFound, Missing: true},
+		{URL: "https://github.com/e.git"},
+	}
+	expected := []string{
+		"2 auth failures on gitlab.internal, " + categoryHints[categoryAuth],
+		"1 network failure on github.com, " + categoryHints[categoryNetwork],
+	}
+	if groups := failureGroups(entries); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("grouped the failures as %q, expected %q", groups, expected)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"runtime"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// defaultPathTemplate places repositories without a path under the host and owner of their
+// URL, like github.com/anchore for https://github.com/anchore/grype.git
+const defaultPathTemplate = "{{ .Host }}/{{ .Owner }}"
+
+// repoURLFields are the parts of a repository URL available to path_template
+type repoURLFields struct {
+	// Host is the host name without user or port, empty for local paths
+	Host string
+	// Port is the port of the URL, empty for the default port of its scheme
+	Port string
+	// Owner are the path elements before the repository, like group/subgroup
+	Owner string
+	// Name is the last path element without .git
+	Name string
+}
+
+// parseRepoURL splits a repository URL, an scp like git@host:owner/repo.git or a local path.
+// Like git, only a URL with :// has a scheme and a colon before the first slash makes an scp
+// like URL, so host:repo.git is not parsed as the scheme host. A drive letter is a local path
+func parseRepoURL(rawURL string) repoURLFields {
+	var fields repoURLFields
+	p := rawURL
+	i := strings.Index(rawURL, ":")
+	if u, err := url.Parse(rawURL); err == nil && strings.Contains(rawURL, "://") {
+		fields.Host, fields.Port, p = u.Hostname(), u.Port(), u.Path
+	} else if i > 1 && !strings.Contains(rawURL[:i], "/") {
+		// scp like git@host:owner/repo.git
+		fields.Host, p = rawURL[:i], rawURL[i+1:]
+		if j := strings.LastIndex(fields.Host, "@"); j >= 0 {
+			fields.Host = fields.Host[j+1:]
+		}
+		if j := strings.IndexAny(p, "?#"); j >= 0 {
+			p = p[:j]
+		}
+	}
+	p = strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+	dir, name := path.Split(p)
+	fields.Owner, fields.Name = strings.Trim(dir, "/"), name
+	return fields
+}
+
+// normalized makes the fields safe to use as names of directories: a host with non-ASCII
+// characters is punycode encoded, like xn--bcher-kva.example for bücher.example, and the
+// characters filesystems reject in names are replaced with _ in every element. Only the URL
+// decides the result, so a repository keeps its derived path from run to run
+func (f repoURLFields) normalized() repoURLFields {
+	f.Host = safePathElement(asciiHost(f.Host))
+	owner := strings.Split(f.Owner, "/")
+	for i := range owner {
+		owner[i] = safePathElement(owner[i])
+	}
+	f.Owner = strings.Join(owner, "/")
+	f.Name = safePathElement(f.Name)
+	return f
+}
+
+// asciiHost is the punycode form of a host with non-ASCII characters, host itself when it
+// has none or is not a valid internationalized name
+func asciiHost(host string) string {
+	for i := 0; i < len(host); i++ {
+		if host[i] >= utf8.RuneSelf {
+			if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+				return ascii
+			}
+			return host
+		}
+	}
+	return host
+}
+
+// invalidNameChars are the characters replaced in derived names, the colon of an IPv6 host
+// everywhere as macOS and Windows reject it, on Windows also the characters it reserves
+func invalidNameChars() string {
+	if runtime.GOOS == "windows" {
+		return `:<>|"?*`
+	}
+	return ":"
+}
+
+// safePathElement replaces the characters of invalidNameChars and control characters in a
+// single element of a derived path with _
+func safePathElement(element string) string {
+	invalid := invalidNameChars()
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(invalid, r) {
+			return '_'
+		}
+		return r
+	}, element)
+}
+
+// pathTemplate parses the path_template of a configuration, defaultPathTemplate when empty
+func pathTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultPathTemplate
+	}
+	tmpl, err := template.New("path_template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid path_template '%s': %w", text, err)
+	}
+	return tmpl, nil
+}
+
+// deriveNameAndPath names a repository after the last element of its URL without .git
+// and renders tmpl with the fields of the URL as its path, when the configuration leaves
+// name or path empty. Explicit values are kept
+func (repo *Repository) deriveNameAndPath(tmpl *template.Template) error {
+	fields := parseRepoURL(repo.URL).normalized()
+	if repo.Name == "" {
+		repo.Name = fields.Name
+		repo.NameDerived = repo.Name != ""
+	}
+	if repo.Path == "" {
+		var rendered strings.Builder
+		if err := tmpl.Execute(&rendered, fields); err != nil {
+			return fmt.Errorf("Cannot derive the path of '%s': %w", repo.URL, err)
+		}
+		repo.Path = strings.Trim(path.Clean("/"+rendered.String()), "/")
+		repo.PathDerived = true
+	}
+	return nil
+}
+
+// validateClonePaths checks that every repository has a name and clones inside the staging
+// directory to a path of its own, for explicit and derived names and paths alike
+func validateClonePaths(repos []Repository) error {
+	owners := make(map[string]int)
+	for i, repo := range repos {
+		if repo.Name == "" {
+			return fmt.Errorf("Repository %d of the configuration has no name and none can be derived from '%s'", i+1, repo.URL)
+		}
+		clonePath := path.Join(repo.Path, repo.Name)
+		elements := strings.Split(strings.ReplaceAll(repo.Path+"/"+repo.Name, `\`, "/"), "/")
+		if path.IsAbs(repo.Path) || contains(elements, "..") || clonePath == "." {
+			return fmt.Errorf("Invalid clone path '%s'%s of repository '%s', it must stay inside the backup", clonePath, repo.derivedNote(), repo.URL)
+		}
+		if j, ok := owners[clonePath]; ok {
+			return fmt.Errorf("Repositories '%s' and '%s' both clone to '%s'%s, set a name or path for one of them",
+				repos[j].URL, repo.URL, clonePath, repo.derivedNote())
+		}
+		owners[clonePath] = i
+	}
+	clonePaths := make(map[string]bool, len(owners))
+	for clonePath := range owners {
+		clonePaths[clonePath] = true
+	}
+	for clonePath, j := range owners {
+		if stagedClone(clonePath, clonePaths) {
+			return fmt.Errorf("Repository '%s' clones to '%s', a name reserved for staging another repository while it is cloned, set a name or path for it",
+				repos[j].URL, clonePath)
+		}
+	}
+	return nil
+}
+
+// derivedNote tells which of the name and path of repo were derived from its URL
+func (repo Repository) derivedNote() string {
+	switch {
+	case repo.NameDerived && repo.PathDerived:
+		return " (name and path derived)"
+	case repo.NameDerived:
+		return " (name derived)"
+	case repo.PathDerived:
+		return " (path derived)"
+	}
+	return ""
+}
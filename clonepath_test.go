@@ -0,0 +1,147 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseRepoURL(t *testing.T) {
+	// windowsName is name with the characters Windows reserves replaced there only
+	windowsName := func(name string) string {
+		if runtime.GOOS == "windows" {
+			return strings.NewReplacer("<", "_", ">", "_", "|", "_", `"`, "_", "?", "_", "*", "_").Replace(name)
+		}
+		return name
+	}
+	for _, tc := range []struct {
+		url      string
+		expected repoURLFields
+	}{
+		{"https://github.com/anchore/grype.git", repoURLFields{Host: "github.com", Owner: "anchore", Name: "grype"}},
+		{"https://github.com/anchore/grype/", repoURLFields{Host: "github.com", Owner: "anchore", Name: "grype"}},
+		{"https://git.bücher.example:8443/team/app.git", repoURLFields{Host: "git.xn--bcher-kva.example", Port: "8443", Owner: "team", Name: "app"}},
+		{"https://user:secret@bücher.example/team/app", repoURLFields{Host: "xn--bcher-kva.example", Owner: "team", Name: "app"}},
+		{"ssh://git@git.example.com:2222/group/sub/app.git", repoURLFields{Host: "git.example.com", Port: "2222", Owner: "group/sub", Name: "app"}},
+		{"git@github.com:anchore/grype.git", repoURLFields{Host: "github.com", Owner: "anchore", Name: "grype"}},
+		{"git@git.bücher.example:team/app.git", repoURLFields{Host: "git.xn--bcher-kva.example", Owner: "team", Name: "app"}},
+		{"github.com:app.git", repoURLFields{Host: "github.com", Name: "app"}},
+		{"https://example.com/team/app.git?ref=main#readme", repoURLFields{Host: "example.com", Owner: "team", Name: "app"}},
+		{"git@example.com:team/app.git?ref=main", repoURLFields{Host: "example.com", Owner: "team", Name: "app"}},
+		{"https://[::1]:8080/team/app", repoURLFields{Host: "__1", Port: "8080", Owner: "team", Name: "app"}},
+		{"https://example.com/te:am/a|pp%01.git", repoURLFields{Host: "example.com", Owner: "te_am", Name: windowsName("a|pp_")}},
+		{"https://example.com/team/w*ld?.git", repoURLFields{Host: "example.com", Owner: "team", Name: "w*ld"}},
+		{"https://example.com/team/%22quoted%22", repoURLFields{Host: "example.com", Owner: "team", Name: windowsName(`"quoted"`)}},
+		{"file:///srv/git/app.git", repoURLFields{Owner: "srv/git", Name: "app"}},
+		{"/srv/git/app.git", repoURLFields{Owner: "srv/git", Name: "app"}},
+		{"../app", repoURLFields{Owner: "..", Name: "app"}},
+		{"./team:app.git", repoURLFields{Owner: ".", Name: "team_app"}},
+		{`C:\git\app.git`, repoURLFields{Name: `C_\git\app`}},
+		{"", repoURLFields{}},
+	} {
+		fields := parseRepoURL(tc.url).normalized()
+		if fields != tc.expected {
+			t.Errorf("%q: %+v, expected %+v", tc.url, fields, tc.expected)
+		}
+		if again := parseRepoURL(tc.url).normalized(); again != fields {
+			t.Errorf("%q: %+v the second time, %+v the first", tc.url, again, fields)
+		}
+	}
+}
+
+func TestDeriveNameAndPath(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		template string
+		repo     Repository
+		expected Repository
+		err      bool
+	}{
+		{
+			name:     "default",
+			repo:     Repository{URL: "https://git.bücher.example:8443/team/app.git"},
+			expected: Repository{Name: "app", Path: "git.xn--bcher-kva.example/team", NameDerived: true, PathDerived: true},
+		},
+		{
+			name:     "port in the template",
+			template: "{{ .Host }}{{ if .Port }}_{{ .Port }}{{ end }}/{{ .Owner }}",
+			repo:     Repository{URL: "ssh://git@git.example.com:2222/group/sub/app.git"},
+			expected: Repository{Name: "app", Path: "git.example.com_2222/group/sub", NameDerived: true, PathDerived: true},
+		},
+		{
+			name:     "no owner",
+			repo:     Repository{URL: "github.com:app.git"},
+			expected: Repository{Name: "app", Path: "github.com", NameDerived: true, PathDerived: true},
+		},
+		{
+			name:     "explicit name and path",
+			repo:     Repository{URL: "https://github.com/anchore/grype.git", Name: "scanner", Path: "tools"},
+			expected: Repository{Name: "scanner", Path: "tools"},
+		},
+		{
+			name:     "escape is cleaned",
+			template: "{{ .Owner }}",
+			repo:     Repository{URL: "../app"},
+			expected: Repository{Name: "app", NameDerived: true, PathDerived: true},
+		},
+		{
+			name:     "unknown field",
+			template: "{{ .Group }}",
+			repo:     Repository{URL: "https://github.com/anchore/grype.git"},
+			err:      true,
+		},
+	} {
+		tmpl, err := pathTemplate(tc.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo := tc.repo
+		err = repo.deriveNameAndPath(tmpl)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, expected one %v", tc.name, err, tc.err)
+			continue
+		}
+		if tc.err {
+			continue
+		}
+		if repo.Name != tc.expected.Name || repo.Path != tc.expected.Path || repo.NameDerived != tc.expected.NameDerived || repo.PathDerived != tc.expected.PathDerived {
+			t.Errorf("%s: name %q and path %q derived %v %v, expected %q and %q derived %v %v", tc.name,
+				repo.Name, repo.Path, repo.NameDerived, repo.PathDerived,
+				tc.expected.Name, tc.expected.Path, tc.expected.NameDerived, tc.expected.PathDerived)
+		}
+	}
+	if _, err := pathTemplate("{{ .Host"); err == nil {
+		t.Errorf("an invalid path_template was parsed")
+	}
+}
+
+func TestValidateClonePaths(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		repos []Repository
+		err   string
+	}{
+		{name: "distinct", repos: []Repository{{Name: "app", Path: "team"}, {Name: "app", Path: "other"}}},
+		{name: "no name", repos: []Repository{{URL: "https://example.com/"}}, err: "has no name"},
+		{name: "absolute", repos: []Repository{{Name: "app", Path: "/srv"}}, err: "must stay inside the backup"},
+		{name: "escape", repos: []Repository{{Name: "app", Path: "team/../.."}}, err: "must stay inside the backup"},
+		{name: "backslash escape", repos: []Repository{{Name: "app", Path: `team\..\..`}}, err: "must stay inside the backup"},
+		{
+			name:  "same path",
+			repos: []Repository{{URL: "https://a.example/team/app", Name: "app", Path: "team"}, {URL: "https://b.example/team/app", Name: "app", Path: "team", NameDerived: true}},
+			err:   "both clone to 'team/app' (name derived)",
+		},
+		{name: "staging name", repos: []Repository{{Name: "app", Path: "team"}, {Name: ".app.123456.tmp", Path: "team"}}, err: "reserved for staging"},
+	} {
+		err := validateClonePaths(tc.repos)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, expected %q", tc.name, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+var (
+	awsConfigOnce sync.Once
+	awsConfig     aws.Config
+	awsConfigErr  error
+)
+
+// codeCommitRegion returns the region of a git-codecommit.<region>.amazonaws.com URL
+func codeCommitRegion(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	host := strings.ToLower(u.Hostname())
+	if !strings.HasPrefix(host, "git-codecommit.") || !strings.HasSuffix(host, ".amazonaws.com") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "git-codecommit."), ".amazonaws.com"), true
+}
+
+func isCodeCommit(rawURL string) bool {
+	_, ok := codeCommitRegion(rawURL)
+	return ok
+}
+
+// codeCommitAuth signs the clone of repo with credentials from the standard AWS credential
+// chain the way the CodeCommit credential helper does. The password is only valid for
+// about 15 minutes so it is generated for every clone
+func codeCommitAuth(ctx context.Context, repo Repository, now time.Time) (*http.BasicAuth, error) {
+	u, err := url.Parse(repo.URL)
+	if err != nil {
+		return nil, err
+	}
+	region, _ := codeCommitRegion(repo.URL)
+	if repo.Region != "" {
+		region = repo.Region
+	}
+
+	awsConfigOnce.Do(func() {
+		awsConfig, awsConfigErr = awsconfig.LoadDefaultConfig(context.Background())
+	})
+	if awsConfigErr != nil {
+		return nil, fmt.Errorf("cannot load AWS configuration: %w", awsConfigErr)
+	}
+	creds, err := awsConfig.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve AWS credentials: %w", err)
+	}
+
+	timestamp := now.UTC().Format("20060102T150405")
+	date := timestamp[:8]
+	canonicalRequest := fmt.Sprintf("GIT\n%s\n\nhost:%s\n\nhost\n", u.EscapedPath(), u.Hostname())
+	scope := fmt.Sprintf("%s/%s/codecommit/aws4_request", date, region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", timestamp, scope, hex.EncodeToString(requestHash[:]))
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, "codecommit", "aws4_request", stringToSign} {
+		key = hmacSHA256(key, part)
+	}
+
+	username := creds.AccessKeyID
+	if creds.SessionToken != "" {
+		username += "%" + creds.SessionToken
+	}
+	return &http.BasicAuth{Username: username, Password: timestamp + "Z" + hex.EncodeToString(key)}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
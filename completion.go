@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// subcommands are the commands dispatched on the first argument, offered by shell completion
+var subcommands = []string{"restore", "consolidate", "list", "archive", "check", "auth-check", "verify-restore", "migrate", "rewrap", "config", "catalog", "completion"}
+
+// completing is set by the hidden __complete command, parseFlags then prints the
+// flags of the command being completed instead of parsing its arguments
+var completing bool
+
+// completeCommand prints the candidates for the last of words, the arguments typed after
+// codepack. Printing nothing lets the shell complete file names. It returns true when the
+// flags of the backup itself are to be listed, which main does once they are defined
+func completeCommand(words []string) bool {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur := words[len(words)-1]
+	if len(words) == 1 {
+		if strings.HasPrefix(cur, "-") {
+			completing = true
+			return true
+		}
+		for _, name := range subcommands {
+			fmt.Println(name)
+		}
+		return false
+	}
+	if !strings.HasPrefix(cur, "-") {
+		if words[0] == "completion" && len(words) == 2 {
+			fmt.Println("bash\nzsh\nfish")
+		}
+		if words[0] == "config" && len(words) == 2 {
+			fmt.Println("add\nremove\nlist")
+		}
+		if words[0] == "catalog" && len(words) == 2 {
+			fmt.Println("list\nfind\nprune")
+		}
+		return false
+	}
+
+	completing = true
+	switch words[0] {
+	case "restore":
+		restoreCommand(nil)
+	case "consolidate":
+		consolidateCommand(nil)
+	case "list":
+		listCommand(nil)
+	case "archive":
+		archiveCommand(nil)
+	case "check":
+		checkCommand(nil)
+	case "auth-check":
+		authCheckCommand(nil)
+	case "verify-restore":
+		verifyRestoreCommand(nil)
+	case "migrate":
+		migrateCommand(nil)
+	case "rewrap":
+		rewrapCommand(nil)
+	case "config":
+		if len(words) > 2 {
+			configCommand(words[1:2])
+		}
+	case "catalog":
+		if len(words) > 2 {
+			catalogCommand(words[1:2])
+		}
+	case "completion":
+		return false
+	default:
+		return true
+	}
+	return false
+}
+
+const bashCompletion = `_codepack() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local candidates
+    candidates="$(codepack __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)"
+    if [ -z "$candidates" ]; then
+        COMPREPLY=($(compgen -f -- "$cur"))
+    else
+        COMPREPLY=($(compgen -W "$candidates" -- "$cur"))
+    fi
+}
+complete -o filenames -F _codepack codepack
+`
+
+const zshCompletion = `#compdef codepack
+
+_codepack() {
+    local -a candidates
+    candidates=(${(f)"$(codepack __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+    if (( ${#candidates} )); then
+        compadd -a candidates
+    else
+        _files
+    fi
+}
+
+compdef _codepack codepack
+`
+
+const fishCompletion = `function __codepack_complete
+    set -l tokens (commandline -opc) (commandline -ct)
+    set -l candidates (codepack __complete $tokens[2..-1] 2>/dev/null)
+    if test (count $candidates) -eq 0
+        __fish_complete_path (commandline -ct)
+    else
+        printf '%s\n' $candidates
+    end
+end
+complete -c codepack -f -a '(__codepack_complete)'
+`
+
+// completionCommand prints the completion script of a shell
+func completionCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: codepack completion bash|zsh|fish")
+	}
+	switch args[0] {
+	case "bash":
+		os.Stdout.WriteString(bashCompletion)
+	case "zsh":
+		os.Stdout.WriteString(zshCompletion)
+	case "fish":
+		os.Stdout.WriteString(fishCompletion)
+	default:
+		return fmt.Errorf("Unsupported shell '%s', use bash, zsh or fish", args[0])
+	}
+	return nil
+}
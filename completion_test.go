@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompleteCommand(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		words    []string
+		expected []string
+		absent   []string
+	}{
+		{words: []string{""}, expected: subcommands},
+		{words: []string{"-"}, expected: []string{"-config", "-out", "-workers"}, absent: []string{"restore"}},
+		{words: []string{"restore", "-"}, expected: []string{"-from", "-dest", "-checkout"}, absent: []string{"-workers"}},
+		{words: []string{"list", "-"}, expected: []string{"-archive"}, absent: []string{"-config"}},
+		{words: []string{"completion", ""}, expected: []string{"bash", "zsh", "fish"}},
+		{words: []string{"config", ""}, expected: []string{"add", "remove", "list"}},
+		{words: []string{"config", "add", "-"}, expected: []string{"-url", "-name", "-path"}},
+		{words: []string{"catalog", ""}, expected: []string{"list", "find", "prune"}},
+		// nothing printed lets the shell complete file names
+		{words: []string{"restore", "backup"}},
+		{words: []string{"completion", "bash", ""}},
+	} {
+		out, code := runCodePack(t, dir, nil, append([]string{"__complete"}, tc.words...)...)
+		if code != 0 {
+			t.Errorf("%q: exited with %d:\n%s", tc.words, code, out)
+		}
+		candidates := strings.Fields(out)
+		if tc.expected == nil && len(candidates) > 0 {
+			t.Errorf("%q: expected no candidates, got %q", tc.words, candidates)
+		}
+		for _, expected := range tc.expected {
+			if !contains(candidates, expected) {
+				t.Errorf("%q: %s is missing from %q", tc.words, expected, candidates)
+			}
+		}
+		for _, absent := range tc.absent {
+			if contains(candidates, absent) {
+				t.Errorf("%q: %s should not be offered", tc.words, absent)
+			}
+		}
+	}
+}
+
+func TestCompletionScripts(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		out, code := runCodePack(t, t.TempDir(), nil, "completion", shell)
+		if code != 0 || !strings.Contains(out, "codepack __complete") {
+			t.Errorf("%s: exited with %d and printed:\n%s", shell, code, out)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	dsnetbzip2 "github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archive formats of -format, the tar stream with the compression applied to it
+const (
+	formatGzip  = "gzip"
+	formatTar   = "tar"
+	formatXZ    = "xz"
+	formatBzip2 = "bzip2"
+	formatZstd  = "zstd"
+)
+
+// xzPresetDictCap are the dictionary sizes of the xz presets 0 to 9
+var xzPresetDictCap = [10]int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// archiveFormat describes the compression layer of an archive format
+type archiveFormat struct {
+	extension   string
+	contentType string
+	// ociLayerType is the media type of the archive pushed to oci:// destinations
+	ociLayerType string
+	// magic are the first bytes of a compressed stream, empty for an uncompressed tar
+	magic []byte
+	// compress wraps w in the compression at level, 1 is the fastest and 9 the smallest,
+	// 0 the default of the format
+	compress   func(w io.Writer, level int) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var archiveFormats = map[string]archiveFormat{
+	formatGzip: {
+		extension:    ".tar.gz",
+		contentType:  "application/gzip",
+		ociLayerType: ociLayerType,
+		magic:        []byte{0x1f, 0x8b},
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	formatTar: {
+		extension:    ".tar",
+		contentType:  "application/x-tar",
+		ociLayerType: "application/vnd.codepack.backup.layer.v1.tar",
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+	},
+	formatXZ: {
+		extension:    ".tar.xz",
+		contentType:  "application/x-xz",
+		ociLayerType: "application/vnd.codepack.backup.layer.v1.tar+xz",
+		magic:        []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			config := xz.WriterConfig{}
+			if level > 0 {
+				config.DictCap = xzPresetDictCap[level]
+			}
+			return config.NewWriter(w)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := xz.NewReader(r)
+			return io.NopCloser(zr), err
+		},
+	},
+	formatBzip2: {
+		extension:    ".tar.bz2",
+		contentType:  "application/x-bzip2",
+		ociLayerType: "application/vnd.codepack.backup.layer.v1.tar+bzip2",
+		magic:        []byte{'B', 'Z', 'h'},
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return dsnetbzip2.NewWriter(w, &dsnetbzip2.WriterConfig{Level: level})
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+	formatZstd: {
+		extension:    ".tar.zst",
+		contentType:  "application/zstd",
+		ociLayerType: "application/vnd.codepack.backup.layer.v1.tar+zstd",
+		magic:        []byte{0x28, 0xb5, 0x2f, 0xfd},
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				return zstd.NewWriter(w)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		},
+	},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// validCompressionLevel checks a -compression-level, 0 is the default of the format
+func validCompressionLevel(level int) error {
+	if level < 0 || level > 9 {
+		return fmt.Errorf("Invalid compression level %d, use 1 (fastest) to 9 (smallest) or 0 for the default of the format", level)
+	}
+	return nil
+}
+
+// lookupFormat returns the archive format called name, gzip when name is empty
+func lookupFormat(name string) (archiveFormat, error) {
+	if name == "" {
+		name = formatGzip
+	}
+	format, ok := archiveFormats[name]
+	if !ok {
+		return archiveFormat{}, fmt.Errorf("Unsupported archive format '%s', the supported formats are %s", name, strings.Join(formatNames(), ", "))
+	}
+	return format, nil
+}
+
+func formatNames() []string {
+	var names []string
+	for name := range archiveFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// decompress returns the tar stream of an archive read from r, the compression is
+// detected by the magic bytes at its start and the stream is read as a plain tar
+// when they match no format
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	for _, name := range formatNames() {
+		format := archiveFormats[name]
+		if len(format.magic) == 0 {
+			continue
+		}
+		if magic, err := br.Peek(len(format.magic)); err == nil && bytes.Equal(magic, format.magic) {
+			return format.decompress(br)
+		}
+	}
+	return io.NopCloser(br), nil
+}
+
+// errArchiveLimits is returned when an archive exceeds the limits it is read with
+var errArchiveLimits = errors.New("archive exceeds safety limits")
+
+// maxExpansion is the default bound of the bytes decompressed from an archive as a multiple of
+// its size, far above the ratio the compression of git objects reaches, so a gzip bomb is
+// stopped long before it fills the disk or memory
+const maxExpansion = 1100
+
+// archiveLimits bound what is read from an archive that may be corrupt or hostile,
+// zero fields are derived from the size of the archive by withDefaults
+type archiveLimits struct {
+	// MaxTotal is the number of decompressed bytes, tar headers included
+	MaxTotal int64
+	// MaxEntry is the size of a single entry
+	MaxEntry int64
+	// MaxEntries is the number of entries
+	MaxEntries int64
+}
+
+// archiveLimitFlags adds the flags setting the limits of archives read by a subcommand
+func archiveLimitFlags(flags *flag.FlagSet) func() archiveLimits {
+	totalPtr := flags.Int64("max-decompressed-size", 0, fmt.Sprintf("maximum MiB decompressed from an archive (default %d times the size of the archive)", maxExpansion))
+	entryPtr := flags.Int64("max-entry-size", 0, "maximum MiB of a single entry of an archive (default -max-decompressed-size)")
+	entriesPtr := flags.Int64("max-entries", 0, "maximum number of entries of an archive (default one per 512 bytes of -max-decompressed-size)")
+	return func() archiveLimits {
+		return archiveLimits{MaxTotal: *totalPtr * 1024 * 1024, MaxEntry: *entryPtr * 1024 * 1024, MaxEntries: *entriesPtr}
+	}
+}
+
+func (l archiveLimits) withDefaults(archiveSize int64) archiveLimits {
+	if l.MaxTotal <= 0 {
+		l.MaxTotal = archiveSize * maxExpansion
+	}
+	if l.MaxEntry <= 0 {
+		l.MaxEntry = l.MaxTotal
+	}
+	if l.MaxEntries <= 0 {
+		// every entry takes at least a 512 byte header
+		l.MaxEntries = l.MaxTotal / 512
+	}
+	return l
+}
+
+// archiveReader reads the entries of an archive of any supported format within limits
+type archiveReader struct {
+	*tar.Reader
+	zr      io.ReadCloser
+	lr      *limitedReader
+	limits  archiveLimits
+	entries int64
+}
+
+// openArchive decrypts the archive read from r, of archiveSize bytes, with the keys of
+// -identity when it is encrypted, detects its compression and reads its entries within limits
+func openArchive(r io.Reader, archiveSize int64, limits archiveLimits) (*archiveReader, error) {
+	plaintext, err := decrypt(r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := decompress(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	limits = limits.withDefaults(archiveSize)
+	lr := &limitedReader{r: zr, n: limits.MaxTotal}
+	return &archiveReader{
+		Reader: tar.NewReader(lr),
+		zr:     zr,
+		lr:     lr,
+		limits: limits,
+	}, nil
+}
+
+// Next advances to the next entry, failing with errArchiveLimits when the archive has too
+// many entries or the entry declares more than the size limit
+func (a *archiveReader) Next() (*tar.Header, error) {
+	header, err := a.Reader.Next()
+	if err != nil {
+		return nil, err
+	}
+	a.entries++
+	if a.entries > a.limits.MaxEntries {
+		return nil, fmt.Errorf("%w: more than %d entries", errArchiveLimits, a.limits.MaxEntries)
+	}
+	if header.Size < 0 || header.Size > a.limits.MaxEntry {
+		return nil, fmt.Errorf("%w: entry '%s' declares %d bytes, the limit is %d", errArchiveLimits, displayName(header.Name), header.Size, a.limits.MaxEntry)
+	}
+	return header, nil
+}
+
+// Drain reads the rest of the decompressed stream, which verifies the checksum of formats carrying one
+func (a *archiveReader) Drain() error {
+	_, err := io.Copy(io.Discard, a.lr)
+	return err
+}
+
+func (a *archiveReader) Close() error {
+	return a.zr.Close()
+}
+
+// limitedReader fails with errArchiveLimits once more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, fmt.Errorf("%w: more decompressed bytes than allowed", errArchiveLimits)
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, fmt.Errorf("%w: more decompressed bytes than allowed", errArchiveLimits)
+	}
+	return n, err
+}
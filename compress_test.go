@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeGzipBomb writes a tar.gz of entries files of size zero bytes each to filename, which
+// compresses about a thousand times
+func writeGzipBomb(t *testing.T, filename string, entries int, size int64) {
+	t.Helper()
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	zeros := make([]byte, 64*1024)
+	for i := 0; i < entries; i++ {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("codepack/team/app/objects/%03d", i), Typeflag: tar.TypeReg, Mode: 0644, Size: size}); err != nil {
+			t.Fatal(err)
+		}
+		for written := int64(0); written < size; written += int64(len(zeros)) {
+			if _, err := tw.Write(zeros[:min64(int64(len(zeros)), size-written)]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestGzipBombExceedsLimits(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "bomb.tar.gz")
+	// 64 MiB of zeros in 16 entries of 4 MiB, compressed to a few dozen KiB
+	writeGzipBomb(t, archive, 16, 4*1024*1024)
+	info, err := os.Stat(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 256*1024 {
+		t.Fatalf("the bomb is %d bytes, expected a high compression ratio", info.Size())
+	}
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	m := &Manifest{
+		FormatVersion: manifestFormatVersion,
+		Archive:       "bomb.tar.gz",
+		SHA256:        hex.EncodeToString(sum[:]),
+		Repos:         []ManifestRepo{{Name: "app", Path: "team", Archive: "bomb.tar.gz"}},
+	}
+	manifestPath := filepath.Join(dir, "bomb.tar.gz.manifest.json")
+	if err := m.WriteFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		run  func(limits ...string) error
+	}{
+		{name: "list", run: func(limits ...string) error {
+			return listCommand(append([]string{"-archive", archive}, limits...))
+		}},
+		{name: "restore", run: func(limits ...string) error {
+			dest := filepath.Join(t.TempDir(), "restored")
+			return restoreCommand(append([]string{"-manifest", manifestPath, "-dest", dest}, limits...))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.run("-max-decompressed-size", "8", "-max-entry-size", "8"); !errors.Is(err, errArchiveLimits) {
+				t.Errorf("expected the total limit to abort, got %v", err)
+			}
+			if err := tc.run("-max-decompressed-size", "128", "-max-entry-size", "1"); !errors.Is(err, errArchiveLimits) {
+				t.Errorf("expected the entry limit to abort, got %v", err)
+			}
+			if err := tc.run("-max-decompressed-size", "128", "-max-entries", "4"); !errors.Is(err, errArchiveLimits) {
+				t.Errorf("expected the entry count limit to abort, got %v", err)
+			}
+			if err := tc.run("-max-decompressed-size", "128"); err != nil {
+				t.Errorf("the archive was rejected within its limits: %v", err)
+			}
+		})
+	}
+}
+
+func TestArchiveFormatsRoundTrip(t *testing.T) {
+	files := map[string]string{
+		"codepack/team/app/HEAD":   "ref: refs/heads/main\n",
+		"codepack/team/app/config": "[core]\n\tbare = true\n",
+	}
+	for _, name := range formatNames() {
+		for _, level := range []int{0, 1, 9} {
+			format, err := lookupFormat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			zw, err := format.compress(&buf, level)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", name, level, err)
+			}
+			tw := tar.NewWriter(zw)
+			for _, file := range []string{"codepack/team/app/HEAD", "codepack/team/app/config"} {
+				if err := tw.WriteHeader(&tar.Header{Name: file, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[file]))}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.WriteString(tw, files[file]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if len(format.magic) > 0 && !bytes.HasPrefix(buf.Bytes(), format.magic) {
+				t.Errorf("%s level %d: the archive does not start with the magic bytes of the format", name, level)
+			}
+
+			archive, err := openArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()), archiveLimits{})
+			if err != nil {
+				t.Fatalf("%s level %d: %v", name, level, err)
+			}
+			read := make(map[string]string)
+			for {
+				header, err := archive.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%s level %d: %v", name, level, err)
+				}
+				data, err := io.ReadAll(archive)
+				if err != nil {
+					t.Fatalf("%s level %d: %v", name, level, err)
+				}
+				read[header.Name] = string(data)
+			}
+			archive.Close()
+			if !reflect.DeepEqual(read, files) {
+				t.Errorf("%s level %d: read %q, expected %q", name, level, read, files)
+			}
+		}
+	}
+}
+
+func TestLookupFormat(t *testing.T) {
+	for name, extension := range map[string]string{"": ".tar.gz", "gzip": ".tar.gz", "tar": ".tar", "xz": ".tar.xz", "bzip2": ".tar.bz2", "zstd": ".tar.zst"} {
+		format, err := lookupFormat(name)
+		if err != nil || format.extension != extension {
+			t.Errorf("lookupFormat(%q) = %q, %v, expected %q", name, format.extension, err, extension)
+		}
+	}
+	_, err := lookupFormat("lz4")
+	if err == nil || !strings.Contains(err.Error(), "bzip2, gzip, tar, xz, zstd") {
+		t.Errorf("an unknown format was not rejected with the supported formats: %v", err)
+	}
+	for _, level := range []int{-1, 10} {
+		if err := validCompressionLevel(level); err == nil {
+			t.Errorf("the compression level %d was accepted", level)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const (
+	// autoWorkersStart is the concurrency -workers auto starts at, below -workers-min or
+	// above -workers-max it is moved inside them
+	autoWorkersStart = 4
+	// concurrencyBackoffThrottles is the number of timeouts or 429 and 5xx responses after
+	// which concurrency is reduced without waiting for the window to complete
+	concurrencyBackoffThrottles = 3
+	// concurrencyMaxErrorRate is the fraction of failed clones in a window above which
+	// concurrency is reduced
+	concurrencyMaxErrorRate = 0.1
+	// concurrencyMaxSlowdown is how much slower the median clone of a window may be than
+	// the one of the window before and still count as healthy
+	concurrencyMaxSlowdown = 2
+)
+
+// concurrencyController adapts the number of clones running at once for -workers auto.
+// Every window of as many clones as the limit increases it while the clones succeed and
+// are not much slower than in the window before, timeouts and 429 and 5xx responses or
+// too many failures reduce it, always within Floor and Ceiling
+type concurrencyController struct {
+	Floor   int
+	Ceiling int
+	// Now is the clock the profile is recorded with, time.Now outside of tests
+	Now func() time.Time
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	running  int
+	started  time.Time
+	window   []cloneOutcome
+	previous time.Duration
+	profile  []concurrencyStep
+}
+
+// cloneOutcome is a finished clone the controller decides on
+type cloneOutcome struct {
+	Host     string
+	Duration time.Duration
+	Err      error
+}
+
+// concurrencyStep is a change of the limit, recorded in the JSON report. Elapsed is the
+// time since the first clone started
+type concurrencyStep struct {
+	Elapsed string `json:"elapsed"`
+	Limit   int    `json:"limit"`
+	Reason  string `json:"reason"`
+}
+
+func newConcurrencyController(floor int, ceiling int, now func() time.Time) *concurrencyController {
+	if floor < 1 {
+		floor = 1
+	}
+	if ceiling < floor {
+		ceiling = floor
+	}
+	start := autoWorkersStart
+	if start < floor {
+		start = floor
+	}
+	if start > ceiling {
+		start = ceiling
+	}
+	c := &concurrencyController{Floor: floor, Ceiling: ceiling, Now: now, limit: start, started: now()}
+	c.cond = sync.NewCond(&c.mu)
+	c.profile = []concurrencyStep{{Elapsed: "0s", Limit: start, Reason: "start"}}
+	return c
+}
+
+// acquire blocks until fewer clones than the limit are running and counts one more, a nil
+// *concurrencyController never blocks
+func (c *concurrencyController) acquire() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.running >= c.limit {
+		c.cond.Wait()
+	}
+	c.running++
+}
+
+// release counts a clone as finished and decides on its outcome
+func (c *concurrencyController) release(outcome cloneOutcome) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	c.observe(outcome)
+	c.cond.Broadcast()
+}
+
+// Limit is the number of clones currently allowed to run at once
+func (c *concurrencyController) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// observe adds outcome to the window and changes the limit once the window is complete,
+// or early once it holds concurrencyBackoffThrottles throttled clones
+func (c *concurrencyController) observe(outcome cloneOutcome) {
+	c.window = append(c.window, outcome)
+	var throttled, failed int
+	for _, o := range c.window {
+		if throttleKind(o.Err) != "" {
+			throttled++
+		}
+		if o.Err != nil {
+			failed++
+		}
+	}
+	if throttled < concurrencyBackoffThrottles && len(c.window) < c.limit {
+		return
+	}
+
+	median := medianDuration(c.window)
+	switch {
+	case throttled > 0:
+		c.change(c.limit*2/3, throttleReason(c.window))
+	case float64(failed) > concurrencyMaxErrorRate*float64(len(c.window)):
+		c.change(c.limit*3/4, fmt.Sprintf("%d of %d clones failed", failed, len(c.window)))
+	case c.previous > 0 && median > concurrencyMaxSlowdown*c.previous:
+		// the server is slowing down, wait for another window before adding clones
+		log.Printf("Keeping concurrency at %d, the median clone took %s after %s", c.limit, median.Round(time.Millisecond), c.previous.Round(time.Millisecond))
+	default:
+		step := c.limit / 4
+		if step < 1 {
+			step = 1
+		}
+		c.change(c.limit+step, fmt.Sprintf("%d clones succeeded in %s on median", len(c.window)-failed, median.Round(time.Millisecond)))
+	}
+	c.window = nil
+	c.previous = median
+}
+
+// change moves the limit to limit within Floor and Ceiling and records why
+func (c *concurrencyController) change(limit int, reason string) {
+	if limit < c.Floor {
+		limit = c.Floor
+	}
+	if limit > c.Ceiling {
+		limit = c.Ceiling
+	}
+	if limit == c.limit {
+		return
+	}
+	verb := "increasing"
+	if limit < c.limit {
+		verb = "reducing"
+	}
+	log.Printf("%s concurrency %d→%d after %s", strings.ToUpper(verb[:1])+verb[1:], c.limit, limit, reason)
+	c.limit = limit
+	c.profile = append(c.profile, concurrencyStep{Elapsed: c.Now().Sub(c.started).Round(time.Second).String(), Limit: limit, Reason: reason})
+}
+
+// Profile returns the changes of the limit over the run, a nil *concurrencyController has none
+func (c *concurrencyController) Profile() []concurrencyStep {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]concurrencyStep(nil), c.profile...)
+}
+
+// profileSummary is the concurrency profile on one line like "4 at 0s, 5 at 12s, 3 at 40s"
+func profileSummary(profile []concurrencyStep) string {
+	steps := make([]string, len(profile))
+	for i, step := range profile {
+		steps[i] = fmt.Sprintf("%d at %s", step.Limit, step.Elapsed)
+	}
+	return strings.Join(steps, ", ")
+}
+
+// throttleKind is "timeout", "HTTP 429" or "HTTP 5xx" for a clone failing with a sign of
+// an overloaded server, empty for any other outcome
+func throttleKind(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || strings.Contains(strings.ToLower(err.Error()), "timeout") {
+		return "timeout"
+	}
+	code := 0
+	var httpErr *githttp.Err
+	if asGitError(err, &httpErr) {
+		code = httpErr.Response.StatusCode
+	} else if m := statusCode.FindStringSubmatch(strings.ToLower(err.Error())); m != nil {
+		code, _ = strconv.Atoi(m[1])
+	}
+	switch {
+	case code == 429:
+		return "HTTP 429"
+	case code >= 500:
+		return "HTTP 5xx"
+	}
+	return ""
+}
+
+// throttleReason describes the throttled clones of window like "3 timeouts from gitlab.internal"
+func throttleReason(window []cloneOutcome) string {
+	counts := make(map[string]int)
+	hosts := make(map[string]map[string]bool)
+	for _, o := range window {
+		kind := throttleKind(o.Err)
+		if kind == "" {
+			continue
+		}
+		counts[kind]++
+		if hosts[kind] == nil {
+			hosts[kind] = make(map[string]bool)
+		}
+		hosts[kind][o.Host] = true
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		names := make([]string, 0, len(hosts[kind]))
+		for host := range hosts[kind] {
+			names = append(names, host)
+		}
+		sort.Strings(names)
+		noun := kind + " responses"
+		if kind == "timeout" {
+			noun = "timeouts"
+		}
+		if counts[kind] == 1 {
+			noun = strings.TrimSuffix(noun, "s")
+		}
+		parts[i] = fmt.Sprintf("%d %s from %s", counts[kind], noun, strings.Join(names, ", "))
+	}
+	return strings.Join(parts, " and ")
+}
+
+func medianDuration(window []cloneOutcome) time.Duration {
+	durations := make([]time.Duration, len(window))
+	for i, o := range window {
+		durations[i] = o.Duration
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2]
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+func TestNewConcurrencyController(t *testing.T) {
+	for _, tc := range []struct {
+		floor, ceiling int
+		limit          int
+	}{
+		{floor: 1, ceiling: 32, limit: autoWorkersStart},
+		{floor: 8, ceiling: 32, limit: 8},
+		{floor: 1, ceiling: 2, limit: 2},
+		{floor: 0, ceiling: 0, limit: 1},
+		{floor: 6, ceiling: 3, limit: 6},
+	} {
+		c := newConcurrencyController(tc.floor, tc.ceiling, time.Now)
+		if c.Limit() != tc.limit {
+			t.Errorf("floor %d and ceiling %d start at %d, expected %d", tc.floor, tc.ceiling, c.Limit(), tc.limit)
+		}
+	}
+}
+
+func TestThrottleKind(t *testing.T) {
+	req, err := nethttp.NewRequest(nethttp.MethodGet, "https://example.com/a.git/info/refs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpErr := func(code int) error {
+		return plumbing.NewUnexpectedError(&githttp.Err{Response: &nethttp.Response{StatusCode: code, Request: req}})
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		kind string
+	}{
+		{"success", nil, ""},
+		{"deadline", fmt.Errorf("attempt 1: %w", context.DeadlineExceeded), "timeout"},
+		{"timeout message", errors.New("read tcp: i/o timeout"), "timeout"},
+		{"http 429", httpErr(429), "HTTP 429"},
+		{"http 503", httpErr(503), "HTTP 5xx"},
+		{"status in message", errors.New("unexpected requesting \"https://example.com/a.git/info/refs\" status code: 502"), "HTTP 5xx"},
+		{"http 404", httpErr(404), ""},
+		{"other", errors.New("something else"), ""},
+	} {
+		if kind := throttleKind(tc.err); kind != tc.kind {
+			t.Errorf("%s: kind %q, expected %q", tc.name, kind, tc.kind)
+		}
+	}
+}
+
+// simulatedClock is a clock advanced by the test only
+type simulatedClock struct {
+	now time.Time
+}
+
+func (c *simulatedClock) Now() time.Time {
+	return c.now
+}
+
+func TestConcurrencyController(t *testing.T) {
+	ok := func(d time.Duration) cloneOutcome {
+		return cloneOutcome{Host: "gitlab.internal", Duration: d}
+	}
+	timeout := cloneOutcome{Host: "gitlab.internal", Duration: time.Minute, Err: context.DeadlineExceeded}
+	tooMany := cloneOutcome{Host: "github.com", Duration: time.Second, Err: errors.New("unexpected client error: status code: 429")}
+	failed := cloneOutcome{Host: "gitlab.internal", Duration: time.Second, Err: errors.New("something else")}
+	repeat := func(n int, o cloneOutcome) []cloneOutcome {
+		outcomes := make([]cloneOutcome, n)
+		for i := range outcomes {
+			outcomes[i] = o
+		}
+		return outcomes
+	}
+	for _, tc := range []struct {
+		name           string
+		floor, ceiling int
+		// windows are the outcomes of each step, the clock advances 10s before each
+		windows [][]cloneOutcome
+		profile []concurrencyStep
+	}{
+		{
+			name:  "healthy windows increase",
+			floor: 1, ceiling: 32,
+			windows: [][]cloneOutcome{repeat(4, ok(time.Second)), repeat(5, ok(time.Second))},
+			profile: []concurrencyStep{
+				{Elapsed: "0s", Limit: 4, Reason: "start"},
+				{Elapsed: "10s", Limit: 5, Reason: "4 clones succeeded in 1s on median"},
+				{Elapsed: "20s", Limit: 6, Reason: "5 clones succeeded in 1s on median"},
+			},
+		},
+		{
+			name:  "incomplete window keeps the limit",
+			floor: 1, ceiling: 32,
+			windows: [][]cloneOutcome{repeat(3, ok(time.Second))},
+			profile: []concurrencyStep{{Elapsed: "0s", Limit: 4, Reason: "start"}},
+		},
+		{
+			name:  "timeouts back off early",
+			floor: 1, ceiling: 32,
+			windows: [][]cloneOutcome{repeat(4, ok(time.Second)), repeat(concurrencyBackoffThrottles, timeout)},
+			profile: []concurrencyStep{
+				{Elapsed: "0s", Limit: 4, Reason: "start"},
+				{Elapsed: "10s", Limit: 5, Reason: "4 clones succeeded in 1s on median"},
+				{Elapsed: "20s", Limit: 3, Reason: "3 timeouts from gitlab.internal"},
+			},
+		},
+		{
+			name:  "throttles of several kinds and hosts",
+			floor: 1, ceiling: 32,
+			windows: [][]cloneOutcome{{timeout, ok(time.Second), tooMany, timeout}},
+			profile: []concurrencyStep{
+				{Elapsed: "0s", Limit: 4, Reason: "start"},
+				{Elapsed: "10s", Limit: 2, Reason: "1 HTTP 429 response from github.com and 2 timeouts from gitlab.internal"},
+			},
+		},
+		{
+			name:  "failures reduce",
+			floor: 1, ceiling: 32,
+			windows: [][]cloneOutcome{{ok(time.Second), failed, ok(time.Second), ok(time.Second)}},
+			profile: []concurrencyStep{
+				{Elapsed: "0s", Limit: 4, Reason: "start"},
+				{Elapsed: "10s", Limit: 3, Reason: "1 of 4 clones failed"},
+			},
+		},
+		{
+			name:  "slowdown holds",
+			floor: 1, ceiling: 32,
+			windows: [][]cloneOutcome{repeat(4, ok(time.Second)), repeat(5, ok(3*time.Second)), repeat(5, ok(3*time.Second))},
+			profile: []concurrencyStep{
+				{Elapsed: "0s", Limit: 4, Reason: "start"},
+				{Elapsed: "10s", Limit: 5, Reason: "4 clones succeeded in 1s on median"},
+				{Elapsed: "30s", Limit: 6, Reason: "5 clones succeeded in 3s on median"},
+			},
+		},
+		{
+			name:  "ceiling",
+			floor: 1, ceiling: 5,
+			windows: [][]cloneOutcome{repeat(4, ok(time.Second)), repeat(5, ok(time.Second))},
+			profile: []concurrencyStep{
+				{Elapsed: "0s", Limit: 4, Reason: "start"},
+				{Elapsed: "10s", Limit: 5, Reason: "4 clones succeeded in 1s on median"},
+			},
+		},
+		{
+			name:  "floor",
+			floor: 3, ceiling: 32,
+			windows: [][]cloneOutcome{repeat(concurrencyBackoffThrottles, timeout)},
+			profile: []concurrencyStep{
+				{Elapsed: "0s", Limit: 4, Reason: "start"},
+				{Elapsed: "10s", Limit: 3, Reason: "3 timeouts from gitlab.internal"},
+			},
+		},
+	} {
+		clock := &simulatedClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		c := newConcurrencyController(tc.floor, tc.ceiling, clock.Now)
+		for _, window := range tc.windows {
+			clock.now = clock.now.Add(10 * time.Second)
+			for _, outcome := range window {
+				c.acquire()
+				c.release(outcome)
+			}
+		}
+		if profile := c.Profile(); !reflect.DeepEqual(profile, tc.profile) {
+			t.Errorf("%s: profile %+v, expected %+v", tc.name, profile, tc.profile)
+		}
+	}
+}
+
+func TestConcurrencyAcquire(t *testing.T) {
+	c := newConcurrencyController(2, 2, time.Now)
+	c.acquire()
+	c.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		c.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a third clone started at the limit of 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.release(cloneOutcome{Duration: time.Second})
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a released clone did not let the next one start")
+	}
+
+	var nilController *concurrencyController
+	nilController.acquire()
+	nilController.release(cloneOutcome{})
+	if nilController.Profile() != nil {
+		t.Errorf("a nil controller has a profile")
+	}
+}
+
+func TestProfileSummary(t *testing.T) {
+	profile := []concurrencyStep{{Elapsed: "0s", Limit: 4}, {Elapsed: "12s", Limit: 5}, {Elapsed: "40s", Limit: 3}}
+	if summary := profileSummary(profile); summary != "4 at 0s, 5 at 12s, 3 at 40s" {
+		t.Errorf("summary %q", summary)
+	}
+}
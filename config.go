@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// Vars are substituted in to the name, path and url of every repository as {{ .name }}
+	Vars map[string]string `yaml:"vars" json:"vars" toml:"vars"`
+	// Defaults apply to every repository that does not set the same field itself
+	Defaults RepoDefaults `yaml:"defaults" json:"defaults" toml:"defaults"`
+	Repos    []Repository `yaml:"repos" json:"repos" toml:"repos"`
+	// Notify sends the summary of every run
+	Notify *NotifyConfig `yaml:"notify" json:"notify" toml:"notify"`
+	// Destinations receive the archive when -out is not set
+	Destinations []Destination `yaml:"destinations" json:"destinations" toml:"destinations"`
+	// PathTemplate derives the path of repositories without one from their URL, see repoURLFields
+	PathTemplate string `yaml:"path_template" json:"path_template" toml:"path_template"`
+	// Plugins are external commands exec://<name>/<archive name> destinations upload with
+	Plugins map[string]ExecPlugin `yaml:"plugins" json:"plugins" toml:"plugins"`
+	// Hosts override the transport go-git uses for a host, keyed by its name
+	Hosts map[string]HostTransport `yaml:"hosts" json:"hosts" toml:"hosts"`
+	// HostAuth are the credentials of the repositories of a host without auth of their own,
+	// keyed by the host or the host and a path prefix like gitlab.example.com/platform
+	HostAuth map[string]RepoAuth `yaml:"host_auth" json:"host_auth" toml:"host_auth"`
+	// HostAuthUnmatched is what a repository on a host of HostAuth no key matches does: warn
+	// (the default) or global fall back to the default credentials, with or without a warning,
+	// and fail rejects the configuration
+	HostAuthUnmatched string `yaml:"host_auth_unmatched" json:"host_auth_unmatched" toml:"host_auth_unmatched"`
+}
+
+// RepoDefaults holds the settings a repository inherits, the fields are pointers so
+// a repository can override a default with an explicit zero value
+type RepoDefaults struct {
+	Depth          *int      `yaml:"depth" json:"depth" toml:"depth"`
+	Retries        *int      `yaml:"retries" json:"retries" toml:"retries"`
+	Timeout        *Duration `yaml:"timeout" json:"timeout" toml:"timeout"`
+	Auth           *RepoAuth `yaml:"auth" json:"auth" toml:"auth"`
+	PathPrefix     *string   `yaml:"path_prefix" json:"path_prefix" toml:"path_prefix"`
+	ExcludeRefs    []string  `yaml:"exclude_refs" json:"exclude_refs" toml:"exclude_refs"`
+	MaxObjectCache *int      `yaml:"max_object_cache" json:"max_object_cache" toml:"max_object_cache"`
+	// IncludeHostMetadata stores the project settings of the git host next to the mirror
+	IncludeHostMetadata *bool           `yaml:"include_host_metadata" json:"include_host_metadata" toml:"include_host_metadata"`
+	Export              *string         `yaml:"export" json:"export" toml:"export"`
+	OutputFormat        *string         `yaml:"output_format" json:"output_format" toml:"output_format"`
+	Secrets             *string         `yaml:"secrets" json:"secrets" toml:"secrets"`
+	InMemory            *bool           `yaml:"in_memory" json:"in_memory" toml:"in_memory"`
+	Tags                []string        `yaml:"tags" json:"tags" toml:"tags"`
+	AllowInsecureHTTP   *bool           `yaml:"allow_insecure_http" json:"allow_insecure_http" toml:"allow_insecure_http"`
+	RemoteConfig        *RemoteSettings `yaml:"remote_config" json:"remote_config" toml:"remote_config"`
+	Branches            []string        `yaml:"branches" json:"branches" toml:"branches"`
+	LFS                 *bool           `yaml:"lfs" json:"lfs" toml:"lfs"`
+}
+
+// RepoAuth names the environment variables holding the credentials of a repository,
+// replacing CODEPACK_GIT_USER and CODEPACK_GIT_PASS
+type RepoAuth struct {
+	UsernameEnv string `yaml:"username_env" json:"username_env" toml:"username_env"`
+	PasswordEnv string `yaml:"password_env" json:"password_env" toml:"password_env"`
+}
+
+// BasicAuth reads the credentials from the environment, nil when either variable is unset
+func (a *RepoAuth) BasicAuth() *http.BasicAuth {
+	username, password := os.Getenv(a.UsernameEnv), os.Getenv(a.PasswordEnv)
+	if username == "" || password == "" {
+		return nil
+	}
+	return &http.BasicAuth{Username: username, Password: password}
+}
+
+type Repository struct {
+	Name string `yaml:"name" json:"name" toml:"name"`
+	URL  string `yaml:"url" json:"url" toml:"url"`
+	Path string `yaml:"path" json:"path" toml:"path"`
+	// MaxObjectCache overrides -max-object-cache in MiB for this repository
+	MaxObjectCache int `yaml:"max_object_cache" json:"max_object_cache" toml:"max_object_cache"`
+	// Depth limits the clone to the most recent commits of every reference, 0 clones the full history
+	Depth *int `yaml:"depth" json:"depth" toml:"depth"`
+	// Retries is the number of times a failed clone is attempted again
+	Retries *int `yaml:"retries" json:"retries" toml:"retries"`
+	// Timeout cancels a single clone attempt, 0 is unlimited
+	Timeout *Duration `yaml:"timeout" json:"timeout" toml:"timeout"`
+	Auth    *RepoAuth `yaml:"auth" json:"auth" toml:"auth"`
+	// PathPrefix is prepended to Path when the configuration is loaded
+	PathPrefix *string `yaml:"path_prefix" json:"path_prefix" toml:"path_prefix"`
+	// ExcludeRefs are patterns of references removed from the mirror after cloning,
+	// a trailing * matches any remainder of the name
+	ExcludeRefs []string `yaml:"exclude_refs" json:"exclude_refs" toml:"exclude_refs"`
+	// RemoteConfig changes the remote written to the config of the mirror after cloning
+	RemoteConfig *RemoteSettings `yaml:"remote_config" json:"remote_config" toml:"remote_config"`
+	// Enabled set to false leaves the repository out of the run, it is listed in the manifest as skipped
+	Enabled *bool `yaml:"enabled" json:"enabled" toml:"enabled"`
+	// SkipReason records why the repository is disabled
+	SkipReason string `yaml:"skip_reason" json:"skip_reason" toml:"skip_reason"`
+	// Priority dispatches the repository before those with a lower priority, the default is 0
+	Priority int `yaml:"priority" json:"priority" toml:"priority"`
+	// Tags group repositories for runs selecting them with -tags, like critical or payments
+	Tags []string `yaml:"tags" json:"tags" toml:"tags"`
+	// AllowInsecureHTTP lets a plain http:// URL be cloned with credentials, sending them in cleartext
+	AllowInsecureHTTP *bool `yaml:"allow_insecure_http" json:"allow_insecure_http" toml:"allow_insecure_http"`
+	// InsecureHTTP is set when the credentials are sent over http:// with allow_insecure_http
+	InsecureHTTP bool `yaml:"-" json:"-" toml:"-"`
+	// HostAuth is the host_auth key Auth was taken from, HostAuthUnmatched is set for a
+	// repository on a host of host_auth none of its keys matches
+	HostAuth          string `yaml:"-" json:"-" toml:"-"`
+	HostAuthUnmatched bool   `yaml:"-" json:"-" toml:"-"`
+	// IncludeHostMetadata writes the description, topics, default branch, visibility and branch
+	// protection of the project from the GitHub or GitLab API to host-metadata.json in the mirror
+	IncludeHostMetadata *bool `yaml:"include_host_metadata" json:"include_host_metadata" toml:"include_host_metadata"`
+	// HostType selects the API used for host metadata, github or gitlab, detected from the host name by default
+	HostType string `yaml:"host_type" json:"host_type" toml:"host_type"`
+	// Filter is a partial clone filter like blob:none or blob:limit=10m, go-git cannot negotiate
+	// filters so repositories setting it fail instead of being archived incomplete
+	Filter string `yaml:"filter" json:"filter" toml:"filter"`
+	// Pin is a tag, branch or full commit sha that must exist in the clone, it is recorded
+	// in the manifest as the point the repository was captured at
+	Pin string `yaml:"pin" json:"pin" toml:"pin"`
+	// PinOnly removes every reference but the pin so only its history is archived
+	PinOnly bool `yaml:"pin_only" json:"pin_only" toml:"pin_only"`
+	// Branches and LFS are rejected: a mirror captures every branch and go-git cannot fetch
+	// LFS objects, so a configuration relying on them fails instead of being ignored
+	Branches []string `yaml:"branches" json:"branches" toml:"branches"`
+	LFS      *bool    `yaml:"lfs" json:"lfs" toml:"lfs"`
+	// Region overrides the AWS region of CodeCommit repositories taken from the host name
+	Region string `yaml:"region" json:"region" toml:"region"`
+	// Flavor adapts the clone to the git server, gerrit keeps refs/changes and refs/notes
+	// regardless of exclude_refs and uses the authenticated /a/ URL when credentials are set
+	Flavor string `yaml:"flavor" json:"flavor" toml:"flavor"`
+	// MovedTo is the URL the git host redirected the repository to, set during the run
+	MovedTo string `yaml:"-" json:"-" toml:"-"`
+	// IgnorePatterns are the patterns of -ignore-file, set during the run
+	IgnorePatterns []string `yaml:"-" json:"-" toml:"-"`
+	// DedupGroup stores the objects shared by repositories of the same group once,
+	// the first repository of the group is cloned normally and the others borrow its objects
+	DedupGroup string `yaml:"dedup_group" json:"dedup_group" toml:"dedup_group"`
+	// Export is mirror (the default) for a bare mirror, worktree for the files of HEAD without git internals
+	// or fast-export for a git fast-export stream of every ref
+	Export string `yaml:"export" json:"export" toml:"export"`
+	// OutputFormat overrides -format for the file of the repository in a -per-repo backup:
+	// a tar format, zip, or none for a plain directory
+	OutputFormat string `yaml:"output_format" json:"output_format" toml:"output_format"`
+	// Secrets is what -scan-secrets does when it finds secrets: warn (the default), exclude or fail
+	Secrets string `yaml:"secrets" json:"secrets" toml:"secrets"`
+	// InMemory clones the repository in memory regardless of its expected size, false always
+	// clones it on disk, unset leaves it to -in-memory-threshold
+	InMemory *bool `yaml:"in_memory" json:"in_memory" toml:"in_memory"`
+	// NameDerived and PathDerived are set when the name or path were derived from the URL
+	NameDerived bool `yaml:"-" json:"-" toml:"-"`
+	PathDerived bool `yaml:"-" json:"-" toml:"-"`
+}
+
+// IsEnabled reports whether the repository takes part in runs, repositories are enabled unless set otherwise
+func (r Repository) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// splitDisabled separates the disabled repositories from config unless includeDisabled is set,
+// warning when more than maxFraction of the repositories are disabled
+func splitDisabled(config *Config, includeDisabled bool, maxFraction float64) (*Config, []Repository) {
+	enabled := &Config{Vars: config.Vars, Defaults: config.Defaults, Notify: config.Notify, Destinations: config.Destinations, PathTemplate: config.PathTemplate, Plugins: config.Plugins, Hosts: config.Hosts}
+	var disabled []Repository
+	for _, repo := range config.Repos {
+		if repo.IsEnabled() || includeDisabled {
+			enabled.Repos = append(enabled.Repos, repo)
+			continue
+		}
+		disabled = append(disabled, repo)
+	}
+	for _, repo := range disabled {
+		reason := repo.SkipReason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		log.Printf("Skipping disabled repository %s: %s", repo.URL, reason)
+	}
+	if len(config.Repos) > 0 && float64(len(disabled))/float64(len(config.Repos)) > maxFraction {
+		log.Printf("WARNING: %d of %d repositories are disabled, the configuration may be stale", len(disabled), len(config.Repos))
+	}
+	return enabled, disabled
+}
+
+// applyDefaults fills every field of repo left unset from d and resolves the path prefix
+func (repo *Repository) applyDefaults(d RepoDefaults) {
+	if repo.Depth == nil {
+		repo.Depth = d.Depth
+	}
+	if repo.Retries == nil {
+		repo.Retries = d.Retries
+	}
+	if repo.Timeout == nil {
+		repo.Timeout = d.Timeout
+	}
+	if repo.Auth == nil {
+		repo.Auth = d.Auth
+	}
+	if repo.PathPrefix == nil {
+		repo.PathPrefix = d.PathPrefix
+	}
+	if repo.ExcludeRefs == nil {
+		repo.ExcludeRefs = d.ExcludeRefs
+	}
+	if repo.RemoteConfig == nil {
+		repo.RemoteConfig = d.RemoteConfig
+	}
+	if repo.Tags == nil {
+		repo.Tags = d.Tags
+	}
+	if repo.AllowInsecureHTTP == nil {
+		repo.AllowInsecureHTTP = d.AllowInsecureHTTP
+	}
+	if repo.IncludeHostMetadata == nil {
+		repo.IncludeHostMetadata = d.IncludeHostMetadata
+	}
+	if repo.Export == "" && d.Export != nil {
+		repo.Export = *d.Export
+	}
+	if repo.OutputFormat == "" && d.OutputFormat != nil {
+		repo.OutputFormat = *d.OutputFormat
+	}
+	if repo.InMemory == nil {
+		repo.InMemory = d.InMemory
+	}
+	if repo.Secrets == "" && d.Secrets != nil {
+		repo.Secrets = *d.Secrets
+	}
+	if repo.MaxObjectCache == 0 && d.MaxObjectCache != nil {
+		repo.MaxObjectCache = *d.MaxObjectCache
+	}
+	if repo.Branches == nil {
+		repo.Branches = d.Branches
+	}
+	if repo.LFS == nil {
+		repo.LFS = d.LFS
+	}
+	if repo.PathPrefix != nil && *repo.PathPrefix != "" {
+		repo.Path = path.Join(*repo.PathPrefix, repo.Path)
+	}
+	repo.PathPrefix = nil
+}
+
+func (repo Repository) depth() int {
+	if repo.Depth == nil {
+		return 0
+	}
+	return *repo.Depth
+}
+
+// secretsPolicy is what -scan-secrets does when it finds secrets in the repository
+func (repo Repository) secretsPolicy() string {
+	if repo.Secrets == "" {
+		return secretsWarn
+	}
+	return repo.Secrets
+}
+
+func (repo Repository) retries() int {
+	if repo.Retries == nil {
+		return 0
+	}
+	return *repo.Retries
+}
+
+func (repo Repository) timeout() time.Duration {
+	if repo.Timeout == nil {
+		return 0
+	}
+	return time.Duration(*repo.Timeout)
+}
+
+// Duration is a time.Duration written as a string like "30m" in every configuration format
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// validFilter accepts the partial clone filters blob:none and blob:limit=<n>[k|m|g]
+func validFilter(filter string) error {
+	if filter == "" || filter == "blob:none" {
+		return nil
+	}
+	limit, ok := strings.CutPrefix(filter, "blob:limit=")
+	if !ok {
+		return fmt.Errorf("'%s' is not blob:none or blob:limit=<size>", filter)
+	}
+	limit = strings.TrimRight(strings.ToLower(limit), "kmg")
+	if _, err := strconv.ParseUint(limit, 10, 64); err != nil {
+		return fmt.Errorf("'%s' has an invalid size", filter)
+	}
+	return nil
+}
+
+// excluded reports whether the reference name matches one of the ExcludeRefs patterns
+func (repo Repository) excluded(name string) bool {
+	if repo.Flavor == flavorGerrit && isGerritRef(name) {
+		return false
+	}
+	for _, pattern := range repo.ExcludeRefs {
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// expandVars replaces the {{ .var }} references in the name, path and url of repo with vars,
+// referencing a variable that is not defined is an error
+func (repo *Repository) expandVars(vars map[string]string) error {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"name", &repo.Name},
+		{"path", &repo.Path},
+		{"url", &repo.URL},
+	}
+	for _, field := range fields {
+		if !strings.Contains(*field.value, "{{") {
+			continue
+		}
+		tmpl, err := template.New(field.name).Option("missingkey=error").Parse(*field.value)
+		if err != nil {
+			return fmt.Errorf("Invalid %s '%s': %w", field.name, *field.value, err)
+		}
+		var expanded strings.Builder
+		if err := tmpl.Execute(&expanded, vars); err != nil {
+			return fmt.Errorf("Undefined variable in %s '%s': %w", field.name, *field.value, err)
+		}
+		*field.value = expanded.String()
+	}
+	return nil
+}
+
+// configFormat is the format of a configuration file by its extension, YAML when unknown
+func configFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		return "toml"
+	case ".json":
+		return "json"
+	default:
+		return "yaml"
+	}
+}
+
+// ConfigFromFile reads a YAML, TOML or JSON configuration, - reads it from stdin.
+// An empty format is detected from the file extension
+func ConfigFromFile(filename string, format string) (*Config, error) {
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	if format == "" {
+		format = configFormat(filename)
+	}
+	return ConfigFromReader(r, format)
+}
+
+// ConfigFromReader decodes a configuration in format, one of yaml, toml or json
+func ConfigFromReader(r io.Reader, format string) (*Config, error) {
+	config := new(Config)
+
+	var err error
+	switch format {
+	case "yaml", "yml":
+		err = yaml.NewDecoder(r).Decode(config)
+	case "toml":
+		_, err = toml.NewDecoder(r).Decode(config)
+	case "json":
+		err = json.NewDecoder(r).Decode(config)
+	default:
+		return nil, fmt.Errorf("Unsupported configuration format '%s', expected yaml, toml or json", format)
+	}
+	if err != nil {
+		return config, err
+	}
+	for i, dest := range config.Destinations {
+		if dest.URL == "" {
+			return config, fmt.Errorf("Destination %d of the configuration has no url", i+1)
+		}
+	}
+	tmpl, err := pathTemplate(config.PathTemplate)
+	if err != nil {
+		return config, err
+	}
+	hostAuth, err := config.hostAuthEntries()
+	if err != nil {
+		return config, err
+	}
+	for i := range config.Repos {
+		if err := config.Repos[i].expandVars(config.Vars); err != nil {
+			return config, fmt.Errorf("Repository %d of the configuration: %w", i+1, err)
+		}
+		config.Repos[i].deriveAzureDevOpsPath()
+		// an empty path is the root of the backup for named repositories unless path_template is set
+		if repo := &config.Repos[i]; repo.Name == "" || (repo.Path == "" && config.PathTemplate != "") {
+			if err := repo.deriveNameAndPath(tmpl); err != nil {
+				return config, fmt.Errorf("Repository %d of the configuration: %w", i+1, err)
+			}
+		}
+		if err := hostAuth.apply(&config.Repos[i]); err != nil {
+			return config, err
+		}
+		config.Repos[i].applyDefaults(config.Defaults)
+		if len(config.Repos[i].Branches) > 0 {
+			return config, fmt.Errorf("Repository '%s' sets branches, which is not supported: a mirror captures every branch, leave branches out with exclude_refs", config.Repos[i].URL)
+		}
+		if lfs := config.Repos[i].LFS; lfs != nil && *lfs {
+			return config, fmt.Errorf("Repository '%s' sets lfs, which is not supported: go-git cannot fetch LFS objects, the mirror only holds their pointers", config.Repos[i].URL)
+		}
+		if err := validFilter(config.Repos[i].Filter); err != nil {
+			return config, fmt.Errorf("Invalid filter for repository '%s': %w", config.Repos[i].URL, err)
+		}
+		if err := config.Repos[i].RemoteConfig.validate(); err != nil {
+			return config, fmt.Errorf("Invalid remote_config for repository '%s': %w", config.Repos[i].URL, err)
+		}
+		if e := config.Repos[i].Export; e != "" && e != exportMirror && e != exportWorktree && e != exportFastExport {
+			return config, fmt.Errorf("Invalid export '%s' for repository '%s', use mirror, worktree or fast-export", e, config.Repos[i].URL)
+		}
+		if f := config.Repos[i].OutputFormat; f != "" {
+			if err := validOutputFormat(f); err != nil {
+				return config, fmt.Errorf("Repository '%s': %w", config.Repos[i].URL, err)
+			}
+		}
+		if p := config.Repos[i].Secrets; p != "" && p != secretsWarn && p != secretsExclude && p != secretsFail {
+			return config, fmt.Errorf("Invalid secrets '%s' for repository '%s', use warn, exclude or fail", p, config.Repos[i].URL)
+		}
+		if err := validTags(config.Repos[i].Tags); err != nil {
+			return config, fmt.Errorf("Repository '%s': %w", config.Repos[i].URL, err)
+		}
+		if d := config.Repos[i].depth(); d < 0 {
+			return config, fmt.Errorf("Invalid depth %d for repository '%s'", d, config.Repos[i].URL)
+		}
+	}
+	if err := validateClonePaths(config.Repos); err != nil {
+		return config, err
+	}
+	for name, plugin := range config.Plugins {
+		if err := plugin.validate(name); err != nil {
+			return config, err
+		}
+	}
+	for name, host := range config.Hosts {
+		if err := host.validate(name); err != nil {
+			return config, err
+		}
+	}
+	if config.Notify != nil && config.Notify.Exec != nil {
+		if err := config.Notify.Exec.validate("notify"); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
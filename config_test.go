@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// representativeConfig sets a field of most kinds the configuration has: vars, defaults,
+// nested structs, maps of structs, durations and pointers to zero values
+const representativeConfig = `vars:
+  org: acme
+defaults:
+  depth: 0
+  retries: 2
+  timeout: 30m
+  exclude_refs: [refs/pull/*]
+  tags: [nightly]
+repos:
+  - name: app
+    url: https://github.com/{{ .org }}/app.git
+    path: team
+    path_prefix: mirror
+    auth:
+      username_env: APP_USER
+      password_env: APP_PASS
+  - url: https://gitlab.example.com/{{ .org }}/tools/cli.git
+    retries: 0
+    enabled: false
+    skip_reason: archived
+destinations:
+  - url: s3://backups/codepack
+    required: false
+plugins:
+  rclone:
+    command: [rclone, rcat, "remote:{{ .name }}"]
+    timeout: 1h
+host_auth:
+  gitlab.example.com:
+    username_env: GITLAB_USER
+    password_env: GITLAB_TOKEN
+`
+
+func TestConfigFormatsRoundTrip(t *testing.T) {
+	expected, err := ConfigFromReader(strings.NewReader(representativeConfig), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// decoded without the Config struct, so the encoders only write the fields it sets
+	var raw map[string]any
+	if err := yaml.Unmarshal([]byte(representativeConfig), &raw); err != nil {
+		t.Fatal(err)
+	}
+	for format, encode := range map[string]func(*bytes.Buffer) error{
+		"yaml": func(b *bytes.Buffer) error { return yaml.NewEncoder(b).Encode(raw) },
+		"toml": func(b *bytes.Buffer) error { return toml.NewEncoder(b).Encode(raw) },
+		"json": func(b *bytes.Buffer) error { return json.NewEncoder(b).Encode(raw) },
+	} {
+		var b bytes.Buffer
+		if err := encode(&b); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		config, err := ConfigFromReader(&b, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: the configuration changed through the format:\n%+v\nexpected\n%+v", format, config, expected)
+		}
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	for filename, format := range map[string]string{
+		"codepack.yaml":   "yaml",
+		"codepack.yml":    "yaml",
+		"codepack.toml":   "toml",
+		"CODEPACK.TOML":   "toml",
+		"codepack.json":   "json",
+		"codepack":        "yaml",
+		"-":               "yaml",
+		"conf.d/app.json": "json",
+	} {
+		if got := configFormat(filename); got != format {
+			t.Errorf("configFormat(%q) = %q, expected %q", filename, got, format)
+		}
+	}
+	if _, err := ConfigFromReader(strings.NewReader("{}"), "ini"); err == nil || !strings.Contains(err.Error(), "Unsupported configuration format") {
+		t.Errorf("an unknown format was not rejected: %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configCommand edits the repositories of a local YAML configuration file through the
+// yaml.v3 document nodes, keeping comments, ordering and anchors
+func configCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: codepack config add|remove|list")
+	}
+	switch args[0] {
+	case "add":
+		return configAddCommand(args[1:])
+	case "remove":
+		return configRemoveCommand(args[1:])
+	case "list":
+		return configListCommand(args[1:])
+	}
+	return fmt.Errorf("Unknown config command '%s', use add, remove or list", args[0])
+}
+
+// configListCommand prints the clone path and url of every repository of a configuration,
+// marking the names and paths derived from the url so they can be checked before a run
+func configListCommand(args []string) error {
+	flags := flag.NewFlagSet("config_list", flag.ExitOnError)
+	configFilePtr := flags.String("config", "codepack.yaml", "Configuration file, - reads it from stdin, an https:// URL or a git URL with a #path fragment fetches it")
+	configFormatPtr := flags.String("config-format", "", "format of the configuration file: yaml, toml or json (default detected from the extension)")
+	parseFlags(flags, args)
+
+	config, _, err := loadConfig(*configFilePtr, *configFormatPtr, envAuth())
+	if err != nil {
+		return fmt.Errorf("Cannot read configuration '%s': %w", *configFilePtr, err)
+	}
+	width := 0
+	for _, repo := range config.Repos {
+		if n := len(path.Join(repo.Path, repo.Name)); n > width {
+			width = n
+		}
+	}
+	for _, repo := range config.Repos {
+		line := fmt.Sprintf("%-*s  %s%s", width, path.Join(repo.Path, repo.Name), sanitizeURL(repo.URL), repo.derivedNote())
+		if !repo.IsEnabled() {
+			line += " (disabled)"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// configAddPathTemplate derives the path written by config add when the configuration has no path_template
+const configAddPathTemplate = "{{ .Owner }}"
+
+func configAddCommand(args []string) error {
+	flags := flag.NewFlagSet("config_add", flag.ExitOnError)
+	configFilePtr := flags.String("config", "codepack.yaml", "Configuration file")
+	urlPtr := flags.String("url", "", "URL of the repository to add")
+	namePtr := flags.String("name", "", "name of the repository (default derived from the url)")
+	pathPtr := flags.String("path", "", "path of the repository (default derived from the url)")
+	sortPtr := flags.Bool("sort", false, "sort the repos block by name and path")
+	parseFlags(flags, args)
+
+	if *urlPtr == "" {
+		return fmt.Errorf("config add requires -url")
+	}
+	doc, repos, err := readConfigNodes(*configFilePtr)
+	if err != nil {
+		return err
+	}
+
+	// the path is written out so the configuration reads the same without path_template,
+	// which derives it when set and otherwise the path is the owner of the url
+	text := configAddPathTemplate
+	if root := doc.Content[0]; root.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == "path_template" {
+				text = root.Content[i+1].Value
+			}
+		}
+	}
+	tmpl, err := pathTemplate(text)
+	if err != nil {
+		return err
+	}
+	repo := Repository{Name: *namePtr, Path: *pathPtr, URL: *urlPtr}
+	repo.deriveAzureDevOpsPath()
+	if err := repo.deriveNameAndPath(tmpl); err != nil {
+		return err
+	}
+	if repo.Name == "" {
+		return fmt.Errorf("Cannot derive a name from '%s', set -name", repo.URL)
+	}
+	for _, item := range repos.Content {
+		existing := repoNodeFields(item)
+		if existing["url"] == repo.URL {
+			return fmt.Errorf("Repository '%s' is already configured as %s", repo.URL, path.Join(existing["path"], existing["name"]))
+		}
+		if existing["name"] == repo.Name && existing["path"] == repo.Path {
+			return fmt.Errorf("A repository named '%s' is already configured at path '%s', set -name or -path", repo.Name, repo.Path)
+		}
+	}
+
+	item := &yaml.Node{Kind: yaml.MappingNode}
+	for _, field := range [][2]string{{"name", repo.Name}, {"path", repo.Path}, {"url", repo.URL}} {
+		if field[1] == "" {
+			continue
+		}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: field[1]}
+		if field[0] == "url" {
+			value.Style = yaml.DoubleQuotedStyle
+		}
+		item.Content = append(item.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: field[0]}, value)
+	}
+	repos.Content = append(repos.Content, item)
+	if *sortPtr {
+		sortRepoNodes(repos)
+	}
+	if err := writeConfigNodes(*configFilePtr, doc); err != nil {
+		return err
+	}
+	log.Printf("Added %s as %s to '%s'", sanitizeURL(repo.URL), path.Join(repo.Path, repo.Name), *configFilePtr)
+	return nil
+}
+
+func configRemoveCommand(args []string) error {
+	flags := flag.NewFlagSet("config_remove", flag.ExitOnError)
+	configFilePtr := flags.String("config", "codepack.yaml", "Configuration file")
+	pathPtr := flags.String("path", "", "path of the repository, required when several repositories share the name")
+	sortPtr := flags.Bool("sort", false, "sort the repos block by name and path")
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: codepack config remove [-path p] <name>")
+	}
+	name := flags.Arg(0)
+
+	doc, repos, err := readConfigNodes(*configFilePtr)
+	if err != nil {
+		return err
+	}
+	var matches []int
+	for i, item := range repos.Content {
+		fields := repoNodeFields(item)
+		if fields["name"] == name && (*pathPtr == "" || fields["path"] == *pathPtr) {
+			matches = append(matches, i)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return fmt.Errorf("No repository named '%s' in '%s'", name, *configFilePtr)
+	case len(matches) > 1:
+		return fmt.Errorf("%d repositories are named '%s', select one with -path", len(matches), name)
+	}
+	i := matches[0]
+	removed := repoNodeFields(repos.Content[i])
+	repos.Content = append(repos.Content[:i], repos.Content[i+1:]...)
+	if *sortPtr {
+		sortRepoNodes(repos)
+	}
+	if err := writeConfigNodes(*configFilePtr, doc); err != nil {
+		return err
+	}
+	log.Printf("Removed %s from '%s'", sanitizeURL(removed["url"]), *configFilePtr)
+	return nil
+}
+
+// readConfigNodes parses a local YAML configuration in to its document node and
+// returns it along with the sequence node of the repos block, which is added when missing
+func readConfigNodes(filename string) (*yaml.Node, *yaml.Node, error) {
+	if configFormat(filename) != "yaml" || isRemoteConfig(filename) || filename == "-" {
+		return nil, nil, fmt.Errorf("Only local YAML configuration files can be edited, '%s' is not one", filename)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("Cannot parse '%s': %w", filename, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("'%s' is not a CodePack configuration", filename)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "repos" {
+			repos := root.Content[i+1]
+			if repos.Kind == yaml.ScalarNode && repos.Tag == "!!null" {
+				repos.Kind, repos.Tag, repos.Value = yaml.SequenceNode, "", ""
+			}
+			if repos.Kind != yaml.SequenceNode {
+				return nil, nil, fmt.Errorf("repos of '%s' is not a list", filename)
+			}
+			return &doc, repos, nil
+		}
+	}
+	repos := &yaml.Node{Kind: yaml.SequenceNode}
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "repos"}, repos)
+	return &doc, repos, nil
+}
+
+// repoNodeFields returns the scalar fields of a repository node, following aliases
+func repoNodeFields(n *yaml.Node) map[string]string {
+	fields := make(map[string]string)
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind != yaml.MappingNode {
+		return fields
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Value == "<<" {
+			for k, v := range repoNodeFields(value) {
+				if _, ok := fields[k]; !ok {
+					fields[k] = v
+				}
+			}
+			continue
+		}
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		if value.Kind == yaml.ScalarNode {
+			fields[key.Value] = value.Value
+		}
+	}
+	return fields
+}
+
+// sortRepoNodes orders the repos block by name and path, an anchor must come before its
+// aliases in YAML so repositories defining anchors are kept in front
+func sortRepoNodes(repos *yaml.Node) {
+	sort.SliceStable(repos.Content, func(i, j int) bool {
+		a, b := repos.Content[i], repos.Content[j]
+		if (a.Anchor != "") != (b.Anchor != "") {
+			return a.Anchor != ""
+		}
+		fa, fb := repoNodeFields(a), repoNodeFields(b)
+		if fa["name"] != fb["name"] {
+			return fa["name"] < fb["name"]
+		}
+		return fa["path"] < fb["path"]
+	})
+}
+
+// writeConfigNodes writes doc to filename through a temporary file renamed over it,
+// so a failure never leaves a truncated configuration behind
+func writeConfigNodes(filename string, doc *yaml.Node) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	enc := yaml.NewEncoder(f)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
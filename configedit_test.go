@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// commentedConfig has comments on the document, the repos block, a repository and a field,
+// and an anchor the repositories share
+const commentedConfig = `# Backups of the platform team
+defaults:
+  retries: 2
+
+auth: &platform
+  username_env: PLATFORM_USER
+  password_env: PLATFORM_PASS
+
+# every repository of the team
+repos:
+  # the public website
+  - name: website
+    path: acme
+    url: "https://github.com/acme/website.git" # moved from gitlab
+    auth: *platform
+  - name: api
+    path: acme
+    url: "https://github.com/acme/api.git"
+`
+
+func TestConfigEditKeepsComments(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "codepack.yaml")
+	if err := os.WriteFile(filename, []byte(commentedConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := configAddCommand([]string{"-config", filename, "-url", "https://github.com/acme/cli.git", "-sort"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := configRemoveCommand([]string{"-config", filename, "website"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := string(data)
+	for _, kept := range []string{"# Backups of the platform team", "# every repository of the team", "auth: &platform", "password_env: PLATFORM_PASS"} {
+		if !strings.Contains(edited, kept) {
+			t.Errorf("%q was lost in the edit:\n%s", kept, edited)
+		}
+	}
+	if strings.Contains(edited, "website") {
+		t.Errorf("the removed repository is still configured:\n%s", edited)
+	}
+	api, cli := strings.Index(edited, "name: api"), strings.Index(edited, "name: cli")
+	if api < 0 || cli < api {
+		t.Errorf("the repositories are not sorted by name:\n%s", edited)
+	}
+	if !strings.Contains(edited, `url: "https://github.com/acme/cli.git"`) || !strings.Contains(edited, "path: acme") {
+		t.Errorf("the added repository has no derived path:\n%s", edited)
+	}
+
+	config, err := ConfigFromFile(filename, "")
+	if err != nil {
+		t.Fatalf("the edited configuration cannot be read: %v\n%s", err, edited)
+	}
+	if len(config.Repos) != 2 {
+		t.Errorf("the edited configuration has %d repositories, expected 2", len(config.Repos))
+	}
+}
+
+func TestConfigEditRefusals(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "codepack.yaml")
+	if err := os.WriteFile(filename, []byte(commentedConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		run  func() error
+		err  string
+	}{
+		{"duplicate url", func() error {
+			return configAddCommand([]string{"-config", filename, "-url", "https://github.com/acme/api.git"})
+		}, "already configured"},
+		{"duplicate name and path", func() error {
+			return configAddCommand([]string{"-config", filename, "-url", "https://gitlab.example.com/acme/api.git", "-path", "acme"})
+		}, "already configured at path"},
+		{"missing url", func() error { return configAddCommand([]string{"-config", filename}) }, "requires -url"},
+		{"unknown name", func() error { return configRemoveCommand([]string{"-config", filename, "docs"}) }, "No repository named"},
+		{"toml file", func() error {
+			return configAddCommand([]string{"-config", filepath.Join(filepath.Dir(filename), "codepack.toml"), "-url", "https://github.com/acme/cli.git"})
+		}, "Only local YAML"},
+	} {
+		if err := tc.run(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error with %q, got %v", tc.name, tc.err, err)
+		}
+	}
+	if data, _ := os.ReadFile(filename); string(data) != commentedConfig {
+		t.Errorf("a refused edit changed the file:\n%s", data)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// configRepoName is the clone path of the configuration repository -include-config-repo
+// adds to the backup
+const configRepoName = "_codepack-config"
+
+// ManifestConfigRepo records the commit of the configuration repository a backup was made from
+type ManifestConfigRepo struct {
+	URL string `json:"url"`
+	// File is the path of the configuration file in the repository
+	File string `json:"file"`
+	// Head is the branch checked out in the working copy the configuration was read from
+	Head   string `json:"head,omitempty"`
+	Commit string `json:"commit"`
+	// Modified is set when the configuration file has changes not committed to Commit
+	Modified bool `json:"modified,omitempty"`
+}
+
+// configRepository returns the repository the configuration at location was read from,
+// to mirror in to configRepoName: the git working copy a local file lives in or the
+// repository of a git URL with a #path fragment. source is what loadConfig returned
+func configRepository(location string, source *ConfigSource) (Repository, *ManifestConfigRepo, error) {
+	repo := Repository{Name: configRepoName, Export: exportMirror}
+	if source != nil {
+		repoURL, file, ok := strings.Cut(location, "#")
+		if !ok || source.Commit == "" {
+			return repo, nil, fmt.Errorf("Configuration '%s' was not fetched from a git repository", source.URL)
+		}
+		repo.URL = repoURL
+		return repo, &ManifestConfigRepo{URL: sanitizeURL(repoURL), File: path.Clean(file), Commit: source.Commit}, nil
+	}
+	if location == "-" {
+		return repo, nil, fmt.Errorf("Configuration read from stdin has no repository")
+	}
+
+	abs, err := filepath.Abs(location)
+	if err != nil {
+		return repo, nil, err
+	}
+	r, err := git.PlainOpenWithOptions(filepath.Dir(abs), &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return repo, nil, fmt.Errorf("Configuration file '%s' is not in a git working copy: %w", location, err)
+	}
+	worktree, err := r.Worktree()
+	if err != nil {
+		return repo, nil, fmt.Errorf("Configuration file '%s' is not in a git working copy: %w", location, err)
+	}
+	root := worktree.Filesystem.Root()
+	file, err := filepath.Rel(root, abs)
+	if err != nil {
+		return repo, nil, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return repo, nil, fmt.Errorf("Cannot read HEAD of the configuration repository '%s': %w", root, err)
+	}
+	entry := &ManifestConfigRepo{URL: root, File: filepath.ToSlash(file), Commit: head.Hash().String()}
+	if head.Name().IsBranch() {
+		entry.Head = head.Name().Short()
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return repo, nil, fmt.Errorf("Cannot read the status of the configuration repository '%s': %w", root, err)
+	}
+	// status only lists changed and untracked files, File would report the others as untracked
+	if s, ok := status[entry.File]; ok && (s.Worktree != git.Unmodified || s.Staging != git.Unmodified) {
+		entry.Modified = true
+	}
+	repo.URL = root
+	return repo, entry, nil
+}
+
+// checkConfigRepoPath fails when a configured repository clones to or below configRepoName
+func checkConfigRepoPath(config *Config) error {
+	for _, repo := range config.Repos {
+		clonePath := path.Join(repo.Path, repo.Name)
+		if clonePath == configRepoName || strings.HasPrefix(clonePath, configRepoName+"/") {
+			return fmt.Errorf("Repository '%s' clones to '%s', which -include-config-repo reserves for the configuration repository", repo.URL, clonePath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+const (
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorGreen  = "\033[32m"
+	colorReset  = "\033[0m"
+	// clearLine returns the cursor to the start of the line and erases it
+	clearLine = "\r\033[K"
+)
+
+// console renders log lines for a person watching the terminal, separately from the log file
+// which always receives every line unchanged. On a terminal failures, warnings and the final
+// summary are colored and the per repository clone lines are condensed in to a single
+// progress line, piped output is written plain
+type console struct {
+	mu   sync.Mutex
+	out  io.Writer
+	file io.Writer
+	// sink also receives every line, like syslog
+	sink logSink
+	// color enables ANSI colors, condense replaces clone lines with the progress line
+	color    bool
+	condense bool
+
+	cloned   int
+	failed   int
+	progress string
+}
+
+// terminal is the destination of every log line and of the final error
+var terminal = &console{out: os.Stderr}
+
+// setup configures the console for stderr, coloring only on a terminal unless noColor
+// or the NO_COLOR environment variable is set, file receives the full log when not nil
+func (c *console) setup(file io.Writer, noColor bool) {
+	tty := term.IsTerminal(int(os.Stderr.Fd()))
+	c.file = file
+	c.condense = tty
+	c.color = tty && !noColor && os.Getenv("NO_COLOR") == ""
+}
+
+// Write receives one log line per call from the log package
+func (c *console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		if _, err := c.file.Write(p); err != nil {
+			return 0, err
+		}
+	}
+
+	line := string(bytes.TrimRight(p, "\n"))
+	c.send(line)
+	if c.condense && c.condensed(line) {
+		return len(p), nil
+	}
+	if c.progress != "" {
+		fmt.Fprint(c.out, clearLine)
+	}
+	fmt.Fprintln(c.out, c.colorize(line))
+	if c.progress != "" && !strings.HasSuffix(line, "Cloning complete") {
+		fmt.Fprint(c.out, c.progress)
+	} else {
+		c.progress = ""
+	}
+	return len(p), nil
+}
+
+// condensed updates the progress line with the clone and clone progress lines of cloneRepos, reporting
+// whether line was absorbed by it. Failed clones are still printed in full
+func (c *console) condensed(line string) bool {
+	msg := line
+	if i := strings.Index(line, "] "); i >= 0 {
+		msg = line[i+2:]
+	}
+	switch {
+	case strings.HasPrefix(msg, "Cloning ") && strings.Contains(msg, " to path ") && !strings.Contains(msg, " failed: "):
+	case strings.HasPrefix(msg, "Cloned ") && strings.Contains(msg, " to path "):
+		c.cloned++
+	case strings.HasPrefix(msg, "Clone progress "):
+		msg = strings.TrimPrefix(msg, "Clone progress ")
+	case strings.HasPrefix(msg, "Cloning ") && strings.Contains(msg, " failed: "):
+		c.failed++
+		return false
+	default:
+		return false
+	}
+	c.progress = fmt.Sprintf("%s%d cloned, %d failed, %s", clearLine, c.cloned, c.failed, msg)
+	if width, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && width > 0 && len(c.progress)-len(clearLine) >= width {
+		c.progress = c.progress[:len(clearLine)+width-1]
+	}
+	fmt.Fprint(c.out, c.progress)
+	return true
+}
+
+// logLevel classifies a log line, the log package has no levels so they are derived
+// from the WARNING prefix and the wording of failures and the final summary
+type logLevel int
+
+const (
+	levelInfo logLevel = iota
+	levelWarning
+	levelError
+	levelSummary
+)
+
+func lineLevel(line string) logLevel {
+	switch {
+	case strings.Contains(line, "WARNING"):
+		return levelWarning
+	case strings.Contains(line, " failed") || strings.HasPrefix(line, "Error:"):
+		return levelError
+	case strings.Contains(line, "] Run ") && strings.Contains(line, " complete"):
+		return levelSummary
+	}
+	return levelInfo
+}
+
+func (c *console) colorize(line string) string {
+	if !c.color {
+		return line
+	}
+	switch lineLevel(line) {
+	case levelWarning:
+		return colorYellow + line + colorReset
+	case levelError:
+		return colorRed + line + colorReset
+	case levelSummary:
+		return colorGreen + line + colorReset
+	}
+	return line
+}
+
+// Error writes the error a run ended with, in red on a color terminal
+func (c *console) Error(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	line := fmt.Sprint("Error: ", err)
+	if c.file != nil {
+		fmt.Fprintln(c.file, line)
+	}
+	c.send(line)
+	if c.progress != "" {
+		fmt.Fprint(c.out, clearLine)
+		c.progress = ""
+	}
+	fmt.Fprintln(c.out, c.colorize(line))
+}
+
+// logSink is an additional destination of the log lines
+type logSink interface {
+	Log(level logLevel, line string) error
+}
+
+func (c *console) send(line string) {
+	if c.sink == nil {
+		return
+	}
+	if err := c.sink.Log(lineLevel(line), line); err != nil {
+		fmt.Fprintln(c.out, "WARNING: cannot write to syslog:", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// seedRefPrefix holds the primary's references in a group member during its clone,
+// they are advertised as haves so the remote only sends objects the primary lacks
+const seedRefPrefix = "refs/codepack-seed/"
+
+// dedupGroup is a set of repositories sharing a dedup_group, the first repository
+// in the configuration is the primary and the others borrow its objects through
+// objects/info/alternates
+type dedupGroup struct {
+	name    string
+	primary string
+	fs      billy.Filesystem
+	members []string
+	// done is closed once the primary clone finished, ok reports whether it succeeded
+	done chan struct{}
+	ok   bool
+}
+
+// alternateSource is the primary repository a group member borrows objects from
+type alternateSource struct {
+	fs billy.Filesystem
+	// rel is the path of the primary relative to the member
+	rel string
+}
+
+func newAlternateSource(g *dedupGroup, clonePath string) *alternateSource {
+	rel := strings.Repeat("../", strings.Count(clonePath, "/")+1) + g.primary
+	return &alternateSource{fs: g.fs, rel: rel}
+}
+
+// seedAlternates points the objects of s at the primary with a relative alternates
+// entry, so the layout still works after extraction, and copies the primary's
+// references under seedRefPrefix
+func seedAlternates(s *filesystem.Storage, repoFS billy.Filesystem, alt *alternateSource) error {
+	if err := repoFS.MkdirAll(path.Join("objects", "info"), 0755); err != nil {
+		return err
+	}
+	entry := path.Join("..", alt.rel, "objects") + "\n"
+	if err := util.WriteFile(repoFS, path.Join("objects", "info", "alternates"), []byte(entry), 0644); err != nil {
+		return err
+	}
+
+	primary := filesystem.NewStorage(alt.fs, cache.NewObjectLRUDefault())
+	refs, err := primary.IterReferences()
+	if err != nil {
+		return err
+	}
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		name := seedRefPrefix + strings.TrimPrefix(ref.Name().String(), "refs/")
+		return s.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), ref.Hash()))
+	})
+}
+
+func removeSeedRefs(s *filesystem.Storage) error {
+	refs, err := s.IterReferences()
+	if err != nil {
+		return err
+	}
+	var seeded []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), seedRefPrefix) {
+			seeded = append(seeded, ref.Name())
+		}
+		return nil
+	})
+	if err != nil && err != storer.ErrStop {
+		return err
+	}
+	for _, name := range seeded {
+		if err := s.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logDedupSavings reports per group how much object storage was not duplicated,
+// estimated as the primary's object store for every member that borrowed it
+func logDedupSavings(groups map[string]*dedupGroup, staging billy.Filesystem) {
+	for _, g := range groups {
+		if !g.ok || len(g.members) < 2 {
+			continue
+		}
+		primarySize := dirSize(staging, path.Join(g.primary, "objects"))
+		var memberSize int64
+		for _, member := range g.members[1:] {
+			memberSize += dirSize(staging, path.Join(member, "objects"))
+		}
+		log.Printf("Dedup group '%s': %d repositories borrow %s of objects from %s, saving about %s (members store %s of their own objects)",
+			g.name, len(g.members)-1, formatBytes(primarySize), g.primary,
+			formatBytes(primarySize*int64(len(g.members)-1)), formatBytes(memberSize))
+	}
+}
+
+func dirSize(fsys billy.Filesystem, root string) int64 {
+	var size int64
+	util.Walk(fsys, root, func(_ string, info fs.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
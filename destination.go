@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploader sends the compressed archive stream to a remote destination
+type Uploader interface {
+	Upload(r io.Reader) error
+}
+
+// DestinationOptions are the settings shared by the remote output destinations
+type DestinationOptions struct {
+	LocalCopy    string
+	StorageClass string
+	ChunkSize    int
+	SFTP         SFTPOptions
+	OCIPlainHTTP bool
+	Annotations  map[string]string
+	// Format is the format of the archive, the zero value is treated as gzip
+	Format archiveFormat
+	// VerifyUploads checks every upload against the destination once it is sent
+	VerifyUploads bool
+	// VerifyFullMax is the size up to which a destination without checksums is read back in full
+	VerifyFullMax int64
+	// UploadRetries is the number of times a failed upload of the -local-copy is sent again
+	UploadRetries int
+	// UploadConcurrency is the number of chunks of a resumable azblob:// upload sent at once
+	UploadConcurrency int
+	// ChunkRetries is the number of times a chunk of a resumable upload is sent again
+	ChunkRetries int
+	// UploadStateMaxAge is the age of an abandoned resumable upload whose state is removed
+	UploadStateMaxAge time.Duration
+	// Plugins are the exec plugins of the configuration exec:// destinations name
+	Plugins map[string]ExecPlugin
+	// Recipients encrypt the archive written to every destination, nil writes it as it is
+	Recipients *archiveRecipients
+}
+
+// archiveFormat is the format of the archive written to the destination
+func (opts DestinationOptions) archiveFormat() archiveFormat {
+	if opts.Format.compress == nil {
+		return archiveFormats[formatGzip]
+	}
+	return opts.Format
+}
+
+// Destination is an output of the archive, a local file path or a remote destination URL
+type Destination struct {
+	URL string `yaml:"url" json:"url" toml:"url"`
+	// Required fails the run when writing to the destination fails, unset is required
+	Required *bool `yaml:"required" json:"required" toml:"required"`
+}
+
+func (d Destination) IsRequired() bool {
+	return d.Required == nil || *d.Required
+}
+
+// destinationResult is the outcome of writing the archive to one destination
+type destinationResult struct {
+	URL      string `json:"url"`
+	Required bool   `json:"required"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256,omitempty"`
+	// Verified is what -verify-uploads compared for a remote destination
+	Verified string `json:"verified,omitempty"`
+}
+
+// destinationFlags defines the flags of the destinations on flags, like -local-copy and
+// -sftp-key, the returned function reads them once flags are parsed
+func destinationFlags(flags *flag.FlagSet) func() DestinationOptions {
+	localCopyPtr := flags.String("local-copy", "", "keep a local copy of the tarball at this path when uploading to a remote destination")
+	storageClassPtr := flags.String("storage-class", "", "storage class (gs://) or access tier (azblob://) for uploaded tarballs")
+	chunkSizePtr := flags.Int("chunk-size", 16, "upload chunk size in MiB for gs://, azblob:// and oci:// destinations")
+	sftpKeyPtr := flags.String("sftp-key", "", "private key file for sftp:// destinations")
+	sftpKnownHostsPtr := flags.String("sftp-known-hosts", "", "known_hosts file for sftp:// destinations (default ~/.ssh/known_hosts)")
+	sftpInsecurePtr := flags.Bool("sftp-insecure", false, "skip host key verification for sftp:// destinations")
+	ociPlainHTTPPtr := flags.Bool("oci-plain-http", false, "use plain http for oci:// registry destinations")
+	verifyUploadsPtr := flags.Bool("verify-uploads", false, "check every remote upload against the checksums or a read back of the destination")
+	verifyFullMaxPtr := flags.Int64("verify-upload-full-max", 64, "size in MiB up to which -verify-uploads reads an sftp:// upload back in full instead of sampling blocks")
+	uploadRetriesPtr := flags.Int("upload-retries", 0, "number of times a failed or unverified upload of the -local-copy is sent again")
+	uploadConcurrencyPtr := flags.Int("upload-concurrency", 4, "number of chunks of a resumable azblob:// upload of the -local-copy sent at once")
+	chunkRetriesPtr := flags.Int("chunk-retries", 3, "number of times a chunk of a resumable upload of the -local-copy is sent again")
+	uploadStateDaysPtr := flags.Int("upload-state-days", 7, "days after which the state of an abandoned resumable upload next to the -local-copy is removed, 0 keeps it")
+	return func() DestinationOptions {
+		return DestinationOptions{
+			LocalCopy:    *localCopyPtr,
+			StorageClass: *storageClassPtr,
+			ChunkSize:    *chunkSizePtr * 1024 * 1024,
+			SFTP: SFTPOptions{
+				KeyFile:    *sftpKeyPtr,
+				KnownHosts: *sftpKnownHostsPtr,
+				Insecure:   *sftpInsecurePtr,
+			},
+			OCIPlainHTTP:  *ociPlainHTTPPtr,
+			VerifyUploads: *verifyUploadsPtr,
+			VerifyFullMax: *verifyFullMaxPtr * 1024 * 1024,
+			UploadRetries: *uploadRetriesPtr,
+
+			UploadConcurrency: *uploadConcurrencyPtr,
+			ChunkRetries:      *chunkRetriesPtr,
+			UploadStateMaxAge: time.Duration(*uploadStateDaysPtr) * 24 * time.Hour,
+		}
+	}
+}
+
+// outputDestinations are the destinations of a run: every -out when given on the command
+// line, otherwise the destinations of the configuration, otherwise the default -out
+func outputDestinations(outs *stringsFlag, config *Config) []Destination {
+	if !outs.set && len(config.Destinations) > 0 {
+		return config.Destinations
+	}
+	dests := make([]Destination, len(outs.values))
+	for i, out := range outs.values {
+		dests[i] = Destination{URL: out}
+	}
+	return dests
+}
+
+// fanoutChunks is the number of chunks of fanoutChunkSize queued for each destination,
+// a destination slower than the archive blocks it once its queue is full
+const (
+	fanoutChunks    = 16
+	fanoutChunkSize = 256 * 1024
+)
+
+// fanoutDestination is the queue and outcome of one destination of a fanout
+type fanoutDestination struct {
+	Destination
+	chunks chan []byte
+	// done is closed when the destination stopped reading chunks and result is set
+	done   chan struct{}
+	failed bool
+	result destinationResult
+	// err is the error the destination failed with, result.Error is its message
+	err error
+}
+
+// fanout writes the archive stream to several destinations concurrently with a bounded
+// queue for each. A destination that fails is dropped, Write fails once a required
+// destination failed or none is left
+type fanout struct {
+	dests []*fanoutDestination
+	// srcErr is the error the archive ended with, read by the destinations once their queue is closed
+	srcErr error
+	wg     sync.WaitGroup
+}
+
+func newFanout(dests []Destination, opts DestinationOptions) *fanout {
+	f := &fanout{}
+	for _, dest := range dests {
+		d := &fanoutDestination{
+			Destination: dest,
+			chunks:      make(chan []byte, fanoutChunks),
+			done:        make(chan struct{}),
+			result:      destinationResult{URL: sanitizeURL(dest.URL), Required: dest.IsRequired()},
+		}
+		f.dests = append(f.dests, d)
+		f.wg.Add(1)
+		go f.run(d, opts)
+	}
+	return f
+}
+
+func (f *fanout) run(d *fanoutDestination, opts DestinationOptions) {
+	defer f.wg.Done()
+	start := time.Now()
+	hash := sha256.New()
+	verified, err := writeToDestination(d.URL, opts, func(w io.Writer) error {
+		w = io.MultiWriter(w, hash)
+		for chunk := range d.chunks {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			d.result.Bytes += int64(len(chunk))
+		}
+		return f.srcErr
+	})
+
+	d.result.Duration = time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		d.err = err
+		d.result.Status, d.result.Error = "FAILURE", err.Error()
+	} else {
+		d.result.Status, d.result.SHA256 = "SUCCESS", hex.EncodeToString(hash.Sum(nil))
+		d.result.Verified = verified
+	}
+	close(d.done)
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	chunk := append([]byte(nil), p...)
+	live := 0
+	for _, d := range f.dests {
+		if d.failed {
+			continue
+		}
+		select {
+		case <-d.done:
+			d.failed = true
+		default:
+			select {
+			case d.chunks <- chunk:
+				live++
+				continue
+			case <-d.done:
+				d.failed = true
+			}
+		}
+		if d.IsRequired() {
+			return 0, fmt.Errorf("Writing to required destination '%s' failed: %w", d.result.URL, d.err)
+		}
+	}
+	if live == 0 {
+		return 0, fmt.Errorf("Writing to every destination failed")
+	}
+	return len(p), nil
+}
+
+// Close ends the stream with err, waits for every destination to finish and returns their outcomes
+func (f *fanout) Close(err error) []destinationResult {
+	f.srcErr = err
+	for _, d := range f.dests {
+		close(d.chunks)
+	}
+	f.wg.Wait()
+	results := make([]destinationResult, len(f.dests))
+	for i, d := range f.dests {
+		results[i] = d.result
+	}
+	return results
+}
+
+// destinationsError is the failure of the required destinations, wrapping the error of each
+type destinationsError struct {
+	msg    string
+	causes []error
+}
+
+func (e *destinationsError) Error() string {
+	return e.msg
+}
+
+func (e *destinationsError) Unwrap() []error {
+	return e.causes
+}
+
+// writeToDestinations passes a writer teeing to every destination to write. The run fails
+// when write fails, when a required destination fails or when every destination fails,
+// optional destinations that fail are only reported
+func writeToDestinations(dests []Destination, opts DestinationOptions, write func(w io.Writer) error) ([]destinationResult, error) {
+	if len(dests) > 1 && opts.LocalCopy != "" {
+		return nil, fmt.Errorf("-local-copy cannot be used with several destinations, add the local path as another destination")
+	}
+	if opts.UploadRetries > 0 && opts.LocalCopy == "" {
+		return nil, fmt.Errorf("-upload-retries needs -local-copy, a streamed archive cannot be sent again")
+	}
+	f := newFanout(dests, opts)
+	buffered := bufio.NewWriterSize(f, fanoutChunkSize)
+	err := write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	results := f.Close(err)
+	if err != nil {
+		return results, err
+	}
+
+	var failed []string
+	var causes []error
+	succeeded := 0
+	for i, result := range results {
+		if result.Status == "SUCCESS" {
+			succeeded++
+			log.Printf("Wrote '%s' in %s, sha256 %s", result.URL, result.Duration, result.SHA256)
+			continue
+		}
+		if result.Required {
+			failed = append(failed, result.URL)
+			causes = append(causes, f.dests[i].err)
+			log.Printf("Writing to '%s' failed: %s", result.URL, result.Error)
+		} else {
+			log.Printf("WARNING: writing to optional destination '%s' failed: %s", result.URL, result.Error)
+		}
+	}
+	if len(failed) > 0 {
+		return results, &destinationsError{
+			msg:    fmt.Sprintf("%d required destination(s) failed: %s", len(failed), strings.Join(failed, ", ")),
+			causes: causes,
+		}
+	}
+	if succeeded == 0 {
+		return results, fmt.Errorf("Writing to every destination failed")
+	}
+	return results, nil
+}
+
+// errUnsupportedScheme is a destination URL of a scheme no Uploader writes to, like s3://,
+// it is never mistaken for a local path
+var errUnsupportedScheme = errors.New("Unsupported destination scheme")
+
+// newUploader selects a remote destination by the URL scheme of target,
+// a nil Uploader means target is a local file path
+func newUploader(target string, opts DestinationOptions) (Uploader, error) {
+	if !strings.Contains(target, "://") {
+		return nil, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		// the error of url.Parse repeats the URL with its credentials
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, configError(fmt.Errorf("Invalid destination URL: %w", err))
+	}
+
+	switch u.Scheme {
+	case "sftp":
+		return newSFTPUploader(u, opts)
+	case "gs":
+		return newGCSUploader(u, opts)
+	case "azblob":
+		return newAzureBlobUploader(u, opts)
+	case "oci":
+		return newOCIUploader(u, opts)
+	case "exec":
+		return newExecUploader(u, opts)
+	}
+	return nil, configError(fmt.Errorf("%w '%s://', use a local path, sftp://, gs://, azblob://, oci:// or exec://", errUnsupportedScheme, u.Scheme))
+}
+
+// writeToDestination passes a writer for target, which is either a local file path
+// or a remote destination URL, to write. When write fails nothing is left at target.
+// With opts.VerifyUploads it returns what the upload was verified with
+func writeToDestination(target string, opts DestinationOptions, write func(w io.Writer) error) (string, error) {
+	uploader, err := newUploader(target, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if uploader == nil {
+		return "", writeToLocalFile(target, write)
+	}
+
+	// the digest is summed from the stream as it is written, the upload is never read again
+	var digest *streamDigest
+	verifier, ok := uploader.(uploadVerifier)
+	if opts.VerifyUploads && ok {
+		digest = newStreamDigest()
+		next := write
+		write = func(w io.Writer) error {
+			return next(io.MultiWriter(w, digest))
+		}
+	}
+
+	if opts.LocalCopy != "" {
+		if err := writeToLocalFile(opts.LocalCopy, write); err != nil {
+			return "", err
+		}
+		pruneUploadStates(opts.LocalCopy, opts.UploadStateMaxAge)
+		for attempt := 0; ; attempt++ {
+			verified, err := uploadLocalCopy(target, opts, uploader, verifier, digest)
+			if err == nil || attempt >= opts.UploadRetries {
+				return verified, err
+			}
+			log.Printf("WARNING: %v, uploading again (%d/%d)", err, attempt+1, opts.UploadRetries)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	writeErr := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		writeErr <- err
+	}()
+
+	log.Printf("Streaming archive to '%s'", target)
+	uploadErr := uploader.Upload(pr)
+	pr.Close()
+	if err := <-writeErr; err != nil {
+		return "", err
+	}
+	if uploadErr != nil {
+		return "", fmt.Errorf("Upload to '%s' failed: %w", target, uploadErr)
+	}
+	return verifyUpload(target, verifier, digest)
+}
+
+// uploadLocalCopy uploads the -local-copy to target and verifies it against the digest
+// summed while the copy was written, when there is one. A resumableUploader sends it in
+// chunks recorded in the upload state, which is kept when the upload fails
+func uploadLocalCopy(target string, opts DestinationOptions, uploader Uploader, verifier uploadVerifier, digest *streamDigest) (string, error) {
+	f, err := os.Open(opts.LocalCopy)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	log.Printf("Uploading '%s' to '%s'", opts.LocalCopy, target)
+	resumable, ok := uploader.(resumableUploader)
+	if !ok {
+		if err := uploader.Upload(f); err != nil {
+			return "", fmt.Errorf("Upload to '%s' failed: %w", target, err)
+		}
+		return verifyUpload(target, verifier, digest)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	chunkSize := int64(opts.ChunkSize)
+	if chunkSize <= 0 {
+		chunkSize = 16 * 1024 * 1024
+	}
+	state := newUploadState(target, opts.LocalCopy, info, chunkSize)
+	if err := resumable.UploadFile(f, state); err != nil {
+		log.Printf("Upload state kept in '%s', run again with -resume-upload to continue the upload", state.path)
+		return "", fmt.Errorf("Upload to '%s' failed: %w", target, err)
+	}
+	// an upload failing verification is sent again from the start
+	if err := state.Remove(); err != nil {
+		log.Println("WARNING: cannot remove the upload state:", err)
+	}
+	return verifyUpload(target, verifier, digest)
+}
+
+// verifyUpload checks the upload to target against digest, a nil digest is not verified
+func verifyUpload(target string, verifier uploadVerifier, digest *streamDigest) (string, error) {
+	if digest == nil {
+		return "", nil
+	}
+	verified, err := verifier.Verify(digest)
+	if err != nil {
+		return "", fmt.Errorf("Verification of the upload to '%s' failed: %w", target, err)
+	}
+	log.Printf("Verified upload to '%s': %s", target, verified)
+	return verified, nil
+}
+
+func writeToLocalFile(target string, write func(w io.Writer) error) error {
+	outputFile, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("Cannot open output file: %v", err)
+	}
+	if err := write(outputFile); err != nil {
+		outputFile.Close()
+		os.Remove(target)
+		return err
+	}
+	return outputFile.Close()
+}
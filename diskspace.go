@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+)
+
+// exitCodeInfrastructure is the exit status of a run that failed for the host it runs on,
+// like a full staging filesystem, rather than for a repository
+const exitCodeInfrastructure = 5
+
+// diskSpace is what a filesystem has left for unprivileged users, Inodes is only set
+// when the filesystem has a fixed number of them
+type diskSpace struct {
+	Bytes  uint64
+	Inodes uint64
+	// TotalBytes and TotalInodes are the size of the filesystem
+	TotalBytes  uint64
+	TotalInodes uint64
+	// HasInodes is false for filesystems like btrfs that allocate inodes on demand
+	HasInodes bool
+}
+
+// stagingFullError is a clone or an archive that failed for a full staging filesystem,
+// the run stops dispatching clones once one happens
+type stagingFullError struct {
+	clonePath string
+	reason    string
+	err       error
+}
+
+func (e *stagingFullError) Error() string {
+	return fmt.Sprintf("Staging filesystem %s at repo %s: %v", e.reason, e.clonePath, e.err)
+}
+
+func (e *stagingFullError) Unwrap() error {
+	return e.err
+}
+
+// isDiskFull reports whether err is a write the filesystem refused for space, inodes or quota
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// diskFullReason tells a filesystem out of inodes from one out of bytes or quota. The
+// failed clone may already be removed, so the inodes are the cause when a smaller share
+// of them is left than of the bytes
+func diskFullReason(dir string, err error) string {
+	if errors.Is(err, syscall.EDQUOT) {
+		return "over its quota"
+	}
+	space, ok := filesystemSpace(dir)
+	if ok && space.HasInodes && space.TotalBytes > 0 &&
+		float64(space.Inodes)/float64(space.TotalInodes) < float64(space.Bytes)/float64(space.TotalBytes) {
+		return "out of inodes"
+	}
+	return "out of space"
+}
+
+// infrastructureError exits a run that failed for a full filesystem with exitCodeInfrastructure
+func infrastructureError(err error) error {
+	var coded *exitCodeError
+	if err == nil || !isDiskFull(err) || errors.As(err, &coded) {
+		return err
+	}
+	return &exitCodeError{err: err, code: exitCodeInfrastructure}
+}
+
+// checkStagingSpace refuses to start cloning when the staging filesystem of dir has fewer
+// than minBytes free beyond the expected size of the clones, or fewer than minInodes free
+// inodes. Nothing is checked on platforms that cannot tell
+func checkStagingSpace(dir string, expected int64, minBytes int64, minInodes uint64) error {
+	space, ok := filesystemSpace(dir)
+	if !ok {
+		return nil
+	}
+	inodes := "no fixed number of inodes"
+	if space.HasInodes {
+		inodes = fmt.Sprintf("%d inodes", space.Inodes)
+	}
+	log.Printf("Staging filesystem of '%s' has %s and %s free", dir, formatBytes(int64(space.Bytes)), inodes)
+
+	var problem string
+	switch {
+	case space.Bytes < uint64(expected+minBytes):
+		problem = fmt.Sprintf("%s free, the clones are expected to take %s and -min-free-space is %s",
+			formatBytes(int64(space.Bytes)), formatBytes(expected), formatBytes(minBytes))
+	case space.HasInodes && space.Inodes < minInodes:
+		problem = fmt.Sprintf("%d inodes free, -min-free-inodes is %d", space.Inodes, minInodes)
+	default:
+		return nil
+	}
+	return &exitCodeError{
+		err:  fmt.Errorf("Staging filesystem of '%s' has only %s", dir, problem),
+		code: exitCodeInfrastructure,
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// filesystemSpace reports nothing, the free space is not read on this platform
+func filesystemSpace(dir string) (diskSpace, bool) {
+	return diskSpace{}, false
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+func TestIsDiskFull(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"enospc", &os.PathError{Op: "write", Path: "objects/pack/tmp", Err: syscall.ENOSPC}, true},
+		{"edquot", fmt.Errorf("clone: %w", &os.PathError{Op: "open", Path: "HEAD", Err: syscall.EDQUOT}), true},
+		{"wrapped twice", fmt.Errorf("archive: %w", &stagingFullError{clonePath: "team/app", reason: "out of space", err: syscall.ENOSPC}), true},
+		{"permission", &os.PathError{Op: "open", Path: "HEAD", Err: syscall.EACCES}, false},
+		{"nil", nil, false},
+	} {
+		if full := isDiskFull(tc.err); full != tc.expected {
+			t.Errorf("%s: disk full %v, expected %v", tc.name, full, tc.expected)
+		}
+	}
+}
+
+func TestInfrastructureError(t *testing.T) {
+	enospc := fmt.Errorf("Failed to create 'backup.tar.gz': %w", syscall.ENOSPC)
+	coded := &exitCodeError{err: syscall.ENOSPC, code: exitCodeFailOn}
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{name: "disk full", err: enospc, code: exitCodeInfrastructure},
+		{name: "required destination", err: &destinationsError{msg: "1 required destination(s) failed", causes: []error{errors.New("auth"), enospc}}, code: exitCodeInfrastructure},
+		{name: "already coded", err: coded, code: exitCodeFailOn},
+		{name: "other", err: errors.New("something else")},
+	} {
+		err := infrastructureError(tc.err)
+		var exitErr *exitCodeError
+		code := 0
+		if errors.As(err, &exitErr) {
+			code = exitErr.code
+		}
+		if code != tc.code || !errors.Is(err, tc.err) {
+			t.Errorf("%s: %v exits with %d, expected %d", tc.name, err, code, tc.code)
+		}
+	}
+	if infrastructureError(nil) != nil {
+		t.Errorf("no error became one")
+	}
+}
+
+func TestDiskFullReason(t *testing.T) {
+	if reason := diskFullReason(t.TempDir(), syscall.EDQUOT); reason != "over its quota" {
+		t.Errorf("EDQUOT is %q", reason)
+	}
+	if reason := diskFullReason(filepath.Join(t.TempDir(), "missing"), syscall.ENOSPC); reason != "out of space" {
+		t.Errorf("ENOSPC without a filesystem to read is %q", reason)
+	}
+}
+
+func TestCheckStagingSpace(t *testing.T) {
+	dir := t.TempDir()
+	space, ok := filesystemSpace(dir)
+	if !ok {
+		t.Skip("the free space cannot be read on this platform")
+	}
+	for _, tc := range []struct {
+		name      string
+		expected  int64
+		minBytes  int64
+		minInodes uint64
+		problem   string
+	}{
+		{name: "enough", expected: 1024},
+		{name: "clones too large", expected: int64(space.Bytes) + 1, problem: "the clones are expected to take"},
+		{name: "min free space", minBytes: int64(space.Bytes) + 1, problem: "-min-free-space is"},
+		{name: "min free inodes", minInodes: space.Inodes + 1, problem: "-min-free-inodes is"},
+	} {
+		if tc.minInodes != 0 && !space.HasInodes {
+			continue
+		}
+		err := checkStagingSpace(dir, tc.expected, tc.minBytes, tc.minInodes)
+		if tc.problem == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		var exitErr *exitCodeError
+		if !errors.As(err, &exitErr) || exitErr.code != exitCodeInfrastructure || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%s: error %v, expected %q with the exit status %d", tc.name, err, tc.problem, exitCodeInfrastructure)
+		}
+	}
+	if err := checkStagingSpace(filepath.Join(dir, "missing"), 1<<62, 0, 0); err != nil {
+		t.Errorf("a staging directory that cannot be read fails: %v", err)
+	}
+}
+
+// fullFS is a filesystem refusing every new file with ENOSPC, like a full staging filesystem
+type fullFS struct {
+	billy.Filesystem
+}
+
+func (fs fullFS) full(filename string) error {
+	return &os.PathError{Op: "open", Path: filename, Err: syscall.ENOSPC}
+}
+
+func (fs fullFS) Create(filename string) (billy.File, error) {
+	return nil, fs.full(filename)
+}
+
+func (fs fullFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, fs.full(filename)
+	}
+	return fs.Filesystem.OpenFile(filename, flag, perm)
+}
+
+func (fs fullFS) TempFile(dir string, prefix string) (billy.File, error) {
+	return nil, fs.full(dir)
+}
+
+func (fs fullFS) Chroot(path string) (billy.Filesystem, error) {
+	chroot, err := fs.Filesystem.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return fullFS{chroot}, nil
+}
+
+func TestCloneReposStagingFull(t *testing.T) {
+	saved := workers
+	workers = 1
+	defer func() { workers = saved }()
+
+	config := &Config{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		dir := filepath.Join(t.TempDir(), name)
+		newTestRepo(t, dir, [2]string{"README.md", name})
+		config.Repos = append(config.Repos, Repository{Name: name, Path: "team", URL: dir})
+	}
+	report := newRunReport(nil, runKindFull, len(config.Repos))
+	err := cloneRepos(context.Background(), config, fullFS{memfs.New()}, CloneOptions{Report: report}, nil)
+
+	var exitErr *exitCodeError
+	var full *stagingFullError
+	if !errors.As(err, &exitErr) || exitErr.code != exitCodeInfrastructure || !errors.As(err, &full) {
+		t.Fatalf("error %v, expected a full staging filesystem with the exit status %d", err, exitCodeInfrastructure)
+	}
+	if !strings.HasPrefix(err.Error(), "Staging filesystem out of space at repo team/") {
+		t.Errorf("unexpected error %q", err)
+	}
+	// the first clone fails before the third is dispatched, the second may already be
+	notCloned := 0
+	for _, entry := range report.Repos {
+		if entry.Status != statusFailed || entry.Category != categoryDiskFull {
+			t.Errorf("%s: status %q in category %q", entry.Path, entry.Status, entry.Category)
+		}
+		if strings.HasPrefix(entry.Error, "Not cloned, the staging filesystem is out of space") {
+			notCloned++
+		}
+	}
+	if len(report.Repos) != len(config.Repos) || notCloned < 2 {
+		t.Errorf("%d of %d repositories recorded, %d not cloned, expected at least 2", len(report.Repos), len(config.Repos), notCloned)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// filesystemSpace reads the free bytes and inodes of the filesystem of dir
+func filesystemSpace(dir string) (diskSpace, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return diskSpace{}, false
+	}
+	return diskSpace{
+		Bytes:       uint64(stat.Bavail) * uint64(stat.Bsize),
+		Inodes:      uint64(stat.Ffree),
+		TotalBytes:  uint64(stat.Blocks) * uint64(stat.Bsize),
+		TotalInodes: uint64(stat.Files),
+		HasInodes:   stat.Files > 0,
+	}, true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// ManifestAlias is a repository of the configuration with the same URL and settings as an
+// earlier one, it is cloned once and restored as a link to the clone of the earlier one
+type ManifestAlias struct {
+	Name string `json:"name" yaml:"name"`
+	Path string `json:"path" yaml:"path"`
+	URL  string `json:"url" yaml:"url"`
+	// AliasOf is the clone path of the repository cloned for it
+	AliasOf string `json:"alias_of" yaml:"alias_of"`
+}
+
+func (a ManifestAlias) ClonePath() string {
+	return path.Join(a.Path, a.Name)
+}
+
+// normalizeRepoURL is the URL compared to find repositories listed twice: the scheme and
+// host in lower case, the path without trailing slashes and .git. The path keeps its case,
+// most hosts tell repositories apart by it
+func normalizeRepoURL(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Scheme != "" && u.Host != "" {
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+		u.Path = strings.TrimSuffix(strings.TrimRight(u.Path, "/"), ".git")
+		u.RawPath = ""
+		return u.String()
+	}
+	p := strings.TrimSuffix(strings.TrimRight(rawURL, "/"), ".git")
+	// scp like git@host:owner/repo.git
+	if i := strings.Index(p, ":"); i >= 0 && !strings.HasPrefix(p, "/") && !strings.Contains(p[:i], "/") {
+		host := p[:i]
+		user := ""
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			user, host = host[:j+1], host[j+1:]
+		}
+		return user + strings.ToLower(host) + ":" + p[i+1:]
+	}
+	return p
+}
+
+// sameClone reports whether a and b are cloned the same way apart from their name, path,
+// tags and priority, which do not change what is cloned
+func sameClone(a Repository, b Repository) bool {
+	for _, r := range []*Repository{&a, &b} {
+		r.Name, r.Path, r.URL, r.PathPrefix, r.Tags, r.Priority = "", "", "", nil, nil, 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// mergeDuplicateURLs clones repositories listed more than once with the same normalized
+// URL and settings only once, under the first of them, and returns the others as aliases
+// of it. Repositories sharing a URL with different settings are cloned as configured
+func mergeDuplicateURLs(config *Config) (*Config, []ManifestAlias) {
+	merged := *config
+	merged.Repos = nil
+	var aliases []ManifestAlias
+	first := make(map[string][]int)
+	for _, repo := range config.Repos {
+		key := normalizeRepoURL(repo.URL)
+		canonical := -1
+		for _, i := range first[key] {
+			if sameClone(merged.Repos[i], repo) {
+				canonical = i
+				break
+			}
+		}
+		if canonical < 0 {
+			if len(first[key]) > 0 {
+				log.Printf("WARNING: %s is listed as %s and %s with different settings, it is cloned twice", sanitizeURL(repo.URL), path.Join(repo.Path, repo.Name), path.Join(merged.Repos[first[key][0]].Path, merged.Repos[first[key][0]].Name))
+			}
+			first[key] = append(first[key], len(merged.Repos))
+			merged.Repos = append(merged.Repos, repo)
+			continue
+		}
+		target := path.Join(merged.Repos[canonical].Path, merged.Repos[canonical].Name)
+		alias := ManifestAlias{Name: repo.Name, Path: repo.Path, URL: sanitizeURL(repo.URL), AliasOf: target}
+		log.Printf("Merging %s into %s, both clone %s", alias.ClonePath(), target, sanitizeURL(repo.URL))
+		aliases = append(aliases, alias)
+	}
+	if len(aliases) > 0 {
+		log.Printf("Merged %d repositories listed more than once, %d left to clone", len(aliases), len(merged.Repos))
+	}
+	return &merged, aliases
+}
+
+// linkAliases links the clone path of every alias of m below dest to the restored clone
+// it is an alias of with a relative symlink
+func linkAliases(m *Manifest, dest string) error {
+	for _, alias := range m.Aliases {
+		target := filepath.Join(dest, filepath.FromSlash(alias.ClonePath()))
+		if _, err := os.Lstat(target); err == nil {
+			log.Printf("WARNING: not linking %s to %s, it exists already", alias.ClonePath(), alias.AliasOf)
+			continue
+		}
+		if err := checkNoSymlink(dest, alias.ClonePath()); err != nil {
+			log.Printf("WARNING: not linking %s: %v", alias.ClonePath(), err)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		linkname, err := filepath.Rel(filepath.Dir(target), filepath.Join(dest, filepath.FromSlash(alias.AliasOf)))
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(linkname, target); err != nil {
+			return err
+		}
+		log.Printf("Linked %s to %s", alias.ClonePath(), alias.AliasOf)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EffectiveConfig is the configuration a run acts on, after loading, variable expansion,
+// defaults, derived names and paths and the command line are applied. -print-config prints
+// it as YAML and the manifest embeds it, credentials are only named, never included
+type EffectiveConfig struct {
+	Destinations []EffectiveDestination `yaml:"destinations" json:"destinations"`
+	Repos        []EffectiveRepo        `yaml:"repos" json:"repos"`
+	// Disabled are the repositories left out of the run, with the reason they are disabled
+	Disabled []EffectiveRepo `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	// Aliases are the repositories with the URL and settings of an earlier one, cloned once
+	Aliases []ManifestAlias `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	// Hosts are the transport overrides of hosts, with the names of their extra headers
+	Hosts map[string]EffectiveHost `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+}
+
+type EffectiveHost struct {
+	Protocol     string   `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	DisableHTTP2 bool     `yaml:"disable_http2,omitempty" json:"disable_http2,omitempty"`
+	ExtraHeaders []string `yaml:"extra_headers,omitempty" json:"extra_headers,omitempty"`
+}
+
+type EffectiveDestination struct {
+	URL      string `yaml:"url" json:"url"`
+	Required bool   `yaml:"required" json:"required"`
+}
+
+// EffectiveRepo are the settings a repository is cloned with, every default applied
+type EffectiveRepo struct {
+	Name string `yaml:"name" json:"name"`
+	Path string `yaml:"path" json:"path"`
+	URL  string `yaml:"url" json:"url"`
+	// Derived notes the fields that were derived from the URL, name and path
+	Derived      []string  `yaml:"derived,omitempty" json:"derived,omitempty"`
+	Export       string    `yaml:"export,omitempty" json:"export,omitempty"`
+	OutputFormat string    `yaml:"output_format,omitempty" json:"output_format,omitempty"`
+	Depth        int       `yaml:"depth,omitempty" json:"depth,omitempty"`
+	Retries      int       `yaml:"retries,omitempty" json:"retries,omitempty"`
+	Timeout      string    `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Auth         *RepoAuth `yaml:"auth,omitempty" json:"auth,omitempty"`
+	// HostAuth is the host_auth key the auth was taken from
+	HostAuth            string          `yaml:"host_auth,omitempty" json:"host_auth,omitempty"`
+	ExcludeRefs         []string        `yaml:"exclude_refs,omitempty" json:"exclude_refs,omitempty"`
+	RemoteConfig        *RemoteSettings `yaml:"remote_config,omitempty" json:"remote_config,omitempty"`
+	MaxObjectCache      int             `yaml:"max_object_cache,omitempty" json:"max_object_cache,omitempty"`
+	Priority            int             `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Tags                []string        `yaml:"tags,omitempty" json:"tags,omitempty"`
+	AllowInsecureHTTP   bool            `yaml:"allow_insecure_http,omitempty" json:"allow_insecure_http,omitempty"`
+	IncludeHostMetadata bool            `yaml:"include_host_metadata,omitempty" json:"include_host_metadata,omitempty"`
+	HostType            string          `yaml:"host_type,omitempty" json:"host_type,omitempty"`
+	Filter              string          `yaml:"filter,omitempty" json:"filter,omitempty"`
+	Pin                 string          `yaml:"pin,omitempty" json:"pin,omitempty"`
+	PinOnly             bool            `yaml:"pin_only,omitempty" json:"pin_only,omitempty"`
+	Region              string          `yaml:"region,omitempty" json:"region,omitempty"`
+	Flavor              string          `yaml:"flavor,omitempty" json:"flavor,omitempty"`
+	DedupGroup          string          `yaml:"dedup_group,omitempty" json:"dedup_group,omitempty"`
+	Secrets             string          `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+	InMemory            *bool           `yaml:"in_memory,omitempty" json:"in_memory,omitempty"`
+	IgnorePatterns      []string        `yaml:"ignore_patterns,omitempty" json:"ignore_patterns,omitempty"`
+	SkipReason          string          `yaml:"skip_reason,omitempty" json:"skip_reason,omitempty"`
+}
+
+// newEffectiveConfig describes the repositories of config and the disabled ones a run writes to dests
+func newEffectiveConfig(config *Config, disabled []Repository, dests []Destination) *EffectiveConfig {
+	effective := &EffectiveConfig{Repos: []EffectiveRepo{}}
+	for _, dest := range dests {
+		effective.Destinations = append(effective.Destinations, EffectiveDestination{URL: sanitizeURL(dest.URL), Required: dest.IsRequired()})
+	}
+	for _, repo := range config.Repos {
+		effective.Repos = append(effective.Repos, newEffectiveRepo(repo))
+	}
+	for name, host := range config.Hosts {
+		if effective.Hosts == nil {
+			effective.Hosts = make(map[string]EffectiveHost)
+		}
+		effective.Hosts[strings.ToLower(name)] = EffectiveHost{Protocol: host.Protocol, DisableHTTP2: host.DisableHTTP2, ExtraHeaders: host.headerNames()}
+	}
+	for _, repo := range disabled {
+		entry := newEffectiveRepo(repo)
+		entry.SkipReason = repo.SkipReason
+		if entry.SkipReason == "" {
+			entry.SkipReason = "disabled"
+		}
+		effective.Disabled = append(effective.Disabled, entry)
+	}
+	return effective
+}
+
+func newEffectiveRepo(repo Repository) EffectiveRepo {
+	entry := EffectiveRepo{
+		Name:                repo.Name,
+		Path:                repo.Path,
+		URL:                 sanitizeURL(repo.URL),
+		Export:              repo.Export,
+		OutputFormat:        repo.OutputFormat,
+		Depth:               repo.depth(),
+		Retries:             repo.retries(),
+		Auth:                repo.Auth,
+		HostAuth:            repo.HostAuth,
+		ExcludeRefs:         repo.ExcludeRefs,
+		RemoteConfig:        repo.RemoteConfig,
+		MaxObjectCache:      repo.MaxObjectCache,
+		Priority:            repo.Priority,
+		Tags:                repo.Tags,
+		AllowInsecureHTTP:   repo.allowsInsecureHTTP(),
+		IncludeHostMetadata: repo.IncludeHostMetadata != nil && *repo.IncludeHostMetadata,
+		HostType:            repo.HostType,
+		Filter:              repo.Filter,
+		Pin:                 repo.Pin,
+		PinOnly:             repo.PinOnly,
+		Region:              repo.Region,
+		Flavor:              repo.Flavor,
+		DedupGroup:          repo.DedupGroup,
+		Secrets:             repo.Secrets,
+		InMemory:            repo.InMemory,
+		IgnorePatterns:      repo.IgnorePatterns,
+	}
+	if repo.timeout() > 0 {
+		entry.Timeout = repo.timeout().String()
+	}
+	if repo.NameDerived {
+		entry.Derived = append(entry.Derived, "name")
+	}
+	if repo.PathDerived {
+		entry.Derived = append(entry.Derived, "path")
+	}
+	return entry
+}
+
+// printConfig writes the effective configuration to stdout as YAML for -print-config
+func printConfig(effective *EffectiveConfig) error {
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(effective); err != nil {
+		return fmt.Errorf("Cannot print the configuration: %w", err)
+	}
+	return enc.Close()
+}
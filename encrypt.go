@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const (
+	encryptionAge     = "age"
+	encryptionOpenPGP = "openpgp"
+	// identityPassphraseEnv holds the passphrase of the encrypted OpenPGP private keys of -identity
+	identityPassphraseEnv = "CODEPACK_IDENTITY_PASSPHRASE"
+)
+
+// ageIntro starts every binary age file
+var ageIntro = []byte("age-encryption.org/v1\n")
+
+const recipientUsage = "encrypt the tarball to this age public key (age1...) or to the age recipients or OpenPGP public keys of this file, repeat it to encrypt to several keys"
+const identityUsage = "age identity or OpenPGP private key file decrypting encrypted archives, repeat it to try several, " + identityPassphraseEnv + " holds the passphrase of an encrypted OpenPGP key"
+
+// ManifestEncryption records who can decrypt an archive, by the public keys of age and
+// the fingerprints of OpenPGP, never a private key
+type ManifestEncryption struct {
+	Format     string              `json:"format"`
+	Recipients []ManifestRecipient `json:"recipients"`
+}
+
+// ManifestRecipient is one key an archive is encrypted to. Recipient is an age public key,
+// which rewrap needs to wrap the file key again since age recipient stanzas do not name
+// their key. Fingerprint is an OpenPGP key and KeyID the subkey the archive is encrypted to
+type ManifestRecipient struct {
+	Recipient   string `json:"recipient,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	KeyID       string `json:"key_id,omitempty"`
+}
+
+// archiveRecipients are the keys archives are encrypted to, all of age or all of OpenPGP
+type archiveRecipients struct {
+	format  string
+	age     []age.Recipient
+	ageKeys []string
+	pgp     openpgp.EntityList
+}
+
+// parseRecipients reads the values of -recipient, nil when there are none
+func parseRecipients(values []string) (*archiveRecipients, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	r := &archiveRecipients{}
+	for _, value := range values {
+		if strings.HasPrefix(value, "age1") {
+			if err := r.addAge(value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read recipient '%s': %w", value, err)
+		}
+		if keys := ageRecipientLines(data); keys != nil {
+			for _, key := range keys {
+				if err := r.addAge(key); err != nil {
+					return nil, fmt.Errorf("Invalid recipient in '%s': %w", value, err)
+				}
+			}
+			continue
+		}
+		el, err := readKeyRing(data)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read OpenPGP public key '%s': %w", value, err)
+		}
+		for _, entity := range el {
+			if _, ok := entity.EncryptionKey(time.Now()); !ok {
+				return nil, fmt.Errorf("OpenPGP key %X of '%s' has no valid encryption key", entity.PrimaryKey.Fingerprint, value)
+			}
+		}
+		r.pgp = append(r.pgp, el...)
+	}
+	switch {
+	case len(r.age) > 0 && len(r.pgp) > 0:
+		return nil, fmt.Errorf("An archive is encrypted with age or OpenPGP, the recipients cannot mix both")
+	case len(r.age) > 0:
+		r.format = encryptionAge
+	default:
+		r.format = encryptionOpenPGP
+	}
+	return r, nil
+}
+
+func (r *archiveRecipients) addAge(key string) error {
+	recipient, err := age.ParseX25519Recipient(key)
+	if err != nil {
+		return fmt.Errorf("Invalid age recipient '%s': %w", key, err)
+	}
+	r.age = append(r.age, recipient)
+	r.ageKeys = append(r.ageKeys, recipient.String())
+	return nil
+}
+
+// ageRecipientLines returns the age public keys of a recipients file, nil when data is
+// not one. Empty lines and # comments are skipped
+func ageRecipientLines(data []byte) []string {
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "age1") {
+			return nil
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
+
+// readKeyRing reads armored or binary OpenPGP keys
+func readKeyRing(data []byte) (openpgp.EntityList, error) {
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// encrypt runs produce with a writer encrypting what it writes to w, a nil
+// *archiveRecipients writes to w as it is
+func (r *archiveRecipients) encrypt(w io.Writer, produce func(w io.Writer) error) error {
+	if r == nil {
+		return produce(w)
+	}
+	var ew io.WriteCloser
+	var err error
+	if r.format == encryptionAge {
+		ew, err = age.Encrypt(w, r.age...)
+	} else {
+		ew, err = openpgp.Encrypt(w, r.pgp, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot encrypt the archive: %w", err)
+	}
+	if err := produce(ew); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// extension is appended to the name of an encrypted archive
+func (r *archiveRecipients) extension() string {
+	switch {
+	case r == nil:
+		return ""
+	case r.format == encryptionAge:
+		return ".age"
+	}
+	return ".gpg"
+}
+
+// manifest records the recipients, nil for an archive that is not encrypted
+func (r *archiveRecipients) manifest() *ManifestEncryption {
+	if r == nil {
+		return nil
+	}
+	m := &ManifestEncryption{Format: r.format}
+	for _, key := range r.ageKeys {
+		m.Recipients = append(m.Recipients, ManifestRecipient{Recipient: key})
+	}
+	for _, entity := range r.pgp {
+		m.Recipients = append(m.Recipients, openPGPRecipient(entity))
+	}
+	return m
+}
+
+func openPGPRecipient(entity *openpgp.Entity) ManifestRecipient {
+	recipient := ManifestRecipient{Fingerprint: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)}
+	if key, ok := entity.EncryptionKey(time.Now()); ok {
+		recipient.KeyID = fmt.Sprintf("%016X", key.PublicKey.KeyId)
+	}
+	return recipient
+}
+
+// archiveIdentities are the private keys encrypted archives are read with
+type archiveIdentities struct {
+	age []age.Identity
+	pgp openpgp.EntityList
+}
+
+// identities are the keys of -identity, nil reads no encrypted archive
+var identities *archiveIdentities
+
+// identityFlags adds -identity to flags, the function it returns loads the keys given
+func identityFlags(flags *flag.FlagSet) func() error {
+	files := &stringsFlag{}
+	flags.Var(files, "identity", identityUsage)
+	return func() error {
+		loaded, err := loadIdentities(files.values)
+		identities = loaded
+		return err
+	}
+}
+
+func loadIdentities(files []string) (*archiveIdentities, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	ids := &archiveIdentities{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read identity '%s': %w", file, err)
+		}
+		if bytes.Contains(data, []byte("AGE-SECRET-KEY-")) {
+			parsed, err := age.ParseIdentities(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid age identity '%s': %w", file, err)
+			}
+			ids.age = append(ids.age, parsed...)
+			continue
+		}
+		el, err := readKeyRing(data)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read OpenPGP private key '%s': %w", file, err)
+		}
+		for _, entity := range el {
+			if entity.PrivateKey == nil {
+				return nil, fmt.Errorf("OpenPGP key %X of '%s' has no private key", entity.PrimaryKey.Fingerprint, file)
+			}
+			if passphrase := os.Getenv(identityPassphraseEnv); passphrase != "" {
+				if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+					return nil, fmt.Errorf("Cannot decrypt OpenPGP key %X of '%s' with %s: %w", entity.PrimaryKey.Fingerprint, file, identityPassphraseEnv, err)
+				}
+			}
+		}
+		ids.pgp = append(ids.pgp, el...)
+	}
+	return ids, nil
+}
+
+// encryptedFormat is age or openpgp for an encrypted archive starting in br, empty otherwise.
+// An OpenPGP message written for recipients starts with a public key encrypted session key
+// packet, tag 1 in the old or the new packet format
+func encryptedFormat(br *bufio.Reader) string {
+	if magic, err := br.Peek(len(ageIntro)); err == nil && bytes.Equal(magic, ageIntro) {
+		return encryptionAge
+	}
+	if b, err := br.Peek(1); err == nil && (b[0]&0xfc == 0x84 || b[0] == 0xc1) {
+		return encryptionOpenPGP
+	}
+	return ""
+}
+
+// decrypt returns the plaintext of an encrypted archive read from r with the keys of
+// -identity, or the archive as it is when it is not encrypted
+func decrypt(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	format := encryptedFormat(br)
+	if format == "" {
+		return br, nil
+	}
+	if identities == nil {
+		return nil, fmt.Errorf("the archive is encrypted with %s, pass -identity with a key it is encrypted to", format)
+	}
+	if format == encryptionAge {
+		if len(identities.age) == 0 {
+			return nil, fmt.Errorf("the archive is encrypted with age, -identity has no age identity")
+		}
+		plaintext, err := age.Decrypt(br, identities.age...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt the archive: %w", err)
+		}
+		return plaintext, nil
+	}
+	md, err := openpgp.ReadMessage(br, identities.pgp, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt the archive: %w", err)
+	}
+	return md.UnverifiedBody, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// input modes of an exec plugin
+const (
+	execInputStdin = "stdin"
+	execInputPath  = "path"
+)
+
+// ExecPlugin is an external command CodePack hands an archive or a notification to, for
+// storage and notification services it has no built-in support for. The arguments of
+// Command are templates of {{ .archive }}, {{ .path }}, {{ .run_id }}, {{ .checksum }}
+// and {{ .status }}, the environment carries RUN_ID, ARCHIVE, CHECKSUM and STATUS, and
+// the exit status of the command decides whether it succeeded
+type ExecPlugin struct {
+	Command []string `yaml:"command" json:"command" toml:"command"`
+	// Input is how an archive is handed to the command: stdin (the default) streams it to
+	// the standard input, path writes it to a temporary file passed as {{ .path }}
+	Input string `yaml:"input" json:"input" toml:"input"`
+	// Timeout kills the command when it runs longer, unset is unlimited
+	Timeout *Duration `yaml:"timeout" json:"timeout" toml:"timeout"`
+	// Retries is the number of times a failed command is run again, an archive streamed to
+	// stdin can only be sent again from the -local-copy with -upload-retries
+	Retries int `yaml:"retries" json:"retries" toml:"retries"`
+}
+
+func (p ExecPlugin) validate(name string) error {
+	if len(p.Command) == 0 {
+		return fmt.Errorf("exec plugin '%s' has no command", name)
+	}
+	if p.Input != "" && p.Input != execInputStdin && p.Input != execInputPath {
+		return fmt.Errorf("Invalid input '%s' of exec plugin '%s', use stdin or path", p.Input, name)
+	}
+	for _, arg := range p.Command {
+		if _, err := template.New(name).Option("missingkey=error").Parse(arg); err != nil {
+			return fmt.Errorf("Invalid command of exec plugin '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// execData are the template values and environment of a run of a plugin, every field is
+// set so that only misspelled ones fail to expand
+func execData(archive string, runID string, checksum string, status string) map[string]string {
+	return map[string]string{"archive": archive, "path": "", "run_id": runID, "checksum": checksum, "status": status}
+}
+
+// run runs the command once with the fields of data as its template values and
+// environment, stdin as its standard input and its standard error logged line by line
+func (p ExecPlugin) run(name string, data map[string]string, stdin io.Reader) error {
+	args := make([]string, len(p.Command))
+	for i, arg := range p.Command {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return fmt.Errorf("cannot expand '%s': %w", arg, err)
+		}
+		args[i] = b.String()
+	}
+
+	ctx := runContext
+	if p.Timeout != nil && *p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*p.Timeout))
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"RUN_ID="+data["run_id"],
+		"ARCHIVE="+data["archive"],
+		"CHECKSUM="+data["checksum"],
+		"STATUS="+data["status"],
+	)
+	cmd.Stdin = stdin
+	// a killed command gives up its standard input instead of waiting for the archive
+	cmd.WaitDelay = 10 * time.Second
+	stderr := &stderrLog{prefix: name}
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	stderr.flush()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("'%s' timed out after %s", args[0], time.Duration(*p.Timeout))
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if stderr.last != "" {
+			return fmt.Errorf("'%s' exited with status %d: %s", args[0], exitErr.ExitCode(), stderr.last)
+		}
+		return fmt.Errorf("'%s' exited with status %d", args[0], exitErr.ExitCode())
+	}
+	return err
+}
+
+// runRetried runs the command until it succeeds, at most Retries times more
+func (p ExecPlugin) runRetried(name string, data map[string]string, stdin func() (io.Reader, error)) error {
+	for attempt := 0; ; attempt++ {
+		r, err := stdin()
+		if err != nil {
+			return err
+		}
+		if err = p.run(name, data, r); err == nil || attempt >= p.Retries {
+			return err
+		}
+		log.Printf("WARNING: exec plugin '%s' failed, running it again (%d/%d): %v", name, attempt+1, p.Retries, err)
+	}
+}
+
+// stderrLog logs the standard error of a command line by line, keeping the last line
+// for the error of a failed command
+type stderrLog struct {
+	prefix string
+	mu     sync.Mutex
+	buf    []byte
+	last   string
+}
+
+func (l *stderrLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.line(string(l.buf[:i]))
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (l *stderrLog) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		l.line(string(l.buf))
+		l.buf = nil
+	}
+}
+
+func (l *stderrLog) line(s string) {
+	if s = strings.TrimRight(s, "\r"); s == "" {
+		return
+	}
+	l.last = s
+	log.Printf("%s: %s", l.prefix, s)
+}
+
+// execUploader hands the archive to the exec plugin named by the host of an
+// exec://<plugin>/<archive name> destination
+type execUploader struct {
+	name    string
+	plugin  ExecPlugin
+	archive string
+}
+
+func newExecUploader(u *url.URL, opts DestinationOptions) (*execUploader, error) {
+	plugin, ok := opts.Plugins[u.Host]
+	if !ok {
+		return nil, fmt.Errorf("exec destination '%s' names no plugin of the configuration", u.String())
+	}
+	archive := path.Base(u.Path)
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return nil, fmt.Errorf("exec destination '%s' must include a file name", u.String())
+	}
+	return &execUploader{name: u.Host, plugin: plugin, archive: archive}, nil
+}
+
+// Probe looks the command up, what it does with an archive is only known to it
+func (e *execUploader) Probe() error {
+	if strings.Contains(e.plugin.Command[0], "{{") {
+		return nil
+	}
+	if _, err := exec.LookPath(e.plugin.Command[0]); err != nil {
+		return fmt.Errorf("exec plugin '%s': %w", e.name, err)
+	}
+	return nil
+}
+
+func (e *execUploader) Upload(r io.Reader) error {
+	data := execData(e.archive, runID, "", "")
+	if e.plugin.Input != execInputPath {
+		used := false
+		return e.plugin.runRetried(e.name, data, func() (io.Reader, error) {
+			// a stream can only be read once, the -local-copy is sent again by -upload-retries
+			if used {
+				return nil, fmt.Errorf("the archive streamed to '%s' cannot be sent again", e.name)
+			}
+			used = true
+			return r, nil
+		})
+	}
+
+	// the -local-copy is passed as it is, a stream is written to a temporary file first
+	f, ok := r.(*os.File)
+	if !ok {
+		tmp, err := os.CreateTemp("", "codepack-exec-*-"+e.archive)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return err
+		}
+		f = tmp
+	}
+	hash := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	data["path"] = f.Name()
+	data["checksum"] = hex.EncodeToString(hash.Sum(nil))
+	return e.plugin.runRetried(e.name, data, func() (io.Reader, error) {
+		return nil, nil
+	})
+}
+
+// execNotifier hands the JSON run report to an exec plugin on its standard input
+type execNotifier struct {
+	plugin ExecPlugin
+}
+
+func (n execNotifier) String() string {
+	return fmt.Sprintf("exec notification to '%s'", n.plugin.Command[0])
+}
+
+func (n execNotifier) Notify(report *runReport, attachment []byte) error {
+	data := execData("", report.RunID, "", report.Status)
+	for _, dest := range report.Destinations {
+		if dest.SHA256 != "" {
+			data["archive"], data["checksum"] = archiveName(dest.URL), dest.SHA256
+			break
+		}
+	}
+	return n.plugin.runRetried("notify", data, func() (io.Reader, error) {
+		return bytes.NewReader(attachment), nil
+	})
+}
+
+func (n execNotifier) Test() error {
+	return n.plugin.run("notify", execData("", runID, "", "TEST"), strings.NewReader("{}\n"))
+}
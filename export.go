@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+const (
+	exportMirror   = "mirror"
+	exportWorktree = "worktree"
+	// exportFastExport archives a git fast-export stream of every ref in place of the mirror
+	exportFastExport = "fast-export"
+	// exportScratch is the staging directory holding the bare clones of exports
+	// and the manifest entries recorded before they are removed, it is never archived
+	exportScratch = ".codepack-export"
+)
+
+// ManifestExport records the commit the files of a worktree export were taken from, or HEAD
+// of the mirror a fast-export stream was written from
+type ManifestExport struct {
+	Mode   string `json:"mode"`
+	Commit string `json:"commit"`
+	// Ref is the branch HEAD pointed at or the pin of a pinned repository
+	Ref string `json:"ref,omitempty"`
+	// Stream is the file name of the fast-export stream in the directory of the repository
+	Stream string `json:"stream,omitempty"`
+	// Caveats are what the fast-export stream does not restore as it was
+	Caveats []string `json:"caveats,omitempty"`
+}
+
+func (repo Repository) exportsWorktree() bool {
+	return repo.Export == exportWorktree
+}
+
+// exported reports whether repo is cloned in to the export scratch directory and archived
+// as something else than its mirror
+func (repo Repository) exported() bool {
+	return repo.Export == exportWorktree || repo.Export == exportFastExport
+}
+
+// restoresStream reports whether e is a fast-export stream the restored mirror is imported from
+func (e *ManifestExport) restoresStream() bool {
+	return e != nil && e.Mode == exportFastExport
+}
+
+// exportScratchFS is where the bare clone of an export of clonePath is made
+func exportScratchFS(staging billy.Filesystem, clonePath string) (billy.Filesystem, error) {
+	return staging.Chroot(path.Join(exportScratch, clonePath))
+}
+
+func exportRecordName(clonePath string) string {
+	return path.Join(exportScratch, clonePath+".json")
+}
+
+// checkoutWorktree checks out the files of HEAD of the bare clone in scratch in to worktree,
+// without a .git directory, and removes the bare clone. Files matching the ignore patterns
+// are left out. The manifest entry of the repository is recorded in staging to be picked up
+// by completeManifest once the bare clone is gone
+func checkoutWorktree(staging billy.Filesystem, clonePath string, scratch billy.Filesystem, worktree billy.Filesystem, repo Repository) error {
+	entry, err := newManifestRepo(repo, scratch, "")
+	if err != nil {
+		return err
+	}
+	storage := filesystem.NewStorage(scratch, cache.NewObjectLRUDefault())
+	r, err := git.Open(storage, worktree)
+	if err != nil {
+		return err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return fmt.Errorf("HEAD: %w", err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := w.Checkout(&git.CheckoutOptions{Hash: head.Hash(), Force: true}); err != nil {
+		return fmt.Errorf("checkout of %s: %w", head.Hash(), err)
+	}
+
+	if entry.Exclusions != nil {
+		if err := removeIgnored(worktree, entry.Exclusions.Patterns); err != nil {
+			return err
+		}
+		entry.Exclusions.Removed = true
+	}
+	entry.Export = &ManifestExport{Mode: exportWorktree, Commit: head.Hash().String(), Ref: entry.Head}
+	if entry.Pin != nil {
+		entry.Export.Ref = entry.Pin.Ref
+	}
+	if head.Name() != plumbing.HEAD && entry.Export.Ref == "" {
+		entry.Export.Ref = head.Name().String()
+	}
+	return recordExport(staging, clonePath, entry)
+}
+
+// streamExport writes a fast-export stream of every ref of the bare clone in scratch in to
+// dir as <name>.fast-export and removes the bare clone, recording the manifest entry like
+// checkoutWorktree
+func streamExport(staging billy.Filesystem, clonePath string, scratch billy.Filesystem, dir billy.Filesystem, repo Repository) error {
+	entry, err := newManifestRepo(repo, scratch, "")
+	if err != nil {
+		return err
+	}
+	storage := filesystem.NewStorage(scratch, cache.NewObjectLRUDefault())
+	name := repo.Name + fastExportExt
+	f, err := dir.Create(name)
+	if err != nil {
+		return err
+	}
+	caveats, err := writeFastExport(storage, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("fast-export: %w", err)
+	}
+	entry.Export = &ManifestExport{Mode: exportFastExport, Commit: entry.Refs[entry.Head], Ref: entry.Head, Stream: name, Caveats: caveats}
+	for _, caveat := range caveats {
+		log.Printf("WARNING: fast-export of %s: %s", repo.URL, caveat)
+	}
+	return recordExport(staging, clonePath, entry)
+}
+
+// recordExport records the manifest entry of the export of clonePath in staging and removes
+// its bare clone
+func recordExport(staging billy.Filesystem, clonePath string, entry ManifestRepo) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFile(staging, exportRecordName(clonePath), data, 0644); err != nil {
+		return err
+	}
+	return removeAll(staging, path.Join(exportScratch, clonePath))
+}
+
+// removeIgnored deletes the files of worktree matching patterns
+func removeIgnored(worktree billy.Filesystem, patterns []string) error {
+	parsed := make([]gitignore.Pattern, len(patterns))
+	for i, p := range patterns {
+		parsed[i] = gitignore.ParsePattern(p, nil)
+	}
+	matcher := gitignore.NewMatcher(parsed)
+	var ignored []string
+	err := util.Walk(worktree, "", func(name string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if matcher.Match(strings.Split(strings.TrimPrefix(name, "/"), "/"), false) {
+			ignored = append(ignored, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range ignored {
+		if err := worktree.Remove(name); err != nil {
+			return err
+		}
+		// directories left empty would still reveal the names of what was removed
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if entries, err := worktree.ReadDir(dir); err != nil || len(entries) > 0 || worktree.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// exportedManifestRepo reads the manifest entry recorded by recordExport
+func exportedManifestRepo(staging billy.Filesystem, clonePath string, repoFS billy.Filesystem, archive string) (ManifestRepo, error) {
+	var entry ManifestRepo
+	data, err := util.ReadFile(staging, exportRecordName(clonePath))
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, err
+	}
+	entry.Archive = archive
+	entry.Size = dirSize(repoFS, "")
+	return entry, nil
+}
+
+// exportOrResume clones repo bare in to the export scratch directory of staging and exports
+// its worktree or fast-export stream to clonePath, unless an interrupted run already
+// exported it
+func exportOrResume(ctx context.Context, staging billy.Filesystem, repo Repository, clonePath string, cacheSize int64, opts CloneOptions) error {
+	if opts.State.Done(clonePath) {
+		log.Printf("Already exported %s to path %s, skipping", repo.URL, clonePath)
+		return nil
+	}
+	scratch, err := exportScratchFS(staging, clonePath)
+	if err != nil {
+		return err
+	}
+	if err := removeAll(staging, path.Join(exportScratch, clonePath)); err != nil {
+		return fmt.Errorf("Cannot remove partial clone at '%s': %w", clonePath, err)
+	}
+	return cloneStaged(staging, clonePath, opts.RepoSizeLimit, func(worktree billy.Filesystem) error {
+		if err := cloneWithRetries(ctx, repo, newSizeLimitFS(scratch, opts.RepoSizeLimit), cacheSize, opts, nil); err != nil {
+			return err
+		}
+		if repo.Export == exportFastExport {
+			log.Printf("Writing the fast-export stream of %s to path %s", repo.URL, clonePath)
+			return streamExport(staging, clonePath, scratch, worktree, repo)
+		}
+		log.Printf("Exporting the worktree of %s to path %s", repo.URL, clonePath)
+		return checkoutWorktree(staging, clonePath, scratch, worktree, repo)
+	})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	nethttp "net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// failureSuffix is the extension of the bundle of a failed repository
+const failureSuffix = ".failure.json"
+
+// maxExchanges is the number of HTTP exchanges a bundle keeps, the last ones of the clone
+const maxExchanges = 50
+
+// failureDebug writes the bundles of -debug-failures, nil unless it is given
+var failureDebug *failureBundles
+
+// failureBundles writes a bundle for every failed repository to a directory of the run
+// below dir
+type failureBundles struct {
+	dir string
+}
+
+// FailureBundle is what is known about the failed clone of a repository, never credentials
+// or response bodies
+type FailureBundle struct {
+	RunID     string         `json:"run_id"`
+	URL       string         `json:"url"`
+	Path      string         `json:"path"`
+	Status    repoStatus     `json:"status"`
+	Category  string         `json:"category"`
+	Error     string         `json:"error"`
+	Chain     []chainedError `json:"chain"`
+	Started   time.Time      `json:"started"`
+	Finished  time.Time      `json:"finished"`
+	Duration  float64        `json:"duration_seconds"`
+	DNS       *dnsLookup     `json:"dns,omitempty"`
+	Exchanges []httpExchange `json:"http_exchanges,omitempty"`
+	// Dropped is the number of earlier exchanges left out of the bundle
+	Dropped int `json:"dropped_exchanges,omitempty"`
+}
+
+// chainedError is an error of the chain errors.Unwrap walks, the outermost first
+type chainedError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// dnsLookup is the lookup of the host of the URL when the bundle is written
+type dnsLookup struct {
+	Host      string   `json:"host"`
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// httpExchange is a request of go-git and the status line and headers of its response
+type httpExchange struct {
+	Method        string              `json:"method"`
+	URL           string              `json:"url"`
+	Started       time.Time           `json:"started"`
+	Duration      float64             `json:"duration_seconds"`
+	DNSAddresses  []string            `json:"dns_addresses,omitempty"`
+	DNSError      string              `json:"dns_error,omitempty"`
+	RemoteAddress string              `json:"remote_address,omitempty"`
+	ConnectError  string              `json:"connect_error,omitempty"`
+	TLSError      string              `json:"tls_error,omitempty"`
+	TLSVersion    string              `json:"tls_version,omitempty"`
+	ReusedConn    bool                `json:"reused_connection,omitempty"`
+	StatusLine    string              `json:"status_line,omitempty"`
+	Header        map[string][]string `json:"response_header,omitempty"`
+	Error         string              `json:"error,omitempty"`
+}
+
+// cloneTrace collects the HTTP exchanges of a clone
+type cloneTrace struct {
+	mu        sync.Mutex
+	exchanges []httpExchange
+	dropped   int
+}
+
+func (t *cloneTrace) add(exchange httpExchange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.exchanges) == maxExchanges {
+		t.exchanges = t.exchanges[1:]
+		t.dropped++
+	}
+	t.exchanges = append(t.exchanges, exchange)
+}
+
+type cloneTraceKey struct{}
+
+// sensitiveHeader matches the names of response headers whose values are left out
+var sensitiveHeader = regexp.MustCompile(`(?i)cookie|authorization|authenticate|token|secret|session|key`)
+
+// openFailureBundles writes the bundles below dir and installs the transport capturing the
+// HTTP exchanges of go-git on top of the one of the hosts
+func openFailureBundles(dir string) (*failureBundles, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create the -debug-failures directory '%s': %w", dir, err)
+	}
+	cloneTransport = &captureTransport{base: cloneTransport}
+	httpClient := githttp.NewClient(&nethttp.Client{Transport: cloneTransport})
+	client.InstallProtocol("https", httpClient)
+	client.InstallProtocol("http", httpClient)
+	return &failureBundles{dir: dir}, nil
+}
+
+// trace gives ctx a trace of the exchanges of a clone. A nil *failureBundles traces nothing
+func (b *failureBundles) trace(ctx context.Context) context.Context {
+	if b == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cloneTraceKey{}, &cloneTrace{})
+}
+
+// write writes the bundle of the failed clone of repo to clonePath, started at started
+// and traced in ctx, and logs where it is. A nil *failureBundles writes nothing
+func (b *failureBundles) write(ctx context.Context, repo Repository, clonePath string, status repoStatus, err error, started time.Time) {
+	if b == nil {
+		return
+	}
+	finished := time.Now()
+	bundle := FailureBundle{
+		RunID:    runID,
+		URL:      bundleURL(repo.URL),
+		Path:     clonePath,
+		Status:   status,
+		Category: classifyCloneError(err),
+		Error:    bundleText(err.Error()),
+		Chain:    errorChain(err),
+		Started:  started.UTC(),
+		Finished: finished.UTC(),
+		Duration: finished.Sub(started).Seconds(),
+		DNS:      lookupRepoHost(repo.URL),
+	}
+	if t, ok := ctx.Value(cloneTraceKey{}).(*cloneTrace); ok {
+		t.mu.Lock()
+		bundle.Exchanges, bundle.Dropped = append([]httpExchange(nil), t.exchanges...), t.dropped
+		t.mu.Unlock()
+	}
+	filename := filepath.Join(b.dir, runID, filepath.FromSlash(clonePath)+failureSuffix)
+	data, jsonErr := json.MarshalIndent(bundle, "", "  ")
+	if jsonErr == nil {
+		jsonErr = os.MkdirAll(filepath.Dir(filename), 0755)
+	}
+	if jsonErr == nil {
+		jsonErr = os.WriteFile(filename, append(data, '\n'), 0644)
+	}
+	if jsonErr != nil {
+		log.Printf("WARNING: cannot write the failure bundle of %s: %v", clonePath, jsonErr)
+		return
+	}
+	log.Printf("Failure bundle of %s: %s", clonePath, filename)
+}
+
+// errorChain lists the errors err wraps, following the first of errors joined together
+func errorChain(err error) []chainedError {
+	var chain []chainedError
+	for err != nil {
+		chain = append(chain, chainedError{Type: fmt.Sprintf("%T", err), Message: bundleText(err.Error())})
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			if errs := joined.Unwrap(); len(errs) > 0 {
+				err = errs[0]
+				continue
+			}
+		}
+		err = errors.Unwrap(err)
+	}
+	return chain
+}
+
+// lookupRepoHost resolves the host of rawURL, nil for a local source
+func lookupRepoHost(rawURL string) *dnsLookup {
+	host := parseRepoURL(rawURL).Host
+	if host == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lookup := &dnsLookup{Host: host}
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		lookup.Error = err.Error()
+	}
+	lookup.Addresses = addresses
+	return lookup
+}
+
+// redactRequestURL is the URL of a request without its user and the values of its query
+// besides the service go-git asks for
+func redactRequestURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redactQuery(&redacted)
+	return redacted.String()
+}
+
+// redactQuery replaces the values of the query of u besides service, they may be tokens
+func redactQuery(u *url.URL) {
+	if u.RawQuery == "" {
+		return
+	}
+	query := u.Query()
+	for name := range query {
+		if name != "service" {
+			query[name] = []string{"REDACTED"}
+		}
+	}
+	u.RawQuery = query.Encode()
+}
+
+// bundleURL is rawURL as sanitizeURL leaves it and without the values of its query
+func bundleURL(rawURL string) string {
+	sanitized := sanitizeURL(rawURL)
+	u, err := url.Parse(sanitized)
+	if err != nil || u.RawQuery == "" {
+		return sanitized
+	}
+	redactQuery(u)
+	return u.String()
+}
+
+// bundleText is text with the URLs in it as bundleURL leaves them
+func bundleText(text string) string {
+	return urlInText.ReplaceAllStringFunc(text, bundleURL)
+}
+
+// redactHeader copies header, the values of headers that may hold credentials replaced
+func redactHeader(header nethttp.Header) map[string][]string {
+	redacted := make(map[string][]string, len(header))
+	for name, values := range header {
+		if sensitiveHeader.MatchString(name) {
+			redacted[name] = []string{"REDACTED"}
+			continue
+		}
+		redacted[name] = append([]string(nil), values...)
+	}
+	return redacted
+}
+
+// captureTransport records the requests of a clone whose context has a trace, with what
+// happened resolving, connecting and the status line and headers of the response. The body
+// of the response is never read
+type captureTransport struct {
+	base nethttp.RoundTripper
+}
+
+func (t *captureTransport) RoundTrip(req *nethttp.Request) (*nethttp.Response, error) {
+	trace, ok := req.Context().Value(cloneTraceKey{}).(*cloneTrace)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	exchange := httpExchange{Method: req.Method, URL: redactRequestURL(req.URL), Started: time.Now().UTC()}
+	var mu sync.Mutex
+	clientTrace := &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, addr := range info.Addrs {
+				exchange.DNSAddresses = append(exchange.DNSAddresses, addr.String())
+			}
+			if info.Err != nil {
+				exchange.DNSError = info.Err.Error()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			exchange.RemoteAddress = addr
+			if err != nil {
+				exchange.ConnectError = err.Error()
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				exchange.TLSError = err.Error()
+			} else {
+				exchange.TLSVersion = tlsVersionName(state.Version)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			exchange.ReusedConn = info.Reused
+			if info.Conn != nil && exchange.RemoteAddress == "" {
+				exchange.RemoteAddress = info.Conn.RemoteAddr().String()
+			}
+		},
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace)))
+	mu.Lock()
+	exchange.Duration = time.Since(exchange.Started).Seconds()
+	if err != nil {
+		exchange.Error = bundleText(err.Error())
+	}
+	if resp != nil {
+		exchange.StatusLine = resp.Proto + " " + resp.Status
+		exchange.Header = redactHeader(resp.Header)
+	}
+	mu.Unlock()
+	trace.add(exchange)
+	return resp, err
+}
+
+// tlsVersionName names a TLS version like TLS 1.3
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
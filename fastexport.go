@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+)
+
+// fastExportExt is the extension of the stream a fast-export export writes in place of the
+// mirror of a repository
+const fastExportExt = ".fast-export"
+
+// fastExporter writes the objects reachable from the references of a repository as a
+// git fast-import stream, like git fast-export --all --signed-tags=verbatim
+type fastExporter struct {
+	s     storer.Storer
+	w     *bufio.Writer
+	marks map[plumbing.Hash]int
+	// caveats are what the stream cannot reproduce, recorded in the manifest
+	caveats []string
+	// signed counts the commits whose signature, merged tags or other headers are dropped
+	signed int
+}
+
+// rawCommit is a commit object split in to the headers fast-import can write and the rest
+type rawCommit struct {
+	tree      plumbing.Hash
+	parents   []plumbing.Hash
+	author    string
+	committer string
+	encoding  string
+	// dropped are the names of the headers fast-import cannot write, like gpgsig
+	dropped []string
+	message []byte
+}
+
+// rawTag is an annotated tag object, its message holding the signature verbatim
+type rawTag struct {
+	object     plumbing.Hash
+	objectType string
+	name       string
+	tagger     string
+	message    []byte
+}
+
+// writeFastExport writes every reference of s with the objects they reach to w and returns
+// the caveats of the stream
+func writeFastExport(s storer.Storer, w io.Writer) ([]string, error) {
+	e := &fastExporter{s: s, w: bufio.NewWriter(w), marks: make(map[plumbing.Hash]int)}
+	refs, err := s.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var names []plumbing.ReferenceName
+	targets := make(map[plumbing.ReferenceName]plumbing.Hash)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || ref.Name() == plumbing.HEAD {
+			return nil
+		}
+		names = append(names, ref.Name())
+		targets[ref.Name()] = ref.Hash()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	var tags []plumbing.ReferenceName
+	rawTags := make(map[plumbing.ReferenceName]*rawTag)
+	heads := make(map[plumbing.ReferenceName]plumbing.Hash)
+	for _, name := range names {
+		switch {
+		case strings.HasPrefix(name.String(), "refs/notes/"):
+			e.caveat("%s is restored as the commits of a notes ref, its notes stay attached only to commits keeping their hash", name)
+		case strings.HasPrefix(name.String(), "refs/replace/"):
+			e.caveat("%s is restored as a plain ref, it replaces its object only while the hash of the object is kept", name)
+		}
+		obj, err := s.EncodedObject(plumbing.AnyObject, targets[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			if err := e.exportCommits(name, obj.Hash()); err != nil {
+				return nil, err
+			}
+			heads[name] = obj.Hash()
+		case plumbing.TagObject:
+			tag, err := e.readTag(obj)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if tag.objectType != "commit" {
+				e.caveat("%s is left out, it tags a %s rather than a commit", name, tag.objectType)
+				continue
+			}
+			if name.String() != "refs/tags/"+tag.name {
+				e.caveat("%s is left out, it points at the tag object named %s", name, tag.name)
+				continue
+			}
+			if err := e.exportCommits(name, tag.object); err != nil {
+				return nil, err
+			}
+			tags = append(tags, name)
+			rawTags[name] = tag
+		default:
+			e.caveat("%s is left out, it points at a %s rather than a commit", name, obj.Type())
+		}
+	}
+
+	for _, name := range names {
+		if hash, ok := heads[name]; ok {
+			fmt.Fprintf(e.w, "reset %s\nfrom :%d\n\n", name, e.marks[hash])
+		}
+	}
+	for _, name := range tags {
+		tag := rawTags[name]
+		fmt.Fprintf(e.w, "tag %s\nfrom :%d\n", tag.name, e.marks[tag.object])
+		if tag.tagger != "" {
+			fmt.Fprintf(e.w, "tagger %s\n", tag.tagger)
+		}
+		e.data(tag.message)
+	}
+	if e.signed > 0 {
+		e.caveat("%d commits lose their signature, merged tag or other headers fast-import cannot write, they and their descendants get new hashes", e.signed)
+	}
+	return e.caveats, e.w.Flush()
+}
+
+func (e *fastExporter) caveat(format string, args ...interface{}) {
+	e.caveats = append(e.caveats, fmt.Sprintf(format, args...))
+}
+
+// exportCommits writes the commits reachable from tip missing from the stream on ref,
+// parents before their children
+func (e *fastExporter) exportCommits(ref plumbing.ReferenceName, tip plumbing.Hash) error {
+	stack := []plumbing.Hash{tip}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		if _, ok := e.marks[hash]; ok {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		commit, err := e.readCommit(hash)
+		if err != nil {
+			return fmt.Errorf("commit %s: %w", hash, err)
+		}
+		missing := false
+		for _, parent := range commit.parents {
+			if _, ok := e.marks[parent]; !ok {
+				stack = append(stack, parent)
+				missing = true
+			}
+		}
+		if missing {
+			continue
+		}
+		stack = stack[:len(stack)-1]
+		if err := e.writeCommit(ref, hash, commit); err != nil {
+			return fmt.Errorf("commit %s: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+func (e *fastExporter) writeCommit(ref plumbing.ReferenceName, hash plumbing.Hash, commit *rawCommit) error {
+	tree, err := object.GetTree(e.s, commit.tree)
+	if err != nil {
+		return err
+	}
+	var parent *object.Tree
+	if len(commit.parents) > 0 {
+		first, err := e.readCommit(commit.parents[0])
+		if err != nil {
+			return err
+		}
+		if parent, err = object.GetTree(e.s, first.tree); err != nil {
+			return err
+		}
+	}
+	changes, err := object.DiffTree(parent, tree)
+	if err != nil {
+		return err
+	}
+	var deleted, modified []string
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return err
+		}
+		if action == merkletrie.Delete {
+			deleted = append(deleted, "D "+quotePath(change.From.Name))
+			continue
+		}
+		entry := change.To.TreeEntry
+		mode := entry.Mode
+		switch mode {
+		case filemode.Submodule:
+			modified = append(modified, fmt.Sprintf("M %o %s %s", mode, entry.Hash, quotePath(change.To.Name)))
+			continue
+		case filemode.Deprecated:
+			mode = filemode.Regular
+		}
+		mark, err := e.exportBlob(entry.Hash)
+		if err != nil {
+			return fmt.Errorf("%s: %w", change.To.Name, err)
+		}
+		modified = append(modified, fmt.Sprintf("M %o :%d %s", mode, mark, quotePath(change.To.Name)))
+	}
+	if len(commit.dropped) > 0 {
+		e.signed++
+	}
+
+	if len(commit.parents) == 0 {
+		fmt.Fprintf(e.w, "reset %s\n", ref)
+	}
+	e.marks[hash] = len(e.marks) + 1
+	fmt.Fprintf(e.w, "commit %s\nmark :%d\nauthor %s\ncommitter %s\n", ref, e.marks[hash], commit.author, commit.committer)
+	if commit.encoding != "" {
+		fmt.Fprintf(e.w, "encoding %s\n", commit.encoding)
+	}
+	e.data(commit.message)
+	for i, p := range commit.parents {
+		command := "merge"
+		if i == 0 {
+			command = "from"
+		}
+		fmt.Fprintf(e.w, "%s :%d\n", command, e.marks[p])
+	}
+	// deletions go first, a file may replace a directory removed by the commit
+	for _, line := range append(deleted, modified...) {
+		fmt.Fprintln(e.w, line)
+	}
+	fmt.Fprintln(e.w)
+	return nil
+}
+
+// exportBlob writes the blob of hash unless the stream holds it already and returns its mark
+func (e *fastExporter) exportBlob(hash plumbing.Hash) (int, error) {
+	if mark, ok := e.marks[hash]; ok {
+		return mark, nil
+	}
+	obj, err := e.s.EncodedObject(plumbing.BlobObject, hash)
+	if err != nil {
+		return 0, err
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	mark := len(e.marks) + 1
+	fmt.Fprintf(e.w, "blob\nmark :%d\ndata %d\n", mark, obj.Size())
+	if _, err := io.Copy(e.w, r); err != nil {
+		return 0, err
+	}
+	fmt.Fprintln(e.w)
+	e.marks[hash] = mark
+	return mark, nil
+}
+
+// data writes the data command holding b
+func (e *fastExporter) data(b []byte) {
+	fmt.Fprintf(e.w, "data %d\n", len(b))
+	e.w.Write(b)
+	fmt.Fprintln(e.w)
+}
+
+func (e *fastExporter) readCommit(hash plumbing.Hash) (*rawCommit, error) {
+	obj, err := e.s.EncodedObject(plumbing.CommitObject, hash)
+	if err != nil {
+		return nil, err
+	}
+	headers, message, err := readRawObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	c := &rawCommit{message: message}
+	for _, h := range headers {
+		switch h[0] {
+		case "tree":
+			c.tree = plumbing.NewHash(h[1])
+		case "parent":
+			c.parents = append(c.parents, plumbing.NewHash(h[1]))
+		case "author":
+			c.author = h[1]
+		case "committer":
+			c.committer = h[1]
+		case "encoding":
+			c.encoding = h[1]
+		default:
+			c.dropped = append(c.dropped, h[0])
+		}
+	}
+	return c, nil
+}
+
+func (e *fastExporter) readTag(obj plumbing.EncodedObject) (*rawTag, error) {
+	headers, message, err := readRawObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	t := &rawTag{message: message}
+	for _, h := range headers {
+		switch h[0] {
+		case "object":
+			t.object = plumbing.NewHash(h[1])
+		case "type":
+			t.objectType = h[1]
+		case "tag":
+			t.name = h[1]
+		case "tagger":
+			t.tagger = h[1]
+		}
+	}
+	return t, nil
+}
+
+// readRawObject splits a commit or tag object in to its headers, a name and value each with
+// the continuation lines of the value joined, and the message following them
+func readRawObject(obj plumbing.EncodedObject) ([][2]string, []byte, error) {
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var headers [][2]string
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' && len(headers) > 0 {
+			headers[len(headers)-1][1] += "\n" + string(line[1:])
+			continue
+		}
+		name, value, _ := strings.Cut(string(line), " ")
+		headers = append(headers, [2]string{name, value})
+	}
+	return headers, data, nil
+}
+
+// quotePath quotes name in the C style of fast-import when it could not be read unquoted
+func quotePath(name string) string {
+	if !strings.HasPrefix(name, `"`) && !strings.ContainsAny(name, "\n\\") {
+		return name
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// importStreams rebuilds a bare mirror from every fast-export stream of m restored to dest
+// with git fast-import, in the directory of the stream which is removed. The mirrors of the
+// other repositories are still imported when one fails and every failure is returned
+func importStreams(m *Manifest, dest string) error {
+	var errs []error
+	done := make(map[string]bool)
+	for _, repo := range m.Repos {
+		if repo.Skipped != "" || !repo.Export.restoresStream() || done[repo.ClonePath()] {
+			continue
+		}
+		done[repo.ClonePath()] = true
+		if _, err := exec.LookPath("git"); err != nil {
+			return fmt.Errorf("Restoring the fast-export stream of %s requires git: %w", repo.ClonePath(), err)
+		}
+		dir := filepath.Join(dest, filepath.FromSlash(repo.ClonePath()))
+		if err := importStream(dir, repo); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", repo.ClonePath(), err))
+			continue
+		}
+		log.Printf("Imported the fast-export stream of %s", repo.ClonePath())
+		for _, caveat := range repo.Export.Caveats {
+			log.Printf("WARNING: %s: %s", repo.ClonePath(), caveat)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Cannot import %d fast-export streams: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// importStream imports the stream of repo in dir in to a new bare repository next to it,
+// then moves the repository in to dir, keeping the repositories nested below it
+func importStream(dir string, repo ManifestRepo) error {
+	stream := filepath.Join(dir, repo.Export.Stream)
+	f, err := os.Open(stream)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".codepack-import-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := runGit(nil, "init", "--quiet", "--bare", tmp); err != nil {
+		return err
+	}
+	if err := runGit(f, "--git-dir", tmp, "fast-import", "--quiet"); err != nil {
+		return err
+	}
+	if _, ok := repo.Refs[repo.Head]; ok {
+		if err := runGit(nil, "--git-dir", tmp, "symbolic-ref", "HEAD", repo.Head); err != nil {
+			return err
+		}
+	}
+	f.Close()
+	if err := os.Remove(stream); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(tmp, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runGit(stdin io.Reader, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Stdin = stdin
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
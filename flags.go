@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parseFlags parses args with flags, or lists the flags for shell completion.
+// Every flag but -version can also be set with an environment variable, see flagEnv, the
+// command line taking precedence over the environment and the environment over the flag default.
+// Booleans accept the values of strconv.ParseBool, like 1, true, 0 or false, and the
+// environment variable of a repeatable flag holds its values separated by commas
+func parseFlags(flags *flag.FlagSet, args []string) {
+	if completing {
+		flags.VisitAll(func(f *flag.Flag) {
+			fmt.Println("-" + f.Name)
+		})
+		os.Exit(0)
+	}
+
+	flags.Parse(args)
+	onCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	var envErr error
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "version" {
+			// CODEPACK_VERSION is commonly set by images to the release they package
+			return
+		}
+		name := flagEnv(flags, f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok || envErr != nil {
+			return
+		}
+		if onCommandLine[f.Name] {
+			log.Printf("Setting -%s from the command line, ignoring %s", f.Name, name)
+			return
+		}
+		values := []string{value}
+		if _, ok := f.Value.(*stringsFlag); ok {
+			if values = splitList(value); len(values) == 0 {
+				return
+			}
+		}
+		for _, v := range values {
+			if err := flags.Set(f.Name, v); err != nil {
+				envErr = fmt.Errorf("Invalid value '%s' of %s for -%s: %w", loggedValue(f.Name, v), name, f.Name, err)
+				return
+			}
+		}
+		log.Printf("Setting -%s=%s from %s", f.Name, loggedValue(f.Name, strings.Join(values, ",")), name)
+	})
+	if envErr != nil {
+		Exit(envErr)
+	}
+}
+
+// secretFlags are the flags whose values are credentials, never logged when they are taken
+// from the environment
+var secretFlags = map[string]bool{
+	"trigger-token": true,
+}
+
+// loggedValue is value of the flag name as it is logged, REDACTED for a secret flag and
+// without the passwords of URLs otherwise
+func loggedValue(name string, value string) string {
+	if secretFlags[name] {
+		return "REDACTED"
+	}
+	values := strings.Split(value, ",")
+	for i := range values {
+		values[i] = sanitizeURL(values[i])
+	}
+	return strings.Join(values, ",")
+}
+
+// splitList splits the comma separated values of a repeatable flag, leaving out empty ones
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// flagEnv is the environment variable of a flag, CODEPACK_ and the flag name in upper case with
+// dashes as underscores, like CODEPACK_WORKERS. Flags of a subcommand add the subcommand, like
+// CODEPACK_CHECK_MANIFEST
+func flagEnv(flags *flag.FlagSet, name string) string {
+	prefix := "CODEPACK_"
+	if flags != flag.CommandLine {
+		prefix += flags.Name() + "_"
+	}
+	return strings.ToUpper(strings.ReplaceAll(prefix+name, "-", "_"))
+}
+
+// stringsFlag is a flag that can be repeated, the first value given replaces the default
+type stringsFlag struct {
+	values []string
+	set    bool
+}
+
+func newStringsFlag(def string) *stringsFlag {
+	return &stringsFlag{values: []string{def}}
+}
+
+func (s *stringsFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(s.values, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	if !s.set {
+		s.values, s.set = nil, true
+	}
+	s.values = append(s.values, value)
+	return nil
+}
+
+// workersFlag is a number of workers or auto for the adaptive concurrency of -workers auto
+type workersFlag struct {
+	n    int
+	auto bool
+}
+
+func (f *workersFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	if f.auto {
+		return "auto"
+	}
+	return strconv.Itoa(f.n)
+}
+
+func (f *workersFlag) Set(value string) error {
+	if value == "auto" {
+		f.auto = true
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("use a number of workers or auto")
+	}
+	f.n, f.auto = n, false
+	return nil
+}
+
+// optionalPathFlag is a flag given alone to write a file at its default path, or with
+// =<path> to write it at path. As a boolean flag it also accepts the values of strconv.ParseBool
+type optionalPathFlag struct {
+	path string
+	set  bool
+}
+
+func (f *optionalPathFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	if f.path == "" {
+		return "true"
+	}
+	return f.path
+}
+
+func (f *optionalPathFlag) Set(value string) error {
+	if b, err := strconv.ParseBool(value); err == nil {
+		f.path, f.set = "", b
+		return nil
+	}
+	f.path, f.set = value, true
+	return nil
+}
+
+func (f *optionalPathFlag) IsBoolFlag() bool {
+	return true
+}
+
+// pathOr is the path of the flag, or def when it was given without one
+func (f *optionalPathFlag) pathOr(def string) string {
+	if f.path == "" {
+		return def
+	}
+	return f.path
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+// gcsUploader streams the archive to a gs://bucket/object destination using
+// the application default credentials, STORAGE_EMULATOR_HOST is honored
+type gcsUploader struct {
+	bucket       string
+	object       string
+	storageClass string
+	chunkSize    int
+	contentType  string
+	// attrs are the attributes of the uploaded object
+	attrs *storage.ObjectAttrs
+	// chunkRetries is the number of times UploadFile sends a chunk again
+	chunkRetries int
+}
+
+func newGCSUploader(u *url.URL, opts DestinationOptions) (*gcsUploader, error) {
+	object := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || object == "" {
+		return nil, fmt.Errorf("gcs destination must be gs://bucket/object, got '%s'", u.String())
+	}
+	return &gcsUploader{
+		bucket:       u.Host,
+		object:       object,
+		storageClass: opts.StorageClass,
+		chunkSize:    opts.ChunkSize,
+		contentType:  opts.archiveFormat().contentType,
+		chunkRetries: opts.ChunkRetries,
+	}, nil
+}
+
+func (g *gcsUploader) Upload(r io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("Cannot create gcs client: %w", err)
+	}
+	defer client.Close()
+
+	w := client.Bucket(g.bucket).Object(g.object).NewWriter(ctx)
+	w.ContentType = g.contentType
+	w.StorageClass = g.storageClass
+	if g.chunkSize > 0 {
+		w.ChunkSize = g.chunkSize
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		// Cancelling before Close aborts the upload instead of finalizing a partial object
+		cancel()
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	g.attrs = w.Attrs()
+	return nil
+}
+
+// Probe checks that the credentials may create objects in the bucket, an emulator is
+// only asked for the bucket
+func (g *gcsUploader) Probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("Cannot create gcs client: %w", err)
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(g.bucket)
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		if _, err := bucket.Attrs(ctx); err != nil {
+			return fmt.Errorf("Cannot access bucket '%s': %w", g.bucket, err)
+		}
+		return nil
+	}
+	granted, err := bucket.IAM().TestPermissions(ctx, []string{"storage.objects.create"})
+	if err != nil {
+		return fmt.Errorf("Cannot access bucket '%s': %w", g.bucket, err)
+	}
+	if len(granted) == 0 {
+		return fmt.Errorf("No permission to create objects in bucket '%s'", g.bucket)
+	}
+	return nil
+}
+
+// gcsHTTPClient returns the JSON API endpoint and a client authorized with the application
+// default credentials, or the unauthenticated STORAGE_EMULATOR_HOST
+func gcsHTTPClient(ctx context.Context) (string, *nethttp.Client, error) {
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return strings.TrimSuffix(host, "/"), nethttp.DefaultClient, nil
+	}
+	client, err := google.DefaultClient(ctx, storage.ScopeReadWrite)
+	if err != nil {
+		return "", nil, fmt.Errorf("Cannot create gcs client: %w", err)
+	}
+	return "https://storage.googleapis.com", client, nil
+}
+
+// gcsObject are the attributes of an object in a JSON API response
+type gcsObject struct {
+	Size    string `json:"size"`
+	CRC32C  string `json:"crc32c"`
+	MD5Hash string `json:"md5Hash"`
+}
+
+func (o gcsObject) attrs() (*storage.ObjectAttrs, error) {
+	size, err := strconv.ParseInt(o.Size, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("gcs returned an invalid size '%s'", o.Size)
+	}
+	attrs := &storage.ObjectAttrs{Size: size}
+	if crc, err := base64.StdEncoding.DecodeString(o.CRC32C); err == nil && len(crc) == 4 {
+		attrs.CRC32C = binary.BigEndian.Uint32(crc)
+	}
+	attrs.MD5, _ = base64.StdEncoding.DecodeString(o.MD5Hash)
+	return attrs, nil
+}
+
+// UploadFile sends f through a resumable upload session recorded in state, in chunks of
+// the chunk size of state. A session of state that is still open continues from the bytes
+// it persisted, gcs only accepts the chunks of a session in order
+func (g *gcsUploader) UploadFile(f *os.File, state *uploadState) error {
+	ctx := runContext
+	endpoint, client, err := gcsHTTPClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	if state.Session != "" {
+		persisted, err := g.sessionStatus(ctx, client, state.Session, state.Size)
+		switch {
+		case err != nil:
+			log.Printf("WARNING: cannot continue the upload session of '%s', starting the upload over: %v", g.object, err)
+			state.Session = ""
+		case persisted == state.Size:
+			return nil
+		default:
+			log.Printf("Upload session of '%s' holds %d of %d bytes, sending the rest", g.object, persisted, state.Size)
+			offset = persisted
+		}
+	}
+	if state.Session == "" {
+		session, err := g.startSession(ctx, endpoint, client, state.Size)
+		if err != nil {
+			return err
+		}
+		if err := state.setSession(session); err != nil {
+			return err
+		}
+	}
+
+	for offset < state.Size {
+		length := state.ChunkSize
+		if state.Size-offset < length {
+			length = state.Size - offset
+		}
+		err := retryChunk(g.chunkRetries, fmt.Sprintf("bytes %d-%d", offset, offset+length-1), func() error {
+			next, err := g.putChunk(ctx, client, state.Session, io.NewSectionReader(f, offset, length), offset, length, state.Size)
+			if err != nil {
+				// the session may have persisted part of the chunk, the retry sends the rest
+				if persisted, statusErr := g.sessionStatus(ctx, client, state.Session, state.Size); statusErr == nil {
+					offset = persisted
+				}
+				return err
+			}
+			offset = next
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSession opens a resumable upload session of size bytes and returns its URI
+func (g *gcsUploader) startSession(ctx context.Context, endpoint string, client *nethttp.Client, size int64) (string, error) {
+	metadata, err := json.Marshal(map[string]string{"contentType": g.contentType, "storageClass": g.storageClass})
+	if err != nil {
+		return "", err
+	}
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s", endpoint, url.PathEscape(g.bucket), url.QueryEscape(g.object))
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodPost, u, bytes.NewReader(metadata))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", g.contentType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Cannot start the upload session: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK || resp.Header.Get("Location") == "" {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("Cannot start the upload session: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+// putChunk sends length bytes of body at offset of the upload and returns the number
+// of bytes the session persisted, the attributes of the object are kept once it is complete
+func (g *gcsUploader) putChunk(ctx context.Context, client *nethttp.Client, session string, body io.Reader, offset int64, length int64, size int64) (int64, error) {
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodPut, session, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return g.sessionResponse(resp, size)
+}
+
+// sessionStatus asks the session how many bytes of the upload it persisted
+func (g *gcsUploader) sessionStatus(ctx context.Context, client *nethttp.Client, session string, size int64) (int64, error) {
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodPut, session, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return g.sessionResponse(resp, size)
+}
+
+// sessionResponse reads the bytes persisted from a 308 of the session, or the object once
+// a 200 or 201 completed the upload
+func (g *gcsUploader) sessionResponse(resp *nethttp.Response, size int64) (int64, error) {
+	switch resp.StatusCode {
+	case nethttp.StatusPermanentRedirect:
+		// Range is bytes=0-<last byte persisted>, missing when nothing is persisted yet
+		r := resp.Header.Get("Range")
+		if r == "" {
+			return 0, nil
+		}
+		last, err := strconv.ParseInt(r[strings.LastIndex(r, "-")+1:], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("gcs returned an invalid range '%s'", r)
+		}
+		return last + 1, nil
+	case nethttp.StatusOK, nethttp.StatusCreated:
+		var object gcsObject
+		if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+			return 0, fmt.Errorf("gcs returned an invalid object: %w", err)
+		}
+		attrs, err := object.attrs()
+		if err != nil {
+			return 0, err
+		}
+		g.attrs = attrs
+		return size, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// cancelGCSSession ends an abandoned upload session, gcs answers 499 once it is cancelled
+func cancelGCSSession(session string) {
+	ctx := context.Background()
+	_, client, err := gcsHTTPClient(ctx)
+	if err != nil {
+		return
+	}
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodDelete, session, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Verify compares the size, CRC32C and MD5 gcs computed for the object with the ones
+// uploaded, the MD5 is missing for composite objects
+func (g *gcsUploader) Verify(d *streamDigest) (string, error) {
+	if g.attrs == nil {
+		return "", fmt.Errorf("gcs returned no attributes of the object")
+	}
+	if err := d.checkSize(g.attrs.Size); err != nil {
+		return "", err
+	}
+	if g.attrs.CRC32C != d.CRC32C() {
+		return "", fmt.Errorf("gcs reports CRC32C %08x, %08x was uploaded", g.attrs.CRC32C, d.CRC32C())
+	}
+	if err := d.checkMD5(g.attrs.MD5); err != nil {
+		return "", err
+	}
+	if len(g.attrs.MD5) == 0 {
+		return "size and CRC32C match", nil
+	}
+	return "size, CRC32C and MD5 match", nil
+}
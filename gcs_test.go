@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGCS emulates the parts of the JSON API of fake-gcs-server the gs:// destination
+// talks to: multipart and resumable uploads and the attributes of a bucket. An object only
+// exists once its last byte was received
+type fakeGCS struct {
+	mu       sync.Mutex
+	buckets  map[string]bool
+	objects  map[string]fakeGCSObject
+	sessions map[string]*fakeGCSSession
+	// chunks counts the PUT requests sending bytes to a session
+	chunks int
+}
+
+type fakeGCSObject struct {
+	data         []byte
+	contentType  string
+	storageClass string
+}
+
+type fakeGCSSession struct {
+	bucket   string
+	metadata map[string]string
+	data     []byte
+}
+
+func newFakeGCS(t *testing.T, buckets ...string) *fakeGCS {
+	t.Helper()
+	f := &fakeGCS{buckets: map[string]bool{}, objects: map[string]fakeGCSObject{}, sessions: map[string]*fakeGCSSession{}}
+	for _, bucket := range buckets {
+		f.buckets[bucket] = true
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	return f
+}
+
+func (f *fakeGCS) object(bucket string, name string) (fakeGCSObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[bucket+"/"+name]
+	return o, ok
+}
+
+func (f *fakeGCS) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/") && r.Method == nethttp.MethodPost:
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		if !f.buckets[bucket] {
+			nethttp.Error(w, "bucket not found", nethttp.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("uploadType") {
+		case "multipart":
+			f.multipart(w, r, bucket)
+		case "resumable":
+			metadata := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&metadata)
+			if name := r.URL.Query().Get("name"); name != "" {
+				metadata["name"] = name
+			}
+			id := strconv.Itoa(len(f.sessions) + 1)
+			f.sessions[id] = &fakeGCSSession{bucket: bucket, metadata: metadata}
+			w.Header().Set("Location", fmt.Sprintf("http://%s/upload/session/%s", r.Host, id))
+			w.WriteHeader(nethttp.StatusOK)
+		default:
+			nethttp.Error(w, "unsupported upload", nethttp.StatusBadRequest)
+		}
+	case strings.HasPrefix(r.URL.Path, "/upload/session/") && (r.Method == nethttp.MethodPut || r.Method == nethttp.MethodPost):
+		// the go client sends its chunks with POST, the resumable upload of UploadFile with PUT
+		f.putChunk(w, r, strings.TrimPrefix(r.URL.Path, "/upload/session/"))
+	case strings.HasPrefix(r.URL.Path, "/upload/session/") && r.Method == nethttp.MethodDelete:
+		delete(f.sessions, strings.TrimPrefix(r.URL.Path, "/upload/session/"))
+		w.WriteHeader(499)
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/") && r.Method == nethttp.MethodGet:
+		bucket := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/")
+		if !f.buckets[bucket] {
+			nethttp.Error(w, `{"error":{"code":404,"message":"bucket not found"}}`, nethttp.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"kind": "storage#bucket", "name": bucket})
+	default:
+		nethttp.Error(w, "unexpected request", nethttp.StatusNotImplemented)
+	}
+}
+
+func (f *fakeGCS) multipart(w nethttp.ResponseWriter, r *nethttp.Request, bucket string) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	part, err := parts.NextPart()
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	metadata := map[string]string{}
+	if err := json.NewDecoder(part).Decode(&metadata); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	part, err = parts.NextPart()
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(part)
+	if err != nil {
+		// an aborted request creates no object
+		return
+	}
+	f.finish(w, bucket, metadata, data)
+}
+
+func (f *fakeGCS) putChunk(w nethttp.ResponseWriter, r *nethttp.Request, id string) {
+	session, ok := f.sessions[id]
+	if !ok {
+		nethttp.Error(w, "no such session", nethttp.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	// Content-Range is bytes first-last/total, bytes */total to query or with * for an unknown total
+	first, total, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/")
+	if first != "*" {
+		f.chunks++
+		start, _ := strconv.Atoi(first[:strings.Index(first, "-")])
+		if start != len(session.data) {
+			nethttp.Error(w, "chunk out of order", nethttp.StatusBadRequest)
+			return
+		}
+		session.data = append(session.data, data...)
+	}
+	if total != "*" {
+		if size, _ := strconv.Atoi(total); size == len(session.data) {
+			delete(f.sessions, id)
+			f.finish(w, session.bucket, session.metadata, session.data)
+			return
+		}
+	}
+	if len(session.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+	}
+	if r.Header.Get("X-GUploader-No-308") == "yes" {
+		// the go client asks for a 200 marked as 308, a 308 is a redirect to net/http
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		w.WriteHeader(nethttp.StatusOK)
+		return
+	}
+	w.WriteHeader(nethttp.StatusPermanentRedirect)
+}
+
+func (f *fakeGCS) finish(w nethttp.ResponseWriter, bucket string, metadata map[string]string, data []byte) {
+	f.objects[bucket+"/"+metadata["name"]] = fakeGCSObject{data: data, contentType: metadata["contentType"], storageClass: metadata["storageClass"]}
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	sum := md5.Sum(data)
+	json.NewEncoder(w).Encode(map[string]string{
+		"kind":         "storage#object",
+		"bucket":       bucket,
+		"name":         metadata["name"],
+		"size":         strconv.Itoa(len(data)),
+		"contentType":  metadata["contentType"],
+		"storageClass": metadata["storageClass"],
+		"crc32c":       base64.StdEncoding.EncodeToString(crc),
+		"md5Hash":      base64.StdEncoding.EncodeToString(sum[:]),
+	})
+}
+
+// failingReader returns the bytes of data and then err, like an archive failing half way
+type failingReader struct {
+	data *bytes.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func testArchive(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+func testGCSUploader(t *testing.T, target string, opts DestinationOptions) *gcsUploader {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newGCSUploader(u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGCSUpload(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		size      int
+		chunkSize int
+	}{
+		{name: "single request", size: 100 * 1024},
+		{name: "chunked", size: 700 * 1024, chunkSize: 256 * 1024},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeGCS(t, "backups")
+			g := testGCSUploader(t, "gs://backups/nightly/codepack.tar.gz", DestinationOptions{StorageClass: "COLDLINE", ChunkSize: tc.chunkSize})
+			data := testArchive(tc.size)
+			if err := g.Upload(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			o, ok := fake.object("backups", "nightly/codepack.tar.gz")
+			if !ok {
+				t.Fatal("no object was created")
+			}
+			if !bytes.Equal(o.data, data) {
+				t.Errorf("object holds %d bytes, %d were uploaded", len(o.data), len(data))
+			}
+			if o.storageClass != "COLDLINE" || o.contentType != "application/gzip" {
+				t.Errorf("object has storage class %q and content type %q", o.storageClass, o.contentType)
+			}
+			if tc.chunkSize > 0 && fake.chunks < 3 {
+				t.Errorf("upload was sent in %d chunks, expected 3", fake.chunks)
+			}
+			if g.attrs == nil || g.attrs.Size != int64(len(data)) {
+				t.Errorf("attributes of the object are %+v", g.attrs)
+			}
+		})
+	}
+}
+
+func TestGCSUploadFailureLeavesNoObject(t *testing.T) {
+	for _, chunkSize := range []int{0, 256 * 1024} {
+		t.Run(fmt.Sprintf("chunk size %d", chunkSize), func(t *testing.T) {
+			fake := newFakeGCS(t, "backups")
+			g := testGCSUploader(t, "gs://backups/codepack.tar.gz", DestinationOptions{ChunkSize: chunkSize})
+			archiveErr := errors.New("archive failed")
+			err := g.Upload(&failingReader{data: bytes.NewReader(testArchive(600 * 1024)), err: archiveErr})
+			if !errors.Is(err, archiveErr) {
+				t.Fatalf("Upload returned %v, expected the error of the archive", err)
+			}
+			if _, ok := fake.object("backups", "codepack.tar.gz"); ok {
+				t.Error("a truncated object was finalized")
+			}
+		})
+	}
+}
+
+func TestGCSUploaderURL(t *testing.T) {
+	for _, target := range []string{"gs://backups", "gs://backups/", "gs:///object"} {
+		u, _ := url.Parse(target)
+		if _, err := newGCSUploader(u, DestinationOptions{}); err == nil {
+			t.Errorf("%s was accepted", target)
+		}
+	}
+	uploader, err := newUploader("gs://backups/a/b.tar.gz", DestinationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, ok := uploader.(*gcsUploader)
+	if !ok || g.bucket != "backups" || g.object != "a/b.tar.gz" {
+		t.Errorf("gs:// selected %#v", uploader)
+	}
+}
+
+func TestGCSProbe(t *testing.T) {
+	newFakeGCS(t, "backups")
+	if err := testGCSUploader(t, "gs://backups/codepack.tar.gz", DestinationOptions{}).Probe(); err != nil {
+		t.Errorf("Probe of an existing bucket failed: %v", err)
+	}
+	if err := testGCSUploader(t, "gs://missing/codepack.tar.gz", DestinationOptions{}).Probe(); err == nil {
+		t.Error("Probe of a missing bucket succeeded")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const flavorGerrit = "gerrit"
+
+// gerritRefPrefixes hold the review history of a Gerrit project, they are never excluded
+var gerritRefPrefixes = []string{"refs/changes/", "refs/notes/"}
+
+// gerritPushRefSpecs push the branches, tags and review history of a Gerrit mirror namespace
+// by namespace, leaving out refs/meta/config which holds the access rights of the source server
+var gerritPushRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+	"+refs/notes/*:refs/notes/*",
+	"+refs/changes/*:refs/changes/*",
+}
+
+func isGerritRef(name string) bool {
+	for _, prefix := range gerritRefPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// gerritAuthURLs rewrites the http URLs of Gerrit repositories cloned with credentials to the
+// authenticated /a/ endpoint, Gerrit only accepts HTTP credentials below it
+func gerritAuthURLs(cfg *Config, auth *http.BasicAuth) {
+	for i, repo := range cfg.Repos {
+		if repo.Flavor != flavorGerrit || repoAuth(repo, CloneOptions{Auth: auth}) == nil {
+			continue
+		}
+		u, err := url.Parse(repo.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || strings.HasPrefix(u.Path, "/a/") {
+			continue
+		}
+		u.Path = "/a" + u.Path
+		log.Printf("Using the authenticated Gerrit URL %s for %s", sanitizeURL(u.String()), sanitizeURL(repo.URL))
+		cfg.Repos[i].URL = u.String()
+	}
+}
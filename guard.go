@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// exitCodeBackupGuard is the exit status of a run refused by the backup guard, so monitoring
+// can tell a backup that was never written apart from one that failed
+const exitCodeBackupGuard = 3
+
+// exitCodeError ends the process with code instead of the failure status when passed to Exit
+type exitCodeError struct {
+	err  error
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// backupGuard refuses to write an archive holding fewer repositories than expected,
+// like one left empty by a configuration mistake
+type backupGuard struct {
+	// FailOnEmpty requires at least one repository
+	FailOnEmpty bool
+	// MinRepos is the number of repositories required
+	MinRepos int
+	// MinFraction is the fraction of the configured repositories required, disabled ones included
+	MinFraction float64
+}
+
+// guardResult is the outcome of the backup guard recorded in the run report
+type guardResult struct {
+	Repos      int    `json:"repos"`
+	Configured int    `json:"configured"`
+	Minimum    int    `json:"minimum"`
+	Passed     bool   `json:"passed"`
+	Rule       string `json:"rule"`
+}
+
+// check compares the repos of the backup with the configured number of repositories,
+// it returns nil when no guard is set
+func (g backupGuard) check(repos int, configured int) *guardResult {
+	result := &guardResult{Repos: repos, Configured: configured}
+	var rules []string
+	require := func(minimum int, rule string) {
+		rules = append(rules, rule)
+		if minimum > result.Minimum {
+			result.Minimum = minimum
+			result.Rule = rule
+		}
+	}
+	if g.FailOnEmpty {
+		require(1, "-fail-on-empty-backup")
+	}
+	if g.MinRepos > 0 {
+		require(g.MinRepos, fmt.Sprintf("-min-repos %d", g.MinRepos))
+	}
+	if g.MinFraction > 0 {
+		require(int(math.Ceil(g.MinFraction*float64(configured))), fmt.Sprintf("-min-repos-fraction %g", g.MinFraction))
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	if result.Rule == "" {
+		result.Rule = strings.Join(rules, ", ")
+	}
+	result.Passed = repos >= result.Minimum
+	return result
+}
+
+func (r *guardResult) String() string {
+	outcome := "passed"
+	if !r.Passed {
+		outcome = "failed"
+	}
+	return fmt.Sprintf("%d of %d configured repositories, at least %d required by %s, %s", r.Repos, r.Configured, r.Minimum, r.Rule, outcome)
+}
+
+// err is the error a run refused by the guard exits with, nil when it passed
+func (r *guardResult) err() error {
+	if r == nil || r.Passed {
+		return nil
+	}
+	return &exitCodeError{
+		err:  fmt.Errorf("Refusing to write the backup: it holds %d of %d configured repositories, at least %d are required by %s", r.Repos, r.Configured, r.Minimum, r.Rule),
+		code: exitCodeBackupGuard,
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+const (
+	// headUnborn is a HEAD pointing at a branch the mirror does not have, usually the
+	// default branch of a remote that was deleted
+	headUnborn = "unborn"
+	// headDangling is a HEAD detached from any branch or pointing at a commit the mirror
+	// does not hold
+	headDangling = "dangling"
+)
+
+// checkHead records the HeadState of entry when HEAD does not name a branch of the mirror
+// holding a commit, clearing Head so nothing reads a branch that is not there, and suggests
+// the most recently updated branch instead. Empty and pinned repositories are left alone,
+// an empty one has no branch to point at and pin_only detaches HEAD on purpose
+func checkHead(s storage.Storer, entry *ManifestRepo) {
+	if len(entry.Refs) == 0 || entry.Pin != nil {
+		return
+	}
+	head, err := s.Reference(plumbing.HEAD)
+	switch {
+	case err != nil:
+		entry.HeadState = headUnborn
+	case head.Type() == plumbing.SymbolicReference:
+		hash, ok := entry.Refs[head.Target().String()]
+		if !ok {
+			entry.HeadState = headUnborn
+		} else if _, err := s.EncodedObject(plumbing.CommitObject, plumbing.NewHash(hash)); err != nil {
+			entry.HeadState = headDangling
+		}
+	default:
+		entry.HeadState = headDangling
+	}
+	if entry.HeadState == "" {
+		return
+	}
+	entry.Head = ""
+	entry.SuggestedHead = latestBranch(s, entry.Refs)
+	log.Printf("WARNING: HEAD of %s is %s, recording it without a head, suggested head %s", entry.URL, entry.HeadState, suggestedHeadName(entry.SuggestedHead))
+}
+
+// hasReferences reports whether s holds any reference besides HEAD
+func hasReferences(s storage.Storer) bool {
+	refs, err := s.IterReferences()
+	if err != nil {
+		return false
+	}
+	defer refs.Close()
+	found := errors.New("found")
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			return found
+		}
+		return nil
+	}) == found
+}
+
+// latestBranch returns the branch of refs whose commit was committed last, the first by
+// name of those committed at the same time, empty when no branch has a commit in s
+func latestBranch(s storage.Storer, refs map[string]string) string {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		if plumbing.ReferenceName(name).IsBranch() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var latest string
+	var latestCommit *object.Commit
+	for _, name := range names {
+		commit, err := object.GetCommit(s, plumbing.NewHash(refs[name]))
+		if err != nil {
+			continue
+		}
+		if latestCommit == nil || commit.Committer.When.After(latestCommit.Committer.When) {
+			latest, latestCommit = name, commit
+		}
+	}
+	return latest
+}
+
+func suggestedHeadName(branch string) string {
+	if branch == "" {
+		return "none, it has no branches"
+	}
+	return branch
+}
+
+// needsAttention describes every repository whose HEAD was unborn or dangling
+func (r *runReport) needsAttention() []string {
+	var lines []string
+	for _, entry := range r.Repos {
+		if entry.HeadState == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s to path %s: HEAD is %s, suggested head %s", entry.URL, entry.Path, entry.HeadState, suggestedHeadName(entry.SuggestedHead)))
+	}
+	return lines
+}
+
+// checkoutRestored checks out a working copy of every mirror of m restored to dest in to
+// the same path below dir, with the mirror as its origin and the remotes of -add-remote. A
+// repository whose HEAD was unborn or dangling gets its suggested head and is skipped with a
+// warning without one. A path already existing below dir is never checked out over, the
+// other repositories are still checked out and every failure is returned
+func checkoutRestored(m *Manifest, dest string, dir string, remotes []remoteSpec, force bool) error {
+	var errs []error
+	done := make(map[string]bool)
+	for _, repo := range m.Repos {
+		if repo.Skipped != "" || done[repo.ClonePath()] {
+			continue
+		}
+		done[repo.ClonePath()] = true
+		if repo.Export != nil && !repo.Export.restoresStream() {
+			log.Printf("Not checking out %s, it was exported as a worktree already", repo.ClonePath())
+			continue
+		}
+		branch := repo.Head
+		if repo.HeadState != "" {
+			branch = repo.SuggestedHead
+			if branch != "" {
+				log.Printf("WARNING: HEAD of %s is %s, checking out its suggested head %s", repo.ClonePath(), repo.HeadState, branch)
+			}
+		}
+		if _, ok := repo.Refs[branch]; !ok || !plumbing.ReferenceName(branch).IsBranch() {
+			log.Printf("WARNING: Not checking out %s, HEAD names no branch of the mirror", repo.ClonePath())
+			continue
+		}
+		mirror, err := filepath.Abs(filepath.Join(dest, filepath.FromSlash(repo.ClonePath())))
+		if err != nil {
+			return err
+		}
+		worktree := filepath.Join(dir, filepath.FromSlash(repo.ClonePath()))
+		if _, err := os.Lstat(worktree); !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("%s: '%s' exists already", repo.ClonePath(), worktree))
+			continue
+		}
+		created := firstMissingDir(worktree)
+		_, err = git.PlainClone(worktree, false, &git.CloneOptions{URL: mirror, ReferenceName: plumbing.ReferenceName(branch)})
+		if err != nil {
+			os.RemoveAll(created)
+			errs = append(errs, fmt.Errorf("%s: %w", repo.ClonePath(), err))
+			continue
+		}
+		log.Printf("Checked out %s of %s to '%s'", strings.TrimPrefix(branch, "refs/heads/"), repo.ClonePath(), worktree)
+		if len(remotes) > 0 {
+			if err := addRepoRemotes(worktree, repo, remotes, force); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", repo.ClonePath(), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Cannot check out %d repositories: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// firstMissingDir is the outermost directory of the missing parents of name, name itself
+// when its parent exists, the one to remove to undo creating name and its parents
+func firstMissingDir(name string) string {
+	for {
+		parent := filepath.Dir(name)
+		if parent == name {
+			return name
+		}
+		if _, err := os.Lstat(parent); err == nil {
+			return name
+		}
+		name = parent
+	}
+}
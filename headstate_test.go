@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestCheckoutRestored(t *testing.T) {
+	dir := t.TempDir()
+	source := newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	head, err := source.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "restored")
+	if _, err := git.PlainClone(filepath.Join(dest, "team", "app"), true, &git.CloneOptions{URL: filepath.Join(dir, "src"), Mirror: true}); err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]string{"refs/heads/main": head.Hash().String()}
+	repo := func(p string, name string) ManifestRepo {
+		return ManifestRepo{Name: name, Path: p, Head: "refs/heads/main", Refs: refs}
+	}
+	remotes, err := parseRemoteSpecs([]string{"upstream=https://new.example.com/{{ .path }}/{{ .name }}.git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		repo    ManifestRepo
+		prepare func(worktrees string)
+		check   func(t *testing.T, worktrees string, err error)
+	}{
+		{
+			name: "checked out with the remotes",
+			repo: repo("team", "app"),
+			check: func(t *testing.T, worktrees string, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				clone, err := git.PlainOpen(filepath.Join(worktrees, "team", "app"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				upstream, err := clone.Remote("upstream")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if url := upstream.Config().URLs[0]; url != "https://new.example.com/team/app.git" {
+					t.Errorf("upstream is %s", url)
+				}
+				if _, err := os.Stat(filepath.Join(worktrees, "team", "app", "README.md")); err != nil {
+					t.Error("README.md was not checked out")
+				}
+			},
+		},
+		{
+			name: "existing path kept",
+			repo: repo("team", "app"),
+			prepare: func(worktrees string) {
+				os.MkdirAll(filepath.Join(worktrees, "team", "app"), 0755)
+				os.WriteFile(filepath.Join(worktrees, "team", "app", "notes.txt"), []byte("mine\n"), 0644)
+			},
+			check: func(t *testing.T, worktrees string, err error) {
+				if err == nil || !strings.Contains(err.Error(), "exists already") {
+					t.Errorf("expected the existing path to fail, got %v", err)
+				}
+				if data, err := os.ReadFile(filepath.Join(worktrees, "team", "app", "notes.txt")); err != nil || string(data) != "mine\n" {
+					t.Error("the existing directory was changed")
+				}
+			},
+		},
+		{
+			name: "failed clone removes only what it created",
+			repo: repo("other/deep", "gone"),
+			check: func(t *testing.T, worktrees string, err error) {
+				if err == nil {
+					t.Fatal("expected the clone of a missing mirror to fail")
+				}
+				if _, err := os.Stat(filepath.Join(worktrees, "other")); !os.IsNotExist(err) {
+					t.Error("the directories of the failed clone were left behind")
+				}
+				if _, err := os.Stat(worktrees); err != nil {
+					t.Error("the checkout directory was removed")
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			worktrees := filepath.Join(t.TempDir(), "worktrees")
+			if err := os.Mkdir(worktrees, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tc.prepare != nil {
+				tc.prepare(worktrees)
+			}
+			err := checkoutRestored(&Manifest{Repos: []ManifestRepo{tc.repo}}, dest, worktrees, remotes, false)
+			tc.check(t, worktrees, err)
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// maxLargeBlobs is the number of large blobs listed for a repository, the largest ones
+const maxLargeBlobs = 20
+
+// errHealthBudget stops the analysis of a repository that took longer than -health-budget
+var errHealthBudget = errors.New("health budget exceeded")
+
+// healthOptions configure the analysis of -health-report
+type healthOptions struct {
+	// LargeBlob is the size in bytes above which a blob is reported
+	LargeBlob int64
+	// StaleMonths is the age in months, of 30 days, of the last commit above which a branch is stale
+	StaleMonths int
+	// Budget is the time the analysis of a single repository may take
+	Budget time.Duration
+	// CacheSize is the size in bytes of the object cache used while reading the repository
+	CacheSize int64
+
+	mu      sync.Mutex
+	entries []healthReportEntry
+}
+
+// repoHealth is the hygiene of a repository found by -health-report, to decide what to
+// prune or migrate to LFS
+type repoHealth struct {
+	// Size is the size in bytes of the object store, the whole history
+	Size     int64 `json:"size"`
+	Refs     int   `json:"refs"`
+	Branches int   `json:"branches"`
+	// StaleBranches are the branches whose last commit is older than -health-stale-months
+	StaleBranches []string `json:"stale_branches,omitempty"`
+	// LargeBlobs counts the blobs above -health-large-blob, the largest are listed in LargeBlobList
+	LargeBlobs    int          `json:"large_blobs"`
+	LargeBlobList []healthBlob `json:"large_blob_list,omitempty"`
+	Duration      string       `json:"duration"`
+	// Incomplete is set when the analysis stopped at -health-budget, the counts cover what was read until then
+	Incomplete string `json:"incomplete,omitempty"`
+}
+
+type healthBlob struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// healthReport is the JSON file written by -health-report
+type healthReport struct {
+	RunID       string              `json:"run_id"`
+	LargeBlob   int64               `json:"large_blob"`
+	StaleMonths int                 `json:"stale_months"`
+	Repos       []healthReportEntry `json:"repos"`
+}
+
+type healthReportEntry struct {
+	URL    string      `json:"url"`
+	Path   string      `json:"path"`
+	Health *repoHealth `json:"health"`
+}
+
+// analyze reads the bare repository in repoFS without writing to it, stopping once Budget is spent
+func (o *healthOptions) analyze(repoFS billy.Filesystem) (*repoHealth, error) {
+	start := time.Now()
+	deadline := start.Add(o.Budget)
+	health := &repoHealth{Size: dirSize(repoFS, "objects")}
+	storage := filesystem.NewStorage(repoFS, cache.NewObjectLRU(cache.FileSize(o.CacheSize)))
+	defer storage.Close()
+
+	err := o.analyzeRefs(storage, health, deadline)
+	if err == nil {
+		err = o.analyzeBlobs(storage, health, deadline)
+	}
+	health.Duration = time.Since(start).Round(time.Millisecond).String()
+	if errors.Is(err, errHealthBudget) {
+		health.Incomplete = fmt.Sprintf("stopped after the -health-budget of %s", o.Budget)
+		return health, nil
+	}
+	return health, err
+}
+
+func (o *healthOptions) analyzeRefs(storage *filesystem.Storage, health *repoHealth, deadline time.Time) error {
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return err
+	}
+	stale := time.Now().Add(-time.Duration(o.StaleMonths) * 30 * 24 * time.Hour)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		health.Refs++
+		if !ref.Name().IsBranch() {
+			return nil
+		}
+		health.Branches++
+		if time.Now().After(deadline) {
+			return errHealthBudget
+		}
+		commit, err := object.GetCommit(storage, ref.Hash())
+		if err != nil {
+			// a branch pointing at another kind of object has no age
+			return nil
+		}
+		if commit.Committer.When.Before(stale) {
+			health.StaleBranches = append(health.StaleBranches, ref.Name().Short())
+		}
+		return nil
+	})
+	sort.Strings(health.StaleBranches)
+	return err
+}
+
+func (o *healthOptions) analyzeBlobs(storage *filesystem.Storage, health *repoHealth, deadline time.Time) error {
+	blobs, err := storage.IterEncodedObjects(plumbing.BlobObject)
+	if err != nil {
+		return err
+	}
+	defer blobs.Close()
+	for {
+		if time.Now().After(deadline) {
+			return errHealthBudget
+		}
+		blob, err := blobs.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if blob.Size() <= o.LargeBlob {
+			continue
+		}
+		health.LargeBlobs++
+		health.LargeBlobList = append(health.LargeBlobList, healthBlob{Hash: blob.Hash().String(), Size: blob.Size()})
+		sort.Slice(health.LargeBlobList, func(i, j int) bool { return health.LargeBlobList[i].Size > health.LargeBlobList[j].Size })
+		if len(health.LargeBlobList) > maxLargeBlobs {
+			health.LargeBlobList = health.LargeBlobList[:maxLargeBlobs]
+		}
+	}
+}
+
+// record analyzes the clone of repo at clonePath and adds it to o and report, failures
+// to analyze are logged and never fail the run. A nil *healthOptions analyzes nothing
+func (o *healthOptions) record(repo Repository, clonePath string, repoFS billy.Filesystem, report *runReport) {
+	if o == nil || repo.exported() {
+		return
+	}
+	health, err := o.analyze(repoFS)
+	if err != nil {
+		log.Printf("WARNING: cannot analyze the health of %s: %v", clonePath, err)
+		return
+	}
+	if health.Incomplete != "" {
+		log.Printf("Health of %s is incomplete, %s", clonePath, health.Incomplete)
+	}
+	if health.LargeBlobs > 0 || len(health.StaleBranches) > 0 {
+		log.Printf("Health of %s: %d blobs above %s, %d of %d branches stale", clonePath, health.LargeBlobs, formatBytes(o.LargeBlob), len(health.StaleBranches), health.Branches)
+	}
+	o.mu.Lock()
+	o.entries = append(o.entries, healthReportEntry{URL: sanitizeURL(repo.URL), Path: clonePath, Health: health})
+	o.mu.Unlock()
+	report.RecordHealth(clonePath, health)
+}
+
+// WriteFile writes the health of every analyzed repository to filename as JSON
+func (o *healthOptions) WriteFile(filename string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	sort.Slice(o.entries, func(i, j int) bool { return o.entries[i].Path < o.entries[j].Path })
+	data, err := json.MarshalIndent(healthReport{RunID: runID, LargeBlob: o.LargeBlob, StaleMonths: o.StaleMonths, Repos: o.entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// failOnIncomplete is no status of a repository but the key -fail-on-incomplete sets in a
+// failOnPolicy, failing the run when a repository was cloned with an incomplete history
+const failOnIncomplete repoStatus = "incomplete"
+
+// checkHistory records entry as incomplete when a commit of the mirror has a parent it does
+// not hold, or the mirror lists shallow commits, as left by cloning a shallow mirror which
+// go-git does without an error. The commits at the boundary are recorded as ShallowCommits.
+// A repository cloned with a depth is shallow on purpose and is not checked
+func checkHistory(s storage.Storer, repo Repository, entry *ManifestRepo) {
+	if repo.depth() > 0 {
+		return
+	}
+	boundary := make(map[plumbing.Hash]bool)
+	shallow, err := s.Shallow()
+	if err != nil {
+		log.Printf("WARNING: cannot read the shallow commits of %s: %v", entry.URL, err)
+		return
+	}
+	for _, hash := range shallow {
+		boundary[hash] = true
+	}
+	commits, err := s.IterEncodedObjects(plumbing.CommitObject)
+	if err != nil {
+		log.Printf("WARNING: cannot check the history of %s: %v", entry.URL, err)
+		return
+	}
+	err = commits.ForEach(func(obj plumbing.EncodedObject) error {
+		commit, err := object.DecodeCommit(s, obj)
+		if err != nil {
+			return err
+		}
+		for _, parent := range commit.ParentHashes {
+			if s.HasEncodedObject(parent) != nil {
+				boundary[commit.Hash] = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("WARNING: cannot check the history of %s: %v", entry.URL, err)
+		return
+	}
+	if len(boundary) == 0 {
+		return
+	}
+	complete := false
+	entry.Complete = &complete
+	for hash := range boundary {
+		entry.ShallowCommits = append(entry.ShallowCommits, hash.String())
+	}
+	sort.Strings(entry.ShallowCommits)
+	log.Printf("WARNING: %s has an incomplete history, the parents of %d commits are missing from the remote", entry.URL, len(boundary))
+}
+
+// incompleteHistory describes every repository cloned with an incomplete history
+func (r *runReport) incompleteHistory() []string {
+	var lines []string
+	for _, entry := range r.Repos {
+		if !entry.Incomplete {
+			continue
+		}
+		var commits []string
+		for i, hash := range entry.ShallowCommits {
+			if i == 3 {
+				commits = append(commits, "...")
+				break
+			}
+			commits = append(commits, shortHash(hash))
+		}
+		lines = append(lines, fmt.Sprintf("%s to path %s: %d shallow commits (%s)", entry.URL, entry.Path, len(entry.ShallowCommits), strings.Join(commits, ", ")))
+	}
+	return lines
+}
+
+// incompleteCount counts the repositories of the report cloned with an incomplete history
+func (r *runReport) incompleteCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.incompleteHistory())
+}
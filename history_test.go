@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// newShallowRemote writes a bare repository at dir holding only the last commit of a
+// history of three, like a mirror cloned with git clone --depth 1. With shallow set the
+// commit is listed in its shallow file, otherwise only its parent is missing
+func newShallowRemote(t *testing.T, dir string, shallow bool) plumbing.Hash {
+	t.Helper()
+	src := newTestRepo(t, t.TempDir(), [2]string{"README.md", "one\n"}, [2]string{"README.md", "two\n"}, [2]string{"README.md", "three\n"})
+	head, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := src.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := []plumbing.Hash{commit.Hash, tree.Hash}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		hashes = append(hashes, f.Hash)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := git.PlainInit(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range hashes {
+		obj, err := src.Storer.EncodedObject(plumbing.AnyObject, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := remote.Storer.SetEncodedObject(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	main := plumbing.NewBranchReferenceName("main")
+	if err := remote.Storer.SetReference(plumbing.NewHashReference(main, commit.Hash)); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, main)); err != nil {
+		t.Fatal(err)
+	}
+	if shallow {
+		if err := remote.Storer.SetShallow([]plumbing.Hash{commit.Hash}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return commit.Hash
+}
+
+func TestCheckHistory(t *testing.T) {
+	depth := 1
+	for _, tc := range []struct {
+		name    string
+		storer  func(t *testing.T) (storage.Storer, plumbing.Hash)
+		repo    Repository
+		shallow bool
+	}{
+		{
+			name: "complete",
+			storer: func(t *testing.T) (storage.Storer, plumbing.Hash) {
+				return newTestRepo(t, t.TempDir(), [2]string{"README.md", "one\n"}, [2]string{"README.md", "two\n"}).Storer, plumbing.ZeroHash
+			},
+		},
+		{
+			name: "shallow file",
+			storer: func(t *testing.T) (storage.Storer, plumbing.Hash) {
+				dir := t.TempDir()
+				hash := newShallowRemote(t, dir, true)
+				repo, err := git.PlainOpen(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return repo.Storer, hash
+			},
+			shallow: true,
+		},
+		{
+			name: "missing parent",
+			storer: func(t *testing.T) (storage.Storer, plumbing.Hash) {
+				dir := t.TempDir()
+				hash := newShallowRemote(t, dir, false)
+				repo, err := git.PlainOpen(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return repo.Storer, hash
+			},
+			shallow: true,
+		},
+		{
+			name: "cloned with a depth",
+			storer: func(t *testing.T) (storage.Storer, plumbing.Hash) {
+				dir := t.TempDir()
+				newShallowRemote(t, dir, true)
+				repo, err := git.PlainOpen(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return repo.Storer, plumbing.ZeroHash
+			},
+			repo: Repository{Depth: &depth},
+		},
+	} {
+		s, hash := tc.storer(t)
+		entry := ManifestRepo{URL: "https://example.com/team/app.git"}
+		checkHistory(s, tc.repo, &entry)
+		if !tc.shallow {
+			if entry.Complete != nil || entry.ShallowCommits != nil {
+				t.Errorf("%s: recorded as incomplete at %v", tc.name, entry.ShallowCommits)
+			}
+			continue
+		}
+		if entry.Complete == nil || *entry.Complete || !reflect.DeepEqual(entry.ShallowCommits, []string{hash.String()}) {
+			t.Errorf("%s: complete %v at %v, expected incomplete at %s", tc.name, entry.Complete, entry.ShallowCommits, hash)
+		}
+	}
+}
+
+func TestIncompleteHistory(t *testing.T) {
+	report := &runReport{Repos: []runReportEntry{
+		{URL: "https://example.com/team/app.git", Path: "team/app", Incomplete: true, ShallowCommits: []string{
+			"1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222",
+			"3333333333333333333333333333333333333333", "4444444444444444444444444444444444444444",
+		}},
+		{URL: "https://example.com/team/lib.git", Path: "team/lib"},
+	}}
+	expected := []string{"https://example.com/team/app.git to path team/app: 4 shallow commits (111111111111, 222222222222, 333333333333, ...)"}
+	if lines := report.incompleteHistory(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("incomplete history %q, expected %q", lines, expected)
+	}
+	if n := report.incompleteCount(); n != 1 {
+		t.Errorf("%d incomplete repositories, expected 1", n)
+	}
+}
+
+func TestShallowRemoteRun(t *testing.T) {
+	dir := t.TempDir()
+	hash := newShallowRemote(t, filepath.Join(dir, "src"), true)
+	config := "repos:\n  - name: app\n    path: team\n    url: " + filepath.Join(dir, "src") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "warns"},
+		{name: "fail-on-incomplete", args: []string{"-fail-on-incomplete"}, code: exitCodeFailOn},
+	} {
+		args := append([]string{"-config", "codepack.yaml", "-out", "backup.tar.gz", "-no-catalog"}, tc.args...)
+		out, code := runCodePack(t, dir, nil, args...)
+		if code != tc.code {
+			t.Fatalf("%s: exited with %d, expected %d:\n%s", tc.name, code, tc.code, out)
+		}
+		if !strings.Contains(out, "has an incomplete history") {
+			t.Errorf("%s: no warning of the incomplete history in:\n%s", tc.name, out)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "backup.tar.gz.manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Repos) != 1 {
+			t.Fatalf("%s: manifest lists %d repositories", tc.name, len(manifest.Repos))
+		}
+		repo := manifest.Repos[0]
+		if repo.Complete == nil || *repo.Complete || !reflect.DeepEqual(repo.ShallowCommits, []string{hash.String()}) {
+			t.Errorf("%s: manifest records complete %v at %v, expected incomplete at %s", tc.name, repo.Complete, repo.ShallowCommits, hash)
+		}
+	}
+}
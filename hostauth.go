@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// policies of host_auth_unmatched for a repository on a host of host_auth no entry matches
+const (
+	hostAuthWarn   = "warn"
+	hostAuthGlobal = "global"
+	hostAuthFail   = "fail"
+)
+
+// hostAuthKey is a key of host_auth split in to its host, with or without a port, and the
+// path elements of its prefix
+type hostAuthKey struct {
+	key    string
+	host   string
+	prefix []string
+}
+
+// parseHostAuthKey splits a key like gitlab.example.com or gitlab.example.com/platform,
+// hosts and paths are matched without regard to case
+func parseHostAuthKey(key string) (hostAuthKey, error) {
+	host, prefix, _ := strings.Cut(strings.ToLower(key), "/")
+	if host == "" || strings.ContainsAny(host, "@ ") || strings.Contains(key, "://") {
+		return hostAuthKey{}, fmt.Errorf("Invalid host_auth key '%s', use a host and an optional path prefix like gitlab.example.com/platform", key)
+	}
+	k := hostAuthKey{key: key, host: host}
+	prefix = strings.TrimSuffix(strings.Trim(prefix, "/"), ".git")
+	if prefix != "" {
+		k.prefix = strings.Split(prefix, "/")
+	}
+	for _, element := range k.prefix {
+		if element == "" || element == "." || element == ".." {
+			return hostAuthKey{}, fmt.Errorf("Invalid path prefix of host_auth key '%s'", key)
+		}
+	}
+	return k, nil
+}
+
+// matches reports whether the key matches the host, port and path elements of a URL,
+// the prefix matching whole elements so platform does not match platform-tools
+func (k hostAuthKey) matches(host string, port string, elements []string) bool {
+	if k.host != host && k.host != host+":"+port {
+		return false
+	}
+	if len(k.prefix) > len(elements) {
+		return false
+	}
+	for i, element := range k.prefix {
+		if element != elements[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hostAuthMatch is the host_auth entry of a repository, the longest prefix matching its URL
+// and of keys of the same length the one naming the port. Mapped is set when the host of
+// the URL has entries, also when none of them matches
+func hostAuthMatch(keys []hostAuthKey, rawURL string) (key hostAuthKey, found bool, mapped bool) {
+	fields := parseRepoURL(rawURL)
+	if fields.Host == "" {
+		return hostAuthKey{}, false, false
+	}
+	host := strings.ToLower(fields.Host)
+	var elements []string
+	for _, element := range strings.Split(strings.ToLower(strings.Trim(fields.Owner+"/"+fields.Name, "/")), "/") {
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	for _, k := range keys {
+		if k.host == host || strings.HasPrefix(k.host, host+":") {
+			mapped = true
+		}
+		if !k.matches(host, fields.Port, elements) {
+			continue
+		}
+		if !found || len(k.prefix) > len(key.prefix) || len(k.prefix) == len(key.prefix) && strings.Contains(k.host, ":") {
+			key, found = k, true
+		}
+	}
+	return key, found, mapped
+}
+
+// hostAuthEntries are the parsed entries of host_auth, nil without any
+type hostAuthEntries struct {
+	keys   []hostAuthKey
+	auth   map[string]RepoAuth
+	policy string
+}
+
+// hostAuthEntries parses and checks host_auth and host_auth_unmatched
+func (config *Config) hostAuthEntries() (*hostAuthEntries, error) {
+	if len(config.HostAuth) == 0 {
+		return nil, nil
+	}
+	h := &hostAuthEntries{auth: config.HostAuth, policy: config.HostAuthUnmatched}
+	if h.policy == "" {
+		h.policy = hostAuthWarn
+	}
+	if h.policy != hostAuthWarn && h.policy != hostAuthGlobal && h.policy != hostAuthFail {
+		return nil, fmt.Errorf("Invalid host_auth_unmatched '%s', use warn, global or fail", h.policy)
+	}
+	for key, auth := range config.HostAuth {
+		k, err := parseHostAuthKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if auth.UsernameEnv == "" || auth.PasswordEnv == "" {
+			return nil, fmt.Errorf("The host_auth entry '%s' needs username_env and password_env", key)
+		}
+		h.keys = append(h.keys, k)
+	}
+	// the same match whatever the order of the map
+	sort.Slice(h.keys, func(i, j int) bool { return h.keys[i].key < h.keys[j].key })
+	return h, nil
+}
+
+// apply gives repo the credentials of its entry unless it sets auth itself, before defaults
+// apply. Only http and https URLs take basic credentials, ssh is left to the agent. A
+// repository on a mapped host no entry matches is cloned with the default or global
+// credentials, logged with a warning unless host_auth_unmatched is global, or fails the
+// configuration with fail. Nil entries change nothing
+func (h *hostAuthEntries) apply(repo *Repository) error {
+	if h == nil || repo.Auth != nil {
+		return nil
+	}
+	if u, err := url.Parse(repo.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	key, found, mapped := hostAuthMatch(h.keys, repo.URL)
+	switch {
+	case found:
+		auth := h.auth[key.key]
+		repo.Auth, repo.HostAuth = &auth, key.key
+	case mapped && h.policy == hostAuthFail:
+		return fmt.Errorf("No host_auth entry matches repository '%s' on a host with entries", sanitizeURL(repo.URL))
+	case mapped:
+		repo.HostAuthUnmatched = true
+		if h.policy == hostAuthWarn {
+			log.Printf("WARNING: no host_auth entry matches %s, it is cloned with the default credentials", sanitizeURL(repo.URL))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// hostMetadataName is the file written to the root of a mirror with include_host_metadata
+const hostMetadataName = "host-metadata.json"
+
+// HostMetadata are the project settings of a repository kept by its git host rather than in git
+type HostMetadata struct {
+	Host          string   `json:"host"`
+	Description   string   `json:"description,omitempty"`
+	Topics        []string `json:"topics,omitempty"`
+	DefaultBranch string   `json:"default_branch,omitempty"`
+	Visibility    string   `json:"visibility,omitempty"`
+	// Protection is the branch protection of the default branch as returned by the host API
+	Protection json.RawMessage `json:"protection,omitempty"`
+}
+
+// hostAPI identifies the API of the git host of repoURL, github or gitlab, from the
+// host_type of the repository or the host name
+func hostAPI(repo Repository, u *url.URL) string {
+	if repo.HostType != "" {
+		return repo.HostType
+	}
+	switch {
+	case u.Hostname() == "github.com":
+		return "github"
+	case strings.Contains(u.Hostname(), "gitlab"):
+		return "gitlab"
+	}
+	return ""
+}
+
+// fetchHostMetadata queries the GitHub or GitLab API for the project settings of repo,
+// the password of auth is used as the API token
+func fetchHostMetadata(ctx context.Context, repo Repository, auth *http.BasicAuth) (*HostMetadata, error) {
+	u, err := url.Parse(repo.URL)
+	if err != nil {
+		return nil, err
+	}
+	token := ""
+	if auth != nil {
+		token = auth.Password
+	}
+	bearer := ""
+	if token != "" {
+		bearer = "Bearer " + token
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	switch api := hostAPI(repo, u); api {
+	case "github":
+		base := githubAPIBase(u)
+		var project struct {
+			Description   string   `json:"description"`
+			Topics        []string `json:"topics"`
+			DefaultBranch string   `json:"default_branch"`
+			Visibility    string   `json:"visibility"`
+		}
+		if err := getJSON(ctx, base+"/repos/"+projectPath(u), "Authorization", bearer, &project); err != nil {
+			return nil, err
+		}
+		meta := &HostMetadata{Host: api, Description: project.Description, Topics: project.Topics,
+			DefaultBranch: project.DefaultBranch, Visibility: project.Visibility}
+		// Reading protection rules needs admin rights, the rest of the metadata is kept without them
+		var protection json.RawMessage
+		if err := getJSON(ctx, base+"/repos/"+projectPath(u)+"/branches/"+url.PathEscape(project.DefaultBranch)+"/protection", "Authorization", bearer, &protection); err == nil {
+			meta.Protection = protection
+		}
+		return meta, nil
+	case "gitlab":
+		base := gitlabProjectAPI(u)
+		var project struct {
+			Description   string   `json:"description"`
+			Topics        []string `json:"topics"`
+			DefaultBranch string   `json:"default_branch"`
+			Visibility    string   `json:"visibility"`
+		}
+		if err := getJSON(ctx, base, "PRIVATE-TOKEN", token, &project); err != nil {
+			return nil, err
+		}
+		meta := &HostMetadata{Host: api, Description: project.Description, Topics: project.Topics,
+			DefaultBranch: project.DefaultBranch, Visibility: project.Visibility}
+		var protection json.RawMessage
+		if err := getJSON(ctx, base+"/protected_branches/"+url.PathEscape(project.DefaultBranch), "PRIVATE-TOKEN", token, &protection); err == nil {
+			meta.Protection = protection
+		}
+		return meta, nil
+	default:
+		return nil, fmt.Errorf("unknown git host '%s', set host_type to github or gitlab", u.Host)
+	}
+}
+
+// githubAPIBase is the REST API of github.com or of the GitHub Enterprise server of u
+func githubAPIBase(u *url.URL) string {
+	if u.Hostname() != "github.com" {
+		return fmt.Sprintf("https://%s/api/v3", u.Host)
+	}
+	return "https://api.github.com"
+}
+
+// gitlabProjectAPI is the REST API endpoint of the GitLab project of u
+func gitlabProjectAPI(u *url.URL) string {
+	return fmt.Sprintf("%s://%s/api/v4/projects/%s", u.Scheme, u.Host, url.PathEscape(projectPath(u)))
+}
+
+// projectPath is the namespace and name of the project of a repository URL
+func projectPath(u *url.URL) string {
+	return strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+}
+
+// getJSON decodes the response to a GET of endpoint in to v, header is only sent when value is set
+func getJSON(ctx context.Context, endpoint string, header string, value string, v any) error {
+	return requestJSON(ctx, nethttp.MethodGet, endpoint, header, value, nil, v)
+}
+
+// apiError is a host API response with an unexpected status
+type apiError struct {
+	method     string
+	endpoint   string
+	StatusCode int
+	Status     string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.endpoint, e.Status)
+}
+
+// requestJSON sends body encoded as JSON when it is not nil and decodes a successful
+// response in to v when it is not nil. A request refused by a rate limit of the host is
+// sent again after the wait the host asks for, see hostRateLimits
+func requestJSON(ctx context.Context, method string, endpoint string, header string, value string, body any, v any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := nethttp.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if err := apiRateLimits.wait(ctx, req.URL.Host); err != nil {
+			return err
+		}
+		resp, err := nethttp.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		apiRateLimits.observe(req.URL.Host, resp.Header)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			wait, limited := rateLimitWait(resp, attempt)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if !limited || attempt == rateLimitRetries {
+				return &apiError{method: method, endpoint: endpoint, StatusCode: resp.StatusCode, Status: resp.Status}
+			}
+			log.Printf("Rate limited by %s, sending %s %s again in %s", req.URL.Host, method, endpoint, wait.Round(time.Second))
+			apiRateLimits.waited(req.URL.Host, wait)
+			if err := sleepContext(ctx, wait); err != nil {
+				return err
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if v == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+}
+
+// writeHostMetadata stores the host metadata of repo in the root of its mirror,
+// failures are logged as warnings since the git data is complete without it
+func writeHostMetadata(ctx context.Context, repo Repository, fs billy.Filesystem, opts CloneOptions) {
+	meta, err := fetchHostMetadata(ctx, repo, repoAuth(repo, opts))
+	if err != nil {
+		log.Printf("WARNING: cannot read host metadata of %s: %v", repo.URL, err)
+		return
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err == nil {
+		err = util.WriteFile(fs, hostMetadataName, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		log.Printf("WARNING: cannot write host metadata of %s: %v", repo.URL, err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultPorts are the ports a repository URL leaves out, a host is named without them
+var defaultPorts = map[string]string{"ssh": "22", "git+ssh": "22", "https": "443", "http": "80", "git": "9418"}
+
+// repoHost is the lower case host of a repository URL for grouping repositories, with the port
+// unless it is the default of the scheme. scp-like URLs like git@host:path are the host of ssh,
+// local paths and file:// URLs are "local"
+func repoHost(rawURL string) string {
+	if strings.Contains(rawURL, "://") {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" {
+			return "local"
+		}
+		host := strings.ToLower(u.Hostname())
+		if port := u.Port(); port != "" && port != defaultPorts[strings.ToLower(u.Scheme)] {
+			return net.JoinHostPort(host, port)
+		}
+		return host
+	}
+	// a colon before any slash makes an scp-like URL, a Windows drive letter a local path
+	before, _, ok := strings.Cut(rawURL, ":")
+	if !ok || strings.Contains(before, "/") || len(before) == 1 {
+		return "local"
+	}
+	if _, host, found := strings.Cut(before, "@"); found {
+		before = host
+	}
+	return strings.ToLower(strings.Trim(before, "[]"))
+}
+
+// hostStats aggregates the repositories of a run by the host of their URL
+type hostStats struct {
+	Host   string `json:"host"`
+	Repos  int    `json:"repos"`
+	Failed int    `json:"failed"`
+	// Failures counts the failed repositories by category, see classifyCloneError
+	Failures map[string]int `json:"failures,omitempty"`
+	Bytes    int64          `json:"bytes"`
+	// AvgCloneSeconds is the average time of the clones of the run that took any time
+	AvgCloneSeconds float64 `json:"avg_clone_seconds"`
+	// RateLimitWaits are the waits for a rate limit of the API of the host, see hostRateLimits
+	RateLimitWaits       int     `json:"rate_limit_waits,omitempty"`
+	RateLimitWaitSeconds float64 `json:"rate_limit_wait_seconds,omitempty"`
+}
+
+// hostStatistics aggregates entries by repoHost, with the rate limit waits of the API of each
+// host, largest host first
+func hostStatistics(entries []runReportEntry, waits map[string]rateLimitWaits) []hostStats {
+	byHost := make(map[string]*hostStats)
+	cloneSeconds := make(map[string]float64)
+	clones := make(map[string]int)
+	var hosts []string
+	for _, entry := range entries {
+		host := repoHost(entry.URL)
+		stats := byHost[host]
+		if stats == nil {
+			stats = &hostStats{Host: host}
+			byHost[host] = stats
+			hosts = append(hosts, host)
+		}
+		stats.Repos++
+		stats.Bytes += entry.Size
+		if entry.Error != "" {
+			stats.Failed++
+			if stats.Failures == nil {
+				stats.Failures = make(map[string]int)
+			}
+			stats.Failures[entry.Category]++
+		}
+		if entry.CloneSeconds > 0 {
+			cloneSeconds[host] += entry.CloneSeconds
+			clones[host]++
+		}
+	}
+	sort.SliceStable(hosts, func(i, j int) bool { return byHost[hosts[i]].Repos > byHost[hosts[j]].Repos })
+
+	result := make([]hostStats, len(hosts))
+	for i, host := range hosts {
+		stats := byHost[host]
+		if clones[host] > 0 {
+			stats.AvgCloneSeconds = cloneSeconds[host] / float64(clones[host])
+		}
+		// GitHub answers its API on api.github.com, GitLab and GitHub Enterprise on the host itself
+		for _, api := range []string{host, "api." + host} {
+			stats.RateLimitWaits += waits[api].Count
+			stats.RateLimitWaitSeconds += waits[api].Duration.Seconds()
+		}
+		result[i] = *stats
+	}
+	return result
+}
+
+// String is the line of the host in the summary, like
+// "github.com: 12 repos, 1.2 GiB, clones 3.4s on average, 2 failed (1 auth, 1 network), 3 rate limit waits for 1m20s"
+func (s hostStats) String() string {
+	line := fmt.Sprintf("%s: %d repos, %s, clones %s on average", s.Host, s.Repos, formatBytes(s.Bytes),
+		(time.Duration(s.AvgCloneSeconds * float64(time.Second))).Round(time.Millisecond))
+	if s.Failed > 0 {
+		categories := make([]string, 0, len(s.Failures))
+		for category := range s.Failures {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+		for i, category := range categories {
+			categories[i] = fmt.Sprintf("%d %s", s.Failures[category], category)
+		}
+		line += fmt.Sprintf(", %d failed (%s)", s.Failed, strings.Join(categories, ", "))
+	}
+	if s.RateLimitWaits > 0 {
+		line += fmt.Sprintf(", %d rate limit waits for %s", s.RateLimitWaits,
+			(time.Duration(s.RateLimitWaitSeconds * float64(time.Second))).Round(time.Second))
+	}
+	return line
+}
+
+// hostStats aggregates the repositories of the report by host
+func (r *runReport) hostStats() []hostStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return hostStatistics(r.Repos, apiRateLimits.waitsByHost())
+}
+
+// LogHosts logs the line of every host of the report, a nil *runReport logs nothing
+func (r *runReport) LogHosts() {
+	if r == nil {
+		return
+	}
+	for _, stats := range r.hostStats() {
+		log.Println("Host", stats)
+	}
+}
+
+// WriteHostMetrics writes the host statistics of the report to filename in the Prometheus
+// text format, for the textfile collector of the node exporter. The file is renamed over
+// the previous one so the collector never reads a partial file
+func (r *runReport) WriteHostMetrics(filename string) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(r.hostMetrics()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// hostMetrics are the host statistics of the report in the Prometheus text format
+func (r *runReport) hostMetrics() string {
+	var b strings.Builder
+	metric := func(name string, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	stats := r.hostStats()
+	// the tags label tells the metrics of runs of different -tags apart
+	labels := func(host string) string {
+		if len(r.Tags) == 0 {
+			return fmt.Sprintf("host=%q", host)
+		}
+		return fmt.Sprintf("host=%q,tags=%q", host, tagSelection{Tags: r.Tags, All: r.TagsAll}.Label())
+	}
+	metric("codepack_run_info", "ID and CodePack version of the last run.")
+	fmt.Fprintf(&b, "codepack_run_info{run_id=%q,version=%q} 1\n", r.RunID, r.CodePackVersion)
+	metric("codepack_host_repositories", "Repositories of the last run by host.")
+	for _, s := range stats {
+		fmt.Fprintf(&b, "codepack_host_repositories{%s} %d\n", labels(s.Host), s.Repos)
+	}
+	metric("codepack_host_failures", "Failed repositories of the last run by host and category.")
+	for _, s := range stats {
+		for category, n := range s.Failures {
+			fmt.Fprintf(&b, "codepack_host_failures{%s,category=%q} %d\n", labels(s.Host), category, n)
+		}
+	}
+	metric("codepack_host_bytes", "Bytes of the object stores of the repositories of the last run by host.")
+	for _, s := range stats {
+		fmt.Fprintf(&b, "codepack_host_bytes{%s} %d\n", labels(s.Host), s.Bytes)
+	}
+	metric("codepack_host_clone_seconds_avg", "Average clone duration of the last run by host.")
+	for _, s := range stats {
+		fmt.Fprintf(&b, "codepack_host_clone_seconds_avg{%s} %g\n", labels(s.Host), s.AvgCloneSeconds)
+	}
+	metric("codepack_host_rate_limit_waits", "Waits for an API rate limit of the last run by host.")
+	for _, s := range stats {
+		fmt.Fprintf(&b, "codepack_host_rate_limit_waits{%s} %d\n", labels(s.Host), s.RateLimitWaits)
+	}
+	metric("codepack_host_rate_limit_wait_seconds", "Time waited for API rate limits of the last run by host.")
+	for _, s := range stats {
+		fmt.Fprintf(&b, "codepack_host_rate_limit_wait_seconds{%s} %g\n", labels(s.Host), s.RateLimitWaitSeconds)
+	}
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	nethttp "net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// protocolV0 is the only version of the git wire protocol go-git speaks
+const protocolV0 = "v0"
+
+// HostTransport overrides how go-git talks to a host over http and https, for servers or
+// proxies that need it. The host is matched against the host of the URL with or without
+// its port
+type HostTransport struct {
+	// Protocol pins the git wire protocol, v0 keeps the Git-Protocol header from being sent
+	Protocol string `yaml:"protocol" json:"protocol" toml:"protocol"`
+	// DisableHTTP2 talks HTTP/1.1 to the host, for proxies breaking HTTP/2
+	DisableHTTP2 bool `yaml:"disable_http2" json:"disable_http2" toml:"disable_http2"`
+	// ExtraHeaders are sent with every request to the host
+	ExtraHeaders map[string]string `yaml:"extra_headers" json:"extra_headers" toml:"extra_headers"`
+	// ExtraHeadersEnv are headers sent with the value of an environment variable, for tokens
+	ExtraHeadersEnv map[string]string `yaml:"extra_headers_env" json:"extra_headers_env" toml:"extra_headers_env"`
+}
+
+func (h HostTransport) validate(host string) error {
+	if h.Protocol != "" && h.Protocol != protocolV0 {
+		return fmt.Errorf("Invalid protocol '%s' of host '%s', go-git only speaks protocol v0", h.Protocol, host)
+	}
+	for _, headers := range []map[string]string{h.ExtraHeaders, h.ExtraHeadersEnv} {
+		for name := range headers {
+			if name == "" || strings.ContainsAny(name, " :\r\n") {
+				return fmt.Errorf("Invalid extra header '%s' of host '%s'", name, host)
+			}
+		}
+	}
+	return nil
+}
+
+// summary lists the overrides of the host, only the names of its headers as their values
+// may be credentials
+func (h HostTransport) summary() string {
+	var parts []string
+	if h.Protocol != "" {
+		parts = append(parts, "protocol "+h.Protocol)
+	}
+	if h.DisableHTTP2 {
+		parts = append(parts, "HTTP/2 disabled")
+	}
+	if names := h.headerNames(); len(names) > 0 {
+		parts = append(parts, "extra headers "+strings.Join(names, ", "))
+	}
+	if len(parts) == 0 {
+		return "no overrides"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h HostTransport) headerNames() []string {
+	var names []string
+	for _, headers := range []map[string]string{h.ExtraHeaders, h.ExtraHeadersEnv} {
+		for name := range headers {
+			names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hostTransport is the transport of a host with overrides
+type hostTransport struct {
+	settings  HostTransport
+	transport nethttp.RoundTripper
+	header    nethttp.Header
+}
+
+// hostRoundTripper sends the requests of go-git through the transport of their host, or
+// base for a host without overrides
+type hostRoundTripper struct {
+	base  nethttp.RoundTripper
+	hosts map[string]*hostTransport
+}
+
+// hostOverrides are the transport overrides installed by installHostTransports
+var hostOverrides map[string]HostTransport
+
+// cloneTransport is the transport go-git sends its requests through, the one of the hosts
+// once installHostTransports installed it, capturing the exchanges with -debug-failures.
+// The references advertisements of detectMoves are sent through it as well
+var cloneTransport nethttp.RoundTripper = nethttp.DefaultTransport
+
+func (t *hostRoundTripper) RoundTrip(req *nethttp.Request) (*nethttp.Response, error) {
+	host, ok := t.hosts[strings.ToLower(req.URL.Host)]
+	if !ok {
+		host, ok = t.hosts[strings.ToLower(req.URL.Hostname())]
+	}
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for name, values := range host.header {
+		req.Header[name] = values
+	}
+	if host.settings.Protocol == protocolV0 {
+		req.Header.Del("Git-Protocol")
+	}
+	return host.transport.RoundTrip(req)
+}
+
+// installHostTransports installs the http and https client of go-git with the overrides of
+// hosts, the default client is kept without any
+func installHostTransports(hosts map[string]HostTransport) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	base := nethttp.DefaultTransport.(*nethttp.Transport)
+	rt := &hostRoundTripper{base: base, hosts: make(map[string]*hostTransport)}
+	overrides := make(map[string]HostTransport)
+	for name, settings := range hosts {
+		header := make(nethttp.Header)
+		for key, value := range settings.ExtraHeaders {
+			header.Set(key, value)
+		}
+		for key, env := range settings.ExtraHeadersEnv {
+			value := os.Getenv(env)
+			if value == "" {
+				return fmt.Errorf("The environment variable '%s' of the %s header of host '%s' is not set", env, key, name)
+			}
+			header.Set(key, value)
+		}
+		transport := base.Clone()
+		if settings.DisableHTTP2 {
+			transport.ForceAttemptHTTP2 = false
+			// a non-nil empty map keeps the transport from negotiating h2 over TLS
+			transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) nethttp.RoundTripper)
+		}
+		host := strings.ToLower(name)
+		rt.hosts[host] = &hostTransport{settings: settings, transport: transport, header: header}
+		overrides[host] = settings
+		log.Printf("Host %s: %s", host, settings.summary())
+	}
+	httpClient := githttp.NewClient(&nethttp.Client{Transport: rt})
+	client.InstallProtocol("https", httpClient)
+	client.InstallProtocol("http", httpClient)
+	hostOverrides, cloneTransport = overrides, rt
+	return nil
+}
+
+// withHostOverrides adds the transport overrides of the host of rawURL to err, so a failure
+// caused by them can be told from the log
+func withHostOverrides(err error, rawURL string) error {
+	if err == nil || len(hostOverrides) == 0 {
+		return err
+	}
+	u, parseErr := url.Parse(rawURL)
+	if parseErr != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return err
+	}
+	settings, ok := hostOverrides[strings.ToLower(u.Host)]
+	if !ok {
+		settings, ok = hostOverrides[strings.ToLower(u.Hostname())]
+	}
+	if !ok {
+		return err
+	}
+	return fmt.Errorf("%w (host %s has the transport overrides %s)", err, u.Hostname(), settings.summary())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// ignoreFileName lists gitignore patterns of paths that must not leave the origin host,
+// read from the tree HEAD points at
+const ignoreFileName = ".codepackignore"
+
+// ManifestExclusions flags a repository with paths matching ignore patterns, a bare mirror
+// keeps the complete history so the paths are still inside it, a worktree export leaves them out
+type ManifestExclusions struct {
+	Patterns []string `json:"patterns"`
+	// Matched is the number of files at HEAD matching the patterns
+	Matched int `json:"matched"`
+	// Removed is set when the matching files were left out of a worktree export
+	Removed bool `json:"removed,omitempty"`
+}
+
+// readIgnorePatterns reads the patterns of the ignore file applied to every repository
+func readIgnorePatterns(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIgnorePatterns(f)
+}
+
+// parseIgnorePatterns returns the patterns of r with gitignore syntax, skipping blank lines and comments
+func parseIgnorePatterns(r io.Reader) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// headCommit returns the commit HEAD of a mirror points at, nil for an empty repository
+// and an unborn or dangling HEAD, which checkHead records
+func headCommit(s storage.Storer) (*object.Commit, error) {
+	head, err := s.Reference(plumbing.HEAD)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		if head, err = s.Reference(head.Target()); errors.Is(err, plumbing.ErrReferenceNotFound) {
+			// empty repository
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	commit, err := object.GetCommit(s, head.Hash())
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("HEAD: %w", err)
+	}
+	return commit, nil
+}
+
+// repoExclusions matches the files at HEAD of a mirror against global and the .codepackignore
+// patterns of the repository, nil when no file matches
+func repoExclusions(s storage.Storer, global []string) (*ManifestExclusions, error) {
+	commit, err := headCommit(s)
+	if commit == nil || err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := append([]string{}, global...)
+	if file, err := tree.File(ignoreFileName); err == nil {
+		contents, err := file.Contents()
+		if err != nil {
+			return nil, err
+		}
+		own, err := parseIgnorePatterns(strings.NewReader(contents))
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, own...)
+	} else if !errors.Is(err, object.ErrFileNotFound) {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	parsed := make([]gitignore.Pattern, len(patterns))
+	for i, p := range patterns {
+		parsed[i] = gitignore.ParsePattern(p, nil)
+	}
+	matcher := gitignore.NewMatcher(parsed)
+	matched := 0
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if matcher.Match(strings.Split(f.Name, "/"), false) {
+			matched++
+		}
+		return nil
+	})
+	if err != nil || matched == 0 {
+		return nil, err
+	}
+	return &ManifestExclusions{Patterns: patterns, Matched: matched}, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIgnorePatterns(t *testing.T) {
+	patterns, err := parseIgnorePatterns(strings.NewReader("# fixtures\n\nsecrets/\n!secrets/README.md  \r\n*.pem\t\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"secrets/", "!secrets/README.md", "*.pem"}; !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("parsed %q, expected %q", patterns, expected)
+	}
+}
+
+func TestRepoExclusions(t *testing.T) {
+	files := [][2]string{
+		{"src/main.go", "package main\n"},
+		{"fixtures/keys/server.pem", "key\n"},
+		{"fixtures/keys/public.pem", "public key\n"},
+		{"third_party/vendor/blob.bin", "blob\n"},
+		{"vendor/lib.go", "package lib\n"},
+		{"docs/vendor.md", "notes\n"},
+	}
+	for _, tc := range []struct {
+		name    string
+		ignore  string
+		global  []string
+		matched int
+	}{
+		{name: "no patterns"},
+		{name: "file glob", ignore: "*.pem\n", matched: 2},
+		{name: "negation", ignore: "*.pem\n!public.pem\n", matched: 1},
+		{name: "directory at any depth", ignore: "vendor/\n", matched: 2},
+		{name: "anchored directory", ignore: "/vendor/\n", matched: 1},
+		{name: "global only", global: []string{"fixtures/"}, matched: 2},
+		{name: "global negated by the repository", ignore: "!fixtures/keys/public.pem\n", global: []string{"*.pem"}, matched: 1},
+		{name: "nothing matches", ignore: "*.exe\n"},
+	} {
+		repoFiles := files
+		if tc.ignore != "" {
+			repoFiles = append(append([][2]string{}, files...), [2]string{ignoreFileName, tc.ignore})
+		}
+		repo := newTestRepo(t, filepath.Join(t.TempDir(), "repo"), repoFiles...)
+		exclusions, err := repoExclusions(repo.Storer, tc.global)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		switch {
+		case tc.matched == 0 && exclusions != nil:
+			t.Errorf("%s: expected no exclusions, got %+v", tc.name, exclusions)
+		case tc.matched > 0 && (exclusions == nil || exclusions.Matched != tc.matched):
+			t.Errorf("%s: expected %d matched files, got %+v", tc.name, tc.matched, exclusions)
+		}
+	}
+}
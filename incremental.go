@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// planIncremental compares every repository against the manifest of the parent
+// run, repositories whose remote references are unchanged are not cloned again
+// and are restored from the archive recorded in the parent instead.
+// It returns the configuration of the repositories to clone and a manifest
+// holding the unchanged repositories and the chain of archives they live in
+func planIncremental(config *Config, parent *Manifest, opts CloneOptions, archive string) (*Config, *Manifest) {
+	unchanged := make([]bool, len(config.Repos))
+	previous := make([]ManifestRepo, len(config.Repos))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i, repo := range config.Repos {
+		prev, ok := parent.Find(repo)
+		if !ok || prev.URL != sanitizeURL(repo.URL) {
+			continue
+		}
+		if _, ok := parent.ArchiveSHA256(prev.Archive); !ok {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, repo Repository, prev ManifestRepo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			refs, err := remoteRefs(repo.URL, repoAuth(repo, opts))
+			if err != nil {
+				log.Printf("Cannot list references of %s, it will be cloned: %v", repo.URL, err)
+				return
+			}
+			for name := range refs {
+				_, captured := prev.Refs[name]
+				if repo.excluded(name) || repo.PinOnly && !captured {
+					delete(refs, name)
+				}
+			}
+			if sameRefs(refs, prev.Refs) {
+				unchanged[i] = true
+				previous[i] = prev
+			}
+		}(i, repo, prev)
+	}
+	wg.Wait()
+
+	// the settings of config like its plugins still apply to the repositories to clone
+	toClone := *config
+	toClone.Repos = nil
+	manifest := newManifest(archive)
+	chained := make(map[string]bool)
+	for i, repo := range config.Repos {
+		if !unchanged[i] {
+			toClone.Repos = append(toClone.Repos, repo)
+			continue
+		}
+		log.Printf("Unchanged since %s: %s", previous[i].Archive, repo.URL)
+		previous[i].Tags = repo.Tags
+		manifest.Repos = append(manifest.Repos, previous[i])
+		if !chained[previous[i].Archive] {
+			chained[previous[i].Archive] = true
+			sum, _ := parent.ArchiveSHA256(previous[i].Archive)
+			manifest.Chain = append(manifest.Chain, ManifestArchive{Archive: previous[i].Archive, SHA256: sum})
+		}
+	}
+
+	log.Printf("Incremental backup: %d of %d repositories changed since %s", len(toClone.Repos), len(config.Repos), parent.Archive)
+	return &toClone, manifest
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// tokenUsername matches a user of a URL that is an access token rather than a name, like
+// a GitHub or GitLab token passed as the user with an empty password
+var tokenUsername = regexp.MustCompile(`^(gh[pousr]_|github_pat_|glpat-)[A-Za-z0-9_-]+$|^[A-Za-z0-9_-]{32,}$`)
+
+// allowsInsecureHTTP reports whether allow_insecure_http lets the repository send its
+// credentials over plain http://
+func (r Repository) allowsInsecureHTTP() bool {
+	return r.AllowInsecureHTTP != nil && *r.AllowInsecureHTTP
+}
+
+func isPlainHTTP(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.EqualFold(u.Scheme, "http")
+}
+
+// embeddedSecret reports whether rawURL holds a password or a token as its user
+func embeddedSecret(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return false
+	}
+	if _, ok := u.User.Password(); ok {
+		return true
+	}
+	return tokenUsername.MatchString(u.User.Username())
+}
+
+// hasCredentials reports whether the repository is cloned with credentials, its own auth,
+// the global ones or a secret in its URL
+func hasCredentials(repo Repository, global *http.BasicAuth) bool {
+	if embeddedSecret(repo.URL) {
+		return true
+	}
+	if repo.Auth != nil {
+		return repo.Auth.BasicAuth() != nil
+	}
+	return global != nil
+}
+
+// checkInsecureHTTP refuses repositories with a plain http:// URL that would send their
+// credentials in cleartext unless allow_insecure_http is set for them, in which case they
+// are marked InsecureHTTP for the manifest. It warns about secrets embedded in URLs
+func checkInsecureHTTP(repos []Repository, global *http.BasicAuth) error {
+	var refused []string
+	for i := range repos {
+		repo := &repos[i]
+		if embeddedSecret(repo.URL) {
+			log.Printf("WARNING: %s has a password or token embedded in its URL, move it to the environment variables of its auth with username_env and password_env", sanitizeURL(repo.URL))
+		}
+		if !isPlainHTTP(repo.URL) || !hasCredentials(*repo, global) {
+			continue
+		}
+		if !repo.allowsInsecureHTTP() {
+			refused = append(refused, sanitizeURL(repo.URL))
+			continue
+		}
+		log.Printf("WARNING: INSECURE: credentials for %s are sent in cleartext over http://, allowed by allow_insecure_http", sanitizeURL(repo.URL))
+		repo.InsecureHTTP = true
+	}
+	if len(refused) > 0 {
+		return fmt.Errorf("Refusing to send credentials in cleartext over http:// to %s, use https:// or set allow_insecure_http: true", strings.Join(refused, ", "))
+	}
+	return nil
+}
+
+// checkPromptedHTTP refuses to ask for the credentials of a repository with a plain http://
+// URL like checkInsecureHTTP refuses configured ones, the answer would be sent in cleartext
+func checkPromptedHTTP(repo Repository) error {
+	repo.Auth = nil
+	return checkInsecureHTTP([]Repository{repo}, &http.BasicAuth{})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/go-git/go-git/v5/config"
+)
+
+// urlRewrite replaces the prefix InsteadOf of a repository URL with Base
+type urlRewrite struct {
+	Base      string
+	InsteadOf string
+}
+
+// loadInsteadOf reads the url.<base>.insteadOf rules of the system and global git config,
+// pushInsteadOf rules only apply to pushes and are ignored
+func loadInsteadOf() ([]urlRewrite, error) {
+	var rules []urlRewrite
+	for _, scope := range []config.Scope{config.SystemScope, config.GlobalScope} {
+		cfg, err := config.LoadConfig(scope)
+		if err != nil {
+			return nil, err
+		}
+		for _, sub := range cfg.Raw.Section("url").Subsections {
+			for _, insteadOf := range sub.Options.GetAll("insteadOf") {
+				rules = append(rules, urlRewrite{Base: sub.Name, InsteadOf: insteadOf})
+			}
+		}
+	}
+	return rules, nil
+}
+
+// rewriteURL applies the rule with the longest matching prefix like git does
+func rewriteURL(rawURL string, rules []urlRewrite) (string, bool) {
+	var best *urlRewrite
+	for i, rule := range rules {
+		if strings.HasPrefix(rawURL, rule.InsteadOf) && (best == nil || len(rule.InsteadOf) > len(best.InsteadOf)) {
+			best = &rules[i]
+		}
+	}
+	if best == nil {
+		return rawURL, false
+	}
+	return best.Base + strings.TrimPrefix(rawURL, best.InsteadOf), true
+}
+
+// applyInsteadOf rewrites the URL of every repository of cfg with the insteadOf rules of the git config
+func applyInsteadOf(cfg *Config) error {
+	rules, err := loadInsteadOf()
+	if err != nil {
+		return err
+	}
+	for i, repo := range cfg.Repos {
+		if rewritten, ok := rewriteURL(repo.URL, rules); ok {
+			log.Printf("Rewriting %s to %s with git config insteadOf", sanitizeURL(repo.URL), sanitizeURL(rewritten))
+			cfg.Repos[i].URL = rewritten
+		}
+	}
+	return nil
+}
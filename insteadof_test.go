@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRewriteURL(t *testing.T) {
+	rules := []urlRewrite{
+		{Base: "https://mirror.example.com/github/", InsteadOf: "https://github.com/"},
+		{Base: "https://mirror.example.com/acme/", InsteadOf: "https://github.com/acme/"},
+		{Base: "ssh://git@gitlab.example.com/", InsteadOf: "gl:"},
+	}
+	for _, tc := range []struct {
+		url, rewritten string
+		ok             bool
+	}{
+		{url: "https://github.com/golang/go.git", rewritten: "https://mirror.example.com/github/golang/go.git", ok: true},
+		{url: "https://github.com/acme/app.git", rewritten: "https://mirror.example.com/acme/app.git", ok: true},
+		{url: "gl:platform/cli.git", rewritten: "ssh://git@gitlab.example.com/platform/cli.git", ok: true},
+		{url: "https://gitlab.example.com/platform/cli.git", rewritten: "https://gitlab.example.com/platform/cli.git"},
+	} {
+		rewritten, ok := rewriteURL(tc.url, rules)
+		if rewritten != tc.rewritten || ok != tc.ok {
+			t.Errorf("rewriteURL(%q) = %q, %v, expected %q, %v", tc.url, rewritten, ok, tc.rewritten, tc.ok)
+		}
+	}
+}
+
+func TestApplyInsteadOfIgnoresPushInsteadOf(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	gitconfig := `[url "https://mirror.example.com/github/"]
+	insteadOf = https://github.com/
+[url "https://mirror.example.com/acme/"]
+	insteadOf = https://github.com/acme/
+[url "ssh://git@github.com/"]
+	pushInsteadOf = https://github.com/
+`
+	if err := os.WriteFile(filepath.Join(home, ".gitconfig"), []byte(gitconfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Repos: []Repository{
+		{URL: "https://github.com/golang/go.git"},
+		{URL: "https://github.com/acme/app.git"},
+		{URL: "https://gitlab.example.com/platform/cli.git"},
+	}}
+	if err := applyInsteadOf(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{
+		"https://mirror.example.com/github/golang/go.git",
+		"https://mirror.example.com/acme/app.git",
+		"https://gitlab.example.com/platform/cli.git",
+	} {
+		if cfg.Repos[i].URL != expected {
+			t.Errorf("repository %d was rewritten to %q, expected %q", i+1, cfg.Repos[i].URL, expected)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// inventoryColumns are the columns of -inventory-csv in order, asset management systems
+// ingest them so columns are only ever appended
+var inventoryColumns = []string{"name", "url", "path", "head", "default_branch", "refs", "size_bytes", "clone_seconds", "status", "backup_timestamp"}
+
+// inventoryUsage documents -inventory-csv and its columns in the help
+var inventoryUsage = "write one CSV row per repository to <out>.inventory.csv, or to <file> with -inventory-csv=<file>, columns: " + strings.Join(inventoryColumns, ",")
+
+// writeInventory writes the report to the inventory of -inventory-csv when it is given,
+// next to target unless it names a file
+func writeInventory(inventory *optionalPathFlag, report *runReport, target string) error {
+	if !inventory.set {
+		return nil
+	}
+	filename := inventory.pathOr(defaultInventoryPath(target))
+	log.Println("Writing inventory:", filename)
+	if err := report.WriteInventory(filename); err != nil {
+		return fmt.Errorf("Failed to write inventory '%s': %w", filename, err)
+	}
+	return nil
+}
+
+// defaultInventoryPath is the inventory written next to the archive target, in the working
+// directory for a remote destination
+func defaultInventoryPath(target string) string {
+	if strings.Contains(target, "://") {
+		return archiveName(target) + ".inventory.csv"
+	}
+	return target + ".inventory.csv"
+}
+
+// WriteInventory writes one row of inventoryColumns per repository of the report to filename,
+// through a temporary file renamed over it so a reader never sees a partial inventory
+func (r *runReport) WriteInventory(filename string) error {
+	r.mu.Lock()
+	entries := append([]runReportEntry{}, r.Repos...)
+	started := r.Started
+	r.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := csv.NewWriter(f)
+	w.Write(inventoryColumns)
+	for _, e := range entries {
+		var seconds string
+		if e.CloneSeconds > 0 {
+			seconds = strconv.FormatFloat(e.CloneSeconds, 'f', 3, 64)
+		}
+		w.Write([]string{
+			path.Base(e.Path), e.URL, e.Path, e.Head, e.DefaultBranch, strconv.Itoa(e.Refs),
+			strconv.FormatInt(e.Size, 10), seconds, string(e.Status), started,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// listCommand prints the entries of an archive, a local file or the artifact an oci://
+// destination pushed, with their mode, size and name
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	archivePtr := flags.String("archive", "", "archive to list, a local file or an oci:// reference")
+	ociPlainHTTPPtr := flags.Bool("oci-plain-http", false, "use plain http for the oci:// registry of -archive")
+	limits := archiveLimitFlags(flags)
+	loadIdentities := identityFlags(flags)
+	parseFlags(flags, args)
+
+	if *archivePtr == "" {
+		return fmt.Errorf("list requires -archive")
+	}
+	if err := loadIdentities(); err != nil {
+		return err
+	}
+	filename := *archivePtr
+	if reference, ok := strings.CutPrefix(filename, "oci://"); ok {
+		dir, err := os.MkdirTemp("", "codepack-list")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		filename = filepath.Join(dir, "archive")
+		if err := pullOCIArchive(reference, *ociPlainHTTPPtr, filename); err != nil {
+			return err
+		}
+	}
+	return listArchive(filename, os.Stdout, limits())
+}
+
+// listArchive writes a line for every entry of the archive filename to w
+func listArchive(filename string, w io.Writer, limits archiveLimits) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	archive, err := openArchive(f, info.Size(), limits)
+	if err != nil {
+		return fmt.Errorf("Cannot read archive '%s': %w", filename, err)
+	}
+	defer archive.Close()
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read archive '%s': %w", filename, err)
+		}
+		line := fmt.Sprintf("%s  %10d  %s", header.FileInfo().Mode(), header.Size, displayName(header.Name))
+		if header.Linkname != "" {
+			line += " -> " + displayName(header.Linkname)
+		}
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// archiveSourceScheme is the scheme of a repository taken out of a CodePack archive instead
+// of cloned, codepack+file:///backups/old.tar.gz#team/app is team/app of that archive
+const archiveSourceScheme = "codepack+file://"
+
+// archiveSource splits a codepack+file:// source in to the archive and the clone path of
+// the repository in it, false for any other URL
+func archiveSource(rawURL string) (string, string, bool) {
+	if !strings.HasPrefix(rawURL, archiveSourceScheme) {
+		return "", "", false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", true
+	}
+	return filepath.FromSlash(u.Path), strings.Trim(u.Fragment, "/"), true
+}
+
+// localSourcePath is the path on this machine a repository is read from, a local path,
+// a file:// URL or the archive of a codepack+file:// source, false for a remote URL
+func localSourcePath(rawURL string) (string, bool) {
+	if archive, _, ok := archiveSource(rawURL); ok {
+		return archive, true
+	}
+	if strings.HasPrefix(rawURL, "file://") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return rawURL, true
+		}
+		return filepath.FromSlash(u.Path), true
+	}
+	if strings.Contains(rawURL, "://") || repoHost(rawURL) != "local" {
+		return "", false
+	}
+	return rawURL, true
+}
+
+// checkLocalSources validates the codepack+file:// sources of repos and, with roots, that
+// every local source is inside one of them once symlinks are resolved, so a configuration
+// handed to a shared service cannot read other repositories or files of the machine
+func checkLocalSources(repos []Repository, roots []string) error {
+	resolved := make([]string, len(roots))
+	for i, root := range roots {
+		dir, err := resolvePath(root)
+		if err != nil {
+			return fmt.Errorf("Invalid -allow-local-roots '%s': %w", root, err)
+		}
+		resolved[i] = dir
+	}
+	for _, repo := range repos {
+		if archive, clonePath, ok := archiveSource(repo.URL); ok {
+			if !filepath.IsAbs(archive) || clonePath == "" || path.Clean(clonePath) != clonePath || contains(strings.Split(clonePath, "/"), "..") {
+				return fmt.Errorf("Invalid archive source '%s', use %s/path/to/archive.tar.gz#path/of/repo", repo.URL, archiveSourceScheme)
+			}
+		}
+		source, ok := localSourcePath(repo.URL)
+		if !ok || len(roots) == 0 {
+			continue
+		}
+		dir, err := resolvePath(source)
+		if err != nil {
+			return fmt.Errorf("Cannot resolve the local source of repository '%s': %w", repo.URL, err)
+		}
+		if !insideRoots(dir, resolved) {
+			return fmt.Errorf("Repository '%s' is outside of -allow-local-roots", repo.URL)
+		}
+	}
+	return nil
+}
+
+// resolvePath is the absolute path of name with every symlink resolved
+func resolvePath(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+func insideRoots(dir string, roots []string) bool {
+	for _, root := range roots {
+		if dir == root || strings.HasPrefix(dir, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneFromArchive writes the mirror of the codepack+file:// source of repo to fs, streaming
+// the archive until the entries below the clone path of the repository were read. Only
+// directories and regular files are written, a mirror holds nothing else
+func cloneFromArchive(ctx context.Context, repo Repository, fs billy.Filesystem) error {
+	archive, clonePath, _ := archiveSource(repo.URL)
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tr, err := openArchive(f, info.Size(), archiveLimits{})
+	if err != nil {
+		return fmt.Errorf("Cannot read the compression header of '%s': %w", archive, err)
+	}
+	defer tr.Close()
+
+	prefix := "codepack/" + clonePath
+	found := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Corrupt archive '%s': %w", archive, err)
+		}
+		name := path.Clean(header.Name)
+		if name != prefix && !strings.HasPrefix(name, prefix+"/") {
+			// the entries of a repository are written together, the next one ends it
+			if found {
+				break
+			}
+			continue
+		}
+		found = true
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, prefix), "/")
+		if contains(strings.Split(header.Name, "/"), "..") {
+			return fmt.Errorf("Entry '%s' of '%s' is outside of the repository", displayName(header.Name), archive)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if rel != "" {
+				if err := fs.MkdirAll(rel, 0755); err != nil {
+					return err
+				}
+			}
+		case tar.TypeReg:
+			if err := fs.MkdirAll(path.Dir(rel), 0755); err != nil {
+				return err
+			}
+			out, err := fs.OpenFile(rel, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		default:
+			log.Printf("WARNING: skipping '%s' of '%s', a mirror holds only directories and files", displayName(header.Name), archive)
+		}
+	}
+	if !found {
+		return fmt.Errorf("Archive '%s' has no repository '%s', it may be carried from an earlier archive of its chain", archive, clonePath)
+	}
+	if _, err := fs.Stat("HEAD"); err != nil {
+		return fmt.Errorf("'%s' of '%s' is not a mirror, it was exported as a worktree or fast-export stream", clonePath, archive)
+	}
+	return nil
+}
@@ -1,232 +1,1338 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/fs"
 	"log"
 	"math"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
-	"gopkg.in/yaml.v3"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var workers = 10
+
 const VERSION = "v0.1.3"
 
+// runID identifies this run in every log line and the manifest
+var runID = newRunID(time.Now())
+
+// newRunID is the UTC start time of the run followed by a random suffix,
+// so runs started in the same second can still be told apart
+func newRunID(start time.Time) string {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return start.UTC().Format("20060102T150405Z")
+	}
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
 func Exit(err error) {
+	if err == nil {
+		runExitHooks(nil)
+		os.Exit(1)
+	}
+	Finish(err)
+}
+
+// Finish exits like Exit, but with status 0 for a nil err. Subcommands and the run modes
+// that end before the tarball is written finish with it, -version and -skiptar keep the
+// status 1 of Exit(nil)
+func Finish(err error) {
+	runExitHooks(err)
 	if err != nil {
+		terminal.Error(err)
+		var coded *exitCodeError
+		if errors.As(err, &coded) {
+			os.Exit(coded.code)
+		}
 		os.Exit(-1)
 	}
-	os.Exit(1)
+	os.Exit(0)
+}
+
+// exitHooks are called with the outcome of a run just before the process exits,
+// the last one added first
+var exitHooks []func(err error)
+
+func onExit(hook func(err error)) {
+	exitHooks = append(exitHooks, hook)
+}
+
+func runExitHooks(err error) {
+	hooks := exitHooks
+	exitHooks = nil
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](err)
+	}
 }
 
 func main() {
-	log.SetPrefix("DEBUG ")
+	log.SetPrefix(fmt.Sprintf("DEBUG [%s] ", runID))
 	log.SetFlags(0)
-	defaultOutfile := fmt.Sprintf("%s-git-backup.tar.gz", time.Now().Format("2006-01-02"))
 
-	outFilePtr := flag.String("out", defaultOutfile, "Output filename for the tarball")
-	configFilePtr := flag.String("config", "codepack.yaml", "Configuration file")
-	workersPtr := flag.Int("workers", 10, "Number of works for cloning repos")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			Finish(restoreCommand(os.Args[2:]))
+		case "consolidate":
+			Finish(consolidateCommand(os.Args[2:]))
+		case "list":
+			Finish(listCommand(os.Args[2:]))
+		case "archive":
+			Finish(archiveCommand(os.Args[2:]))
+		case "check":
+			Finish(checkCommand(os.Args[2:]))
+		case "auth-check":
+			Finish(authCheckCommand(os.Args[2:]))
+		case "verify-restore":
+			Finish(verifyRestoreCommand(os.Args[2:]))
+		case "migrate":
+			Finish(migrateCommand(os.Args[2:]))
+		case "rewrap":
+			Finish(rewrapCommand(os.Args[2:]))
+		case "config":
+			Finish(configCommand(os.Args[2:]))
+		case "catalog":
+			Finish(catalogCommand(os.Args[2:]))
+		case "completion":
+			Finish(completionCommand(os.Args[2:]))
+		case "__complete":
+			if !completeCommand(os.Args[2:]) {
+				os.Exit(0)
+			}
+		}
+	}
+
+	defaultOutfile := fmt.Sprintf("%s-git-backup%s", time.Now().Format("2006-01-02"), archiveFormats[formatGzip].extension)
+
+	outFiles := newStringsFlag(defaultOutfile)
+	flag.Var(outFiles, "out", "Output filename or destination URL for the tarball, repeat it to write the tarball to several destinations at once")
+	configFilePtr := flag.String("config", "codepack.yaml", "Configuration file, - reads it from stdin, an https:// URL or a git URL with a #path fragment fetches it")
+	configInsecureHTTPPtr := flag.Bool("config-allow-insecure-http", false, "send the credentials over a plain http:// git URL of -config, in cleartext")
+	configFormatPtr := flag.String("config-format", "", "format of the configuration file: yaml, toml or json (default detected from the extension)")
+	formatPtr := flag.String("format", formatGzip, "archive format: gzip, xz, bzip2, zstd, or tar for an uncompressed tarball")
+	compressionLevelPtr := flag.Int("compression-level", 0, "compression level from 1 (fastest) to 9 (smallest), 0 is the default of the format")
+	workersPtr := &workersFlag{n: 10}
+	flag.Var(workersPtr, "workers", "Number of works for cloning repos, or auto to adapt it to the clone errors and latency of the hosts")
+	workersMinPtr := flag.Int("workers-min", 2, "fewest clones -workers auto runs at once")
+	workersMaxPtr := flag.Int("workers-max", 32, "most clones -workers auto runs at once")
+	cloneProgressPtr := flag.Duration("clone-progress", 10*time.Second, "interval of the progress of running clones in the log, 0 disables it")
+	logSyslogPtr := flag.Bool("log-syslog", false, "also send log output to syslog, or journald when systemd runs the local syslog")
+	syslogAddressPtr := flag.String("syslog-address", "local", "syslog server as host:port (udp), udp://host:port or tcp://host:port, local is the local syslog socket")
+	syslogFacilityPtr := flag.String("syslog-facility", "daemon", "syslog facility of the log output")
+	syslogTagPtr := flag.String("syslog-tag", "codepack", "syslog tag of the log output")
 	logFilePtr := flag.String("log", "", "optional log file for log output")
 	versionPtr := flag.Bool("version", false, "output version information and exit")
 	skipTarPtr := flag.Bool("skiptar", false, "do not tarball and compress codepack content")
+	perRepoPtr := flag.Bool("per-repo", false, "write every repository to a file of its own in the -out directory, in its output_format or -format, zip or none, with an index.json instead of a single tarball")
+	cacheDirPtr := flag.String("cache-dir", "", "keep the mirrors in this directory between runs and fetch in to them instead of cloning, the tarball is written from a snapshot of it every -archive-every runs")
+	archiveEveryPtr := flag.Int("archive-every", 1, "with -cache-dir, write the tarball on every Nth run, the runs in between only update the cache")
+	reflinkPtr := flag.Bool("reflink", false, "with -cache-dir, snapshot the cache with reflinks on filesystems supporting them like btrfs and XFS instead of hard links")
+	destFlags := destinationFlags(flag.CommandLine)
+	recipients := &stringsFlag{}
+	flag.Var(recipients, "recipient", recipientUsage)
+	loadIdentities := identityFlags(flag.CommandLine)
+	reproduciblePtr := flag.Bool("reproducible", false, "write repositories to the tarball in configuration order with fixed timestamps, root:root ownership and normalized modes")
+	tarOwnerPtr := flag.String("tar-owner", "", "owner of every tarball entry as name, uid or name:uid (default the owner of the staged files)")
+	tarGroupPtr := flag.String("tar-group", "", "group of every tarball entry as name, gid or name:gid (default the group of the staged files)")
+	renameInvalidPtr := flag.Bool("rename-invalid", false, "percent-encode the bytes of file names that are not valid UTF-8 in the tarball, the manifest maps them back")
+	normalizeModesPtr := flag.Bool("normalize-modes", false, "write tarball entries with mode 0755 for directories and executable files and 0644 for other files, implied by -reproducible")
+	tarModeMaskPtr := flag.String("tar-mode-mask", "", "octal permission bits cleared from every tarball entry, like 022 to strip group and other write")
+	secureStagingPtr := flag.Bool("secure-staging", false, "clone repositories into memory instead of a temporary directory")
+	maxMemoryPtr := flag.Int("max-memory", 0, "size in MiB of the process RSS above which no clone is started until running ones finish, 0 disables it")
+	resourceIntervalPtr := flag.Duration("resource-interval", 0, "interval of logging the RSS and open files of the process, 0 disables it")
+	maxObjectCachePtr := flag.Int("max-object-cache", 96, "size in MiB of the object cache of each clone worker")
+	largeObjectThresholdPtr := flag.Int("large-object-threshold", 0, "objects larger than this size in MiB are not read in to memory, 0 is unlimited")
+	secureStagingMaxPtr := flag.Int("secure-staging-max", 1024, "maximum size in MiB of a single repository with -secure-staging")
+	minFreeSpacePtr := flag.Int("min-free-space", 0, "size in MiB the staging filesystem must have free beyond the expected size of the clones before cloning, exiting with status 5 otherwise")
+	minFreeInodesPtr := flag.Int("min-free-inodes", 10000, "free inodes the staging filesystem must have before cloning, exiting with status 5 otherwise, 0 disables the check")
+	inMemoryThresholdPtr := flag.Int("in-memory-threshold", 1, "repositories the parent manifest lists below this size in MiB are cloned in memory instead of the staging directory")
+	inMemoryBudgetPtr := flag.Int("in-memory-budget", 64, "total size in MiB of the clones held in memory by -in-memory-threshold and in_memory, 0 clones every repository on disk")
+	verifyArchivePtr := flag.Bool("verify-archive", false, "read local tarballs back after writing them and compare them with the staging directory and the manifest checksum")
+	verifyLimits := archiveLimitFlags(flag.CommandLine)
+	manifestPtr := flag.String("manifest", "", "Output filename for the manifest (default <out>.manifest.json)")
+	inventoryCSV := &optionalPathFlag{}
+	flag.Var(inventoryCSV, "inventory-csv", inventoryUsage)
+	printConfigPtr := flag.Bool("print-config", false, "print the effective configuration of the run as YAML, with defaults, derived names and paths and the command line applied, and exit")
+	exportPtr := flag.String("export", exportMirror, "archive repositories not setting export as a bare mirror, as the files of HEAD or as a git fast-export stream of every ref: mirror, worktree or fast-export")
+	ignoreFilePtr := flag.String("ignore-file", "", "file of gitignore patterns matched against every repository along with its .codepackignore")
+	scanSecretsPtr := flag.Bool("scan-secrets", false, "scan the files at HEAD of every mirror for credentials and apply the secrets setting of the repository: warn, exclude or fail")
+	secretsAllowlistPtr := flag.String("secrets-allowlist", "", "file of path:, value: and rule: lines suppressing false positives of -scan-secrets")
+	secretsMaxFilePtr := flag.Int("secrets-max-file", 1024, "size in KiB above which -scan-secrets skips a file")
+	secretsBudgetPtr := flag.Duration("secrets-budget", time.Minute, "time the -scan-secrets scan of a single repository may take, it is incomplete when exceeded")
+	healthReportPtr := flag.String("health-report", "", "analyze every cloned repository and write the large blobs, stale branches and sizes found to this JSON file")
+	healthLargeBlobPtr := flag.Int("health-large-blob", 50, "size in MiB above which -health-report lists a blob")
+	healthStaleMonthsPtr := flag.Int("health-stale-months", 12, "months since the last commit after which -health-report lists a branch as stale")
+	healthBudgetPtr := flag.Duration("health-budget", time.Minute, "time the -health-report analysis of a single repository may take, it is incomplete when exceeded")
+	includeConfigRepoPtr := flag.Bool("include-config-repo", false, "also mirror the git repository the configuration file was read from to _codepack-config")
+	includeDisabledPtr := flag.Bool("include-disabled", false, "also clone repositories with enabled: false")
+	failOnEmptyPtr := flag.Bool("fail-on-empty-backup", false, "refuse to write a backup without any repository, exiting with status 3")
+	minReposPtr := flag.Int("min-repos", 0, "refuse to write a backup with fewer repositories, exiting with status 3")
+	minReposFractionPtr := flag.Float64("min-repos-fraction", 0, "refuse to write a backup with less than this fraction of the configured repositories, exiting with status 3")
+	maxDisabledPtr := flag.Float64("max-disabled", 0.5, "warn when more than this fraction of the repositories are disabled")
+	tagsPtr := flag.String("tags", "", "comma separated tags, only the repositories having any of them take part in the run")
+	activeSincePtr := flag.String("active-since", "", "skip repositories without a push since this date like 2024-01-31 or duration before now like 90d, read from the host API or ls-remote without cloning, recorded as skipped: stale")
+	createDirsPtr := flag.Bool("create-dirs", false, "create the missing directories of the -out and -local-copy paths instead of failing before cloning")
+	debugFailuresPtr := flag.String("debug-failures", "", "write a bundle of the error, its timing, DNS results and the status lines and headers of the HTTP responses of every failed repository to a directory of the run below this directory, without credentials or response bodies")
+	dropSampleHooksPtr := flag.Bool("drop-sample-hooks", false, "leave the *.sample hooks git writes to every repository out of the mirrors to save space")
+	noCatalogPtr := flag.Bool("no-catalog", false, "do not record the run in the catalog.json next to the manifest")
+	noDedupURLsPtr := flag.Bool("no-dedup-urls", false, "clone every repository listed more than once with the same URL and settings again instead of once, restored as a link")
+	tagsAllPtr := flag.Bool("tags-all", false, "only the repositories having all of the -tags take part in the run")
+	policyFilePtr := flag.String("policy-file", "", "YAML policy of the hosts repositories may come from, the repositories denied and the destinations repositories may be written to, checked before cloning")
+	allowLocalRoots := &stringsFlag{}
+	flag.Var(allowLocalRoots, "allow-local-roots", "directory local paths, file:// and codepack+file:// repository sources must be inside of, repeat it to allow several, by default any local source is allowed")
+	useGitConfigPtr := flag.Bool("use-gitconfig", false, "rewrite repository urls with the url.<base>.insteadOf rules of the system and global git config")
+	watchPtr := flag.Bool("watch", false, "keep running and back up the repositories added or changed in the configuration file to a timestamped delta archive")
+	watchDebouncePtr := flag.Duration("watch-debounce", 5*time.Second, "time to wait for further changes of the configuration file before a delta backup")
+	listenPtr := flag.String("listen", "", "serve /healthz, /status and /metrics on this address like :8080 while running, with -watch between the delta backups")
+	healthyWithinPtr := flag.Duration("healthy-within", 0, "interval a run is expected to succeed within, /healthz of -listen fails when the last successful run is older, 0 only checks the last run")
+	triggerTokenPtr := flag.String("trigger-token", "", "bearer token POST /run of -listen requires to start a manual backup of -watch, /run is not served without it")
+	queueTriggersPtr := flag.Bool("queue-triggers", false, "with -watch, run a manual backup requested during another backup once it finished instead of rejecting it")
+	runKindPtr := flag.String("run-kind", runKindFull, "kind of run recorded in the report and notifications, full, watch or manual")
+	nowPtr := flag.String("now", "", "time the run takes as the current time, like 2024-01-31T12:00:00Z, for testing the default file names and a host with a wrong clock")
+	runIDPtr := flag.String("run-id", "", "ID of the run in the log, manifest and report (default the start time and a random suffix)")
+	updateConfigPtr := flag.Bool("update-config", false, "rewrite the urls of repositories that moved in the configuration file")
+	noColorPtr := flag.Bool("no-color", false, "disable colored terminal output, also disabled by the NO_COLOR environment variable")
+	otelPtr := flag.Bool("otel", false, "export OpenTelemetry traces of the run over OTLP, configured by the OTEL_EXPORTER_OTLP_* environment variables")
+	progressFDPtr := flag.Int("progress-fd", -1, "write the progress of the run as newline delimited JSON events to this open file descriptor, events a stalled reader cannot take are dropped")
+	progressFilePtr := flag.String("progress-file", "", "append the progress events of -progress-fd to this file instead")
+	metricsFilePtr := flag.String("metrics-file", "", "write the repositories, failures, bytes, clone durations and rate limit waits of the run by host to this file in the Prometheus text format")
+	notifyTestPtr := flag.Bool("notify-test", false, "send a test notification with the notify settings of the configuration and exit")
+	noPromptPtr := flag.Bool("no-prompt", false, "never ask for credentials on the terminal when a host requires authentication")
+	shufflePtr := flag.Bool("shuffle", false, "clone repositories of the same priority in random order instead of largest first")
+	failOnMissingPtr := flag.Bool("fail-on-missing", true, "fail the run when the remote reports a repository as not found, false leaves it out of the backup")
+	failOnPtr := flag.String("fail-on", "", "comma separated statuses that fail the run out of cloned,updated,unchanged,skipped,empty,failed,missing, must include failed (default failed,empty,missing, without missing for -fail-on-missing=false)")
+	failOnIncompletePtr := flag.Bool("fail-on-incomplete", false, "fail the run with status 4 once the backup is written when a repository was cloned with an incomplete history, like from a shallow mirror")
+	archiveLastKnownPtr := flag.Bool("archive-last-known", false, "with -parent-manifest and -fail-on-missing=false, archive the copy of the parent of a repository missing from the remote, marked stale")
+	parentManifestPtr := flag.String("parent-manifest", "", "manifest of an earlier run, repositories unchanged since then are not archived again")
+	statePtr := flag.String("state", "", "state file recording the progress of the run (default <out>.state.json)")
+	resumePtr := flag.Bool("resume", false, "continue an interrupted run from its state file, reusing its staging directory")
+	resumeUploadPtr := flag.Bool("resume-upload", false, "continue the failed upload of the -local-copy of an earlier run to its gs:// or azblob:// destination without cloning")
+	resumeVerifyPtr := flag.Bool("resume-verify", false, "with -resume, check the references of repositories cloned by the interrupted run and clone them again if broken")
+	forceReclonePtr := flag.Bool("force-reclone", false, "remove a repository already at the clone path, like a mirror of -cache-dir, and clone it again instead of fetching in to it or failing the clone")
 
-	flag.Parse()
+	parseFlags(flag.CommandLine, os.Args[1:])
+	if *nowPtr != "" {
+		if err := setNow(*nowPtr); err != nil {
+			Exit(configError(err))
+		}
+		defaultOutfile = fmt.Sprintf("%s-git-backup%s", clock().Format("2006-01-02"), archiveFormats[formatGzip].extension)
+		if !outFiles.set {
+			outFiles.values = []string{defaultOutfile}
+		}
+		runID = newRunID(clock())
+		log.SetPrefix(fmt.Sprintf("DEBUG [%s] ", runID))
+	}
+	if *runIDPtr != "" {
+		runID = *runIDPtr
+		log.SetPrefix(fmt.Sprintf("DEBUG [%s] ", runID))
+	}
 
 	if *versionPtr {
 		fmt.Println("CodePack", VERSION)
 		Exit(nil)
 	}
 
-	username := os.Getenv("CODEPACK_GIT_USER")
-	pass := os.Getenv("CODEPACK_GIT_PASS")
-	workers = *workersPtr
-
-	var auth *http.BasicAuth
-
-	if username != "" && pass != "" {
-		auth = &http.BasicAuth{
-			Username: username,
-			Password: pass,
+	// -per-repo also writes zip files and plain directories
+	if *perRepoPtr {
+		if err := validOutputFormat(*formatPtr); err != nil {
+			Exit(err)
+		}
+	}
+	format, err := lookupFormat(*formatPtr)
+	if err != nil && !*perRepoPtr {
+		Exit(err)
+	}
+	if err := validCompressionLevel(*compressionLevelPtr); err != nil {
+		Exit(err)
+	}
+	archiveOpts := archiveOptions{Reproducible: *reproduciblePtr, NormalizeModes: *normalizeModesPtr, Format: format, Level: *compressionLevelPtr, RenameInvalid: *renameInvalidPtr}
+	if archiveOpts.Owner, err = parseTarIdentity(*tarOwnerPtr, lookupUserID); err != nil {
+		Exit(fmt.Errorf("Invalid -tar-owner: %w", err))
+	}
+	if archiveOpts.Group, err = parseTarIdentity(*tarGroupPtr, lookupGroupID); err != nil {
+		Exit(fmt.Errorf("Invalid -tar-group: %w", err))
+	}
+	if *tarModeMaskPtr != "" {
+		mask, err := strconv.ParseInt(*tarModeMaskPtr, 8, 32)
+		if err != nil || mask < 0 || mask > 0777 {
+			Exit(fmt.Errorf("Invalid -tar-mode-mask '%s', expected octal permission bits like 022", *tarModeMaskPtr))
+		}
+		archiveOpts.ModeMask = mask
+	}
+	tags, err := parseTagSelection(*tagsPtr, *tagsAllPtr)
+	if err != nil {
+		Exit(fmt.Errorf("Invalid -tags: %w", err))
+	}
+	encryptTo, err := parseRecipients(recipients.values)
+	if err != nil {
+		Exit(fmt.Errorf("Invalid -recipient: %w", err))
+	}
+	if err := loadIdentities(); err != nil {
+		Exit(err)
+	}
+	if encryptTo != nil && *skipTarPtr {
+		Exit(fmt.Errorf("-recipient cannot be used with -skiptar, it writes no tarball to encrypt"))
+	}
+	if *secureStagingPtr && encryptTo == nil {
+		Exit(configError(fmt.Errorf("-secure-staging requires -recipient, the tarball would be written to disk unencrypted")))
+	}
+	if encryptTo != nil && *verifyArchivePtr && identities == nil {
+		Exit(fmt.Errorf("-verify-archive of an archive encrypted to -recipient needs the -identity of one of them"))
+	}
+	if *perRepoPtr && (*skipTarPtr || encryptTo != nil || *verifyArchivePtr || *parentManifestPtr != "") {
+		Exit(fmt.Errorf("-per-repo cannot be used with -skiptar, -recipient, -verify-archive or -parent-manifest"))
+	}
+	if *cacheDirPtr != "" && (*skipTarPtr || *perRepoPtr || *secureStagingPtr || *resumePtr || *parentManifestPtr != "") {
+		Exit(fmt.Errorf("-cache-dir cannot be used with -skiptar, -per-repo, -secure-staging, -resume or -parent-manifest"))
+	}
+	if *cacheDirPtr == "" && (*reflinkPtr || *archiveEveryPtr != 1) {
+		Exit(fmt.Errorf("-archive-every and -reflink require -cache-dir"))
+	}
+	if *archiveEveryPtr < 1 {
+		Exit(fmt.Errorf("-archive-every must be at least 1"))
+	}
+	if !outFiles.set {
+		defaultOutfile = strings.TrimSuffix(defaultOutfile, archiveFormats[formatGzip].extension)
+		if len(tags.Tags) > 0 {
+			defaultOutfile += "-" + tags.Label()
 		}
+		if !*perRepoPtr {
+			defaultOutfile += format.extension + encryptTo.extension()
+		}
+		outFiles.values = []string{defaultOutfile}
+	}
+	for i := range outFiles.values {
+		outFiles.values[i] = tags.expand(outFiles.values[i])
+	}
+	*metricsFilePtr = tags.expand(*metricsFilePtr)
+
+	var concurrency *concurrencyController
+	if workersPtr.auto {
+		concurrency = newConcurrencyController(*workersMinPtr, limitWorkers(*workersMaxPtr, openFileLimit), time.Now)
+		workers = concurrency.Limit()
+		log.Printf("Adapting concurrency between %d and %d clones, starting at %d", concurrency.Floor, concurrency.Ceiling, workers)
+	} else {
+		workers = limitWorkers(workersPtr.n, openFileLimit)
+	}
+	if *resourceIntervalPtr > 0 {
+		logResources(*resourceIntervalPtr, readResources)
 	}
+	auth := envAuth()
+	// a successful run returns from main instead of calling Exit
+	defer runExitHooks(nil)
 
+	var logFile io.Writer
 	if *logFilePtr != "" {
 		f, err := os.OpenFile(*logFilePtr, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
 		if err != nil {
 			Exit(fmt.Errorf("Cannot open log file: %w", err))
 		}
-		w := io.MultiWriter(f, os.Stderr)
-		log.SetOutput(w)
+		logFile = f
+	}
+	terminal.setup(logFile, *noColorPtr)
+	if *logSyslogPtr {
+		sink, err := newSyslogSink(*syslogAddressPtr, *syslogFacilityPtr, *syslogTagPtr)
+		if err != nil {
+			Exit(fmt.Errorf("Cannot open syslog: %w", err))
+		}
+		terminal.sink = sink
+	}
+	log.SetOutput(terminal)
+	checkClock(clock())
+
+	if *otelPtr {
+		endRun, err := startTracing()
+		if err != nil {
+			Exit(fmt.Errorf("Cannot start tracing: %w", err))
+		}
+		onExit(endRun)
 	}
 
-	log.Println("Output File:", *outFilePtr)
-	log.Println("Configuration File:", *configFilePtr)
+	// SIGINT and SIGTERM cancel the clones in flight, keeping the staging directory for -resume,
+	// a second signal exits immediately
+	ctx, stopSignals := signal.NotifyContext(runContext, os.Interrupt, syscall.SIGTERM)
+	runContext = ctx
+	go func() {
+		<-ctx.Done()
+		stopSignals()
+	}()
+	onExit(startSystemd())
+	onExit(startService(stopSignals))
+	if *listenPtr != "" {
+		server, stop, err := startStatusServer(*listenPtr, *healthyWithinPtr, *triggerTokenPtr)
+		if err != nil {
+			Exit(err)
+		}
+		statusPage = server
+		onExit(stop)
+	}
+	if *progressFDPtr >= 0 && *progressFilePtr != "" {
+		Exit(fmt.Errorf("-progress-fd cannot be used with -progress-file"))
+	}
+	if *progressFDPtr >= 0 || *progressFilePtr != "" {
+		stream, err := openEventStream(*progressFDPtr, *progressFilePtr)
+		if err != nil {
+			Exit(err)
+		}
+		progressEvents = stream
+		onExit(stream.Close)
+	}
+
+	if *watchPtr {
+		// the server reads the metrics of every delta from its -metrics-file
+		metricsFile := *metricsFilePtr
+		if statusPage != nil && metricsFile == "" {
+			f, err := os.CreateTemp("", "codepack-metrics-*.prom")
+			if err != nil {
+				Exit(err)
+			}
+			f.Close()
+			metricsFile = f.Name()
+			onExit(func(error) { os.Remove(metricsFile) })
+		}
+		Finish(watchConfig(runContext, watchOptions{
+			config:        *configFilePtr,
+			format:        *configFormatPtr,
+			outs:          outFiles,
+			debounce:      *watchDebouncePtr,
+			args:          os.Args[1:],
+			metricsFile:   metricsFile,
+			queueTriggers: *queueTriggersPtr,
+		}))
+	}
+
+	log.Println("Run ID:", runID)
+	log.Println("Configuration File:", sanitizeURL(*configFilePtr))
 	if *skipTarPtr {
 		log.Println("Skipping Tarball.")
 	}
 
-	config, err := ConfigFromFile(*configFilePtr)
-	if err != nil {
-		Exit(fmt.Errorf("Failed to open Configuration file '%s': %w", *configFilePtr, err))
+	var policy *Policy
+	var policyRecord *ManifestPolicy
+	if *policyFilePtr != "" {
+		if policy, policyRecord, err = PolicyFromFile(*policyFilePtr); err != nil {
+			Exit(configError(fmt.Errorf("Invalid -policy-file '%s': %w", *policyFilePtr, err)))
+		}
+		log.Printf("Policy File: %s (sha256 %s)", *policyFilePtr, policyRecord.SHA256)
+		if host, ok := policy.allowsHost(*configFilePtr); isRemoteConfig(*configFilePtr) && !ok {
+			Exit(configError(fmt.Errorf("The policy '%s' does not allow fetching the configuration from the host %s", *policyFilePtr, host)))
+		}
 	}
 
-	tempDir, err := os.MkdirTemp(path.Join(os.TempDir()), "codepack")
+	configAllowInsecureHTTP = *configInsecureHTTPPtr
+	config, configSource, err := loadConfig(*configFilePtr, *configFormatPtr, auth)
 	if err != nil {
+		Exit(configError(fmt.Errorf("Failed to open Configuration file '%s': %w", *configFilePtr, err)))
+	}
+	if err := installHostTransports(config.Hosts); err != nil {
+		Exit(configError(err))
+	}
+	if *debugFailuresPtr != "" {
+		bundles, err := openFailureBundles(*debugFailuresPtr)
+		if err != nil {
+			Exit(err)
+		}
+		failureDebug = bundles
+	}
+	if *notifyTestPtr {
+		Finish(notifyTest(config.Notify))
+	}
+
+	if *exportPtr != exportMirror && *exportPtr != exportWorktree && *exportPtr != exportFastExport {
+		Exit(fmt.Errorf("Invalid -export '%s', use mirror, worktree or fast-export", *exportPtr))
+	}
+	for i := range config.Destinations {
+		config.Destinations[i].URL = tags.expand(config.Destinations[i].URL)
+	}
+	if config, err = selectTagged(config, tags); err != nil {
 		Exit(err)
 	}
-	defer func() {
-		// Clean up temp directory
-		if *skipTarPtr {
-			return
+	config, disabled := splitDisabled(config, *includeDisabledPtr, *maxDisabledPtr)
+	if *useGitConfigPtr {
+		if err := applyInsteadOf(config); err != nil {
+			Exit(fmt.Errorf("Cannot read the git config: %w", err))
 		}
-		log.Println("Cleaning up temporary directory...")
-		if err := os.RemoveAll(tempDir); err != nil {
-			Exit(fmt.Errorf("Failed to cleanup temporary directory'%s': %w", tempDir, err))
+	}
+	gerritAuthURLs(config, auth)
+	enableAzureDevOps(config)
+	for i := range config.Repos {
+		if config.Repos[i].Export == "" {
+			config.Repos[i].Export = *exportPtr
 		}
-	}()
+	}
+	if *ignoreFilePtr != "" {
+		patterns, err := readIgnorePatterns(*ignoreFilePtr)
+		if err != nil {
+			Exit(fmt.Errorf("Cannot read ignore file '%s': %w", *ignoreFilePtr, err))
+		}
+		for i := range config.Repos {
+			config.Repos[i].IgnorePatterns = patterns
+		}
+	}
+	if err := checkLocalSources(config.Repos, allowLocalRoots.values); err != nil {
+		Exit(err)
+	}
+	if err := checkInsecureHTTP(config.Repos, auth); err != nil {
+		Exit(err)
+	}
+	if err := checkOutputFormats(config.Repos, *perRepoPtr); err != nil {
+		Exit(err)
+	}
+	if *cacheDirPtr != "" {
+		if err := checkCacheRepos(config.Repos); err != nil {
+			Exit(err)
+		}
+	}
+	if err := checkPolicy(policy, *policyFilePtr, config.Repos, outputDestinations(outFiles, config), encryptTo != nil); err != nil {
+		Exit(err)
+	}
+	var aliases []ManifestAlias
+	if !*noDedupURLsPtr {
+		config, aliases = mergeDuplicateURLs(config)
+	}
+	if *activeSincePtr != "" {
+		cutoff, err := parseActiveSince(*activeSincePtr, clock())
+		if err != nil {
+			Exit(err)
+		}
+		var parent *Manifest
+		if *parentManifestPtr != "" {
+			if parent, err = ManifestFromFile(*parentManifestPtr); err != nil {
+				Exit(fmt.Errorf("Failed to read parent manifest '%s': %w", *parentManifestPtr, err))
+			}
+		}
+		var stale []Repository
+		config, stale = splitStale(config, cutoff, CloneOptions{Auth: auth}, parent)
+		disabled = append(disabled, stale...)
+	}
+
+	var configRepo *ManifestConfigRepo
+	if *includeConfigRepoPtr {
+		if err := checkConfigRepoPath(config); err != nil {
+			Exit(err)
+		}
+		repo, entry, err := configRepository(*configFilePtr, configSource)
+		if err != nil {
+			Exit(fmt.Errorf("Cannot include the configuration repository: %w", err))
+		}
+		log.Printf("Including the configuration repository %s at %s in '%s'", entry.URL, entry.Commit, configRepoName)
+		if entry.Modified {
+			log.Printf("WARNING: '%s' has changes not committed to the configuration repository", entry.File)
+		}
+		config.Repos = append(config.Repos, repo)
+		configRepo = entry
+	}
+
+	dests := outputDestinations(outFiles, config)
+	out := dests[0].URL
+	for _, dest := range dests {
+		log.Println("Output File:", sanitizeURL(dest.URL))
+	}
+	if len(dests) > 1 && *skipTarPtr {
+		Exit(fmt.Errorf("-skiptar writes a single directory, it cannot be used with several destinations"))
+	}
+	if *perRepoPtr && (len(dests) > 1 || strings.Contains(out, "://")) {
+		Exit(fmt.Errorf("-per-repo writes a directory, -out must be a single local path"))
+	}
+	effective := newEffectiveConfig(config, disabled, dests)
+	effective.Aliases = aliases
+	if *printConfigPtr {
+		Finish(printConfig(effective))
+	}
 
-	if err := cloneRepos(config, tempDir, auth); err != nil {
+	statePath := *statePtr
+	if statePath == "" {
+		statePath = defaultStatePath(out)
+	}
+	if *resumeUploadPtr {
+		destOpts := destFlags()
+		destOpts.Format = format
+		destOpts.Plugins = config.Plugins
+		Finish(resumeUpload(dests, destOpts, *manifestPtr, statePath, !*noCatalogPtr))
+	}
+	probeOpts := destFlags()
+	probeOpts.Plugins = config.Plugins
+	if err := checkDestinations(dests, probeOpts, *createDirsPtr); err != nil {
 		Exit(err)
 	}
 
-	if *skipTarPtr {
-		outputFilename := *outFilePtr
-		if outputFilename == defaultOutfile {
-			outputFilename = fmt.Sprintf("%s-codepack", time.Now().Format("2006-01-02"))
+	report := newRunReport(dests, *runKindPtr, len(config.Repos))
+	report.Tags, report.TagsAll = tags.Tags, tags.All
+	statusPage.SetReport(report)
+	progressEvents.RunStarted(report)
+	onExit(func(err error) { progressEvents.RunFinished(report, err) })
+	if config.Notify != nil {
+		onExit(func(err error) {
+			report.Finish(err)
+			notifyRun(config.Notify, report)
+		})
+	}
+	onExit(func(error) {
+		report.LogHosts()
+		if *metricsFilePtr == "" {
+			return
 		}
-		log.Printf("Moving '%s' to '%s'", tempDir, outputFilename)
-		if err := os.Rename(tempDir, outputFilename); err != nil {
-			Exit(fmt.Errorf("Failed to move '%s' to '%s': %w", tempDir, *outFilePtr, err))
+		if err := report.WriteHostMetrics(*metricsFilePtr); err != nil {
+			log.Println("WARNING: cannot write the -metrics-file:", err)
 		}
-		Exit(nil)
+	})
+
+	var staging billy.Filesystem
+	var state *runState
+	var cache *mirrorCache
+	tempDir := "in-memory staging"
+	runFiles := []runFile{
+		{"log", *logFilePtr, true},
+		{"state", statePath, false},
+		{"manifest", *manifestPtr, false},
+		{"metrics-file", *metricsFilePtr, false},
+		{"progress-file", *progressFilePtr, true},
+		{"health-report", *healthReportPtr, false},
+		{"inventory-csv", inventoryCSV.path, false},
+	}
+	if *secureStagingPtr {
+		if *skipTarPtr {
+			Exit(fmt.Errorf("-secure-staging cannot be used with -skiptar, it would write the repositories to disk"))
+		}
+		if *resumePtr {
+			Exit(fmt.Errorf("-resume cannot be used with -secure-staging, nothing is left to resume from memory"))
+		}
+		log.Printf("Secure staging: cloning repositories into memory, limit %d MiB per repository", *secureStagingMaxPtr)
+		staging = newModeFS(memfs.New(), "")
+	} else if *cacheDirPtr != "" {
+		if cache, err = openMirrorCache(*cacheDirPtr, *archiveEveryPtr, *reflinkPtr); err != nil {
+			Exit(err)
+		}
+		onExit(cache.Close)
+		tempDir = cache.dir
+		if err := checkOutsideStaging(tempDir, runFiles); err != nil {
+			Exit(err)
+		}
+		log.Printf("Cache: run %d of '%s', the last archive is of run %d", cache.run(), tempDir, cache.state.LastArchiveRun)
+		staging = newModeFS(osfs.New(tempDir), tempDir)
+	} else {
+		if *resumePtr {
+			state, err = loadRunState(statePath)
+			if err != nil {
+				Exit(fmt.Errorf("Cannot resume from '%s': %w", statePath, err))
+			}
+			tempDir = state.Staging
+			if err := checkOutsideStaging(tempDir, runFiles); err != nil {
+				Exit(err)
+			}
+			log.Printf("Resuming from '%s': %d repositories already cloned to '%s'", statePath, len(state.Completed), tempDir)
+		} else {
+			tempDir, err = os.MkdirTemp(path.Join(os.TempDir()), "codepack")
+			if err != nil {
+				Exit(err)
+			}
+			if err := checkOutsideStaging(tempDir, runFiles); err != nil {
+				os.RemoveAll(tempDir)
+				Exit(err)
+			}
+			state = newRunState(statePath, tempDir)
+			if err := state.write(); err != nil {
+				Exit(fmt.Errorf("Cannot write state file '%s': %w", statePath, err))
+			}
+		}
+		defer func() {
+			// Clean up temp directory
+			if *skipTarPtr {
+				return
+			}
+			log.Println("Cleaning up temporary directory...")
+			if err := os.RemoveAll(tempDir); err != nil {
+				Exit(fmt.Errorf("Failed to cleanup temporary directory'%s': %w", tempDir, err))
+			}
+		}()
+		staging = newModeFS(osfs.New(tempDir), tempDir)
 	}
 
-	if err := compressToFile(tempDir, *outFilePtr); err != nil {
-		Exit(fmt.Errorf("Failed to compress files from '%s' to '%s': %w", tempDir, *outFilePtr, err))
+	cloneOpts := CloneOptions{
+		Auth:                 auth,
+		Policy:               policy,
+		ObjectCacheSize:      int64(*maxObjectCachePtr) * 1024 * 1024,
+		LargeObjectThreshold: int64(*largeObjectThresholdPtr) * 1024 * 1024,
+		State:                state,
+		VerifyResumed:        *resumeVerifyPtr,
+		ForceReclone:         *forceReclonePtr,
+		Shuffle:              *shufflePtr,
+		Report:               report,
+		ProgressInterval:     *cloneProgressPtr,
+		DropSampleHooks:      *dropSampleHooksPtr,
+		Cache:                cache,
+	}
+	if !*secureStagingPtr {
+		cloneOpts.StagingDir = tempDir
+	}
+	if !*noPromptPtr {
+		cloneOpts.Credentials = newHostCredentials()
+	}
+	if *scanSecretsPtr {
+		cloneOpts.Secrets = &secretScanner{
+			MaxFile:   int64(*secretsMaxFilePtr) * 1024,
+			Budget:    *secretsBudgetPtr,
+			CacheSize: cloneOpts.ObjectCacheSize,
+		}
+		if *secretsAllowlistPtr != "" {
+			if cloneOpts.Secrets.Allowlist, err = readSecretAllowlist(*secretsAllowlistPtr); err != nil {
+				Exit(fmt.Errorf("Failed to read the secrets allowlist '%s': %w", *secretsAllowlistPtr, err))
+			}
+		}
+	} else if *secretsAllowlistPtr != "" {
+		Exit(fmt.Errorf("-secrets-allowlist requires -scan-secrets"))
+	}
+	if *healthReportPtr != "" {
+		cloneOpts.Health = &healthOptions{
+			LargeBlob:   int64(*healthLargeBlobPtr) * 1024 * 1024,
+			StaleMonths: *healthStaleMonthsPtr,
+			Budget:      *healthBudgetPtr,
+			CacheSize:   cloneOpts.ObjectCacheSize,
+		}
+		onExit(func(error) {
+			if err := cloneOpts.Health.WriteFile(*healthReportPtr); err != nil {
+				log.Printf("WARNING: cannot write the health report '%s': %v", *healthReportPtr, err)
+				return
+			}
+			log.Println("Wrote health report:", *healthReportPtr)
+		})
+	}
+	if *maxMemoryPtr > 0 {
+		if _, ok := readResources(); !ok {
+			log.Println("WARNING: -max-memory is not supported on this platform")
+		}
+		cloneOpts.MemoryGuard = &memoryGuard{Limit: int64(*maxMemoryPtr) * 1024 * 1024, Read: readResources, Poll: time.Second}
+	}
+	cloneOpts.Concurrency = concurrency
+	failOn := defaultFailOn(*failOnMissingPtr)
+	if *failOnPtr != "" {
+		if failOn, err = parseFailOn(*failOnPtr); err != nil {
+			Exit(err)
+		}
+		if failOn[statusMissing] && !*failOnMissingPtr {
+			Exit(fmt.Errorf("-fail-on includes missing, which -fail-on-missing=false leaves out"))
+		}
+	}
+	if *failOnIncompletePtr {
+		failOn[failOnIncomplete] = true
+	}
+	if *archiveLastKnownPtr && (failOn[statusMissing] || *parentManifestPtr == "") {
+		Exit(fmt.Errorf("-archive-last-known requires -parent-manifest and -fail-on-missing=false or a -fail-on without missing"))
+	}
+	if !failOn[statusMissing] || !failOn[statusEmpty] {
+		cloneOpts.Missing = newMissingRepos(nil, failOn)
+	}
+	if *secureStagingPtr {
+		cloneOpts.RepoSizeLimit = int64(*secureStagingMaxPtr) * 1024 * 1024
+		// go-git resolves alternates on the os filesystem only
+		cloneOpts.DisableDedup = true
+		for _, repo := range config.Repos {
+			if repo.DedupGroup != "" {
+				log.Println("WARNING: dedup_group is ignored with -secure-staging")
+				break
+			}
+		}
+	}
+	// every file of a -per-repo backup holds all the objects of its repository, and a
+	// mirror of the cache fetches in to objects of its own
+	if *perRepoPtr || cache != nil {
+		cloneOpts.DisableDedup = true
 	}
-}
 
-func compressToFile(src string, target string) error {
-	outputFile, err := os.Create(target)
-	if err != nil {
-		return fmt.Errorf("Cannot open output file: %v", err)
+	// -skiptar and -cache-dir leave the staging directory behind, so everything is cloned to disk for them
+	if *inMemoryBudgetPtr > 0 && !*skipTarPtr && !*secureStagingPtr && cache == nil {
+		if *inMemoryThresholdPtr <= 0 {
+			Exit(fmt.Errorf("-in-memory-threshold must be at least 1 MiB, use -in-memory-budget=0 to disable in-memory clones"))
+		}
+		cloneOpts.Memory = newMemoryStaging(staging, int64(*inMemoryThresholdPtr)*1024*1024, int64(*inMemoryBudgetPtr)*1024*1024)
+		staging = cloneOpts.Memory
 	}
-	return compress(src, outputFile)
-}
 
-func compress(src string, buf io.Writer) error {
-	log.Println("Compressing files...")
-	zr := gzip.NewWriter(buf)
-	tw := tar.NewWriter(zr)
+	moved := detectMoves(runContext, config, cloneOpts)
+	if moved > 0 && *updateConfigPtr {
+		if err := updateConfigURLs(*configFilePtr, config); err != nil {
+			log.Println("WARNING: cannot update the configuration:", err)
+		}
+	}
 
-	filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
-		header, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return err
+	manifest := newManifest(archiveName(out))
+	if *parentManifestPtr != "" {
+		if *skipTarPtr {
+			Exit(fmt.Errorf("-parent-manifest cannot be used with -skiptar"))
 		}
-		relPath, err := filepath.Rel(src, path)
+		parent, err := ManifestFromFile(*parentManifestPtr)
 		if err != nil {
-			return err
+			Exit(err)
 		}
+		cloneOpts.ExpectedSizes = expectedSizes(parent)
+		report.RecordParent(parent)
+		config, manifest = planIncremental(config, parent, cloneOpts, manifest.Archive)
+		if *archiveLastKnownPtr {
+			cloneOpts.Missing.lastKnown = parent
+		}
+	}
+	guard := backupGuard{FailOnEmpty: *failOnEmptyPtr, MinRepos: *minReposPtr, MinFraction: *minReposFractionPtr}
+	// a failed clone fails the run, so the backup holds every repository to clone and those of the chain
+	if result := guard.check(len(config.Repos)+len(manifest.Repos), report.Total+len(disabled)); result != nil {
+		log.Println("Backup guard:", result)
+		report.RecordGuard(result)
+		if err := result.err(); err != nil {
+			if !*secureStagingPtr {
+				removeStaging(tempDir, cache)
+			}
+			state.Remove()
+			Exit(err)
+		}
+	}
+	if !*secureStagingPtr {
+		var expected int64
+		for _, repo := range config.Repos {
+			if clonePath := path.Join(repo.Path, repo.Name); !state.Done(clonePath) {
+				expected += cloneOpts.ExpectedSizes[clonePath]
+			}
+		}
+		if err := checkStagingSpace(tempDir, expected, int64(*minFreeSpacePtr)*1024*1024, uint64(*minFreeInodesPtr)); err != nil {
+			if !state.Resumed() {
+				removeStaging(tempDir, cache)
+				state.Remove()
+			}
+			Exit(err)
+		}
+	}
+	manifest.ConfigSource = configSource
+	manifest.ConfigRepo = configRepo
+	manifest.Tags, manifest.TagsAll = tags.Tags, tags.All
+	manifest.Aliases = aliases
+	manifest.Encryption = encryptTo.manifest()
+	manifest.Policy = policyRecord
+	manifest.Config = effective
+	for _, repo := range disabled {
+		manifest.Repos = append(manifest.Repos, newSkippedManifestRepo(repo))
+	}
 
-		header.Name = filepath.ToSlash(filepath.Join("codepack", relPath))
+	if *skipTarPtr {
+		if err := cloneRepos(runContext, config, staging, cloneOpts, nil); err != nil {
+			exitResumable(err, state)
+		}
+		config = cloneOpts.Missing.resolve(config, manifest, report)
+		if config, err = cloneOpts.Secrets.resolve(config, manifest, staging); err != nil {
+			Exit(err)
+		}
+		if err := completeManifest(manifest, config, staging, nil, report); err != nil {
+			Exit(err)
+		}
+		if err := removeAll(staging, exportScratch); err != nil {
+			Exit(err)
+		}
+		outputFilename := out
+		if outputFilename == defaultOutfile {
+			outputFilename = fmt.Sprintf("%s-codepack", clock().Format("2006-01-02"))
+		}
+		log.Printf("Moving '%s' to '%s'", tempDir, outputFilename)
+		if err := os.Rename(tempDir, outputFilename); err != nil {
+			Exit(fmt.Errorf("Failed to move '%s' to '%s': %w", tempDir, out, err))
+		}
+		if err := state.Remove(); err != nil {
+			Exit(fmt.Errorf("Failed to remove state file '%s': %w", statePath, err))
+		}
+		logMoves(moved, *updateConfigPtr)
+		if err := writeInventory(inventoryCSV, report, outputFilename); err != nil {
+			Exit(err)
+		}
+		log.Printf("Run %s complete: %d repositories in '%s'", runID, len(config.Repos), outputFilename)
+		Exit(failOn.check(report))
+	}
 
-		if err := tw.WriteHeader(header); err != nil {
-			return err
+	if *perRepoPtr {
+		if err := cloneRepos(runContext, config, staging, cloneOpts, nil); err != nil {
+			exitResumable(err, state)
 		}
-		if !info.IsDir() {
-			f, err := os.Open(path)
-			if err != nil {
-				return err
+		config = cloneOpts.Missing.resolve(config, manifest, report)
+		if config, err = cloneOpts.Secrets.resolve(config, manifest, staging); err != nil {
+			Exit(err)
+		}
+		if err := writePerRepo(config, staging, out, *formatPtr, archiveOpts, manifest, report); err != nil {
+			exitResumable(infrastructureError(err), state)
+		}
+		if err := removeAll(staging, exportScratch); err != nil {
+			Exit(err)
+		}
+		if err := state.Remove(); err != nil {
+			Exit(fmt.Errorf("Failed to remove state file '%s': %w", statePath, err))
+		}
+		logMoves(moved, *updateConfigPtr)
+		if err := writeInventory(inventoryCSV, report, out); err != nil {
+			Exit(err)
+		}
+		log.Printf("Run %s complete: %d repositories in '%s'", runID, len(config.Repos), out)
+		Finish(failOn.check(report))
+	}
+
+	destOpts := destFlags()
+	destOpts.Format = format
+	destOpts.Plugins = config.Plugins
+	destOpts.Recipients = encryptTo
+	destOpts.Annotations = map[string]string{
+		"version":    VERSION,
+		"repo-count": fmt.Sprint(len(config.Repos)),
+	}
+
+	produce := func(w io.Writer) error {
+		return cloneAndArchive(config, staging, cloneOpts, w, archiveOpts, manifest)
+	}
+	if cache != nil {
+		if err := cloneRepos(runContext, config, staging, cloneOpts, nil); err != nil {
+			Exit(err)
+		}
+		config = cloneOpts.Missing.resolve(config, manifest, report)
+		if config, err = cloneOpts.Secrets.resolve(config, manifest, staging); err != nil {
+			Exit(err)
+		}
+		manifest.CacheDir = cache.dir
+		if !cache.archives() {
+			manifest.Archive = ""
+			if err := completeManifest(manifest, config, staging, nil, report); err != nil {
+				Exit(err)
+			}
+			if err := cache.finish(manifest); err != nil {
+				Exit(err)
 			}
-			if _, err := io.Copy(tw, f); err != nil {
-				return err
+			logMoves(moved, *updateConfigPtr)
+			if err := writeInventory(inventoryCSV, report, cache.dir); err != nil {
+				Exit(err)
 			}
+			if !*noCatalogPtr {
+				manifestPath := *manifestPtr
+				if manifestPath == "" {
+					manifestPath = defaultManifestPath(out)
+				}
+				if err := recordCatalog(manifest, manifestPath, nil); err != nil {
+					log.Printf("WARNING: the run is not in the catalog: %v", err)
+				}
+			}
+			log.Printf("Run %s complete: %d repositories updated in the cache '%s', run %d writes the next archive", runID, len(config.Repos), cache.dir, cache.nextArchive())
+			Finish(failOn.check(report))
 		}
-		return nil
-	})
+		snapshot, err := cache.snapshot(config)
+		if err != nil {
+			Exit(infrastructureError(err))
+		}
+		onExit(func(error) { os.RemoveAll(snapshot) })
+		staging = newModeFS(osfs.New(snapshot), snapshot)
+		produce = func(w io.Writer) error {
+			return archiveMirrors(config, staging, w, archiveOpts, manifest, report)
+		}
+	}
+	results, err := writeArchive(dests, destOpts, manifest, report, produce)
+	if err != nil {
+		exitResumable(infrastructureError(fmt.Errorf("Failed to create '%s' from '%s': %w", report.Output, tempDir, err)), state)
+	}
+	config = cloneOpts.Secrets.filter(cloneOpts.Missing.filter(config))
+	if *verifyArchivePtr {
+		if err := verifyArchives(results, dests, destOpts, staging, config, manifest, verifyLimits()); err != nil {
+			exitResumable(err, state)
+		}
+	}
+	if err := state.Remove(); err != nil {
+		Exit(fmt.Errorf("Failed to remove state file '%s': %w", statePath, err))
+	}
 
-	if err := tw.Close(); err != nil {
-		return err
+	logMoves(moved, *updateConfigPtr)
+	if err := writeInventory(inventoryCSV, report, out); err != nil {
+		Exit(err)
+	}
+	if err := finishArchive(manifest, *manifestPtr, out, results, !*noCatalogPtr); err != nil {
+		Exit(err)
+	}
+	if err := cache.finish(manifest); err != nil {
+		Exit(err)
+	}
+	// the backup is written, a -fail-on status only changes the outcome of the run
+	if err := failOn.check(report); err != nil {
+		if !*secureStagingPtr {
+			removeStaging(tempDir, cache)
+		}
+		Exit(err)
 	}
+}
 
-	if err := zr.Close(); err != nil {
-		return err
+// removeStaging removes the staging directory tempDir of a run exiting early. The mirrors
+// of a -cache-dir are kept for the next runs, only the snapshot of the run is removed
+func removeStaging(tempDir string, cache *mirrorCache) {
+	if cache != nil {
+		os.RemoveAll(filepath.Join(cache.dir, cacheSnapshotName))
+		return
 	}
+	os.RemoveAll(tempDir)
+}
 
+// writeArchive streams the archive produce writes to every destination, recording the
+// outcome in report and the checksum of the archive in manifest. It is the part of a run
+// after the repositories are staged, shared by the backup and the archive command
+func writeArchive(dests []Destination, destOpts DestinationOptions, manifest *Manifest, report *runReport, produce func(w io.Writer) error) ([]destinationResult, error) {
+	hash := sha256.New()
+	_, archiveSpan := tracer.Start(runContext, "codepack.archive", trace.WithAttributes(attribute.String("codepack.destination", report.Output)))
+	results, err := writeToDestinations(dests, destOpts, func(w io.Writer) error {
+		return destOpts.Recipients.encrypt(io.MultiWriter(w, hash), produce)
+	})
+	endSpan(archiveSpan, err)
+	report.RecordDestinations(results)
+	if err != nil {
+		return results, err
+	}
+	manifest.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return results, nil
+}
+
+// finishArchive writes manifest to manifestPath, next to out when it is empty, records the
+// run in the catalog next to it with catalog and logs the destinations written
+func finishArchive(manifest *Manifest, manifestPath string, out string, results []destinationResult, catalog bool) error {
+	if manifestPath == "" {
+		manifestPath = defaultManifestPath(out)
+	}
+	log.Println("Writing manifest:", manifestPath)
+	sdStatus("writing manifest")
+	if err := manifest.WriteFile(manifestPath); err != nil {
+		return fmt.Errorf("Failed to write manifest '%s': %w", manifestPath, err)
+	}
+	if catalog {
+		if err := recordCatalog(manifest, manifestPath, results); err != nil {
+			log.Printf("WARNING: the run is not in the catalog: %v", err)
+		}
+	}
+	var written []string
+	for _, result := range results {
+		if result.Status == "SUCCESS" {
+			written = append(written, result.URL)
+		}
+	}
+	log.Printf("Run %s complete: %d repositories in '%s', sha256 %s", runID, len(manifest.Repos), strings.Join(written, ", "), manifest.SHA256)
 	return nil
 }
 
-func cloneRepos(config *Config, tempDir string, auth *http.BasicAuth) error {
+// envAuth reads the git credentials from CODEPACK_GIT_USER and CODEPACK_GIT_PASS, nil when either is unset
+func envAuth() *http.BasicAuth {
+	username := os.Getenv("CODEPACK_GIT_USER")
+	pass := os.Getenv("CODEPACK_GIT_PASS")
+	if username == "" || pass == "" {
+		return nil
+	}
+	return &http.BasicAuth{
+		Username: username,
+		Password: pass,
+	}
+}
+
+// CloneOptions are the settings shared by every clone worker
+type CloneOptions struct {
+	Auth *http.BasicAuth
+	// RepoSizeLimit is the maximum bytes written for a single repository, 0 is unlimited
+	RepoSizeLimit int64
+	// ObjectCacheSize is the size in bytes of each worker's go-git object cache
+	ObjectCacheSize int64
+	// LargeObjectThreshold is the size in bytes above which objects are streamed
+	// from the packfile instead of being read in to memory, 0 is unlimited
+	LargeObjectThreshold int64
+	// DisableDedup clones every repository standalone, ignoring dedup_group
+	DisableDedup bool
+	// State records completed clones, repositories it lists from an interrupted run are not cloned again
+	State *runState
+	// VerifyResumed checks the references of repositories skipped because of State
+	VerifyResumed bool
+	// ForceReclone replaces a repository already at the clone path instead of fetching in to it
+	ForceReclone bool
+	// ExpectedSizes are the object store sizes of an earlier run by clone path, used to start the largest clones first
+	ExpectedSizes map[string]int64
+	// Shuffle dispatches repositories of the same priority in random order
+	Shuffle bool
+	// Credentials are asked on the terminal for hosts requiring authentication, nil never prompts
+	Credentials *hostCredentials
+	// Policy is the -policy-file, nil without one. The URL a repository moved to must be on a host it allows
+	Policy *Policy
+	// Report records the outcome of every clone for notifications
+	Report *runReport
+	// ProgressInterval is how often the progress of a clone is logged, 0 disables it
+	ProgressInterval time.Duration
+	// Missing collects the repositories missing from the remote, nil fails the run on them
+	Missing *missingRepos
+	// MemoryGuard pauses starting clones while the process uses too much memory, nil never pauses
+	MemoryGuard *memoryGuard
+	// Concurrency adapts the clones running at once for -workers auto, nil runs workers
+	Concurrency *concurrencyController
+	// Health analyzes every clone for -health-report, nil analyzes nothing
+	Health *healthOptions
+	// Secrets scans every clone for -scan-secrets, nil scans nothing
+	Secrets *secretScanner
+	// Memory clones small repositories in memory for -in-memory-budget, nil clones all on disk
+	Memory *memoryStaging
+	// StagingDir is the staging directory on disk, empty with -secure-staging
+	StagingDir string
+	// DropSampleHooks leaves the *.sample hooks out of the mirrors
+	DropSampleHooks bool
+	// Cache is the -cache-dir the mirrors of earlier runs are fetched in to, nil clones every repository
+	Cache *mirrorCache
+}
+
+// exitResumable exits with err, keeping the staging directory and state file of the
+// run so it can be continued with -resume
+func exitResumable(err error, state *runState) {
+	if state != nil {
+		log.Printf("Staging directory '%s' was kept, run again with -resume to continue", state.Staging)
+	}
+	Exit(err)
+}
+
+// cloneResult is sent by a clone worker when it starts cloning a repository and
+// again when the clone finished, with err set when it failed
+type cloneResult struct {
+	index   int
+	url     string
+	path    string
+	started bool
+	err     error
+}
+
+// cloneRepos mirrors every configured repository into staging, when cloned is
+// not nil the outcome of each clone is sent to it as soon as the clone finishes
+func cloneRepos(ctx context.Context, config *Config, staging billy.Filesystem, opts CloneOptions, cloned chan<- clonedRepo) error {
 	var wg sync.WaitGroup
 	var failures atomic.Int32
 	var successes atomic.Int32
+	var missing atomic.Int32
+	var excluded atomic.Int32
+	var inFlight atomic.Int32
+	// conflicts are the failures at clone paths already holding a repository
+	var conflicts atomic.Int32
+	// stagingFull is set by the first clone failing for a full staging filesystem, no
+	// further clone is dispatched as every one would fail the same way
+	var stagingFull atomic.Pointer[stagingFullError]
 
 	type request struct {
-		url  string
-		path string
+		index     int
+		repo      Repository
+		url       string
+		path      string
+		fs        billy.Filesystem
+		cacheSize int64
+		group     *dedupGroup
 	}
-	resultChan := make(chan string)
-
+	if err := createCloneDirs(staging, config); err != nil {
+		return err
+	}
+	results := make(chan cloneResult)
 	repoChan := make(chan request)
 
-	for i := 0; i < int(math.Min(float64(workers), float64(len(config.Repos)))); i++ {
+	pool := workers
+	if opts.Concurrency != nil {
+		pool = opts.Concurrency.Ceiling
+	}
+	for i := 0; i < int(math.Min(float64(pool), float64(len(config.Repos)))); i++ {
 		go func() {
-			for {
-				req := <-repoChan
-				resultChan <- fmt.Sprintf("Cloning %s to path %s", req.url, req.path)
-				if err := bareMirrorClone(req.url, req.path, auth); err != nil {
-					resultChan <- fmt.Sprintf("Cloning %s to path %s failed: %v", req.url, req.path, err)
+			for req := range repoChan {
+				inFlight.Add(1)
+				results <- cloneResult{index: req.index, url: req.url, path: req.path, started: true}
+				progressEvents.RepoStarted(req.url, req.path)
+				var alt *alternateSource
+				isPrimary := req.group != nil && req.group.primary == req.path
+				if req.group != nil && !isPrimary {
+					<-req.group.done
+					if req.group.ok {
+						alt = newAlternateSource(req.group, req.path)
+					}
+				}
+				cloneStart := time.Now()
+				spanCtx, span := startCloneSpan(ctx, req.repo, req.path)
+				spanCtx = failureDebug.trace(spanCtx)
+				var err error
+				switch {
+				case req.repo.exported():
+					err = exportOrResume(spanCtx, staging, req.repo, req.path, req.cacheSize, opts)
+				case req.group == nil && !opts.State.Done(req.path) && opts.Memory.clone(req.repo, req.path, opts.ExpectedSizes[req.path], func(fs billy.Filesystem) error {
+					return cloneWithRetries(spanCtx, req.repo, fs, req.cacheSize, opts, nil)
+				}):
+					// cloned in memory and mounted at req.path of staging
+				default:
+					err = resumeOrClone(spanCtx, staging, req.repo, req.path, req.fs, req.cacheSize, opts, alt)
+				}
+				if tracing {
+					span.SetAttributes(attribute.Int64("codepack.size", dirSize(req.fs, "objects")))
+				}
+				endSpan(span, err)
+				if err == nil && req.repo.IncludeHostMetadata != nil && *req.repo.IncludeHostMetadata {
+					writeHostMetadata(ctx, req.repo, req.fs, opts)
+				}
+				// a clone in memory is gone once the process exits, a resumed run clones it again
+				if err == nil && !opts.Memory.holds(req.path) {
+					if stateErr := opts.State.MarkDone(req.path); stateErr != nil {
+						log.Println("WARNING: cannot update state file:", stateErr)
+					}
+				}
+				var secrets *secretScan
+				if err == nil {
+					secrets, err = opts.Secrets.check(req.repo, req.path, req.fs)
+				}
+				if isPrimary {
+					req.group.ok = err == nil
+					close(req.group.done)
+				}
+				switch {
+				case err == nil:
+					opts.Report.Record(req.repo, req.path, err)
+					successes.Add(1)
+				case opts.Missing.tolerates(err):
+					opts.Missing.add(req.path, err)
+					opts.Report.RecordMissing(req.repo, req.path, err)
+					missing.Add(1)
+				case opts.Secrets.excludes(err):
+					opts.Secrets.add(req.path)
+					opts.Report.RecordExcluded(req.repo, req.path)
+					excluded.Add(1)
+				default:
+					if isDiskFull(err) {
+						full := &stagingFullError{clonePath: req.path, reason: diskFullReason(opts.StagingDir, err), err: err}
+						if stagingFull.CompareAndSwap(nil, full) {
+							log.Printf("%v, no further repository is cloned", full)
+						}
+					}
+					if errors.Is(err, git.ErrRepositoryAlreadyExists) {
+						conflicts.Add(1)
+					}
+					opts.Report.Record(req.repo, req.path, err)
+					failureDebug.write(spanCtx, req.repo, req.path, opts.Report.statusOf(req.path, err), err, cloneStart)
 					failures.Add(1)
-					wg.Done()
-					continue
 				}
-
-				resultChan <- fmt.Sprintf("Cloned %s to path %s", req.url, req.path)
-				successes.Add(1)
+				opts.Report.RecordSecrets(req.path, secrets)
+				opts.Report.RecordDuration(req.path, time.Since(cloneStart))
+				progressEvents.RepoFinished(req.url, req.path, opts.Report.statusOf(req.path, err), err, time.Since(cloneStart))
+				opts.Concurrency.release(cloneOutcome{Host: repoHost(req.url), Duration: time.Since(cloneStart), Err: err})
+				sdStatus("cloning %d/%d", successes.Load()+failures.Load()+missing.Load()+excluded.Load(), len(config.Repos))
+				results <- cloneResult{index: req.index, url: req.url, path: req.path, err: err}
+				if cloned != nil {
+					cloned <- clonedRepo{index: req.index, path: req.path, err: err}
+				}
+				if err == nil {
+					opts.Health.record(req.repo, req.path, req.fs, opts.Report)
+				}
+				inFlight.Add(-1)
 				wg.Done()
 			}
 		}()
 	}
 
-	// Log results from each goroutine
+	// Log the results of every worker until they are all done and results is closed
+	loggerDone := make(chan struct{})
 	go func() {
-		for {
-			msg := <-resultChan
-			if msg == "done" {
-				log.Println("Cloning complete")
-				wg.Done()
-				break
+		defer close(loggerDone)
+		for result := range results {
+			switch {
+			case result.started:
+				log.Printf("Cloning %s to path %s", result.url, result.path)
+			case result.err != nil:
+				log.Printf("Cloning %s to path %s failed: %v", result.url, result.path, result.err)
+			default:
+				log.Printf("Cloned %s to path %s", result.url, result.path)
 			}
-			log.Println(msg)
 		}
+		log.Println("Cloning complete")
 	}()
 
-	for _, repo := range config.Repos {
+	order := dispatchOrder(config, opts.ExpectedSizes, opts.Shuffle)
+	logDispatchOrder(config, order, opts.ExpectedSizes)
+
+	groups := make(map[string]*dedupGroup)
+	for n, i := range order {
+		repo := config.Repos[i]
+		if full := stagingFull.Load(); full != nil {
+			log.Printf("Not cloning the %d remaining repositories, the staging filesystem is %s", len(order)-n, full.reason)
+			for _, j := range order[n:] {
+				rest := config.Repos[j]
+				opts.Report.Record(rest, path.Join(rest.Path, rest.Name), fmt.Errorf("Not cloned, the staging filesystem is %s: %w", full.reason, full.err))
+				failures.Add(1)
+			}
+			break
+		}
 		wg.Add(1)
-		clonePath := path.Join(tempDir, repo.Path, repo.Name)
-		repoChan <- request{url: repo.URL, path: clonePath}
+		clonePath := path.Join(repo.Path, repo.Name)
+		repoFS, err := staging.Chroot(clonePath)
+		if err != nil {
+			return err
+		}
+		var group *dedupGroup
+		if repo.DedupGroup != "" && !opts.DisableDedup && !repo.exported() {
+			group = groups[repo.DedupGroup]
+			if group == nil {
+				group = &dedupGroup{name: repo.DedupGroup, primary: clonePath, fs: repoFS, done: make(chan struct{})}
+				groups[repo.DedupGroup] = group
+			}
+			group.members = append(group.members, clonePath)
+		}
+		cacheSize := opts.ObjectCacheSize
+		if repo.MaxObjectCache > 0 {
+			cacheSize = int64(repo.MaxObjectCache) * 1024 * 1024
+		}
+		opts.MemoryGuard.wait(func() int { return int(inFlight.Load()) })
+		opts.Concurrency.acquire()
+		repoChan <- request{
+			index:     i,
+			repo:      repo,
+			url:       repo.URL,
+			path:      clonePath,
+			fs:        newSizeLimitFS(repoFS, opts.RepoSizeLimit),
+			cacheSize: cacheSize,
+			group:     group,
+		}
 	}
 
+	close(repoChan)
 	wg.Wait()
-	wg.Add(1)
-	resultChan <- "done"
-	// Wait for loging to be competed to avoid race condition
-	wg.Wait()
+	close(results)
+	<-loggerDone
+
+	logDedupSavings(groups, staging)
 
+	if profile := opts.Concurrency.Profile(); len(profile) > 0 {
+		log.Println("Concurrency:", profileSummary(profile))
+		opts.Report.RecordConcurrency(profile)
+	}
+
+	for _, group := range opts.Report.FailureGroups() {
+		log.Println(group)
+	}
+	if missing.Load() != 0 {
+		log.Printf("WARNING: %d repositories are missing from the remote or empty", missing.Load())
+	}
+	if full := stagingFull.Load(); full != nil {
+		return &exitCodeError{err: full, code: exitCodeInfrastructure}
+	}
+	if conflicts.Load() != 0 {
+		return &exitCodeError{err: fmt.Errorf("%d failure(s) cloning repositories, %d at clone paths already holding a repository, check log for details", failures.Load(), conflicts.Load()), code: exitCodeStagingConflict}
+	}
 	if failures.Load() != 0 {
 		return fmt.Errorf("%d failure(s) cloning repositories, check log for details", failures.Load())
 	}
@@ -234,34 +1340,144 @@ func cloneRepos(config *Config, tempDir string, auth *http.BasicAuth) error {
 	return nil
 }
 
-type Config struct {
-	Repos []Repository `yaml:"repos"`
+// cloneWithRetries clones repo, removing what a failed attempt left behind and trying
+// again up to the configured number of retries
+func cloneWithRetries(ctx context.Context, repo Repository, fs billy.Filesystem, cacheSize int64, opts CloneOptions, alt *alternateSource) error {
+	var err error
+	for attempt := 0; attempt <= repo.retries(); attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying %s (%d/%d) after: %v", repo.URL, attempt, repo.retries(), err)
+			if err := removePartialClone(fs); err != nil {
+				return fmt.Errorf("Cannot remove failed clone of '%s': %w", repo.URL, err)
+			}
+			resetSizeLimit(fs)
+		}
+		err = cloneAttempt(ctx, repo, fs, cacheSize, opts, alt)
+		if err == nil || ctx.Err() != nil || errors.Is(err, errFilterUnsupported) {
+			return err
+		}
+		if category := classifyCloneError(err); !retryable(category) {
+			if attempt < repo.retries() {
+				log.Printf("Not retrying %s after a %s failure", repo.URL, category)
+			}
+			return err
+		}
+	}
+	return err
+}
+
+func cloneAttempt(ctx context.Context, repo Repository, fs billy.Filesystem, cacheSize int64, opts CloneOptions, alt *alternateSource) error {
+	if timeout := repo.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return withHostOverrides(bareMirrorClone(ctx, repo, fs, cacheSize, opts, alt), repo.URL)
 }
 
-type Repository struct {
-	Name string `yaml:"name"`
-	URL  string `yaml:"url"`
-	Path string `yaml:"path"`
+// repoAuth is the authentication used for repo, its own auth setting replaces the global credentials
+func repoAuth(repo Repository, opts CloneOptions) *http.BasicAuth {
+	auth := opts.Auth
+	if repo.Auth != nil {
+		auth = repo.Auth.BasicAuth()
+	}
+	if auth == nil && (!isPlainHTTP(repo.URL) || repo.allowsInsecureHTTP()) {
+		auth = opts.Credentials.Get(repo.URL)
+	}
+	if auth == nil && isAzureDevOps(repo.URL) {
+		return azureDevOpsAuth(repo)
+	}
+	if auth == nil && isCodeCommit(repo.URL) {
+		signed, err := codeCommitAuth(context.Background(), repo, time.Now())
+		if err != nil {
+			log.Printf("WARNING: cannot sign CodeCommit credentials for %s: %v", repo.URL, err)
+			return nil
+		}
+		return signed
+	}
+	return auth
 }
 
-func ConfigFromFile(filename string) (*Config, error) {
-	f, err := os.Open(filename)
+// errFilterUnsupported fails repositories with a partial clone filter, a filtered mirror
+// silently missing blobs must never be mistaken for a complete backup
+var errFilterUnsupported = errors.New("requires a git backend with partial clone support, go-git cannot negotiate filters")
+
+func bareMirrorClone(ctx context.Context, repo Repository, fs billy.Filesystem, cacheSize int64, opts CloneOptions, alt *alternateSource) error {
+	if repo.Filter != "" {
+		return fmt.Errorf("filter '%s' %w", repo.Filter, errFilterUnsupported)
+	}
+	storage := filesystem.NewStorageWithOptions(fs, cache.NewObjectLRU(cache.FileSize(cacheSize)), filesystem.Options{
+		LargeObjectThreshold: opts.LargeObjectThreshold,
+	})
+	// a mirror taken out of an archive brings its own objects, nothing is shared with alt
+	_, _, fromArchive := archiveSource(repo.URL)
+	if alt != nil && !fromArchive {
+		if err := seedAlternates(storage, fs, alt); err != nil {
+			return fmt.Errorf("Cannot share objects with '%s': %w", alt.rel, err)
+		}
+	}
+	var err error
+	if fromArchive {
+		err = cloneFromArchive(ctx, repo, fs)
+	} else {
+		progress := opts.startProgress(path.Join(repo.Path, repo.Name), fs)
+		_, err = git.CloneContext(ctx, storage, nil, &git.CloneOptions{
+			URL:      repo.URL,
+			Mirror:   true,
+			Auth:     transportAuth(repo, opts),
+			Depth:    repo.depth(),
+			Progress: progress.sideband(),
+		})
+		progress.Stop()
+	}
+	if errors.Is(err, plumbing.ErrReferenceNotFound) && hasReferences(storage) {
+		// the remote HEAD names a branch it does not have, the references are fetched and
+		// HEAD is left at the default branch like git clone --mirror does, see checkHead
+		log.Printf("WARNING: HEAD of %s names a branch the remote does not have", repo.URL)
+		err = nil
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	config := new(Config)
-
-	err = yaml.NewDecoder(f).Decode(config)
-	return config, err
+	if len(repo.ExcludeRefs) > 0 {
+		if err := removeExcludedRefs(storage, repo); err != nil {
+			return err
+		}
+	}
+	if repo.Pin != "" {
+		if err := applyPin(storage, repo); err != nil {
+			return err
+		}
+	}
+	if alt != nil && !fromArchive {
+		if err := removeSeedRefs(storage); err != nil {
+			return err
+		}
+	}
+	return completeMirror(storage, fs, repo, opts.DropSampleHooks)
 }
 
-func bareMirrorClone(url string, path string, auth *http.BasicAuth) error {
-	_, err := git.PlainClone(path, true, &git.CloneOptions{
-		URL:    url,
-		Mirror: true,
-		Auth:   auth,
+// removeExcludedRefs deletes the references of the mirror matching the exclude_refs patterns of repo
+func removeExcludedRefs(s *filesystem.Storage, repo Repository) error {
+	refs, err := s.IterReferences()
+	if err != nil {
+		return err
+	}
+	var names []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if repo.excluded(ref.Name().String()) {
+			names = append(names, ref.Name())
+		}
+		return nil
 	})
-
-	return err
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
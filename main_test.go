@@ -0,0 +1,499 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"gopkg.in/yaml.v3"
+)
+
+// TestMain runs main instead of the tests when the test binary is started by runCodePack
+func TestMain(m *testing.M) {
+	if os.Getenv("CODEPACK_TEST_MAIN") == "1" {
+		os.Args = append([]string{"codepack"}, os.Args[1:]...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runCodePack runs codepack with args in dir and returns its output and exit code
+func runCodePack(t *testing.T, dir string, env []string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "CODEPACK_TEST_MAIN=1"), env...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), 0
+}
+
+func TestSecureStagingRequiresRecipient(t *testing.T) {
+	dir := t.TempDir()
+	out, code := runCodePack(t, dir, nil, "-secure-staging", "-out", "codepack.tar.gz")
+	if code != exitCodeConfig {
+		t.Errorf("-secure-staging without -recipient exited with %d, expected %d:\n%s", code, exitCodeConfig, out)
+	}
+	if !strings.Contains(out, "-secure-staging requires -recipient") {
+		t.Errorf("-secure-staging without -recipient printed:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "codepack.tar.gz")); !os.IsNotExist(err) {
+		t.Error("a tarball was written")
+	}
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ = runCodePack(t, dir, nil, "-secure-staging", "-recipient", identity.Recipient().String(), "-config", "missing.yaml")
+	if strings.Contains(out, "-secure-staging requires -recipient") {
+		t.Errorf("-secure-staging with -recipient was rejected:\n%s", out)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "version", args: []string{"-version"}, code: 1},
+		{name: "subcommand", args: []string{"completion", "bash"}, code: 0},
+		{name: "failed subcommand", args: []string{"completion", "tcsh"}, code: 255},
+	} {
+		out, code := runCodePack(t, dir, nil, tc.args...)
+		if code != tc.code {
+			t.Errorf("%s: exited with %d, expected %d:\n%s", tc.name, code, tc.code, out)
+		}
+	}
+}
+
+func TestConfigErrorsExitCode(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "invalid.yaml"), []byte("repos: [\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, config := range map[string]string{
+		"missing file":      "missing.yaml",
+		"invalid file":      "invalid.yaml",
+		"unreachable https": "https://127.0.0.1:1/codepack.yaml",
+		"missing git repo":  "file://" + filepath.ToSlash(filepath.Join(dir, "missing.git")) + "#codepack.yaml",
+	} {
+		out, code := runCodePack(t, dir, nil, "-config", config, "-out", "codepack.tar.gz")
+		if code != exitCodeConfig {
+			t.Errorf("%s: exited with %d, expected %d:\n%s", name, code, exitCodeConfig, out)
+		}
+		if !strings.Contains(out, "Failed to open Configuration file") {
+			t.Errorf("%s: printed:\n%s", name, out)
+		}
+	}
+}
+
+func TestConfigRejectsBranchesAndLFS(t *testing.T) {
+	for name, data := range map[string]string{
+		"branches":          "repos:\n  - url: https://example.com/a.git\n    branches: [main]\n",
+		"lfs":               "repos:\n  - url: https://example.com/a.git\n    lfs: true\n",
+		"defaults branches": "defaults:\n  branches: [main]\nrepos:\n  - url: https://example.com/a.git\n",
+		"defaults lfs":      "defaults:\n  lfs: true\nrepos:\n  - url: https://example.com/a.git\n",
+	} {
+		_, err := ConfigFromReader(strings.NewReader(data), "yaml")
+		if err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("%s: expected the configuration to be rejected, got %v", name, err)
+		}
+	}
+	data := "defaults:\n  lfs: true\n  branches: [main]\nrepos:\n  - url: https://example.com/a.git\n    lfs: false\n    branches: []\n"
+	if _, err := ConfigFromReader(strings.NewReader(data), "yaml"); err != nil {
+		t.Errorf("a repository overriding the defaults was rejected: %v", err)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		field      string
+		defaults   string
+		override   string
+		get        func(Repository) any
+		inherited  any
+		overridden any
+	}{
+		{"depth", "depth: 5", "depth: 0", func(r Repository) any { return r.depth() }, 5, 0},
+		{"retries", "retries: 3", "retries: 0", func(r Repository) any { return r.retries() }, 3, 0},
+		{"timeout", "timeout: 30m", "timeout: 0s", func(r Repository) any { return r.timeout() }, 30 * time.Minute, time.Duration(0)},
+		{"auth", "auth: {username_env: A_USER, password_env: A_PASS}", "auth: {username_env: B_USER, password_env: B_PASS}", func(r Repository) any { return *r.Auth }, RepoAuth{UsernameEnv: "A_USER", PasswordEnv: "A_PASS"}, RepoAuth{UsernameEnv: "B_USER", PasswordEnv: "B_PASS"}},
+		{"path_prefix", "path_prefix: mirror", "path_prefix: ''", func(r Repository) any { return r.Path }, "mirror/team", "team"},
+		{"exclude_refs", "exclude_refs: [refs/pull/*]", "exclude_refs: []", func(r Repository) any { return r.ExcludeRefs }, []string{"refs/pull/*"}, []string{}},
+		{"max_object_cache", "max_object_cache: 64", "max_object_cache: 16", func(r Repository) any { return r.MaxObjectCache }, 64, 16},
+		{"include_host_metadata", "include_host_metadata: true", "include_host_metadata: false", func(r Repository) any { return *r.IncludeHostMetadata }, true, false},
+		{"export", "export: worktree", "export: mirror", func(r Repository) any { return r.Export }, "worktree", "mirror"},
+		{"output_format", "output_format: zstd", "output_format: gzip", func(r Repository) any { return r.OutputFormat }, "zstd", "gzip"},
+		{"secrets", "secrets: fail", "secrets: warn", func(r Repository) any { return r.secretsPolicy() }, "fail", "warn"},
+		{"in_memory", "in_memory: true", "in_memory: false", func(r Repository) any { return *r.InMemory }, true, false},
+		{"tags", "tags: [critical]", "tags: []", func(r Repository) any { return r.Tags }, []string{"critical"}, []string{}},
+		{"allow_insecure_http", "allow_insecure_http: true", "allow_insecure_http: false", func(r Repository) any { return r.allowsInsecureHTTP() }, true, false},
+		{"remote_config", "remote_config: {name: upstream}", "remote_config: {name: origin}", func(r Repository) any { return r.RemoteConfig.Name }, "upstream", "origin"},
+		{"branches", "branches: [main]", "branches: []", func(r Repository) any { return r.Branches }, []string{"main"}, []string{}},
+		{"lfs", "lfs: true", "lfs: false", func(r Repository) any { return *r.LFS }, true, false},
+	} {
+		var defaults RepoDefaults
+		if err := yaml.Unmarshal([]byte(tc.defaults), &defaults); err != nil {
+			t.Fatalf("%s: %v", tc.field, err)
+		}
+		for _, repoCase := range []struct {
+			yaml     string
+			expected any
+		}{
+			{"path: team", tc.inherited},
+			{"path: team\n" + tc.override, tc.overridden},
+		} {
+			var repo Repository
+			if err := yaml.Unmarshal([]byte(repoCase.yaml), &repo); err != nil {
+				t.Fatalf("%s: %v", tc.field, err)
+			}
+			repo.applyDefaults(defaults)
+			if got := tc.get(repo); !reflect.DeepEqual(got, repoCase.expected) {
+				t.Errorf("%s: a repository with %q has %#v, expected %#v", tc.field, repoCase.yaml, got, repoCase.expected)
+			}
+		}
+	}
+}
+
+// testSignature is the author of the commits of test repositories
+var testSignature = &object.Signature{Name: "CodePack", Email: "codepack@example.com", When: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}
+
+// newTestRepo creates a repository in dir with a commit on main for each of files, pairs
+// of a path and its content
+func newTestRepo(t testing.TB, dir string, files ...[2]string) *git.Repository {
+	t.Helper()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName("main"))); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		commitTestFile(t, repo, file[0], []byte(file[1]))
+	}
+	return repo
+}
+
+// commitTestFile writes content to name in the worktree of repo and commits it
+func commitTestFile(t testing.TB, repo *git.Repository, name string, content []byte) plumbing.Hash {
+	t.Helper()
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := worktree.Filesystem.Join(name)
+	if err := os.MkdirAll(filepath.Join(worktree.Filesystem.Root(), filepath.Dir(filename)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worktree.Filesystem.Root(), filename), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := worktree.Commit("Add "+name, &git.CommitOptions{Author: testSignature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// syntheticRepo creates a repository of files files of size random bytes, which do not
+// compress, changed in a few places by each of revisions commits so that the pack holds
+// long delta chains
+func syntheticRepo(t testing.TB, files int, size int, revisions int) string {
+	t.Helper()
+	dir := t.TempDir()
+	repo := newTestRepo(t, dir)
+	random := rand.New(rand.NewSource(1))
+	contents := make([][]byte, files)
+	for i := range contents {
+		contents[i] = make([]byte, size)
+		random.Read(contents[i])
+	}
+	for revision := 0; revision <= revisions; revision++ {
+		for i, content := range contents {
+			if revision > 0 {
+				random.Read(content[random.Intn(size-64):][:64])
+			}
+			commitTestFile(t, repo, fmt.Sprintf("blobs/%03d.bin", i), content)
+		}
+	}
+	return dir
+}
+
+// samplePeakHeap records the largest heap in use into peak until the returned function is called
+func samplePeakHeap(peak *uint64) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > *peak {
+				*peak = stats.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func TestBareMirrorCloneSmallObjectCache(t *testing.T) {
+	source := syntheticRepo(t, 2, 256*1024, 3)
+	fs := osfs.New(t.TempDir())
+	opts := CloneOptions{LargeObjectThreshold: 64 * 1024}
+	if err := bareMirrorClone(context.Background(), Repository{Name: "synthetic", URL: source}, fs, 1024*1024, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := git.Open(filesystem.NewStorage(fs, cache.NewObjectLRUDefault()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := mirror.Reference(plumbing.NewBranchReferenceName("main"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := mirror.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := commits.ForEach(func(c *object.Commit) error {
+		count++
+		_, err := c.Tree()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 8 {
+		t.Errorf("mirror has %d commits, expected 8", count)
+	}
+}
+
+// readHistory reads every blob of every commit of the mirror in fs through a storage with
+// an object cache of cacheSize, like the health and secret scans read a clone back
+func readHistory(t testing.TB, fs billy.Filesystem, cacheSize int64, threshold int64) {
+	t.Helper()
+	storage := filesystem.NewStorageWithOptions(fs, cache.NewObjectLRU(cache.FileSize(cacheSize)), filesystem.Options{LargeObjectThreshold: threshold})
+	mirror, err := git.Open(storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := mirror.Reference(plumbing.NewBranchReferenceName("main"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := mirror.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = commits.ForEach(func(c *object.Commit) error {
+		files, err := c.Files()
+		if err != nil {
+			return err
+		}
+		return files.ForEach(func(f *object.File) error {
+			r, err := f.Reader()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = io.Copy(io.Discard, r)
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkBareMirrorClone clones a synthetic repository of 4 files of 4 MiB revised 16
+// times and reads its history back, with a 16 MiB -max-object-cache and a 1 MiB
+// -large-object-threshold and with a cache holding the whole repository and no threshold,
+// reporting the peak heap
+func BenchmarkBareMirrorClone(b *testing.B) {
+	source := syntheticRepo(b, 4, 2*1024*1024, 8)
+	for _, bc := range []struct {
+		name      string
+		cacheSize int64
+		threshold int64
+	}{
+		{name: "bounded", cacheSize: 16 * 1024 * 1024, threshold: 1024 * 1024},
+		{name: "unbounded", cacheSize: 1024 * 1024 * 1024},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var clonePeak, readPeak uint64
+			for i := 0; i < b.N; i++ {
+				fs := osfs.New(b.TempDir())
+				runtime.GC()
+				stop := samplePeakHeap(&clonePeak)
+				err := bareMirrorClone(context.Background(), Repository{Name: "synthetic", URL: source}, fs, bc.cacheSize, CloneOptions{LargeObjectThreshold: bc.threshold}, nil)
+				stop()
+				if err != nil {
+					b.Fatal(err)
+				}
+				runtime.GC()
+				stop = samplePeakHeap(&readPeak)
+				readHistory(b, fs, bc.cacheSize, bc.threshold)
+				stop()
+			}
+			b.ReportMetric(float64(clonePeak)/(1024*1024), "clone-peak-heap-MiB")
+			b.ReportMetric(float64(readPeak)/(1024*1024), "read-peak-heap-MiB")
+		})
+	}
+}
+
+// readArchiveEntry is the content of the entry name of the tar.gz filename
+func readArchiveEntry(t *testing.T, filename string, name string) []byte {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatalf("%s has no entry %s: %v", filename, name, err)
+		}
+		if header.Name == name {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}
+	}
+}
+
+// jsonRunID is the run_id of the JSON object data
+func jsonRunID(t *testing.T, what string, data []byte) string {
+	t.Helper()
+	var v struct {
+		RunID string `json:"run_id"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	return v.RunID
+}
+
+func TestRunIDConsistency(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	config := `notify:
+  exec:
+    command: ["sh", "-c", "cat > notify.json"]
+repos:
+  - name: app
+    path: team
+    url: ` + filepath.Join(dir, "src") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runCodePack(t, dir, nil, "-config", "codepack.yaml", "-out", "backup.tar.gz", "-metrics-file", "codepack.prom", "-progress-file", "events.jsonl")
+	if code != 0 {
+		t.Fatalf("run exited with %d:\n%s", code, out)
+	}
+
+	summary := regexp.MustCompile(`Run (\S+) complete`).FindStringSubmatch(out)
+	if summary == nil {
+		t.Fatalf("no summary of the run in:\n%s", out)
+	}
+	id := summary[1]
+	if !regexp.MustCompile(`^\d{8}T\d{6}Z-[0-9a-f]+$`).MatchString(id) {
+		t.Errorf("run ID %q is not a timestamp with a random suffix", id)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if !strings.HasPrefix(line, "DEBUG ["+id+"] ") {
+			t.Errorf("log line without the run ID: %s", line)
+		}
+	}
+
+	read := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	artifacts := map[string][]byte{
+		"manifest":           read("backup.tar.gz.manifest.json"),
+		"codepack-info.json": readArchiveEntry(t, filepath.Join(dir, "backup.tar.gz"), "codepack/"+manifestName),
+		"notification":       read("notify.json"),
+	}
+	for what, data := range artifacts {
+		if got := jsonRunID(t, what, data); got != id {
+			t.Errorf("%s has run ID %q, the log %q", what, got, id)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(read("events.jsonl"))), "\n") {
+		if got := jsonRunID(t, "progress event", []byte(line)); got != id {
+			t.Errorf("progress event %s has run ID %q, the log %q", line, got, id)
+		}
+	}
+	var catalog struct {
+		Runs []struct {
+			RunID string `json:"run_id"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(read("catalog.json"), &catalog); err != nil || len(catalog.Runs) != 1 || catalog.Runs[0].RunID != id {
+		t.Errorf("catalog records %+v, the log %q", catalog.Runs, id)
+	}
+	if metrics := string(read("codepack.prom")); !strings.Contains(metrics, fmt.Sprintf("codepack_run_info{run_id=%q,", id)) {
+		t.Errorf("metrics do not carry run ID %q:\n%s", id, metrics)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+const (
+	manifestFormatVersion = 1
+	// manifestName is the name of the manifest inside the archive and the staging directory
+	manifestName = "codepack-info.json"
+)
+
+// Manifest describes the repositories captured by a run and the archives holding them
+type Manifest struct {
+	FormatVersion   int    `json:"format_version"`
+	CodePackVersion string `json:"codepack_version"`
+	Created         string `json:"created,omitempty"`
+	// RunID is the ID of the run that wrote the manifest, it prefixes every line of its log
+	RunID string `json:"run_id,omitempty"`
+	// Archive is the file name of the archive written by the run
+	Archive string `json:"archive"`
+	// SHA256 is the checksum of Archive, only known outside of the archive itself
+	SHA256 string `json:"sha256,omitempty"`
+	// ConfigSource is set when the configuration was fetched from a remote location
+	ConfigSource *ConfigSource `json:"config_source,omitempty"`
+	// ConfigRepo is the commit of the configuration repository archived with -include-config-repo
+	ConfigRepo *ManifestConfigRepo `json:"config_repo,omitempty"`
+	// Policy is the -policy-file the run was checked against
+	Policy *ManifestPolicy `json:"policy,omitempty"`
+	// Config is the effective configuration of the run, what -print-config prints
+	Config *EffectiveConfig `json:"config,omitempty"`
+	// Tags is the -tags selection of the run, the repositories having any of them or all with TagsAll
+	Tags    []string `json:"tags,omitempty"`
+	TagsAll bool     `json:"tags_all,omitempty"`
+	// Aliases are repositories listed with the URL and settings of another one, cloned once
+	Aliases []ManifestAlias `json:"aliases,omitempty"`
+	// PerRepo is set for the index of a -per-repo backup, every repository is in a file of
+	// its own named by its Archive
+	PerRepo bool `json:"per_repo,omitempty"`
+	// Encryption lists the recipients of an archive encrypted with -recipient
+	Encryption *ManifestEncryption `json:"encryption,omitempty"`
+	// CacheDir is the -cache-dir the repositories were archived from, the manifest of a run
+	// only updating the cache has no Archive
+	CacheDir string `json:"cache_dir,omitempty"`
+	// Chain lists the earlier archives that unchanged repositories are restored from
+	Chain []ManifestArchive `json:"chain,omitempty"`
+	Repos []ManifestRepo    `json:"repos"`
+}
+
+type ManifestArchive struct {
+	Archive string `json:"archive"`
+	SHA256  string `json:"sha256"`
+}
+
+type ManifestRepo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// MovedTo is the URL the git host redirected URL to
+	MovedTo string `json:"moved_to,omitempty"`
+	// Tags are the tags of the repository in the configuration
+	Tags []string `json:"tags,omitempty"`
+	// InsecureHTTP is set when the credentials were sent in cleartext over http://
+	InsecureHTTP bool `json:"insecure_http,omitempty"`
+	// Head is the branch HEAD points at, left out when HeadState is set
+	Head string `json:"head,omitempty"`
+	// HeadState is unborn or dangling for a HEAD that does not name a branch holding a
+	// commit, SuggestedHead the most recently updated branch to use instead
+	HeadState     string            `json:"head_state,omitempty"`
+	SuggestedHead string            `json:"suggested_head,omitempty"`
+	Refs          map[string]string `json:"refs,omitempty"`
+	// Complete is false for a mirror lacking history, as cloned from a shallow remote, and
+	// ShallowCommits are the commits whose parents it does not hold, see checkHistory
+	Complete       *bool    `json:"complete,omitempty"`
+	ShallowCommits []string `json:"shallow_commits,omitempty"`
+	// Pin is the point a pinned repository was captured at
+	Pin *ManifestPin `json:"pin,omitempty"`
+	// GerritChanges is the number of refs/changes references of a gerrit flavored repository
+	GerritChanges int `json:"gerrit_changes,omitempty"`
+	// Size is the size in bytes of the object store of the clone
+	Size int64 `json:"size,omitempty"`
+	// Archive is the archive containing the repository, an earlier archive of
+	// the chain when the repository was unchanged
+	Archive string `json:"archive,omitempty"`
+	// Format and SHA256 are the output format and checksum of the file of the repository
+	// in a -per-repo backup, for none the checksum of the tree of its directory
+	Format string `json:"format,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Skipped is set to the reason a disabled repository was not captured
+	Skipped string `json:"skipped,omitempty"`
+	// Status is the outcome of the repository in the run that wrote the manifest
+	Status repoStatus `json:"status,omitempty"`
+	// Settings are the clone settings of the repository after applying the configuration defaults
+	Settings *ManifestSettings `json:"settings,omitempty"`
+	// Remote is the remote of the config of the archived mirror, see remote_config
+	Remote *ManifestRemote `json:"remote,omitempty"`
+	// Exclusions is set when files at HEAD match the .codepackignore or -ignore-file patterns
+	Exclusions *ManifestExclusions `json:"exclusions,omitempty"`
+	// Export is set for repositories archived as the files of a commit instead of a mirror
+	Export *ManifestExport `json:"export,omitempty"`
+	// Renamed lists the entries -rename-invalid renamed because their name was not valid UTF-8
+	Renamed []ManifestRename `json:"renamed,omitempty"`
+	// Stale is set for the last known copy of a repository missing from the remote,
+	// carried from an earlier archive by -archive-last-known
+	Stale bool `json:"stale,omitempty"`
+	// LastReachable is the time of the last run that cloned a stale repository
+	LastReachable string `json:"last_reachable,omitempty"`
+}
+
+// ManifestRename maps an archive entry below codepack/ to the name of the file it was
+// staged as, Original is escaped like a Go string literal as it is not valid UTF-8
+type ManifestRename struct {
+	Entry    string `json:"entry"`
+	Original string `json:"original"`
+}
+
+// ManifestSettings records the effective clone settings of a repository,
+// credentials are only referenced by the names of their environment variables
+type ManifestSettings struct {
+	Depth          int       `json:"depth,omitempty"`
+	Retries        int       `json:"retries,omitempty"`
+	Timeout        string    `json:"timeout,omitempty"`
+	Auth           *RepoAuth `json:"auth,omitempty"`
+	ExcludeRefs    []string  `json:"exclude_refs,omitempty"`
+	MaxObjectCache int       `json:"max_object_cache,omitempty"`
+}
+
+func newManifestSettings(repo Repository) *ManifestSettings {
+	settings := &ManifestSettings{
+		Depth:          repo.depth(),
+		Retries:        repo.retries(),
+		Auth:           repo.Auth,
+		ExcludeRefs:    repo.ExcludeRefs,
+		MaxObjectCache: repo.MaxObjectCache,
+	}
+	if repo.timeout() > 0 {
+		settings.Timeout = repo.timeout().String()
+	}
+	if settings.Depth == 0 && settings.Retries == 0 && settings.Timeout == "" && settings.Auth == nil &&
+		len(settings.ExcludeRefs) == 0 && settings.MaxObjectCache == 0 {
+		return nil
+	}
+	return settings
+}
+
+func (r ManifestRepo) ClonePath() string {
+	return path.Join(r.Path, r.Name)
+}
+
+func newManifest(archive string) *Manifest {
+	return &Manifest{
+		FormatVersion:   manifestFormatVersion,
+		CodePackVersion: VERSION,
+		Created:         clock().UTC().Format(time.RFC3339),
+		RunID:           runID,
+		Archive:         archive,
+	}
+}
+
+// ManifestFromFile reads a manifest written by an earlier run
+func ManifestFromFile(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Invalid manifest '%s': %w", filename, err)
+	}
+	if m.FormatVersion != manifestFormatVersion {
+		return nil, fmt.Errorf("Manifest '%s' has format version %d, expected %d", filename, m.FormatVersion, manifestFormatVersion)
+	}
+	if err := m.checkPaths(); err != nil {
+		return nil, fmt.Errorf("Invalid manifest '%s': %w", filename, err)
+	}
+	return m, nil
+}
+
+// checkPaths fails for a repository or alias of m whose name, path or alias_of would be
+// restored outside of the destination, the manifest of an archive is not trusted more than
+// its entries
+func (m *Manifest) checkPaths() error {
+	for _, repo := range m.Repos {
+		if !insideDest(repo.Path) || !insideDest(repo.Name) || path.Clean(repo.ClonePath()) == "." {
+			return fmt.Errorf("repository '%s' has the path '%s' outside of the destination", sanitizeURL(repo.URL), repo.ClonePath())
+		}
+	}
+	for _, alias := range m.Aliases {
+		if !insideDest(alias.Path) || !insideDest(alias.Name) || path.Clean(alias.ClonePath()) == "." {
+			return fmt.Errorf("alias '%s' has the path '%s' outside of the destination", sanitizeURL(alias.URL), alias.ClonePath())
+		}
+		if !insideDest(alias.AliasOf) || path.Clean(alias.AliasOf) == "." {
+			return fmt.Errorf("alias '%s' links to '%s' outside of the destination", alias.ClonePath(), alias.AliasOf)
+		}
+	}
+	return nil
+}
+
+// insideDest reports whether the relative slash separated p stays inside the directory it
+// is joined to, it is not absolute and has no .. element, a backslash counting as a separator
+func insideDest(p string) bool {
+	if path.IsAbs(p) || filepath.IsAbs(p) || filepath.VolumeName(p) != "" || strings.HasPrefix(p, `\`) {
+		return false
+	}
+	return !contains(strings.Split(strings.ReplaceAll(p, `\`, "/"), "/"), "..")
+}
+
+func (m *Manifest) WriteFile(filename string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// Find returns the manifest entry with the clone path of repo
+func (m *Manifest) Find(repo Repository) (ManifestRepo, bool) {
+	clonePath := path.Join(repo.Path, repo.Name)
+	for _, r := range m.Repos {
+		if r.ClonePath() == clonePath {
+			return r, true
+		}
+	}
+	return ManifestRepo{}, false
+}
+
+// ArchiveSHA256 returns the recorded checksum of an archive in the manifest or its chain
+func (m *Manifest) ArchiveSHA256(archive string) (string, bool) {
+	if archive == m.Archive {
+		return m.SHA256, m.SHA256 != ""
+	}
+	for _, a := range m.Chain {
+		if a.Archive == archive {
+			return a.SHA256, true
+		}
+	}
+	return "", false
+}
+
+// newManifestRepo reads the references of a cloned repository from repoFS
+func newManifestRepo(repo Repository, repoFS billy.Filesystem, archive string) (ManifestRepo, error) {
+	entry := ManifestRepo{
+		Name:         repo.Name,
+		Path:         repo.Path,
+		URL:          sanitizeURL(repo.URL),
+		MovedTo:      sanitizeURL(repo.MovedTo),
+		Tags:         repo.Tags,
+		Refs:         make(map[string]string),
+		InsecureHTTP: repo.InsecureHTTP,
+		Archive:      archive,
+		Settings:     newManifestSettings(repo),
+	}
+
+	storage := filesystem.NewStorage(repoFS, cache.NewObjectLRUDefault())
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return entry, err
+	}
+	entry.Size = dirSize(repoFS, "objects")
+	if entry.Exclusions, err = repoExclusions(storage, repo.IgnorePatterns); err != nil {
+		return entry, fmt.Errorf("cannot match ignore patterns: %w", err)
+	}
+	if entry.Exclusions != nil && !repo.exportsWorktree() {
+		log.Printf("WARNING: %s has %d files matching ignore patterns, they are kept in the mirror and flagged in the manifest", repo.URL, entry.Exclusions.Matched)
+	}
+	if repo.Pin != "" {
+		if entry.Pin, err = resolvePin(storage, repo.Pin); err != nil {
+			return entry, err
+		}
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() == plumbing.HEAD {
+			if ref.Type() == plumbing.SymbolicReference {
+				entry.Head = ref.Target().String()
+			}
+			return nil
+		}
+		if ref.Type() == plumbing.HashReference {
+			entry.Refs[ref.Name().String()] = ref.Hash().String()
+			if repo.Flavor == flavorGerrit && strings.HasPrefix(ref.Name().String(), "refs/changes/") {
+				entry.GerritChanges++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return entry, err
+	}
+	checkHead(storage, &entry)
+	checkHistory(storage, repo, &entry)
+	if !repo.exported() {
+		if entry.Remote, err = readManifestRemote(storage, repo); err != nil {
+			return entry, fmt.Errorf("cannot read the remote of the config: %w", err)
+		}
+	}
+	return entry, nil
+}
+
+// newSkippedManifestRepo records a disabled repository that was intentionally left out of the run
+func newSkippedManifestRepo(repo Repository) ManifestRepo {
+	reason := repo.SkipReason
+	if reason == "" {
+		reason = "disabled"
+	}
+	return ManifestRepo{
+		Name:    repo.Name,
+		Path:    repo.Path,
+		URL:     sanitizeURL(repo.URL),
+		Tags:    repo.Tags,
+		Skipped: reason,
+	}
+}
+
+// remoteRefs lists the references advertised by the remote repository
+func remoteRefs(rawURL string, auth *http.BasicAuth) (map[string]string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{rawURL}})
+	opts := &git.ListOptions{}
+	if auth != nil {
+		// a nil *http.BasicAuth is still an auth method transports other than http reject
+		opts.Auth = auth
+	}
+	advertised, err := remote.List(opts)
+	if err != nil {
+		return nil, withHostOverrides(err, rawURL)
+	}
+	refs := make(map[string]string)
+	for _, ref := range advertised {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), "refs/") {
+			refs[ref.Name().String()] = ref.Hash().String()
+		}
+	}
+	return refs, nil
+}
+
+// listRemoteRefs lists references with remoteRefs and auth
+func listRemoteRefs(auth *http.BasicAuth) func(url string) (map[string]string, error) {
+	return func(url string) (map[string]string, error) {
+		return remoteRefs(url, auth)
+	}
+}
+
+func sameRefs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, hash := range a {
+		if b[name] != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// writeStagingManifest stores the manifest in the root of the staging directory
+func writeStagingManifest(staging billy.Filesystem, m *Manifest) error {
+	sort.Slice(m.Repos, func(i, j int) bool { return m.Repos[i].ClonePath() < m.Repos[j].ClonePath() })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFile(staging, manifestName, append(data, '\n'), 0644)
+}
+
+// sanitizeURL removes any password or token embedded in a repository URL
+func sanitizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.User(u.User.Username())
+	}
+	if tokenUsername.MatchString(u.User.Username()) {
+		u.User = url.User("REDACTED")
+	}
+	return u.String()
+}
+
+// archiveName is the file name used to reference the archive written to target
+func archiveName(target string) string {
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil {
+			return path.Base(u.Path)
+		}
+	}
+	return filepath.Base(target)
+}
+
+// defaultManifestPath is where the manifest of target is written when -manifest is not set,
+// next to local archives and in the working directory for remote destinations
+func defaultManifestPath(target string) string {
+	if strings.Contains(target, "://") {
+		return archiveName(target) + ".manifest.json"
+	}
+	return target + ".manifest.json"
+}
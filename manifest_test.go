@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestRejectsPathsOutsideDest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		repos   []ManifestRepo
+		aliases []ManifestAlias
+	}{
+		{name: "parent path", repos: []ManifestRepo{{Name: "app", Path: "../../outside"}}},
+		{name: "parent name", repos: []ManifestRepo{{Name: "..", Path: "team"}}},
+		{name: "absolute path", repos: []ManifestRepo{{Name: "app", Path: "/etc"}}},
+		{name: "backslash parent", repos: []ManifestRepo{{Name: `..\..\app`, Path: "team"}}},
+		{name: "empty clone path", repos: []ManifestRepo{{}}},
+		{name: "alias path", aliases: []ManifestAlias{{Name: "link", Path: "../..", AliasOf: "team/app"}}},
+		{name: "alias name", aliases: []ManifestAlias{{Name: "/tmp/link", Path: "", AliasOf: "team/app"}}},
+		{name: "alias of parent", aliases: []ManifestAlias{{Name: "link", Path: "team", AliasOf: "../../../etc"}}},
+		{name: "alias of absolute", aliases: []ManifestAlias{{Name: "link", Path: "team", AliasOf: "/etc"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			m := &Manifest{FormatVersion: manifestFormatVersion, Archive: "backup.tar.gz", Repos: tc.repos, Aliases: tc.aliases}
+			filename := filepath.Join(dir, "backup.tar.gz.manifest.json")
+			if err := m.WriteFile(filename); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ManifestFromFile(filename); err == nil || !strings.Contains(err.Error(), "outside of the destination") {
+				t.Errorf("expected the manifest to be rejected, got %v", err)
+			}
+			dest := filepath.Join(dir, "nested", "restored")
+			if err := restoreCommand([]string{"-manifest", filename, "-dest", dest}); err == nil {
+				t.Error("restore of the hostile manifest succeeded")
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("restore wrote outside of the destination: %v", entries)
+			}
+		})
+	}
+}
+
+func TestManifestAcceptsRelativePaths(t *testing.T) {
+	data, err := json.Marshal(Manifest{
+		FormatVersion: manifestFormatVersion,
+		Repos:         []ManifestRepo{{Name: "app", Path: "team/sub"}, {Name: "app..v2", Path: ""}},
+		Aliases:       []ManifestAlias{{Name: "link", Path: "other", AliasOf: "team/sub/app"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ManifestFromFile(filename); err != nil {
+		t.Error(err)
+	}
+}
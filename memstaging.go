@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+// memoryStaging is the staging directory with the clones of small repositories held in
+// memory, each mounted at its clone path over the directory on disk. The archiver, the
+// manifest and -verify-archive read them through it like any other clone, so the archive
+// is the same whether a repository was cloned in memory or on disk
+type memoryStaging struct {
+	billy.Filesystem
+	// Threshold is the size in bytes below which a repository is cloned in memory, a
+	// clone writing more falls back to disk
+	Threshold int64
+	// Budget is the total size in bytes of the clones held in memory at once
+	Budget int64
+
+	// umask are the permission bits the disk clears, memfs keeps every bit it is given
+	umask    os.FileMode
+	mu       sync.Mutex
+	reserved int64
+	mounts   map[string]*memoryMount
+}
+
+// memoryMount is a clone held in memory, sys is the stat of its clone path on disk lent
+// to the files in memory so the archive gives them the same owner
+type memoryMount struct {
+	fs  billy.Filesystem
+	sys any
+}
+
+func newMemoryStaging(disk billy.Filesystem, threshold int64, budget int64) *memoryStaging {
+	return &memoryStaging{Filesystem: disk, Threshold: threshold, Budget: budget, umask: stagingUmask(disk), mounts: make(map[string]*memoryMount)}
+}
+
+// stagingUmask finds the permission bits cleared from the files created on disk, 022
+// when it cannot tell
+func stagingUmask(disk billy.Filesystem) os.FileMode {
+	const probe = ".codepack-umask"
+	f, err := disk.OpenFile(probe, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return 022
+	}
+	f.Close()
+	defer disk.Remove(probe)
+	info, err := disk.Lstat(probe)
+	if err != nil {
+		return 022
+	}
+	return 0666 &^ info.Mode().Perm()
+}
+
+// memoryInfo is the stat of a file in memory as the disk would report it
+type memoryInfo struct {
+	os.FileInfo
+	mode os.FileMode
+	sys  any
+}
+
+func (i memoryInfo) Mode() os.FileMode { return i.mode }
+func (i memoryInfo) Sys() any          { return i.sys }
+
+func (m *memoryStaging) info(mount *memoryMount, info os.FileInfo) os.FileInfo {
+	return memoryInfo{FileInfo: info, mode: info.Mode() &^ m.umask, sys: mount.sys}
+}
+
+// clone runs clone in to memory and mounts the result at clonePath when repo is expected
+// to stay below Threshold and fits the budget. It returns false when the repository is left
+// to the disk path instead, including after a failed attempt in memory, a nil
+// *memoryStaging clones nothing
+func (m *memoryStaging) clone(repo Repository, clonePath string, expected int64, clone func(fs billy.Filesystem) error) bool {
+	if m == nil {
+		return false
+	}
+	switch {
+	case repo.InMemory != nil:
+		if !*repo.InMemory {
+			return false
+		}
+	case expected <= 0 || expected >= m.Threshold:
+		return false
+	}
+	// repositories nested below it are cloned on disk
+	if entries, err := m.Filesystem.ReadDir(clonePath); err != nil || len(entries) > 0 {
+		return false
+	}
+	if !m.reserve(m.Threshold) {
+		log.Printf("Cloning %s on disk, the -in-memory-budget is used up", clonePath)
+		return false
+	}
+	mem := newSizeLimitFS(memfs.New(), m.Threshold)
+	if err := clone(mem); err != nil {
+		m.release(m.Threshold)
+		log.Printf("Cloning %s in memory failed, cloning it on disk: %v", clonePath, err)
+		return false
+	}
+	mount := &memoryMount{fs: mem}
+	if info, err := m.Filesystem.Lstat(clonePath); err == nil {
+		mount.sys = info.Sys()
+	}
+	used := mem.(*sizeLimitFS).written.Load()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved -= m.Threshold - used
+	m.mounts[clonePath] = mount
+	return true
+}
+
+func (m *memoryStaging) reserve(n int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reserved+n > m.Budget {
+		return false
+	}
+	m.reserved += n
+	return true
+}
+
+func (m *memoryStaging) release(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved -= n
+}
+
+// holds reports whether the clone at clonePath is in memory, a nil *memoryStaging holds none
+func (m *memoryStaging) holds(clonePath string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mounts[clonePath] != nil
+}
+
+// route returns the filesystem holding name and the name on it, mount is nil on disk.
+// root is set for the clone path of a mount itself, which also exists on disk
+func (m *memoryStaging) route(name string) (fs billy.Filesystem, rel string, mount *memoryMount, root bool) {
+	clean := strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.mounts) > 0 {
+		for p := clean; p != "." && p != ""; p = path.Dir(p) {
+			if mount, ok := m.mounts[p]; ok {
+				rel = strings.TrimPrefix(strings.TrimPrefix(clean, p), "/")
+				return mount.fs, rel, mount, rel == ""
+			}
+		}
+	}
+	return m.Filesystem, name, nil, false
+}
+
+func (m *memoryStaging) Create(filename string) (billy.File, error) {
+	fs, rel, _, _ := m.route(filename)
+	return fs.Create(rel)
+}
+
+func (m *memoryStaging) Open(filename string) (billy.File, error) {
+	fs, rel, _, _ := m.route(filename)
+	return fs.Open(rel)
+}
+
+func (m *memoryStaging) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	fs, rel, _, _ := m.route(filename)
+	return fs.OpenFile(rel, flag, perm)
+}
+
+func (m *memoryStaging) Stat(filename string) (os.FileInfo, error) {
+	fs, rel, mount, root := m.route(filename)
+	if mount == nil || root {
+		return m.Filesystem.Stat(filename)
+	}
+	info, err := fs.Stat(rel)
+	if err != nil {
+		return nil, err
+	}
+	return m.info(mount, info), nil
+}
+
+func (m *memoryStaging) Lstat(filename string) (os.FileInfo, error) {
+	fs, rel, mount, root := m.route(filename)
+	if mount == nil || root {
+		return m.Filesystem.Lstat(filename)
+	}
+	info, err := fs.Lstat(rel)
+	if err != nil {
+		return nil, err
+	}
+	return m.info(mount, info), nil
+}
+
+func (m *memoryStaging) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs, rel, mount, root := m.route(dirname)
+	if mount == nil {
+		return fs.ReadDir(rel)
+	}
+	if root {
+		rel = "/"
+	}
+	infos, err := fs.ReadDir(rel)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		infos[i] = m.info(mount, info)
+	}
+	return infos, nil
+}
+
+func (m *memoryStaging) MkdirAll(filename string, perm os.FileMode) error {
+	fs, rel, _, root := m.route(filename)
+	if root {
+		return nil
+	}
+	return fs.MkdirAll(rel, perm)
+}
+
+func (m *memoryStaging) Remove(filename string) error {
+	fs, rel, _, root := m.route(filename)
+	if root {
+		return fmt.Errorf("Cannot remove '%s', it holds a clone in memory", filename)
+	}
+	return fs.Remove(rel)
+}
+
+func (m *memoryStaging) Rename(oldpath, newpath string) error {
+	fromFS, from, _, _ := m.route(oldpath)
+	toFS, to, _, _ := m.route(newpath)
+	if fromFS != toFS {
+		return fmt.Errorf("Cannot move '%s' to '%s' between memory and disk", oldpath, newpath)
+	}
+	return fromFS.Rename(from, to)
+}
+
+func (m *memoryStaging) TempFile(dir, prefix string) (billy.File, error) {
+	fs, rel, _, _ := m.route(dir)
+	return fs.TempFile(rel, prefix)
+}
+
+func (m *memoryStaging) Symlink(target, link string) error {
+	fs, rel, _, _ := m.route(link)
+	return fs.Symlink(target, rel)
+}
+
+func (m *memoryStaging) Readlink(link string) (string, error) {
+	fs, rel, _, _ := m.route(link)
+	return fs.Readlink(rel)
+}
+
+func (m *memoryStaging) Chroot(p string) (billy.Filesystem, error) {
+	return chroot.New(m, p), nil
+}
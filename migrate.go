@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"text/template"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// migrateResult is the outcome of migrating one repository, stage names the step that failed
+type migrateResult struct {
+	repo  Repository
+	dest  string
+	stage string
+	err   error
+}
+
+// migrateOptions are the settings of the destination shared by every repository of a migration
+type migrateOptions struct {
+	clone             CloneOptions
+	auth              *http.BasicAuth
+	hostType          string
+	create            bool
+	applyHostMetadata bool
+}
+
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configFilePtr := flags.String("config", "codepack.yaml", "Configuration file")
+	configFormatPtr := flags.String("config-format", "", "format of the configuration file: yaml, toml or json (default detected from the extension)")
+	destTemplatePtr := flags.String("dest-template", "", "URL template of the destination repositories, like https://new-host/{{ .path }}/{{ .name }}.git")
+	destTokenEnvPtr := flags.String("dest-token-env", "", "environment variable holding the token of the destination host")
+	destUserEnvPtr := flags.String("dest-user-env", "", "environment variable holding the username of the destination host (default oauth2)")
+	destHostTypePtr := flags.String("dest-host-type", "", "API of the destination host used to create projects: github or gitlab (default detected from the host name)")
+	createPtr := flags.Bool("create", true, "create missing destination projects through the host API")
+	applyHostMetadataPtr := flags.Bool("apply-host-metadata", false, "copy the description, visibility and default branch of the source project to the destination")
+	dryRunPtr := flags.Bool("dry-run", false, "print the source to destination mapping without cloning or pushing")
+	workersPtr := flags.Int("workers", 10, "Number of repositories migrated at once")
+	parseFlags(flags, args)
+
+	if *destTemplatePtr == "" {
+		return fmt.Errorf("migrate requires -dest-template")
+	}
+	tmpl, err := template.New("dest").Option("missingkey=error").Parse(*destTemplatePtr)
+	if err != nil {
+		return fmt.Errorf("Invalid -dest-template: %w", err)
+	}
+	cfg, _, err := loadConfig(*configFilePtr, *configFormatPtr, envAuth())
+	if err != nil {
+		return fmt.Errorf("Failed to open Configuration file '%s': %w", *configFilePtr, err)
+	}
+	if err := installHostTransports(cfg.Hosts); err != nil {
+		return err
+	}
+	cfg, _ = splitDisabled(cfg, false, 1)
+	gerritAuthURLs(cfg, envAuth())
+	enableAzureDevOps(cfg)
+	workers = *workersPtr
+
+	dests := make([]string, len(cfg.Repos))
+	for i, repo := range cfg.Repos {
+		dests[i], err = restoredURL(tmpl, ManifestRepo{Name: repo.Name, Path: repo.Path, URL: repo.URL})
+		if err != nil {
+			return fmt.Errorf("Cannot render destination of %s: %w", repo.URL, err)
+		}
+	}
+	if *dryRunPtr {
+		for i, repo := range cfg.Repos {
+			log.Printf("%s -> %s", sanitizeURL(repo.URL), sanitizeURL(dests[i]))
+		}
+		return nil
+	}
+
+	opts := migrateOptions{
+		clone:             CloneOptions{Auth: envAuth(), ObjectCacheSize: 96 * 1024 * 1024},
+		hostType:          *destHostTypePtr,
+		create:            *createPtr,
+		applyHostMetadata: *applyHostMetadataPtr,
+	}
+	if *destTokenEnvPtr != "" {
+		username := "oauth2"
+		if *destUserEnvPtr != "" {
+			username = os.Getenv(*destUserEnvPtr)
+		}
+		opts.auth = &http.BasicAuth{Username: username, Password: os.Getenv(*destTokenEnvPtr)}
+	}
+
+	results := make([]migrateResult, len(cfg.Repos))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i, repo := range cfg.Repos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, repo Repository) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = migrateRepo(context.Background(), repo, dests[i], opts)
+		}(i, repo)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			log.Printf("Migrating %s to %s failed to %s: %v", sanitizeURL(result.repo.URL), sanitizeURL(result.dest), result.stage, result.err)
+		}
+	}
+	log.Printf("Migrated %d of %d repositories", len(results)-failed, len(results))
+	if failed > 0 {
+		return fmt.Errorf("%d failure(s) migrating repositories, check log for details", failed)
+	}
+	return nil
+}
+
+// migrateRepo mirrors repo in to its own staging directory, creates the destination
+// project when needed, pushes every reference to dest and removes the staging directory
+func migrateRepo(ctx context.Context, repo Repository, dest string, opts migrateOptions) migrateResult {
+	result := migrateResult{repo: repo, dest: dest}
+	fail := func(stage string, err error) migrateResult {
+		result.stage, result.err = stage, err
+		return result
+	}
+
+	dir, err := os.MkdirTemp(os.TempDir(), "codepack-migrate")
+	if err != nil {
+		return fail("clone", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log.Printf("Cloning %s", sanitizeURL(repo.URL))
+	fs := osfs.New(dir)
+	if err := cloneWithRetries(ctx, repo, fs, opts.clone.ObjectCacheSize, opts.clone, nil); err != nil {
+		return fail("clone", err)
+	}
+
+	var meta *HostMetadata
+	if opts.applyHostMetadata {
+		meta, err = fetchHostMetadata(ctx, repo, repoAuth(repo, opts.clone))
+		if err != nil {
+			log.Printf("WARNING: cannot read host metadata of %s: %v", repo.URL, err)
+		}
+	}
+
+	if opts.create {
+		if err := createProject(ctx, dest, opts, meta); err != nil {
+			return fail("create the project", err)
+		}
+	}
+
+	log.Printf("Pushing %s to %s", sanitizeURL(repo.URL), sanitizeURL(dest))
+	mirror, err := git.Open(filesystem.NewStorage(fs, cache.NewObjectLRUDefault()), nil)
+	if err != nil {
+		return fail("push", err)
+	}
+	refSpecs := []config.RefSpec{"+refs/*:refs/*"}
+	if repo.Flavor == flavorGerrit {
+		refSpecs = gerritPushRefSpecs
+	}
+	err = mirror.PushContext(ctx, &git.PushOptions{
+		RemoteURL: dest,
+		RefSpecs:  refSpecs,
+		Auth:      opts.auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fail("push", err)
+	}
+
+	if meta != nil && meta.DefaultBranch != "" {
+		if err := setDefaultBranch(ctx, dest, opts, meta.DefaultBranch); err != nil {
+			log.Printf("WARNING: cannot set default branch of %s: %v", sanitizeURL(dest), err)
+		}
+	}
+	return result
+}
+
+// destinationAPI returns the API of the host of dest with its base URL and the project path
+func destinationAPI(dest string, opts migrateOptions) (api string, base string, project string, err error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", "", "", err
+	}
+	api = hostAPI(Repository{HostType: opts.hostType}, u)
+	project = projectPath(u)
+	switch api {
+	case "github":
+		base = "https://api.github.com"
+		if u.Hostname() != "github.com" {
+			base = fmt.Sprintf("https://%s/api/v3", u.Host)
+		}
+	case "gitlab":
+		base = fmt.Sprintf("%s://%s/api/v4", u.Scheme, u.Host)
+	}
+	return api, base, project, nil
+}
+
+func (opts migrateOptions) token() string {
+	if opts.auth == nil {
+		return ""
+	}
+	return opts.auth.Password
+}
+
+// createProject creates the destination project of dest unless it already exists,
+// hosts without a supported API are expected to accept pushes to new repositories
+func createProject(ctx context.Context, dest string, opts migrateOptions, meta *HostMetadata) error {
+	api, base, project, err := destinationAPI(dest, opts)
+	if err != nil {
+		return err
+	}
+	visibility, description := "private", ""
+	if meta != nil {
+		description = meta.Description
+		if meta.Visibility != "" {
+			visibility = meta.Visibility
+		}
+	}
+	namespace, name := path.Split(project)
+	namespace = path.Clean(namespace)
+
+	var exists *apiError
+	switch api {
+	case "github":
+		bearer := ""
+		if opts.token() != "" {
+			bearer = "Bearer " + opts.token()
+		}
+		err := getJSON(ctx, base+"/repos/"+project, "Authorization", bearer, nil)
+		if err == nil {
+			return nil
+		}
+		if !errors.As(err, &exists) || exists.StatusCode != nethttp.StatusNotFound {
+			return err
+		}
+		log.Printf("Creating GitHub repository %s", project)
+		body := map[string]any{"name": name, "description": description, "private": visibility != "public"}
+		err = requestJSON(ctx, nethttp.MethodPost, base+"/orgs/"+namespace+"/repos", "Authorization", bearer, body, nil)
+		if errors.As(err, &exists) && exists.StatusCode == nethttp.StatusNotFound {
+			// namespace is the authenticated user rather than an organization
+			err = requestJSON(ctx, nethttp.MethodPost, base+"/user/repos", "Authorization", bearer, body, nil)
+		}
+		return err
+	case "gitlab":
+		err := getJSON(ctx, base+"/projects/"+url.PathEscape(project), "PRIVATE-TOKEN", opts.token(), nil)
+		if err == nil {
+			return nil
+		}
+		if !errors.As(err, &exists) || exists.StatusCode != nethttp.StatusNotFound {
+			return err
+		}
+		var ns struct {
+			ID int `json:"id"`
+		}
+		if err := getJSON(ctx, base+"/namespaces/"+url.PathEscape(namespace), "PRIVATE-TOKEN", opts.token(), &ns); err != nil {
+			return fmt.Errorf("cannot find namespace '%s': %w", namespace, err)
+		}
+		log.Printf("Creating GitLab project %s", project)
+		body := map[string]any{"name": name, "path": name, "namespace_id": ns.ID, "description": description, "visibility": visibility}
+		return requestJSON(ctx, nethttp.MethodPost, base+"/projects", "PRIVATE-TOKEN", opts.token(), body, nil)
+	default:
+		log.Printf("Not creating %s, no supported API for its host", sanitizeURL(dest))
+		return nil
+	}
+}
+
+func setDefaultBranch(ctx context.Context, dest string, opts migrateOptions, branch string) error {
+	api, base, project, err := destinationAPI(dest, opts)
+	if err != nil {
+		return err
+	}
+	body := map[string]any{"default_branch": branch}
+	switch api {
+	case "github":
+		return requestJSON(ctx, nethttp.MethodPatch, base+"/repos/"+project, "Authorization", "Bearer "+opts.token(), body, nil)
+	case "gitlab":
+		return requestJSON(ctx, nethttp.MethodPut, base+"/projects/"+url.PathEscape(project), "PRIVATE-TOKEN", opts.token(), body, nil)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// mirrorRefSpec fetches every reference of the remote in to the same name, as git clone --mirror
+const mirrorRefSpec = "+refs/*:refs/*"
+
+// defaultDescription is the description git init writes
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository.\n"
+
+// completeMirror gives a bare mirror cloned by go-git the layout of git clone --mirror: a
+// config fetching every reference with mirror set, and the description, hooks and info
+// entries go-git does not write. A local source has its description, hooks and info files
+// copied. dropSampleHooks removes the *.sample hooks, like those of a mirror taken out of an archive
+func completeMirror(storage *filesystem.Storage, fs billy.Filesystem, repo Repository, dropSampleHooks bool) error {
+	cfg, err := storage.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Core.IsBare = true
+	if remote, ok := cfg.Remotes["origin"]; ok {
+		remote.Fetch = []config.RefSpec{mirrorRefSpec}
+		remote.Mirror = true
+	}
+	if repo.RemoteConfig != nil {
+		err = repo.RemoteConfig.write(fs, cfg)
+	} else {
+		err = storage.SetConfig(cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot write the config of the mirror: %w", err)
+	}
+
+	if _, _, ok := archiveSource(repo.URL); !ok {
+		if dir, ok := localSourcePath(repo.URL); ok {
+			if err := copyRepoFiles(gitDir(dir), fs); err != nil {
+				return fmt.Errorf("Cannot copy the description and hooks of '%s': %w", dir, err)
+			}
+		}
+	}
+	for _, dir := range []string{"hooks", "info"} {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if dropSampleHooks {
+		entries, err := fs.ReadDir("hooks")
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".sample") {
+				if err := fs.Remove("hooks/" + entry.Name()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if _, err := fs.Lstat("description"); os.IsNotExist(err) {
+		return util.WriteFile(fs, "description", []byte(defaultDescription), 0644)
+	}
+	return nil
+}
+
+// gitDir is the git directory of the local repository at dir, dir itself when it is bare
+func gitDir(dir string) string {
+	if info, err := os.Stat(filepath.Join(dir, ".git")); err == nil && info.IsDir() {
+		return filepath.Join(dir, ".git")
+	}
+	return dir
+}
+
+// copyRepoFiles copies the description, the hooks and the files of info of the git directory
+// src to fs with their modes. info/refs is left out, it lists the references of src rather
+// than those of the mirror
+func copyRepoFiles(src string, fs billy.Filesystem) error {
+	if err := copyRepoFile(filepath.Join(src, "description"), fs, "description"); err != nil {
+		return err
+	}
+	for _, dir := range []string{"hooks", "info"} {
+		entries, err := os.ReadDir(filepath.Join(src, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() || dir == "info" && name == "refs" {
+				continue
+			}
+			if err := copyRepoFile(filepath.Join(src, dir, name), fs, dir+"/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copyRepoFile(src string, fs billy.Filesystem, name string) error {
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return util.WriteFile(fs, name, data, info.Mode().Perm())
+}
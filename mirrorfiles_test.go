@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// writeRepoFiles writes files below the git directory of the repository at dir
+func writeRepoFiles(t *testing.T, dir string, files map[string]os.FileMode) {
+	t.Helper()
+	for name, mode := range files {
+		filename := filepath.Join(dir, ".git", name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(name+"\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMirrorRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	app := newTestRepo(t, filepath.Join(dir, "src", "app"), [2]string{"README.md", "app\n"})
+	writeRepoFiles(t, filepath.Join(dir, "src", "app"), map[string]os.FileMode{
+		"description":         0644,
+		"hooks/pre-receive":   0755,
+		"hooks/update.sample": 0755,
+		"info/exclude":        0644,
+	})
+	newTestRepo(t, filepath.Join(dir, "src", "lib"), [2]string{"README.md", "lib\n"})
+	writeRepoFiles(t, filepath.Join(dir, "src", "lib"), map[string]os.FileMode{"hooks/update.sample": 0755})
+	if err := os.RemoveAll(filepath.Join(dir, "src", "lib", ".git", "info")); err != nil {
+		t.Fatal(err)
+	}
+	config := "repos:\n" +
+		"  - name: app\n    path: team\n    url: " + filepath.Join(dir, "src", "app") + "\n" +
+		"  - name: lib\n    path: team\n    url: " + filepath.Join(dir, "src", "lib") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := runCodePack(t, dir, nil, "-config", "codepack.yaml", "-out", "backup.tar.gz", "-no-catalog", "-drop-sample-hooks"); code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, out)
+	}
+	dest := filepath.Join(dir, "restored")
+	if err := extractArchive(filepath.Join(dir, "backup.tar.gz"), dest, archiveLimits{}, nil, func(string) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	mirror := filepath.Join(dest, "team", "app")
+	for _, tc := range []struct {
+		name   string
+		mode   os.FileMode
+		absent bool
+	}{
+		{name: "description", mode: 0644},
+		{name: "hooks/pre-receive", mode: 0755},
+		{name: "hooks/update.sample", absent: true},
+		{name: "info/exclude", mode: 0644},
+		{name: "../lib/description", mode: 0644},
+		{name: "../lib/hooks", mode: os.ModeDir | 0755},
+		{name: "../lib/info", mode: os.ModeDir | 0755},
+		{name: "../lib/hooks/update.sample", absent: true},
+	} {
+		info, err := os.Lstat(filepath.Join(mirror, tc.name))
+		switch {
+		case tc.absent && !os.IsNotExist(err):
+			t.Errorf("%s: extracted, expected it dropped", tc.name)
+		case tc.absent:
+		case err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case info.Mode()&(os.ModeDir|os.ModePerm) != tc.mode:
+			t.Errorf("%s: mode %s, expected %s", tc.name, info.Mode(), tc.mode)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(mirror, "description")); err != nil || string(data) != "description\n" {
+		t.Errorf("description %q, expected the one of the source: %v", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "team", "lib", "description")); err != nil || string(data) != defaultDescription {
+		t.Errorf("description %q, expected the default: %v", data, err)
+	}
+
+	repo, err := git.PlainOpen(mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := cfg.Remotes["origin"]
+	if !cfg.Core.IsBare || origin == nil || !origin.Mirror || len(origin.Fetch) != 1 || origin.Fetch[0] != mirrorRefSpec {
+		t.Fatalf("config of the mirror is not the one of git clone --mirror: %+v %+v", cfg.Core, origin)
+	}
+
+	// the extracted mirror fetches from its origin and can be cloned from
+	head := commitTestFile(t, app, "CHANGELOG.md", []byte("next\n"))
+	if err := repo.Fetch(&git.FetchOptions{RemoteName: "origin"}); err != nil {
+		t.Fatalf("fetch in to the extracted mirror: %v", err)
+	}
+	ref, err := repo.Reference("refs/heads/main", true)
+	if err != nil || ref.Hash() != head {
+		t.Fatalf("main of the mirror is %v after the fetch, expected %s: %v", ref, head, err)
+	}
+	clone, err := git.PlainClone(filepath.Join(dir, "clone"), false, &git.CloneOptions{URL: mirror})
+	if err != nil {
+		t.Fatalf("clone of the extracted mirror: %v", err)
+	}
+	if cloned, err := clone.Head(); err != nil || cloned.Hash() != head {
+		t.Errorf("clone of the extracted mirror is at %v, expected %s: %v", cloned, head, err)
+	}
+}
+
+func TestCompleteMirrorKeepsSampleHooks(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	writeRepoFiles(t, filepath.Join(dir, "src"), map[string]os.FileMode{"hooks/update.sample": 0755})
+	mirror := filepath.Join(dir, "mirror")
+	repo, err := git.PlainClone(mirror, true, &git.CloneOptions{URL: filepath.Join(dir, "src"), Mirror: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := repo.Storer.(*filesystem.Storage)
+	if err := completeMirror(storage, storage.Filesystem(), Repository{URL: filepath.Join(dir, "src")}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(mirror, "hooks", "update.sample")); err != nil {
+		t.Errorf("the sample hook was dropped without -drop-sample-hooks: %v", err)
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetch := cfg.Remotes["origin"].Fetch; len(fetch) != 1 || fetch[0] != config.RefSpec(mirrorRefSpec) {
+		t.Errorf("fetch refspecs %v", fetch)
+	}
+}
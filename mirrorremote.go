@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/config"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// originRemote is the remote go-git writes to the config of a mirror
+const originRemote = "origin"
+
+// RemoteSettings changes the remote go-git writes to the config of a mirror after cloning,
+// for restored mirrors that need to fetch in a particular way
+type RemoteSettings struct {
+	// Name renames the origin remote
+	Name string `yaml:"name" json:"name" toml:"name"`
+	// Fetch replaces the +refs/*:refs/* refspec of the remote
+	Fetch []string `yaml:"fetch" json:"fetch" toml:"fetch"`
+	// Prune sets remote.<name>.prune, removing the references deleted on the remote when fetching
+	Prune *bool `yaml:"prune" json:"prune" toml:"prune"`
+	// TagOpt sets remote.<name>.tagOpt, --tags or --no-tags
+	TagOpt string `yaml:"tag_opt" json:"tag_opt" toml:"tag_opt"`
+	// Extra sets further keys of the config as section.key or section.subsection.key
+	Extra map[string]string `yaml:"extra" json:"extra" toml:"extra"`
+	// Unset removes keys of the config, like remote.origin.partialclonefilter
+	Unset []string `yaml:"unset" json:"unset" toml:"unset"`
+}
+
+var (
+	configSectionPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+	configKeyPattern     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+	remoteNamePattern    = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+)
+
+// configKey is a key of a git config file split in to its section, subsection and name
+type configKey struct {
+	section    string
+	subsection string
+	name       string
+}
+
+// parseConfigKey splits section.key or section.subsection.key, the subsection being what is
+// between the first and the last dot, like git config does
+func parseConfigKey(key string) (configKey, error) {
+	first, last := strings.Index(key, "."), strings.LastIndex(key, ".")
+	if first <= 0 || last == len(key)-1 {
+		return configKey{}, fmt.Errorf("Invalid config key '%s', use section.key or section.subsection.key", key)
+	}
+	k := configKey{section: key[:first], name: key[last+1:]}
+	if first != last {
+		k.subsection = key[first+1 : last]
+	}
+	switch {
+	case !configSectionPattern.MatchString(k.section):
+		return k, fmt.Errorf("Invalid section '%s' of config key '%s'", k.section, key)
+	case !configKeyPattern.MatchString(k.name):
+		return k, fmt.Errorf("Invalid name '%s' of config key '%s'", k.name, key)
+	case strings.ContainsAny(k.subsection, "\n\x00"):
+		return k, fmt.Errorf("Invalid subsection of config key '%s'", key)
+	case strings.EqualFold(k.section, "remote") && (strings.EqualFold(k.name, "url") || strings.EqualFold(k.name, "fetch") || strings.EqualFold(k.name, "mirror")):
+		return k, fmt.Errorf("Config key '%s' is written by go-git, set fetch or name instead", key)
+	case strings.EqualFold(k.section, "core") && strings.EqualFold(k.name, "bare"):
+		return k, fmt.Errorf("Config key '%s' is written by go-git, a mirror is always bare", key)
+	}
+	return k, nil
+}
+
+// validate checks the settings, nil settings are valid
+func (s *RemoteSettings) validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.Name != "" && (!remoteNamePattern.MatchString(s.Name) || strings.Contains(s.Name, "..")) {
+		return fmt.Errorf("Invalid remote name '%s'", s.Name)
+	}
+	for _, refspec := range s.Fetch {
+		if err := config.RefSpec(refspec).Validate(); err != nil {
+			return fmt.Errorf("Invalid fetch refspec '%s': %w", refspec, err)
+		}
+	}
+	if s.TagOpt != "" && s.TagOpt != "--tags" && s.TagOpt != "--no-tags" {
+		return fmt.Errorf("Invalid tag_opt '%s', use --tags or --no-tags", s.TagOpt)
+	}
+	for key := range s.Extra {
+		if _, err := parseConfigKey(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range s.Unset {
+		if _, err := parseConfigKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteName is the name of the remote of the mirror once the settings are applied
+func (s *RemoteSettings) remoteName() string {
+	if s == nil || s.Name == "" {
+		return originRemote
+	}
+	return s.Name
+}
+
+// write applies the settings to cfg, which has the mirror refspec set already, and writes
+// it to the config file of the mirror in fs. The raw config is written as it is, go-git
+// would rebuild the url and branch sections set by Extra from its own fields
+func (s *RemoteSettings) write(fs billy.Filesystem, cfg *config.Config) error {
+	if err := s.apply(cfg); err != nil {
+		return err
+	}
+	f, err := fs.Create("config")
+	if err != nil {
+		return err
+	}
+	if err := format.NewEncoder(f).Encode(cfg.Raw); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// apply changes the remote of cfg and its raw keys
+func (s *RemoteSettings) apply(cfg *config.Config) error {
+	if remote, ok := cfg.Remotes[originRemote]; ok {
+		if s.Name != "" && s.Name != originRemote {
+			delete(cfg.Remotes, originRemote)
+			remote.Name = s.Name
+			cfg.Remotes[s.Name] = remote
+		}
+		if len(s.Fetch) > 0 {
+			remote.Fetch = nil
+			for _, refspec := range s.Fetch {
+				remote.Fetch = append(remote.Fetch, config.RefSpec(refspec))
+			}
+		}
+	}
+	// the raw config gets the renamed remote and the refspecs before its keys are set
+	if _, err := cfg.Marshal(); err != nil {
+		return err
+	}
+	if _, ok := cfg.Remotes[s.remoteName()]; ok {
+		remote := cfg.Raw.Section("remote").Subsection(s.remoteName())
+		if s.Prune != nil {
+			remote.SetOption("prune", strconv.FormatBool(*s.Prune))
+		}
+		if s.TagOpt != "" {
+			remote.SetOption("tagOpt", s.TagOpt)
+		}
+	}
+	keys := make([]string, 0, len(s.Extra))
+	for key := range s.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		k, err := parseConfigKey(key)
+		if err != nil {
+			return err
+		}
+		section := cfg.Raw.Section(k.section)
+		if k.subsection == "" {
+			section.SetOption(k.name, s.Extra[key])
+		} else {
+			section.Subsection(k.subsection).SetOption(k.name, s.Extra[key])
+		}
+	}
+	for _, key := range s.Unset {
+		k, err := parseConfigKey(key)
+		if err != nil {
+			return err
+		}
+		if !cfg.Raw.HasSection(k.section) {
+			continue
+		}
+		section := cfg.Raw.Section(k.section)
+		if k.subsection == "" {
+			section.RemoveOption(k.name)
+		} else if section.HasSubsection(k.subsection) {
+			section.Subsection(k.subsection).RemoveOption(k.name)
+		}
+		if len(section.Options) == 0 && len(section.Subsections) == 0 {
+			cfg.Raw.RemoveSection(k.section)
+		}
+	}
+	return nil
+}
+
+// ManifestRemote is the remote of the config of a mirror as it was archived, so a restore
+// knows what the restored mirror fetches from and how
+type ManifestRemote struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url,omitempty"`
+	Fetch  []string `json:"fetch,omitempty"`
+	Mirror bool     `json:"mirror,omitempty"`
+	Prune  string   `json:"prune,omitempty"`
+	TagOpt string   `json:"tag_opt,omitempty"`
+	// Extra are the keys remote_config set with their values in the config, Unset the keys it removed
+	Extra map[string]string `json:"extra,omitempty"`
+	Unset []string          `json:"unset,omitempty"`
+}
+
+// readManifestRemote reads the remote of the config of the mirror of repo, nil when the
+// config has none
+func readManifestRemote(s *filesystem.Storage, repo Repository) (*ManifestRemote, error) {
+	cfg, err := s.Config()
+	if err != nil {
+		return nil, err
+	}
+	name := repo.RemoteConfig.remoteName()
+	remote, ok := cfg.Remotes[name]
+	if !ok {
+		return nil, nil
+	}
+	raw := cfg.Raw.Section("remote").Subsection(name)
+	entry := &ManifestRemote{Name: name, Mirror: remote.Mirror, Prune: raw.Option("prune"), TagOpt: raw.Option("tagOpt")}
+	if len(remote.URLs) > 0 {
+		entry.URL = sanitizeURL(remote.URLs[0])
+	}
+	for _, refspec := range remote.Fetch {
+		entry.Fetch = append(entry.Fetch, refspec.String())
+	}
+	if repo.RemoteConfig == nil {
+		return entry, nil
+	}
+	unset := make(map[string]bool)
+	for _, key := range repo.RemoteConfig.Unset {
+		unset[key] = true
+	}
+	for key := range repo.RemoteConfig.Extra {
+		if unset[key] {
+			continue
+		}
+		k, err := parseConfigKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Extra == nil {
+			entry.Extra = make(map[string]string)
+		}
+		// the config is only read, looking up a missing section does not write it
+		section := cfg.Raw.Section(k.section)
+		if k.subsection == "" {
+			entry.Extra[key] = section.Option(k.name)
+		} else {
+			entry.Extra[key] = section.Subsection(k.subsection).Option(k.name)
+		}
+	}
+	entry.Unset = repo.RemoteConfig.Unset
+	return entry, nil
+}
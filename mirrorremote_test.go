@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+func TestParseConfigKey(t *testing.T) {
+	for _, tc := range []struct {
+		key      string
+		expected configKey
+		err      bool
+	}{
+		{key: "gc.auto", expected: configKey{section: "gc", name: "auto"}},
+		{key: "remote.upstream.prune", expected: configKey{section: "remote", subsection: "upstream", name: "prune"}},
+		{key: "url.https://example.com/.insteadOf", expected: configKey{section: "url", subsection: "https://example.com/", name: "insteadOf"}},
+		{key: "branch.release/1.0.merge", expected: configKey{section: "branch", subsection: "release/1.0", name: "merge"}},
+		{key: "gc", err: true},
+		{key: ".auto", err: true},
+		{key: "gc.", err: true},
+		{key: "g c.auto", err: true},
+		{key: "gc.1auto", err: true},
+		{key: "gc.au_to", err: true},
+		{key: "remote.origin.url", err: true},
+		{key: "remote.origin.Fetch", err: true},
+		{key: "Remote.origin.mirror", err: true},
+		{key: "core.bare", err: true},
+	} {
+		k, err := parseConfigKey(tc.key)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v, expected one %v", tc.key, err, tc.err)
+			continue
+		}
+		if !tc.err && k != tc.expected {
+			t.Errorf("%q: %+v, expected %+v", tc.key, k, tc.expected)
+		}
+	}
+}
+
+func TestRemoteSettingsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		settings *RemoteSettings
+		err      string
+	}{
+		{name: "nil"},
+		{name: "valid", settings: &RemoteSettings{Name: "upstream/main", Fetch: []string{"+refs/heads/*:refs/heads/*"}, TagOpt: "--tags", Extra: map[string]string{"gc.auto": "0"}, Unset: []string{"remote.upstream.partialclonefilter"}}},
+		{name: "remote name", settings: &RemoteSettings{Name: "up stream"}, err: "Invalid remote name"},
+		{name: "remote name escape", settings: &RemoteSettings{Name: "up/../stream"}, err: "Invalid remote name"},
+		{name: "refspec", settings: &RemoteSettings{Fetch: []string{"refs/heads/*"}}, err: "Invalid fetch refspec"},
+		{name: "tag_opt", settings: &RemoteSettings{TagOpt: "--all"}, err: "Invalid tag_opt"},
+		{name: "extra", settings: &RemoteSettings{Extra: map[string]string{"remote.origin.url": "https://example.com"}}, err: "is written by go-git"},
+		{name: "unset", settings: &RemoteSettings{Unset: []string{"gc"}}, err: "Invalid config key"},
+	} {
+		err := tc.settings.validate()
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, expected %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestRemoteSettingsWrite(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	newTestRepo(t, src, [2]string{"README.md", "app\n"})
+	prune := true
+	for _, tc := range []struct {
+		name     string
+		settings *RemoteSettings
+		config   string
+		remote   ManifestRemote
+	}{
+		{
+			name:   "default",
+			config: "[core]\n\tbare = true\n[remote \"origin\"]\n\turl = " + src + "\n\tfetch = +refs/*:refs/*\n\tmirror = true\n",
+			remote: ManifestRemote{Name: "origin", URL: src, Fetch: []string{"+refs/*:refs/*"}, Mirror: true},
+		},
+		{
+			name:     "prune only",
+			settings: &RemoteSettings{Prune: &prune},
+			config:   "[core]\n\tbare = true\n[remote \"origin\"]\n\turl = " + src + "\n\tfetch = +refs/*:refs/*\n\tmirror = true\n\tprune = true\n",
+			remote:   ManifestRemote{Name: "origin", URL: src, Fetch: []string{"+refs/*:refs/*"}, Mirror: true, Prune: "true"},
+		},
+		{
+			name: "everything",
+			settings: &RemoteSettings{
+				Name:   "upstream",
+				Fetch:  []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+				Prune:  &prune,
+				TagOpt: "--no-tags",
+				Extra:  map[string]string{"gc.auto": "0", "branch.main.merge": "refs/heads/main", "remote.upstream.partialclonefilter": "blob:none"},
+				Unset:  []string{"remote.upstream.partialclonefilter", "pack.threads"},
+			},
+			config: "[core]\n\tbare = true\n" +
+				"[remote \"upstream\"]\n\turl = " + src + "\n\tmirror = true\n\tfetch = +refs/heads/*:refs/heads/*\n\tfetch = +refs/tags/*:refs/tags/*\n\tprune = true\n\ttagOpt = --no-tags\n" +
+				"[branch \"main\"]\n\tmerge = refs/heads/main\n" +
+				"[gc]\n\tauto = 0\n",
+			remote: ManifestRemote{
+				Name:   "upstream",
+				URL:    src,
+				Fetch:  []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+				Mirror: true,
+				Prune:  "true",
+				TagOpt: "--no-tags",
+				Extra:  map[string]string{"gc.auto": "0", "branch.main.merge": "refs/heads/main"},
+				Unset:  []string{"remote.upstream.partialclonefilter", "pack.threads"},
+			},
+		},
+	} {
+		mirror := filepath.Join(dir, tc.name)
+		clone, err := git.PlainClone(mirror, true, &git.CloneOptions{URL: src, Mirror: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := clone.Storer.(*filesystem.Storage)
+		repo := Repository{URL: src, RemoteConfig: tc.settings}
+		if err := completeMirror(storage, storage.Filesystem(), repo, false); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		data, err := os.ReadFile(filepath.Join(mirror, "config"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.config {
+			t.Errorf("%s: config\n%s\nexpected\n%s", tc.name, data, tc.config)
+		}
+		remote, err := readManifestRemote(storage, repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remote == nil || !reflect.DeepEqual(*remote, tc.remote) {
+			t.Errorf("%s: manifest records %+v, expected %+v", tc.name, remote, tc.remote)
+		}
+	}
+}
+
+func TestRemoteConfigRun(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	config := `defaults:
+  remote_config:
+    prune: true
+repos:
+  - name: app
+    path: team
+    url: ` + filepath.Join(dir, "src") + `
+  - name: lib
+    path: team
+    url: ` + filepath.Join(dir, "src") + `
+    remote_config:
+      name: upstream
+      tag_opt: --no-tags
+`
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := runCodePack(t, dir, nil, "-config", "codepack.yaml", "-out", "backup.tar.gz", "-no-catalog", "-no-dedup-urls"); code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, out)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "backup.tar.gz.manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]ManifestRemote{
+		"team/app": {Name: "origin", Prune: "true"},
+		"team/lib": {Name: "upstream", TagOpt: "--no-tags"},
+	}
+	for _, repo := range manifest.Repos {
+		remote := repo.Remote
+		if remote == nil {
+			t.Errorf("%s: no remote in the manifest", repo.ClonePath())
+			continue
+		}
+		if e := expected[repo.ClonePath()]; remote.Name != e.Name || remote.Prune != e.Prune || remote.TagOpt != e.TagOpt || !remote.Mirror {
+			t.Errorf("%s: manifest records %+v, expected %+v", repo.ClonePath(), *remote, e)
+		}
+		delete(expected, repo.ClonePath())
+	}
+	if len(expected) != 0 {
+		t.Errorf("manifest is missing %v", expected)
+	}
+
+	badConfig := "repos:\n  - name: app\n    url: " + filepath.Join(dir, "src") + "\n    remote_config:\n      extra:\n        core.bare: \"false\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "bad.yaml"), []byte(badConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runCodePack(t, dir, nil, "-config", "bad.yaml", "-out", "bad.tar.gz")
+	if code != exitCodeConfig || !strings.Contains(out, "Invalid remote_config") {
+		t.Errorf("an invalid remote_config exited with %d:\n%s", code, out)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"path"
+	"sync"
+)
+
+// missingRepos are the repositories the remote reported as not found or empty in a run
+// whose -fail-on leaves out their status, they are left out of the backup instead of
+// failing the run
+type missingRepos struct {
+	failOn failOnPolicy
+	mu     sync.Mutex
+	paths  map[string]repoStatus
+	// lastKnown is the manifest the last copy of a missing repository is carried from,
+	// nil without -archive-last-known
+	lastKnown *Manifest
+}
+
+func newMissingRepos(lastKnown *Manifest, failOn failOnPolicy) *missingRepos {
+	return &missingRepos{failOn: failOn, paths: make(map[string]repoStatus), lastKnown: lastKnown}
+}
+
+// tolerates reports whether the clone failure err is a repository missing from the
+// remote or empty to leave out of the backup, a nil *missingRepos tolerates none
+func (m *missingRepos) tolerates(err error) bool {
+	return m != nil && err != nil && m.failOn.tolerates(err)
+}
+
+func (m *missingRepos) add(clonePath string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paths[clonePath] = cloneErrorStatus(err)
+}
+
+// filter returns config without the missing repositories, config itself when none are missing
+func (m *missingRepos) filter(config *Config) *Config {
+	if m == nil {
+		return config
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.paths) == 0 {
+		return config
+	}
+	present := *config
+	present.Repos = nil
+	for _, repo := range config.Repos {
+		if _, ok := m.paths[path.Join(repo.Path, repo.Name)]; !ok {
+			present.Repos = append(present.Repos, repo)
+		}
+	}
+	return &present
+}
+
+// resolve records the missing repositories of config in manifest, as the stale copy
+// lastKnown holds of them or as skipped, and returns the configuration of the rest
+func (m *missingRepos) resolve(config *Config, manifest *Manifest, report *runReport) *Config {
+	present := m.filter(config)
+	if present == config {
+		return config
+	}
+	chained := make(map[string]bool)
+	for _, archive := range manifest.Chain {
+		chained[archive.Archive] = true
+	}
+	for _, repo := range config.Repos {
+		clonePath := path.Join(repo.Path, repo.Name)
+		status, ok := m.paths[clonePath]
+		if !ok {
+			continue
+		}
+		if status == statusEmpty {
+			log.Printf("WARNING: %s has no references, it is not in the backup", sanitizeURL(repo.URL))
+			manifest.Repos = append(manifest.Repos, ManifestRepo{Name: repo.Name, Path: repo.Path, URL: sanitizeURL(repo.URL), Skipped: "empty repository"})
+			continue
+		}
+		entry, ok := m.lastKnownCopy(repo)
+		if !ok {
+			log.Printf("WARNING: %s is missing from the remote, it is not in the backup", sanitizeURL(repo.URL))
+			manifest.Repos = append(manifest.Repos, ManifestRepo{Name: repo.Name, Path: repo.Path, URL: sanitizeURL(repo.URL), Skipped: "missing from the remote"})
+			continue
+		}
+		log.Printf("WARNING: %s is missing from the remote, archiving the copy of %s last reachable %s", sanitizeURL(repo.URL), entry.Archive, entry.LastReachable)
+		manifest.Repos = append(manifest.Repos, entry)
+		if !chained[entry.Archive] {
+			chained[entry.Archive] = true
+			sum, _ := m.lastKnown.ArchiveSHA256(entry.Archive)
+			manifest.Chain = append(manifest.Chain, ManifestArchive{Archive: entry.Archive, SHA256: sum})
+		}
+		report.RecordLastKnown(clonePath, entry.Archive, entry.LastReachable)
+	}
+	return present
+}
+
+// lastKnownCopy returns the entry of repo in lastKnown marked stale, false when no archived copy is recorded
+func (m *missingRepos) lastKnownCopy(repo Repository) (ManifestRepo, bool) {
+	if m.lastKnown == nil {
+		return ManifestRepo{}, false
+	}
+	prev, ok := m.lastKnown.Find(repo)
+	if !ok || prev.Skipped != "" || prev.URL != sanitizeURL(repo.URL) {
+		return ManifestRepo{}, false
+	}
+	if _, ok := m.lastKnown.ArchiveSHA256(prev.Archive); !ok {
+		return ManifestRepo{}, false
+	}
+	// a copy carried by an earlier run keeps the date it was last reachable
+	if !prev.Stale {
+		prev.Stale = true
+		prev.LastReachable = m.lastKnown.Created
+	}
+	return prev, true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// fixedUmask are the permission bits cleared from every file and directory created in the
+// staging directory, whatever the umask of the process, since archives carry its modes
+const fixedUmask = 022
+
+// modeFS creates files and directories with the permissions asked for less fixedUmask.
+// With root set fs is the directory root on disk, which they are changed to once created
+// since the umask of the process may have cleared more bits
+type modeFS struct {
+	billy.Filesystem
+	root string
+}
+
+// newModeFS wraps fs, root is the directory of fs on disk or empty for a memory filesystem
+func newModeFS(fs billy.Filesystem, root string) billy.Filesystem {
+	return &modeFS{Filesystem: fs, root: root}
+}
+
+func (m *modeFS) Create(filename string) (billy.File, error) {
+	return m.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *modeFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	perm &^= fixedUmask
+	_, statErr := m.Filesystem.Lstat(filename)
+	f, err := m.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil || flag&os.O_CREATE == 0 || !os.IsNotExist(statErr) {
+		return f, err
+	}
+	if err := m.chmod(filename, perm); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (m *modeFS) MkdirAll(filename string, perm os.FileMode) error {
+	perm &^= fixedUmask
+	var created []string
+	for dir := filepath.Clean(filename); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if _, err := m.Filesystem.Lstat(dir); !os.IsNotExist(err) {
+			break
+		}
+		created = append(created, dir)
+	}
+	if err := m.Filesystem.MkdirAll(filename, perm); err != nil {
+		return err
+	}
+	for _, dir := range created {
+		if err := m.chmod(dir, perm|fs.ModeDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *modeFS) Capabilities() billy.Capability {
+	return billy.Capabilities(m.Filesystem)
+}
+
+func (m *modeFS) Chroot(p string) (billy.Filesystem, error) {
+	fs, err := m.Filesystem.Chroot(p)
+	if err != nil {
+		return nil, err
+	}
+	root := ""
+	if m.root != "" {
+		root = filepath.Join(m.root, filepath.FromSlash(p))
+	}
+	return &modeFS{Filesystem: fs, root: root}, nil
+}
+
+// mkdirTemp creates a directory in dir with a name made of pattern like os.MkdirTemp, which
+// creates it on disk. Its permissions are those of MkdirAll with 0755
+func (m *modeFS) mkdirTemp(dir, pattern string) (string, error) {
+	if m.root == "" {
+		return mkdirTemp(m, dir, pattern)
+	}
+	name, err := os.MkdirTemp(filepath.Join(m.root, filepath.FromSlash(dir)), pattern)
+	if err != nil {
+		return "", err
+	}
+	name = path.Join(dir, filepath.Base(name))
+	return name, m.chmod(name, (0755&^fixedUmask)|fs.ModeDir)
+}
+
+func (m *modeFS) chmod(name string, perm os.FileMode) error {
+	if m.root == "" {
+		return nil
+	}
+	return os.Chmod(filepath.Join(m.root, filepath.FromSlash(name)), perm.Perm())
+}
+
+// normalizedMode is the mode -normalize-modes records for an entry of info: 0755 for
+// directories and executable files, 0644 for other files and 0777 for symlinks like git
+func normalizedMode(info fs.FileInfo) int64 {
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		return 0777
+	case info.IsDir() || info.Mode()&0111 != 0:
+		return 0755
+	}
+	return 0644
+}
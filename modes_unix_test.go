@@ -0,0 +1,80 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+// withUmask runs f with the umask of the process set to umask, which codepack processes
+// started by f inherit
+func withUmask(umask int, f func()) {
+	previous := syscall.Umask(umask)
+	defer syscall.Umask(previous)
+	f()
+}
+
+func TestModeFSUmask(t *testing.T) {
+	for _, umask := range []int{0, 002, 022, 077} {
+		dir := t.TempDir()
+		fs := newModeFS(osfs.New(dir), dir)
+		withUmask(umask, func() {
+			if err := fs.MkdirAll("team/app/hooks", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, perm := range map[string]os.FileMode{"team/app/HEAD": 0666, "team/app/hooks/pre-receive": 0777} {
+				f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			}
+		})
+		for name, expected := range map[string]os.FileMode{
+			"team":                       0755,
+			"team/app":                   0755,
+			"team/app/hooks":             0755,
+			"team/app/HEAD":              0644,
+			"team/app/hooks/pre-receive": 0755,
+		} {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != expected {
+				t.Errorf("umask %03o: %s has mode %s, expected %s", umask, name, info.Mode().Perm(), expected)
+			}
+		}
+	}
+}
+
+func TestReproducibleArchiveUmask(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	config := "repos:\n  - name: app\n    path: team\n    url: " + filepath.Join(dir, "src") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var archives [][]byte
+	for _, umask := range []int{022, 077, 002} {
+		withUmask(umask, func() {
+			if out, code := runCodePack(t, dir, nil, "-config", "codepack.yaml", "-out", "backup.tar.gz", "-no-catalog", "-reproducible"); code != 0 {
+				t.Fatalf("umask %03o: exited with %d:\n%s", umask, code, out)
+			}
+		})
+		data, err := os.ReadFile(filepath.Join(dir, "backup.tar.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(archives) > 0 && !bytes.Equal(data, archives[0]) {
+			t.Errorf("umask %03o: the archive differs from the one of umask 022", umask)
+		}
+		archives = append(archives, data)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"gopkg.in/yaml.v3"
+)
+
+// movedURL asks the git host of repo for its references and returns the URL the
+// host redirected to, or an empty string when the repository has not moved.
+// A host answering 401 is the cue to prompt for its credentials when opts.Credentials is set
+func movedURL(ctx context.Context, repo Repository, opts CloneOptions) (string, error) {
+	if !strings.HasPrefix(repo.URL, "https://") && !strings.HasPrefix(repo.URL, "http://") {
+		return "", nil
+	}
+	auth := repoAuth(repo, opts)
+	resp, err := getInfoRefs(ctx, repo.URL, auth, opts.Policy)
+	if err == nil && resp.StatusCode == nethttp.StatusUnauthorized && opts.Credentials != nil {
+		// credentials asked for are never sent over plain http:// unless allow_insecure_http is set
+		if err := checkPromptedHTTP(repo); err != nil {
+			log.Printf("WARNING: %v", err)
+			return "", err
+		}
+		// the host requires authentication, ask once for its credentials and try again
+		if auth, err = opts.Credentials.Prompt(repo.URL); err != nil {
+			return "", fmt.Errorf("cannot read credentials: %w", err)
+		}
+		resp, err = getInfoRefs(ctx, repo.URL, auth, opts.Policy)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	final := *resp.Request.URL
+	final.RawQuery = ""
+	final.User = nil
+	moved := strings.TrimSuffix(final.String(), infoRefsPath)
+	if sanitizeURL(moved) == sanitizeURL(strings.TrimSuffix(repo.URL, "/")) {
+		return "", nil
+	}
+	return moved, nil
+}
+
+const infoRefsPath = "/info/refs"
+
+// errRedirectNotAllowed is a redirect of a references advertisement to a host the policy
+// does not allow, neither followed nor reported as the new URL of the repository
+var errRedirectNotAllowed = errors.New("the policy does not allow the new URL")
+
+// maxRedirects is the number of redirects of a references advertisement followed, like
+// the default of net/http
+const maxRedirects = 10
+
+// getInfoRefs requests the references advertisement of the repository at rawURL through
+// the transport of the clones, waiting for the rate limit of its host. A redirect to a host
+// policy does not allow is not followed. The body is discarded and the response is only
+// used for its status and final URL
+func getInfoRefs(ctx context.Context, rawURL string, auth *http.BasicAuth, policy *Policy) (*nethttp.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, strings.TrimSuffix(rawURL, "/")+infoRefsPath+"?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	httpClient := &nethttp.Client{
+		Transport: cloneTransport,
+		CheckRedirect: func(req *nethttp.Request, via []*nethttp.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if policy == nil {
+				return nil
+			}
+			if host, ok := policy.allowsHost(req.URL.String()); !ok {
+				return fmt.Errorf("%w, redirected to the host %s", errRedirectNotAllowed, host)
+			}
+			return nil
+		},
+	}
+	if err := apiRateLimits.wait(ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	apiRateLimits.observe(resp.Request.URL.Host, resp.Header)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// detectMoves checks every http repository of config for a redirect to a new URL in parallel,
+// recording the new URL in MovedTo, until ctx is cancelled. It returns the number of moved
+// repositories
+func detectMoves(ctx context.Context, config *Config, opts CloneOptions) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	moved := 0
+	sem := make(chan struct{}, workers)
+	for i := range config.Repos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(repo *Repository) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			newURL, err := movedURL(ctx, *repo, opts)
+			if err != nil || newURL == "" {
+				if errors.Is(err, errRedirectNotAllowed) {
+					log.Printf("WARNING: %s: %v", sanitizeURL(repo.URL), errors.Unwrap(err))
+				}
+				return
+			}
+			log.Printf("WARNING: repository has moved: %s → %s", sanitizeURL(repo.URL), sanitizeURL(newURL))
+			repo.MovedTo = newURL
+			mu.Lock()
+			moved++
+			mu.Unlock()
+		}(&config.Repos[i])
+	}
+	wg.Wait()
+	return moved
+}
+
+// updateConfigURLs rewrites the url of every moved repository in the YAML configuration
+// filename, editing the document nodes so comments and layout are kept
+func updateConfigURLs(filename string, config *Config) error {
+	if configFormat(filename) != "yaml" || isRemoteConfig(filename) || filename == "-" {
+		return fmt.Errorf("-update-config only supports local YAML configuration files")
+	}
+	moves := make(map[string]string)
+	for _, repo := range config.Repos {
+		if repo.MovedTo != "" {
+			moves[repo.URL] = repo.MovedTo
+		}
+	}
+	if len(moves) == 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	updated := 0
+	var visit func(n *yaml.Node)
+	visit = func(n *yaml.Node) {
+		if n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key, value := n.Content[i], n.Content[i+1]
+				if key.Value == "url" && value.Kind == yaml.ScalarNode {
+					if newURL, ok := moves[value.Value]; ok {
+						value.Value = newURL
+						updated++
+					}
+				}
+			}
+		}
+		for _, child := range n.Content {
+			visit(child)
+		}
+	}
+	visit(&doc)
+
+	if err := writeConfigNodes(filename, &doc); err != nil {
+		return err
+	}
+	log.Printf("Updated %d moved repository URLs in '%s'", updated, filename)
+	return nil
+}
+
+func logMoves(moved int, updated bool) {
+	if moved == 0 {
+		return
+	}
+	if updated {
+		log.Printf("%d repositories have moved, their new URLs were written to the configuration", moved)
+		return
+	}
+	log.Printf("WARNING: %d repositories have moved, update their URLs in the configuration or run with -update-config", moved)
+}
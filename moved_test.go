@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingTransport counts the requests sent through it
+type countingTransport struct {
+	base     nethttp.RoundTripper
+	requests atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *nethttp.Request) (*nethttp.Response, error) {
+	t.requests.Add(1)
+	return t.base.RoundTrip(req)
+}
+
+func TestMovedURL(t *testing.T) {
+	var newHostRequests atomic.Int32
+	newHost := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		newHostRequests.Add(1)
+	}))
+	defer newHost.Close()
+	// the new host is reached as localhost, the old one as 127.0.0.1
+	newURL := strings.Replace(newHost.URL, "127.0.0.1", "localhost", 1)
+	oldHost := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if strings.HasPrefix(r.URL.Path, "/team/moved.git") {
+			nethttp.Redirect(w, r, newURL+"/team/app.git"+infoRefsPath+"?"+r.URL.RawQuery, nethttp.StatusMovedPermanently)
+		}
+	}))
+	defer oldHost.Close()
+
+	saved := cloneTransport
+	defer func() { cloneTransport = saved }()
+	transport := &countingTransport{base: saved}
+	cloneTransport = transport
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		policy   *Policy
+		moved    string
+		err      error
+		requests int32
+	}{
+		{name: "not moved", url: oldHost.URL + "/team/app.git", requests: 1},
+		{name: "moved", url: oldHost.URL + "/team/moved.git", moved: newURL + "/team/app.git", requests: 2},
+		{name: "moved to an allowed host", url: oldHost.URL + "/team/moved.git", policy: &Policy{AllowedHosts: []string{"127.0.0.1", "localhost"}}, moved: newURL + "/team/app.git", requests: 2},
+		{name: "moved to a host not allowed", url: oldHost.URL + "/team/moved.git", policy: &Policy{AllowedHosts: []string{"127.0.0.1"}}, err: errRedirectNotAllowed, requests: 1},
+	} {
+		transport.requests.Store(0)
+		newHostRequests.Store(0)
+		moved, err := movedURL(context.Background(), Repository{URL: tc.url}, CloneOptions{Policy: tc.policy})
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) || moved != "" {
+				t.Errorf("%s: moved to %q with error %v, expected %v", tc.name, moved, err, tc.err)
+			}
+			if newHostRequests.Load() != 0 {
+				t.Errorf("%s: the redirect to a host the policy does not allow was followed", tc.name)
+			}
+		} else if err != nil || moved != tc.moved {
+			t.Errorf("%s: moved to %q with error %v, expected %q", tc.name, moved, err, tc.moved)
+		}
+		if n := transport.requests.Load(); n != tc.requests {
+			t.Errorf("%s: %d requests through the transport of the clones, expected %d", tc.name, n, tc.requests)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := movedURL(ctx, Repository{URL: oldHost.URL + "/team/moved.git"}, CloneOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("a cancelled run returned %v", err)
+	}
+	config := &Config{Repos: []Repository{{URL: oldHost.URL + "/team/moved.git"}}}
+	if moved := detectMoves(ctx, config, CloneOptions{}); moved != 0 || config.Repos[0].MovedTo != "" {
+		t.Errorf("a cancelled run detected %d moves", moved)
+	}
+}
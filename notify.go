@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NotifyConfig configures the notifications sent when a run finishes or fails
+type NotifyConfig struct {
+	Email *EmailNotify `yaml:"email" json:"email" toml:"email"`
+	// Exec runs a command with the JSON run report on its standard input
+	Exec *ExecPlugin `yaml:"exec" json:"exec" toml:"exec"`
+}
+
+// Notifier sends the report of a finished run, Test a message validating its settings
+type Notifier interface {
+	Notify(report *runReport, attachment []byte) error
+	Test() error
+	String() string
+}
+
+// notifiers are the notifiers configured in notify, a nil *NotifyConfig has none
+func (n *NotifyConfig) notifiers() []Notifier {
+	if n == nil {
+		return nil
+	}
+	var notifiers []Notifier
+	if n.Email != nil {
+		notifiers = append(notifiers, emailNotifier{n.Email})
+	}
+	if n.Exec != nil {
+		notifiers = append(notifiers, execNotifier{*n.Exec})
+	}
+	return notifiers
+}
+
+// EmailNotify sends the run summary through an SMTP server, TLS is starttls (the default),
+// implicit or none
+type EmailNotify struct {
+	Host        string   `yaml:"host" json:"host" toml:"host"`
+	Port        int      `yaml:"port" json:"port" toml:"port"`
+	TLS         string   `yaml:"tls" json:"tls" toml:"tls"`
+	UsernameEnv string   `yaml:"username_env" json:"username_env" toml:"username_env"`
+	PasswordEnv string   `yaml:"password_env" json:"password_env" toml:"password_env"`
+	From        string   `yaml:"from" json:"from" toml:"from"`
+	To          []string `yaml:"to" json:"to" toml:"to"`
+}
+
+// runReport is the outcome of a run attached to notifications as JSON
+type runReport struct {
+	RunID           string `json:"run_id"`
+	Kind            string `json:"kind"`
+	CodePackVersion string `json:"codepack_version"`
+	Status          string `json:"status"`
+	Started         string `json:"started"`
+	Finished        string `json:"finished"`
+	Output          string `json:"output"`
+	Total           int    `json:"total"`
+	Cloned          int    `json:"cloned"`
+	Failed          int    `json:"failed"`
+	Missing         int    `json:"missing"`
+	Excluded        int    `json:"excluded,omitempty"`
+	// Tags is the -tags selection of the run, empty when it took every repository
+	Tags    []string         `json:"tags,omitempty"`
+	TagsAll bool             `json:"tags_all,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Repos   []runReportEntry `json:"repos"`
+	// Destinations are the outcomes of writing the archive, empty when the run ended before
+	Destinations []destinationResult `json:"destinations,omitempty"`
+	// Archive holds the sizes of the archive, nil when the run ended before it was written
+	Archive *archiveStats `json:"archive,omitempty"`
+	// Guard is the outcome of the backup guard, nil when no guard is set
+	Guard *guardResult `json:"guard,omitempty"`
+	// Statuses counts the repositories by status once the run finished
+	Statuses map[repoStatus]int `json:"statuses,omitempty"`
+	// Hosts aggregates the repositories by the host of their URL once the run finished
+	Hosts []hostStats `json:"hosts,omitempty"`
+	// Concurrency are the changes of the clones run at once by -workers auto
+	Concurrency []concurrencyStep `json:"concurrency,omitempty"`
+	mu          sync.Mutex
+	// previous are the clone paths of the parent manifest, a clone of one is updated
+	previous map[string]bool
+}
+
+type runReportEntry struct {
+	URL    string     `json:"url"`
+	Path   string     `json:"path"`
+	Status repoStatus `json:"status"`
+	Error  string     `json:"error,omitempty"`
+	// Category is the kind of failure, like auth or network, see classifyCloneError
+	Category string `json:"category,omitempty"`
+	// Missing is set for a repository missing from the remote that was left out of the
+	// backup instead of failing the run, see -fail-on-missing
+	Missing bool `json:"missing,omitempty"`
+	// LastKnown is the archive holding the stale copy of a missing repository
+	LastKnown     string `json:"last_known,omitempty"`
+	LastReachable string `json:"last_reachable,omitempty"`
+	// Health is the analysis of the clone by -health-report
+	Health *repoHealth `json:"health,omitempty"`
+	// Secrets is the outcome of -scan-secrets, Excluded is set when it left the repository out of the backup
+	Secrets  *secretScan `json:"secrets,omitempty"`
+	Excluded bool        `json:"excluded,omitempty"`
+	// Tags are the tags of the repository, as recorded in the manifest
+	Tags []string `json:"tags,omitempty"`
+	// Head is the commit and DefaultBranch the branch HEAD pointed at, Refs the number of
+	// references and Size the bytes of the object store, as recorded in the manifest
+	Head          string `json:"head,omitempty"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+	Refs          int    `json:"refs,omitempty"`
+	Size          int64  `json:"size,omitempty"`
+	// HeadState and SuggestedHead are set for an unborn or dangling HEAD, see checkHead
+	HeadState     string `json:"head_state,omitempty"`
+	SuggestedHead string `json:"suggested_head,omitempty"`
+	// Incomplete is set for a repository cloned with an incomplete history, ShallowCommits
+	// are the commits whose parents it lacks, as recorded in the manifest
+	Incomplete     bool     `json:"incomplete,omitempty"`
+	ShallowCommits []string `json:"shallow_commits,omitempty"`
+	// CloneSeconds is the time the clone took
+	CloneSeconds float64 `json:"clone_seconds,omitempty"`
+	// Skipped is the reason a disabled repository was not cloned, CarriedFrom the earlier archive
+	// of the chain holding an unchanged repository
+	Skipped     string `json:"skipped,omitempty"`
+	CarriedFrom string `json:"carried_from,omitempty"`
+}
+
+// runKindFull is a run of the whole configuration, runKindWatch the delta backup
+// of the repositories -watch found added or changed and runKindManual a backup of the
+// whole configuration requested from -watch with SIGUSR1 or POST /run
+const (
+	runKindFull   = "full"
+	runKindWatch  = "watch"
+	runKindManual = "manual"
+)
+
+func newRunReport(outputs []Destination, kind string, total int) *runReport {
+	output := make([]string, len(outputs))
+	for i, dest := range outputs {
+		output[i] = sanitizeURL(dest.URL)
+	}
+	return &runReport{
+		RunID:           runID,
+		Kind:            kind,
+		CodePackVersion: VERSION,
+		Started:         clock().UTC().Format(time.RFC3339),
+		Output:          strings.Join(output, ", "),
+		Total:           total,
+		Repos:           []runReportEntry{},
+	}
+}
+
+// Record adds the outcome of the clone of one repository, a nil *runReport records nothing
+func (r *runReport) Record(repo Repository, clonePath string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry := runReportEntry{URL: sanitizeURL(repo.URL), Path: clonePath, Status: statusCloned}
+	if err != nil {
+		entry.Error = err.Error()
+		entry.Category = classifyCloneError(err)
+		entry.Status = cloneErrorStatus(err)
+		r.Failed++
+	} else {
+		if r.previous[clonePath] {
+			entry.Status = statusUpdated
+		}
+		r.Cloned++
+	}
+	r.Repos = append(r.Repos, entry)
+}
+
+// RecordParent notes the repositories of the parent manifest of an incremental run, so a
+// clone of one is recorded as updated, a nil *runReport records nothing
+func (r *runReport) RecordParent(parent *Manifest) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.previous = make(map[string]bool)
+	for _, repo := range parent.Repos {
+		if repo.Skipped == "" {
+			r.previous[repo.ClonePath()] = true
+		}
+	}
+}
+
+// RecordMissing adds a repository missing from the remote or empty that does not fail
+// the run, a nil *runReport records nothing
+func (r *runReport) RecordMissing(repo Repository, clonePath string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := cloneErrorStatus(err)
+	if status == statusMissing {
+		r.Missing++
+	}
+	r.Repos = append(r.Repos, runReportEntry{
+		URL:      sanitizeURL(repo.URL),
+		Path:     clonePath,
+		Status:   status,
+		Error:    err.Error(),
+		Category: classifyCloneError(err),
+		Missing:  status == statusMissing,
+	})
+}
+
+// RecordLastKnown adds the archive the stale copy of the missing repository at
+// clonePath was carried from, a nil *runReport records nothing
+func (r *runReport) RecordLastKnown(clonePath string, archive string, lastReachable string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Repos {
+		if r.Repos[i].Path == clonePath && r.Repos[i].Missing {
+			r.Repos[i].LastKnown = archive
+			r.Repos[i].LastReachable = lastReachable
+		}
+	}
+}
+
+// FailureGroups summarizes the failed clones by category and host, a nil *runReport has none
+func (r *runReport) FailureGroups() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return failureGroups(r.Repos)
+}
+
+// RecordHealth adds the health of the clone at clonePath, a nil *runReport records nothing
+func (r *runReport) RecordHealth(clonePath string, health *repoHealth) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Repos {
+		if r.Repos[i].Path == clonePath && r.Repos[i].Error == "" {
+			r.Repos[i].Health = health
+		}
+	}
+}
+
+// RecordDuration adds the time the clone of the repository at clonePath took, a nil *runReport records nothing
+func (r *runReport) RecordDuration(clonePath string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Repos {
+		if r.Repos[i].Path == clonePath {
+			r.Repos[i].CloneSeconds = d.Seconds()
+		}
+	}
+}
+
+// RecordManifest adds the HEAD, references and size manifest records to the entries of its
+// repositories, and entries for the disabled and unchanged repositories the run did not clone,
+// so the report and the inventory describe the same backup as the manifest. The status of
+// every entry is set on its repository of manifest in turn
+func (r *runReport) RecordManifest(manifest *Manifest) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := make(map[string]int)
+	for i, entry := range r.Repos {
+		index[entry.Path] = i
+	}
+	for m := range manifest.Repos {
+		repo := &manifest.Repos[m]
+		i, ok := index[repo.ClonePath()]
+		if !ok {
+			entry := runReportEntry{URL: repo.URL, Path: repo.ClonePath(), Status: statusSkipped, Skipped: repo.Skipped}
+			if repo.Skipped == "" && repo.Archive != manifest.Archive {
+				entry.Status = statusUnchanged
+				entry.CarriedFrom = repo.Archive
+			}
+			r.Repos = append(r.Repos, entry)
+			i = len(r.Repos) - 1
+			index[entry.Path] = i
+		}
+		entry := &r.Repos[i]
+		entry.Head = repo.Refs[repo.Head]
+		entry.DefaultBranch = strings.TrimPrefix(repo.Head, "refs/heads/")
+		if repo.Export != nil {
+			entry.Head = repo.Export.Commit
+		}
+		entry.Refs = len(repo.Refs)
+		entry.Size = repo.Size
+		entry.HeadState = repo.HeadState
+		entry.Tags = repo.Tags
+		entry.SuggestedHead = repo.SuggestedHead
+		entry.Incomplete = repo.Complete != nil && !*repo.Complete
+		entry.ShallowCommits = repo.ShallowCommits
+		repo.Status = entry.Status
+	}
+}
+
+// RecordExcluded adds a repository left out of the backup for its secrets, a nil *runReport records nothing
+func (r *runReport) RecordExcluded(repo Repository, clonePath string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Excluded++
+	r.Repos = append(r.Repos, runReportEntry{URL: sanitizeURL(repo.URL), Path: clonePath, Status: statusSkipped, Excluded: true})
+}
+
+// RecordSecrets adds the secret scan of the repository at clonePath, a nil *runReport or scan records nothing
+func (r *runReport) RecordSecrets(clonePath string, scan *secretScan) {
+	if r == nil || scan == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Repos {
+		if r.Repos[i].Path == clonePath {
+			r.Repos[i].Secrets = scan
+		}
+	}
+}
+
+// secretsFound describes every repository -scan-secrets found secrets in and what its policy did
+func (r *runReport) secretsFound() []string {
+	var lines []string
+	for _, entry := range r.Repos {
+		if entry.Secrets == nil || entry.Secrets.Findings == 0 {
+			continue
+		}
+		line := fmt.Sprintf("%s to path %s: %d secrets (%s)", entry.URL, entry.Path, entry.Secrets.Findings, strings.Join(entry.Secrets.rules(), ", "))
+		switch entry.Secrets.Policy {
+		case secretsExclude:
+			line += ", not in the backup"
+		case secretsFail:
+			line += ", failed the run"
+		default:
+			line += ", archived"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// missingFromRemote describes every repository the remote reported as not found, whether it
+// failed the run, was left out of the backup or was archived from its last known copy
+func (r *runReport) missingFromRemote() []string {
+	var lines []string
+	for _, entry := range r.Repos {
+		if entry.Category != categoryNotFound {
+			continue
+		}
+		line := fmt.Sprintf("%s to path %s", entry.URL, entry.Path)
+		switch {
+		case entry.LastKnown != "":
+			line += fmt.Sprintf(", last known copy from %s archived as stale, last reachable %s", entry.LastKnown, entry.LastReachable)
+		case entry.Missing:
+			line += ", not in the backup"
+		default:
+			line += ", failed the run"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// RecordArchive adds the sizes of the archive, a nil *runReport records nothing
+func (r *runReport) RecordArchive(stats archiveStats) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Archive = &stats
+}
+
+// RecordGuard adds the outcome of the backup guard
+func (r *runReport) RecordGuard(result *guardResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Guard = result
+}
+
+// RecordConcurrency adds the concurrency profile of -workers auto, a nil *runReport records nothing
+func (r *runReport) RecordConcurrency(profile []concurrencyStep) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Concurrency = profile
+}
+
+// RecordDestinations adds the outcome of writing the archive to every destination
+func (r *runReport) RecordDestinations(results []destinationResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Destinations = results
+}
+
+// statusCounts counts the repositories of the report by status
+func (r *runReport) statusCounts() map[repoStatus]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.countStatuses()
+}
+
+func (r *runReport) countStatuses() map[repoStatus]int {
+	counts := make(map[repoStatus]int)
+	for _, entry := range r.Repos {
+		counts[entry.Status]++
+	}
+	return counts
+}
+
+// Finish records the error the run ended with, nil for a successful run
+func (r *runReport) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = clock().UTC().Format(time.RFC3339)
+	r.Statuses = r.countStatuses()
+	r.Hosts = hostStatistics(r.Repos, apiRateLimits.waitsByHost())
+	r.Status = "SUCCESS"
+	if err != nil {
+		r.Status = "FAILURE"
+		r.Error = err.Error()
+	}
+}
+
+func (r *runReport) subject() string {
+	if r.Kind == runKindWatch {
+		return fmt.Sprintf("CodePack watch delta backup %s %d/%d repos", r.Status, r.Cloned, r.Total)
+	}
+	if r.Kind == runKindManual {
+		return fmt.Sprintf("CodePack manual backup %s %d/%d repos", r.Status, r.Cloned, r.Total)
+	}
+	return fmt.Sprintf("CodePack backup %s %d/%d repos", r.Status, r.Cloned, r.Total)
+}
+
+// summary is the human readable body of a notification
+func (r *runReport) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Run %s (%s) %s\n\n", r.RunID, r.Kind, strings.ToLower(r.Status))
+	fmt.Fprintf(&b, "Output: %s\nStarted: %s\nFinished: %s\n", r.Output, r.Started, r.Finished)
+	var counts []string
+	for _, status := range repoStatuses {
+		if r.Statuses[status] > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", r.Statuses[status], status))
+		}
+	}
+	counts = append(counts, fmt.Sprintf("%d configured", r.Total))
+	fmt.Fprintf(&b, "Repositories: %s\n", strings.Join(counts, ", "))
+	if len(r.Tags) > 0 {
+		mode := "any"
+		if r.TagsAll {
+			mode = "all"
+		}
+		fmt.Fprintf(&b, "Tags: %s of %s\n", mode, strings.Join(r.Tags, ", "))
+	}
+	if r.Excluded > 0 {
+		fmt.Fprintf(&b, "Excluded for secrets: %d\n", r.Excluded)
+	}
+	if r.Guard != nil {
+		fmt.Fprintf(&b, "Backup guard: %s\n", r.Guard)
+	}
+	if len(r.Concurrency) > 0 {
+		fmt.Fprintf(&b, "Concurrency: %s\n", profileSummary(r.Concurrency))
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, "\nError: %s\n", r.Error)
+	}
+	if len(r.Hosts) > 0 {
+		lines := make([]string, len(r.Hosts))
+		for i, host := range r.Hosts {
+			lines[i] = host.String()
+		}
+		fmt.Fprintf(&b, "\nHosts:\n  %s\n", strings.Join(lines, "\n  "))
+	}
+	if groups := failureGroups(r.Repos); len(groups) > 0 {
+		fmt.Fprintf(&b, "\nFailures:\n  %s\n", strings.Join(groups, "\n  "))
+	}
+	if missing := r.missingFromRemote(); len(missing) > 0 {
+		fmt.Fprintf(&b, "\nMissing from remote:\n  %s\n", strings.Join(missing, "\n  "))
+	}
+	if attention := r.needsAttention(); len(attention) > 0 {
+		fmt.Fprintf(&b, "\nNeeds attention:\n  %s\n", strings.Join(attention, "\n  "))
+	}
+	if incomplete := r.incompleteHistory(); len(incomplete) > 0 {
+		fmt.Fprintf(&b, "\nIncomplete history:\n  %s\n", strings.Join(incomplete, "\n  "))
+	}
+	if secrets := r.secretsFound(); len(secrets) > 0 {
+		fmt.Fprintf(&b, "\nSecrets:\n  %s\n", strings.Join(secrets, "\n  "))
+	}
+	if r.Archive != nil {
+		fmt.Fprintf(&b, "\nArchive: %s\n", r.Archive.table())
+	}
+	for _, dest := range r.Destinations {
+		fmt.Fprintf(&b, "\nDestination %s: %s in %s", dest.URL, strings.ToLower(dest.Status), dest.Duration)
+		if dest.Error != "" {
+			fmt.Fprintf(&b, ", %s", dest.Error)
+		} else {
+			fmt.Fprintf(&b, ", sha256 %s", dest.SHA256)
+		}
+		if !dest.Required {
+			b.WriteString(" (optional)")
+		}
+	}
+	if len(r.Destinations) > 0 {
+		b.WriteString("\n")
+	}
+	for _, entry := range r.Repos {
+		if entry.Error != "" && !entry.Missing {
+			fmt.Fprintf(&b, "\nFailed %s to path %s (%s): %s", entry.URL, entry.Path, entry.Category, entry.Error)
+		}
+	}
+	return b.String()
+}
+
+// notifyRun sends the report of a finished run, a failure to send is logged
+// and never changes the outcome of the run
+func notifyRun(notify *NotifyConfig, report *runReport) {
+	notifiers := notify.notifiers()
+	if len(notifiers) == 0 {
+		return
+	}
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	attachment, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Println("WARNING: cannot encode the run report:", err)
+		return
+	}
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(report, attachment); err != nil {
+			log.Printf("WARNING: cannot send the %s: %v", notifier, err)
+			continue
+		}
+		log.Printf("Sent %s", notifier)
+	}
+}
+
+// notifyTest sends a test message to validate the notification settings of config
+func notifyTest(notify *NotifyConfig) error {
+	notifiers := notify.notifiers()
+	if len(notifiers) == 0 {
+		return fmt.Errorf("No notify block in the configuration")
+	}
+	for _, notifier := range notifiers {
+		if err := notifier.Test(); err != nil {
+			return fmt.Errorf("Failed to send test %s: %w", notifier, err)
+		}
+		log.Printf("Sent test %s", notifier)
+	}
+	return nil
+}
+
+// emailNotifier sends the summary of the run with the report attached as JSON
+type emailNotifier struct {
+	cfg *EmailNotify
+}
+
+func (n emailNotifier) String() string {
+	return fmt.Sprintf("email notification to %s", strings.Join(n.cfg.To, ", "))
+}
+
+func (n emailNotifier) Notify(report *runReport, attachment []byte) error {
+	return sendEmail(n.cfg, report.subject(), report.summary(), "codepack-report.json", attachment)
+}
+
+func (n emailNotifier) Test() error {
+	body := fmt.Sprintf("This is a test message of CodePack %s, the email notification settings work.\n", VERSION)
+	if err := sendEmail(n.cfg, "CodePack notification test", body, "", nil); err != nil {
+		return fmt.Errorf("server '%s': %w", n.cfg.Host, err)
+	}
+	return nil
+}
+
+// sendEmail sends a plain text message with an optional attachment through the server of cfg
+func sendEmail(cfg *EmailNotify, subject string, body string, attachmentName string, attachment []byte) error {
+	if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return fmt.Errorf("email notifications require host, from and to")
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+		if cfg.TLS == "implicit" {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+
+	var client *smtp.Client
+	switch cfg.TLS {
+	case "implicit":
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		if client, err = smtp.NewClient(conn, cfg.Host); err != nil {
+			conn.Close()
+			return err
+		}
+	case "", "starttls", "none":
+		conn, err := net.DialTimeout("tcp", addr, time.Minute)
+		if err != nil {
+			return err
+		}
+		if client, err = smtp.NewClient(conn, cfg.Host); err != nil {
+			conn.Close()
+			return err
+		}
+		if cfg.TLS != "none" {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown tls '%s', use starttls, implicit or none", cfg.TLS)
+	}
+	defer client.Close()
+
+	if cfg.UsernameEnv != "" {
+		auth := smtp.PlainAuth("", os.Getenv(cfg.UsernameEnv), os.Getenv(cfg.PasswordEnv), cfg.Host)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(emailMessage(cfg, subject, body, attachmentName, attachment)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// emailMessage builds a multipart MIME message of the text body and the attachment
+func emailMessage(cfg *EmailNotify, subject string, body string, attachmentName string, attachment []byte) []byte {
+	var msg bytes.Buffer
+	parts := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		cfg.From, strings.Join(cfg.To, ", "), subject, time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+
+	text, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	text.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	if attachment != nil {
+		file, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/json"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", attachmentName)},
+		})
+		encoded := base64.StdEncoding.EncodeToString(attachment)
+		for len(encoded) > 76 {
+			fmt.Fprintf(file, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(file, "%s\r\n", encoded)
+	}
+	parts.Close()
+	return msg.Bytes()
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/credentials"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+const (
+	ociArtifactType  = "application/vnd.codepack.backup.v1"
+	ociLayerType     = "application/vnd.codepack.backup.layer.v1.tar+gzip"
+	ociAnnotationKey = "dev.codepack."
+)
+
+// ociUploader pushes the archive as an OCI artifact to oci://registry/repository:tag
+// using the credentials from the docker config file, a layer larger than chunkSize in
+// chunks of an upload session
+type ociUploader struct {
+	reference    string
+	annotations  map[string]string
+	plainHTTP    bool
+	format       archiveFormat
+	chunkSize    int
+	chunkRetries int
+	// repo and layer are the repository and the layer pushed by Upload
+	repo  *remote.Repository
+	layer ocispec.Descriptor
+}
+
+func newOCIUploader(u *url.URL, opts DestinationOptions) (*ociUploader, error) {
+	ref := u.Host + u.Path
+	if !strings.ContainsAny(path.Base(u.Path), ":@") {
+		return nil, fmt.Errorf("oci destination '%s' must include a tag, e.g. oci://registry/backups/codepack:latest", u.String())
+	}
+	return &ociUploader{
+		reference:    ref,
+		annotations:  opts.Annotations,
+		plainHTTP:    opts.OCIPlainHTTP,
+		format:       opts.archiveFormat(),
+		chunkSize:    opts.ChunkSize,
+		chunkRetries: opts.ChunkRetries,
+	}, nil
+}
+
+// ociClient authenticates with the credentials of the docker config file
+func ociClient() (*auth.Client, error) {
+	store, err := credentials.NewStoreFromDocker(credentials.StoreOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load docker credentials: %w", err)
+	}
+	return &auth.Client{
+		Client:     retry.DefaultClient,
+		Cache:      auth.NewCache(),
+		Credential: credentials.Credential(store),
+	}, nil
+}
+
+// newOCIRepository is the repository of reference authenticated with the docker credentials
+func newOCIRepository(reference string, plainHTTP bool) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(reference)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid oci reference '%s': %w", reference, err)
+	}
+	repo.PlainHTTP = plainHTTP
+	if repo.Client, err = ociClient(); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// Probe pings the registry with the docker credentials
+func (o *ociUploader) Probe() error {
+	ref, err := registry.ParseReference(o.reference)
+	if err != nil {
+		return fmt.Errorf("Invalid oci reference '%s': %w", o.reference, err)
+	}
+	reg, err := remote.NewRegistry(ref.Registry)
+	if err != nil {
+		return err
+	}
+	reg.PlainHTTP = o.plainHTTP
+	if reg.Client, err = ociClient(); err != nil {
+		return err
+	}
+	if err := reg.Ping(context.Background()); err != nil {
+		return fmt.Errorf("Cannot reach registry '%s': %w", ref.Registry, err)
+	}
+	return nil
+}
+
+func (o *ociUploader) Upload(r io.Reader) error {
+	ctx := context.Background()
+
+	repo, err := newOCIRepository(o.reference, o.plainHTTP)
+	if err != nil {
+		return err
+	}
+
+	// The registry needs the digest and size of the blob up front,
+	// so the stream is spooled to a temporary file first
+	spool, err := os.CreateTemp("", "codepack-oci")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), r)
+	if err != nil {
+		return err
+	}
+
+	layer := ocispec.Descriptor{
+		MediaType: o.format.ociLayerType,
+		Digest:    digest.NewDigestFromBytes(digest.SHA256, hash.Sum(nil)),
+		Size:      size,
+		Annotations: map[string]string{
+			ocispec.AnnotationTitle: "codepack" + o.format.extension,
+		},
+	}
+
+	log.Printf("Pushing %d byte layer %s to '%s'", size, layer.Digest, o.reference)
+	if err := o.pushLayer(ctx, repo, layer, spool); err != nil {
+		return fmt.Errorf("Failed to push layer: %w", err)
+	}
+	o.repo, o.layer = repo, layer
+
+	manifestAnnotations := map[string]string{}
+	for k, v := range o.annotations {
+		manifestAnnotations[ociAnnotationKey+k] = v
+	}
+
+	manifest, err := oras.PackManifest(ctx, repo, oras.PackManifestVersion1_1_RC4, ociArtifactType, oras.PackManifestOptions{
+		Layers:              []ocispec.Descriptor{layer},
+		ManifestAnnotations: manifestAnnotations,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to push manifest: %w", err)
+	}
+
+	if err := repo.Tag(ctx, manifest, repo.Reference.Reference); err != nil {
+		return fmt.Errorf("Failed to tag manifest %s: %w", manifest.Digest, err)
+	}
+	log.Printf("Pushed manifest %s to '%s'", manifest.Digest, o.reference)
+	return nil
+}
+
+// Verify resolves the pushed layer in the registry, which addresses it by the sha256 of
+// its content, and compares its size with the bytes uploaded
+func (o *ociUploader) Verify(d *streamDigest) (string, error) {
+	if o.repo == nil {
+		return "", fmt.Errorf("no layer was pushed")
+	}
+	desc, err := o.repo.Blobs().Resolve(context.Background(), o.layer.Digest.String())
+	if err != nil {
+		return "", fmt.Errorf("Cannot resolve layer %s: %w", o.layer.Digest, err)
+	}
+	if err := d.checkSize(o.layer.Size); err != nil {
+		return "", err
+	}
+	if err := d.checkSize(desc.Size); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("layer %s and size match", desc.Digest), nil
+}
+
+// pushLayer pushes layer from content unless the registry has it already. A layer larger
+// than chunkSize is sent in chunks of an upload session, a chunk that fails is sent again
+// from where the registry reports the upload to be instead of starting over
+func (o *ociUploader) pushLayer(ctx context.Context, repo *remote.Repository, layer ocispec.Descriptor, content io.ReaderAt) error {
+	if exists, err := repo.Blobs().Exists(ctx, layer); err == nil && exists {
+		log.Printf("Layer %s is in '%s' already", layer.Digest, o.reference)
+		return nil
+	}
+	if o.chunkSize <= 0 || layer.Size <= int64(o.chunkSize) {
+		return repo.Push(ctx, layer, io.NewSectionReader(content, 0, layer.Size))
+	}
+
+	ctx = auth.AppendRepositoryScope(ctx, repo.Reference, auth.ActionPull, auth.ActionPush)
+	session, err := startOCIUpload(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for session.offset < layer.Size {
+		end := session.offset + int64(o.chunkSize)
+		if end > layer.Size {
+			end = layer.Size
+		}
+		what := fmt.Sprintf("bytes %d-%d of layer %s", session.offset, end-1, layer.Digest)
+		err := retryChunk(o.chunkRetries, what, func() error {
+			err := session.patch(ctx, content, end)
+			if err != nil {
+				if statusErr := session.status(ctx); statusErr != nil {
+					log.Printf("WARNING: cannot read the state of the upload of layer %s: %v", layer.Digest, statusErr)
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return session.commit(ctx, layer.Digest)
+}
+
+// ociUpload is an upload session of the distribution API, location is where the next
+// request goes and offset the number of bytes the registry holds
+type ociUpload struct {
+	client   remote.Client
+	location *url.URL
+	offset   int64
+}
+
+// startOCIUpload opens an upload session in repo
+func startOCIUpload(ctx context.Context, repo *remote.Repository) (*ociUpload, error) {
+	scheme := "https"
+	if repo.PlainHTTP {
+		scheme = "http"
+	}
+	uploads := fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/", scheme, repo.Reference.Host(), repo.Reference.Repository)
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodPost, uploads, nil)
+	if err != nil {
+		return nil, err
+	}
+	session := &ociUpload{client: repo.Client}
+	if err := session.do(req, nethttp.StatusAccepted); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// do sends req and moves the session to the Location and Range of the response, which
+// must have the status expected
+func (u *ociUpload) do(req *nethttp.Request, expected int) error {
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	if expected == nethttp.StatusCreated {
+		return nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("%s %s: no location of the upload: %w", req.Method, req.URL.Redacted(), err)
+	}
+	u.location = location
+	// Range is 0-<last byte received>, missing before the first byte
+	u.offset = 0
+	if _, last, found := strings.Cut(resp.Header.Get("Range"), "-"); found {
+		end, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s %s: invalid range '%s'", req.Method, req.URL.Redacted(), resp.Header.Get("Range"))
+		}
+		u.offset = end + 1
+	}
+	return nil
+}
+
+// patch sends the bytes of content from the offset of the session up to end
+func (u *ociUpload) patch(ctx context.Context, content io.ReaderAt, end int64) error {
+	start := u.offset
+	chunk := func() io.ReadCloser { return io.NopCloser(io.NewSectionReader(content, start, end-start)) }
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodPatch, u.location.String(), chunk())
+	if err != nil {
+		return err
+	}
+	// the retrying client sends the chunk again after a transient error of the registry
+	req.GetBody = func() (io.ReadCloser, error) { return chunk(), nil }
+	req.ContentLength = end - start
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, end-1))
+	if err := u.do(req, nethttp.StatusAccepted); err != nil {
+		return err
+	}
+	if u.offset != end {
+		return fmt.Errorf("registry holds %d bytes of the upload after sending bytes %d-%d", u.offset, start, end-1)
+	}
+	return nil
+}
+
+// status asks the registry how many bytes of the upload it holds
+func (u *ociUpload) status(ctx context.Context) error {
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, u.location.String(), nil)
+	if err != nil {
+		return err
+	}
+	return u.do(req, nethttp.StatusNoContent)
+}
+
+// commit completes the upload as the blob with the digest d
+func (u *ociUpload) commit(ctx context.Context, d digest.Digest) error {
+	location := *u.location
+	query := location.Query()
+	query.Set("digest", d.String())
+	location.RawQuery = query.Encode()
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodPut, location.String(), nil)
+	if err != nil {
+		return err
+	}
+	return u.do(req, nethttp.StatusCreated)
+}
+
+// pullOCIArchive fetches the archive of the artifact an oci:// destination pushed to
+// reference into filename, checked against the digest of its layer
+func pullOCIArchive(reference string, plainHTTP bool, filename string) error {
+	ctx := context.Background()
+	repo, err := newOCIRepository(reference, plainHTTP)
+	if err != nil {
+		return err
+	}
+	desc, rc, err := repo.FetchReference(ctx, repo.Reference.Reference)
+	if err != nil {
+		return fmt.Errorf("Cannot fetch the manifest of '%s': %w", reference, err)
+	}
+	data, err := content.ReadAll(rc, desc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("Cannot read the manifest of '%s': %w", reference, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("Invalid manifest of '%s': %w", reference, err)
+	}
+	if manifest.ArtifactType != ociArtifactType && manifest.Config.MediaType != ociArtifactType {
+		return fmt.Errorf("'%s' is no CodePack backup, its artifact type is '%s'", reference, manifest.ArtifactType)
+	}
+	layer, ok := archiveLayer(manifest.Layers)
+	if !ok {
+		return fmt.Errorf("'%s' has no layer of a CodePack archive", reference)
+	}
+
+	log.Printf("Pulling %d byte layer %s from '%s'", layer.Size, layer.Digest, reference)
+	rc, err = repo.Fetch(ctx, layer)
+	if err != nil {
+		return fmt.Errorf("Cannot fetch layer %s: %w", layer.Digest, err)
+	}
+	defer rc.Close()
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	verifier := content.NewVerifyReader(rc, layer)
+	if _, err := io.Copy(f, verifier); err != nil {
+		f.Close()
+		return fmt.Errorf("Cannot pull layer %s: %w", layer.Digest, err)
+	}
+	if err := verifier.Verify(); err != nil {
+		f.Close()
+		return fmt.Errorf("Layer %s does not match its digest: %w", layer.Digest, err)
+	}
+	return f.Close()
+}
+
+// archiveLayer is the layer of layers in the media type of an archive format
+func archiveLayer(layers []ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	for _, layer := range layers {
+		for _, format := range archiveFormats {
+			if layer.MediaType == format.ociLayerType {
+				return layer, true
+			}
+		}
+	}
+	return ocispec.Descriptor{}, false
+}
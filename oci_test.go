@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeRegistry emulates the parts of the distribution API the oci:// destination talks to:
+// blob uploads, monolithic and in chunks, blobs and manifests. A blob only exists once its
+// upload was completed with a matching digest
+type fakeRegistry struct {
+	mu        sync.Mutex
+	host      string
+	blobs     map[digest.Digest][]byte
+	manifests map[string]fakeManifest
+	uploads   map[string][]byte
+	// patches counts the PATCH requests sending chunks
+	patches int
+	// failPatch is the PATCH answered with a 500 after keeping half of its chunk, 0 for none
+	failPatch int
+}
+
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	t.Helper()
+	f := &fakeRegistry{blobs: map[digest.Digest][]byte{}, manifests: map[string]fakeManifest{}, uploads: map[string][]byte{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	f.host = strings.TrimPrefix(server.URL, "http://")
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	return f
+}
+
+func (f *fakeRegistry) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(nethttp.StatusOK)
+	case strings.Contains(p, "/blobs/uploads/"):
+		repo, id, _ := strings.Cut(p, "/blobs/uploads/")
+		f.upload(w, r, repo, id)
+	case strings.Contains(p, "/blobs/"):
+		_, d, _ := strings.Cut(p, "/blobs/")
+		data, ok := f.blobs[digest.Digest(d)]
+		if !ok {
+			nethttp.Error(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`, nethttp.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Docker-Content-Digest", d)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == nethttp.MethodGet {
+			w.Write(data)
+		}
+	case strings.Contains(p, "/manifests/"):
+		_, ref, _ := strings.Cut(p, "/manifests/")
+		f.manifest(w, r, ref)
+	default:
+		nethttp.Error(w, "unexpected request", nethttp.StatusNotImplemented)
+	}
+}
+
+func (f *fakeRegistry) upload(w nethttp.ResponseWriter, r *nethttp.Request, repo string, id string) {
+	location := func(id string) {
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		if n := len(f.uploads[id]); n > 0 {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", n-1))
+		}
+	}
+	if r.Method == nethttp.MethodPost && id == "" {
+		id = strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = nil
+		location(id)
+		w.WriteHeader(nethttp.StatusAccepted)
+		return
+	}
+	data, ok := f.uploads[id]
+	if !ok {
+		nethttp.Error(w, `{"errors":[{"code":"BLOB_UPLOAD_UNKNOWN"}]}`, nethttp.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	switch r.Method {
+	case nethttp.MethodGet:
+		location(id)
+		w.WriteHeader(nethttp.StatusNoContent)
+	case nethttp.MethodPatch:
+		f.patches++
+		start, _, _ := strings.Cut(r.Header.Get("Content-Range"), "-")
+		if start != strconv.Itoa(len(data)) {
+			nethttp.Error(w, `{"errors":[{"code":"BLOB_UPLOAD_INVALID"}]}`, nethttp.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if f.patches == f.failPatch {
+			f.uploads[id] = append(data, body[:len(body)/2]...)
+			nethttp.Error(w, "connection reset", nethttp.StatusInternalServerError)
+			return
+		}
+		f.uploads[id] = append(data, body...)
+		location(id)
+		w.WriteHeader(nethttp.StatusAccepted)
+	case nethttp.MethodPut:
+		data = append(data, body...)
+		d := digest.Digest(r.URL.Query().Get("digest"))
+		if d.Validate() != nil || digest.FromBytes(data) != d {
+			nethttp.Error(w, `{"errors":[{"code":"DIGEST_INVALID"}]}`, nethttp.StatusBadRequest)
+			return
+		}
+		delete(f.uploads, id)
+		f.blobs[d] = data
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, d))
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(nethttp.StatusCreated)
+	default:
+		nethttp.Error(w, "unexpected upload request", nethttp.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeRegistry) manifest(w nethttp.ResponseWriter, r *nethttp.Request, ref string) {
+	if r.Method == nethttp.MethodPut {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		m := fakeManifest{mediaType: r.Header.Get("Content-Type"), data: data}
+		d := digest.FromBytes(data)
+		f.manifests[d.String()] = m
+		f.manifests[ref] = m
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(nethttp.StatusCreated)
+		return
+	}
+	m, ok := f.manifests[ref]
+	if !ok {
+		nethttp.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, nethttp.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.data)))
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.data).String())
+	if r.Method == nethttp.MethodGet {
+		w.Write(m.data)
+	}
+}
+
+// ociManifest is the manifest tagged ref in the fake registry
+func (f *fakeRegistry) ociManifest(t *testing.T, ref string) ocispec.Manifest {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var m ocispec.Manifest
+	if err := json.Unmarshal(f.manifests[ref].data, &m); err != nil {
+		t.Fatalf("manifest %s: %v", ref, err)
+	}
+	return m
+}
+
+func testOCIUploader(t *testing.T, target string, opts DestinationOptions) *ociUploader {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.OCIPlainHTTP = true
+	o, err := newOCIUploader(u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOCIUpload(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		chunkSize int
+		failPatch int
+		patches   int
+	}{
+		{name: "single request", chunkSize: 1024 * 1024},
+		{name: "chunked", chunkSize: 256 * 1024, patches: 3},
+		// the half of the second chunk the registry kept is not sent again
+		{name: "chunk failing", chunkSize: 256 * 1024, failPatch: 2, patches: 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeRegistry(t)
+			fake.failPatch = tc.failPatch
+			o := testOCIUploader(t, "oci://"+fake.host+"/backups/codepack:2024-05-01", DestinationOptions{
+				ChunkSize:    tc.chunkSize,
+				ChunkRetries: 1,
+				Annotations:  map[string]string{"repo-count": "2"},
+			})
+			data := testArchive(700 * 1024)
+			if err := o.Upload(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fake.blobs[digest.FromBytes(data)], data) {
+				t.Error("the layer was not pushed")
+			}
+			if fake.patches != tc.patches {
+				t.Errorf("the layer was sent in %d chunks, expected %d", fake.patches, tc.patches)
+			}
+			m := fake.ociManifest(t, "2024-05-01")
+			if m.ArtifactType != ociArtifactType || len(m.Layers) != 1 || m.Layers[0].MediaType != ociLayerType {
+				t.Errorf("tagged manifest is %+v", m)
+			}
+			if m.Annotations[ociAnnotationKey+"repo-count"] != "2" {
+				t.Errorf("manifest has annotations %v", m.Annotations)
+			}
+			digest := newStreamDigest()
+			digest.Write(data)
+			if _, err := o.Verify(digest); err != nil {
+				t.Errorf("Verify of the upload failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestPullOCIArchive(t *testing.T) {
+	fake := newFakeRegistry(t)
+	reference := fake.host + "/backups/codepack:2024-05-01"
+	data := testArchive(300 * 1024)
+	if err := testOCIUploader(t, "oci://"+reference, DestinationOptions{ChunkSize: 128 * 1024}).Upload(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "pulled")
+	if err := pullOCIArchive(reference, true, filename); err != nil {
+		t.Fatal(err)
+	}
+	if pulled, _ := os.ReadFile(filename); !bytes.Equal(pulled, data) {
+		t.Errorf("pulled %d bytes, %d were pushed", len(pulled), len(data))
+	}
+
+	fake.blobs[digest.FromBytes(data)][0] ^= 0xff
+	if err := pullOCIArchive(reference, true, filename); err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+		t.Errorf("pull of a corrupted layer returned %v", err)
+	}
+	if err := pullOCIArchive(fake.host+"/backups/codepack:missing", true, filename); err == nil {
+		t.Error("pull of a missing tag succeeded")
+	}
+
+	fake.manifests["image"] = fakeManifest{mediaType: ocispec.MediaTypeImageManifest, data: []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`)}
+	if err := pullOCIArchive(fake.host+"/backups/codepack:image", true, filename); err == nil || !strings.Contains(err.Error(), "no CodePack backup") {
+		t.Errorf("pull of a container image returned %v", err)
+	}
+}
+
+func TestPullManifestArchive(t *testing.T) {
+	fake := newFakeRegistry(t)
+	reference := fake.host + "/backups/codepack:2024-05-02"
+	data := testArchive(64 * 1024)
+	if err := testOCIUploader(t, "oci://"+reference, DestinationOptions{}).Upload(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	archiveDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(archiveDir, "codepack:2024-05-01"), []byte("parent"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Archive: "codepack:2024-05-02", Chain: []ManifestArchive{{Archive: "codepack:2024-05-01"}}}
+
+	dir, err := pullManifestArchive(m, archiveDir, "oci://"+reference, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if pulled, _ := os.ReadFile(filepath.Join(dir, m.Archive)); !bytes.Equal(pulled, data) {
+		t.Error("the archive of the manifest was not pulled")
+	}
+	if parent, _ := os.ReadFile(filepath.Join(dir, "codepack:2024-05-01")); string(parent) != "parent" {
+		t.Error("the parent archive of the chain is not linked next to the pulled archive")
+	}
+
+	for _, tc := range []struct {
+		name string
+		m    *Manifest
+		from string
+	}{
+		{name: "not oci", m: m, from: "gs://backups/codepack.tar.gz"},
+		{name: "per repo", m: &Manifest{PerRepo: true}, from: "oci://" + reference},
+		{name: "archive path", m: &Manifest{Archive: "../codepack.tar.gz"}, from: "oci://" + reference},
+	} {
+		if _, err := pullManifestArchive(tc.m, archiveDir, tc.from, true); err == nil {
+			t.Errorf("%s: pull succeeded", tc.name)
+		}
+	}
+}
+
+// writeTestArchive writes a tar.gz of files, pairs of a name and its content, and a
+// symbolic link to filename
+func writeTestArchive(t *testing.T, filename string, files ...[2]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file[0], Mode: 0644, Size: int64(len(file[1])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(file[1]))
+	}
+	tw.WriteHeader(&tar.Header{Name: "repo.git/link", Linkname: "HEAD", Mode: 0777, Typeflag: tar.TypeSymlink})
+	tw.Close()
+	zw.Close()
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListArchive(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "codepack.tar.gz")
+	writeTestArchive(t, filename, [2]string{"repo.git/HEAD", "ref: refs/heads/main\n"}, [2]string{"repo.git/bad\x1bname", "x"})
+
+	var out bytes.Buffer
+	if err := listArchive(filename, &out, archiveLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []string{
+		"-rw-r--r--          21  repo.git/HEAD",
+		"-rw-r--r--           1  " + displayName("repo.git/bad\x1bname"),
+		"Lrwxrwxrwx           0  repo.git/link -> HEAD",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("list printed\n%s\nexpected\n%s", out.String(), strings.Join(expected, "\n"))
+	}
+	if strings.Contains(out.String(), "\x1b") {
+		t.Error("list printed a control character of an entry name")
+	}
+
+	if err := listArchive(filename, io.Discard, archiveLimits{MaxEntries: 1}); err == nil {
+		t.Error("list read past -max-entries")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// exitCodeConfig is the exit status of a run refused for its configuration or command
+// line before anything is cloned, like the status of the flag package for invalid flags
+const exitCodeConfig = 2
+
+// configError exits a run with exitCodeConfig
+func configError(err error) error {
+	return &exitCodeError{err: err, code: exitCodeConfig}
+}
+
+// destinationProber is an Uploader that can tell cheaply, before a run clones anything,
+// whether it will be able to write the archive
+type destinationProber interface {
+	Probe() error
+}
+
+// checkDestinations fails when a required destination of dests cannot be written, local
+// paths by creating and removing a file in their directory, which createDirs creates when
+// it is missing, remote destinations by their Probe. A destination that is not required only
+// logs a warning, like a failure to write it would, unless its URL is invalid or of a scheme
+// CodePack does not write to
+func checkDestinations(dests []Destination, opts DestinationOptions, createDirs bool) error {
+	for _, dest := range dests {
+		err := checkDestination(dest.URL, opts, createDirs)
+		if err == nil {
+			continue
+		}
+		var exitErr *exitCodeError
+		invalid := errors.As(err, &exitErr) && exitErr.code == exitCodeConfig
+		if !dest.IsRequired() && !invalid {
+			log.Printf("WARNING: optional destination '%s' cannot be written: %v", sanitizeURL(dest.URL), err)
+			continue
+		}
+		return configError(fmt.Errorf("Cannot write to '%s': %w", sanitizeURL(dest.URL), err))
+	}
+	return nil
+}
+
+func checkDestination(target string, opts DestinationOptions, createDirs bool) error {
+	uploader, err := newUploader(target, opts)
+	if err != nil {
+		return err
+	}
+	if uploader == nil {
+		return checkLocalOutput(target, createDirs)
+	}
+	if opts.LocalCopy != "" {
+		if err := checkLocalOutput(opts.LocalCopy, createDirs); err != nil {
+			return fmt.Errorf("-local-copy: %w", err)
+		}
+	}
+	if prober, ok := uploader.(destinationProber); ok {
+		return prober.Probe()
+	}
+	return nil
+}
+
+// checkLocalOutput checks that the directory of target exists, or creates it with createDirs,
+// and that a file can be created in it
+func checkLocalOutput(target string, createDirs bool) error {
+	dir := filepath.Dir(target)
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) && createDirs {
+		log.Printf("Creating output directory '%s'", dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		info, err = os.Stat(dir)
+	}
+	if os.IsNotExist(err) {
+		return fmt.Errorf("the directory '%s' does not exist, create it or pass -create-dirs", dir)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", dir)
+	}
+	probe, err := os.CreateTemp(dir, ".codepack-probe-*")
+	if err != nil {
+		return fmt.Errorf("the directory '%s' is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckDestinations(t *testing.T) {
+	dir := t.TempDir()
+	optional := false
+	for _, tc := range []struct {
+		name       string
+		dests      []Destination
+		createDirs bool
+		err        string
+		created    string
+	}{
+		{name: "local", dests: []Destination{{URL: filepath.Join(dir, "backup.tar.gz")}}},
+		{name: "missing directory", dests: []Destination{{URL: filepath.Join(dir, "missing", "backup.tar.gz")}}, err: "pass -create-dirs"},
+		{name: "create-dirs", dests: []Destination{{URL: filepath.Join(dir, "created", "backup.tar.gz")}}, createDirs: true, created: "created"},
+		{name: "optional missing directory", dests: []Destination{{URL: filepath.Join(dir, "missing", "backup.tar.gz"), Required: &optional}}},
+		{name: "unsupported scheme", dests: []Destination{{URL: "s3://bucket/x.tar.gz"}}, err: "Unsupported destination scheme 's3://'"},
+		{name: "unsupported scheme with create-dirs", dests: []Destination{{URL: "s3://bucket/x.tar.gz"}}, createDirs: true, err: "Unsupported destination scheme 's3://'"},
+		{name: "optional unsupported scheme", dests: []Destination{{URL: "https://backup.example/x.tar.gz", Required: &optional}}, err: "Unsupported destination scheme 'https://'"},
+		{name: "invalid URL", dests: []Destination{{URL: "gs://bucket/%zz.tar.gz"}}, err: "Invalid destination URL"},
+	} {
+		err := checkDestinations(tc.dests, DestinationOptions{}, tc.createDirs)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+		} else {
+			var exitErr *exitCodeError
+			if err == nil || !strings.Contains(err.Error(), tc.err) || !errors.As(err, &exitErr) || exitErr.code != exitCodeConfig {
+				t.Errorf("%s: error %v, expected %q with exit status %d", tc.name, err, tc.err, exitCodeConfig)
+			}
+			if strings.Contains(err.Error(), "-create-dirs") && strings.Contains(tc.dests[0].URL, "://") {
+				t.Errorf("%s: suggests -create-dirs for a URL: %v", tc.name, err)
+			}
+		}
+		if tc.created != "" {
+			if info, err := os.Stat(filepath.Join(dir, tc.created)); err != nil || !info.IsDir() {
+				t.Errorf("%s: the directory %s was not created: %v", tc.name, tc.created, err)
+			}
+		}
+	}
+	if _, err := os.Stat("s3:"); !os.IsNotExist(err) {
+		t.Errorf("an s3:// destination created a local directory")
+	}
+}
+
+func TestUnsupportedSchemeRun(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	config := "repos:\n  - name: app\n    path: team\n    url: " + filepath.Join(dir, "src") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runCodePack(t, dir, nil, "-config", "codepack.yaml", "-out", "s3://bucket/x.tar.gz", "-create-dirs", "-no-catalog")
+	if code != exitCodeConfig || !strings.Contains(out, "Unsupported destination scheme 's3://'") {
+		t.Errorf("an s3:// destination exited with %d:\n%s", code, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "s3:")); !os.IsNotExist(err) {
+		t.Errorf("an s3:// destination was written as a local path: %v", err)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// output formats of a repository in a -per-repo backup besides the tar formats of -format
+const (
+	outputFormatZip  = "zip"
+	outputFormatNone = "none"
+)
+
+// indexName is the manifest of a -per-repo backup in its output directory
+const indexName = "index.json"
+
+func outputFormatNames() []string {
+	return append(formatNames(), outputFormatZip, outputFormatNone)
+}
+
+func validOutputFormat(name string) error {
+	if _, ok := archiveFormats[name]; ok || name == outputFormatZip || name == outputFormatNone {
+		return nil
+	}
+	return fmt.Errorf("Unsupported output format '%s', the supported formats are %s", name, strings.Join(outputFormatNames(), ", "))
+}
+
+// outputExtension is appended to the clone path of a repository written in format
+func outputExtension(format string) string {
+	switch format {
+	case outputFormatZip:
+		return ".zip"
+	case outputFormatNone:
+		return ""
+	}
+	return archiveFormats[format].extension
+}
+
+// outputFormat is the format -per-repo writes the repository in, its output_format or
+// the -format of the run
+func (r Repository) outputFormat(global string) string {
+	if r.OutputFormat != "" {
+		return r.OutputFormat
+	}
+	return global
+}
+
+// checkOutputFormats refuses output_format outside of -per-repo, a single archive has
+// the one format of -format
+func checkOutputFormats(repos []Repository, perRepo bool) error {
+	if perRepo {
+		return nil
+	}
+	var set []string
+	for _, repo := range repos {
+		if repo.OutputFormat != "" {
+			set = append(set, path.Join(repo.Path, repo.Name))
+		}
+	}
+	if len(set) > 0 {
+		return fmt.Errorf("output_format of %s only applies with -per-repo, a single archive is written in the -format of the run", strings.Join(set, ", "))
+	}
+	return nil
+}
+
+// writePerRepo writes every repository of config in staging to a file of its own below
+// dir, named after its clone path and in its output format, and the manifest listing the
+// format and checksum of every file as the index of the backup
+func writePerRepo(config *Config, staging billy.Filesystem, dir string, global string, opts archiveOptions, manifest *Manifest, report *runReport) error {
+	if _, err := os.Stat(filepath.Join(dir, indexName)); err == nil {
+		return fmt.Errorf("'%s' holds a backup already, write the -per-repo backup to a new directory", dir)
+	}
+	repoPaths := make(map[string]bool)
+	for _, repo := range config.Repos {
+		repoPaths[path.Join(repo.Path, repo.Name)] = true
+	}
+
+	type written struct {
+		format string
+		file   string
+		sum    string
+	}
+	files := make(map[string]written)
+	renamed := make(map[string]string)
+	for _, repo := range config.Repos {
+		clonePath := path.Join(repo.Path, repo.Name)
+		format := repo.outputFormat(global)
+		file := clonePath + outputExtension(format)
+		target := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		var sum string
+		var err error
+		switch format {
+		case outputFormatNone:
+			sum, err = copyTree(staging, clonePath, target, repoPaths)
+		case outputFormatZip:
+			sum, err = writeZip(staging, clonePath, target, repoPaths)
+		default:
+			opts.Format = archiveFormats[format]
+			sum, err = writeRepoTarball(staging, clonePath, target, repoPaths, opts, renamed)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to write %s to '%s': %w", clonePath, target, err)
+		}
+		log.Printf("Wrote %s as %s to '%s'", clonePath, format, target)
+		files[clonePath] = written{format: format, file: file, sum: sum}
+	}
+
+	if err := completeManifest(manifest, config, staging, renamed, report); err != nil {
+		return err
+	}
+	manifest.PerRepo = true
+	for i, repo := range manifest.Repos {
+		if w, ok := files[repo.ClonePath()]; ok && repo.Skipped == "" {
+			manifest.Repos[i].Archive, manifest.Repos[i].Format, manifest.Repos[i].SHA256 = w.file, w.format, w.sum
+		}
+	}
+	indexPath := filepath.Join(dir, indexName)
+	log.Println("Writing index:", indexPath)
+	return manifest.WriteFile(indexPath)
+}
+
+// writeRepoTarball writes the repository at clonePath to a tarball at target and returns its checksum
+func writeRepoTarball(staging billy.Filesystem, clonePath string, target string, repoPaths map[string]bool, opts archiveOptions, renamed map[string]string) (string, error) {
+	f, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	a, err := newArchiver(staging, io.MultiWriter(f, hash), repoPaths, opts)
+	if err != nil {
+		return "", err
+	}
+	if err := a.Add(clonePath); err != nil {
+		return "", err
+	}
+	if err := a.Close(); err != nil {
+		return "", err
+	}
+	for entry, original := range a.renamed {
+		renamed[entry] = original
+	}
+	return hex.EncodeToString(hash.Sum(nil)), f.Close()
+}
+
+// writeZip writes the repository at clonePath to a zip file at target below codepack/,
+// like the entries of a tarball, and returns its checksum
+func writeZip(staging billy.Filesystem, clonePath string, target string, repoPaths map[string]bool) (string, error) {
+	f, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	zw := zip.NewWriter(io.MultiWriter(f, hash))
+	err = util.Walk(staging, clonePath, func(entry string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entry = filepath.ToSlash(entry)
+		if info.IsDir() && entry != clonePath && repoPaths[entry] {
+			return filepath.SkipDir
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join("codepack", entry)
+		switch {
+		case info.IsDir():
+			header.Name += "/"
+			_, err = zw.CreateHeader(header)
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			linkname, err := staging.Readlink(entry)
+			if err != nil {
+				return err
+			}
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, linkname)
+			return err
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		header.Method = zip.Deflate
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		src, err := staging.Open(entry)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), f.Close()
+}
+
+// copyTree copies the directory root of src to dest and returns the checksum of its
+// tree, the sha256 of a line for every directory, file with its own sha256 and symlink
+// with its target, in the order of the walk. An empty dest only computes the checksum.
+// Symlinks are created last and must point inside dest, the nested repositories and files
+// of other repositories in nested are left out
+func copyTree(src billy.Filesystem, root string, dest string, nested map[string]bool) (string, error) {
+	type link struct {
+		target   string
+		linkname string
+	}
+	var links []link
+	tree := sha256.New()
+	err := util.Walk(src, root, func(entry string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entry = filepath.ToSlash(entry)
+		if entry != root && nested[entry] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(entry, root), "/")
+		target := filepath.Join(dest, filepath.FromSlash(rel))
+		switch {
+		case info.IsDir():
+			fmt.Fprintf(tree, "d %s\n", rel)
+			if dest == "" {
+				return nil
+			}
+			return os.MkdirAll(target, 0755)
+		case info.Mode()&os.ModeSymlink != 0:
+			linkname, err := src.Readlink(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tree, "l %s -> %s\n", rel, linkname)
+			links = append(links, link{target: target, linkname: linkname})
+			return nil
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		in, err := src.Open(entry)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		hash := sha256.New()
+		w := io.Writer(hash)
+		if dest != "" {
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			w = io.MultiWriter(out, hash)
+		}
+		if _, err := io.Copy(w, in); err != nil {
+			return err
+		}
+		fmt.Fprintf(tree, "f %s %s\n", hex.EncodeToString(hash.Sum(nil)), rel)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if dest != "" {
+		for _, l := range links {
+			if err := checkLinkTarget(dest, filepath.Dir(l.target), l.linkname); err != nil {
+				return "", fmt.Errorf("Symlink '%s' to '%s' %w", l.target, l.linkname, err)
+			}
+			if err := os.Symlink(l.linkname, l.target); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+// restoreBackup restores the repositories of m from the archives next to it, from the
+// file of every repository for the index of a -per-repo backup
+func restoreBackup(m *Manifest, archiveDir string, dest string, limits archiveLimits) error {
+	if m.PerRepo {
+		return restorePerRepo(m, archiveDir, dest, limits)
+	}
+	return restoreFromManifest(m, archiveDir, dest, limits)
+}
+
+// restorePerRepo restores every repository of the index m of a -per-repo backup from its
+// file in dir, read in the format the index records for it after verifying its checksum
+func restorePerRepo(m *Manifest, dir string, dest string, limits archiveLimits) error {
+	restored := 0
+	repos := append([]ManifestRepo{}, m.Repos...)
+	// parents first, so that a nested repository is restored into its parent
+	sort.SliceStable(repos, func(i, j int) bool { return repos[i].ClonePath() < repos[j].ClonePath() })
+	for _, repo := range repos {
+		if repo.Skipped != "" {
+			log.Printf("Not restoring %s, it was skipped: %s", repo.URL, repo.Skipped)
+			continue
+		}
+		if repo.Archive == "" || path.IsAbs(repo.Archive) || contains(strings.Split(repo.Archive, "/"), "..") {
+			return fmt.Errorf("Invalid file '%s' of %s in the index", repo.Archive, repo.ClonePath())
+		}
+		filename := filepath.Join(dir, filepath.FromSlash(repo.Archive))
+		log.Printf("Restoring %s from '%s' (%s)", repo.ClonePath(), filename, repo.Format)
+		var err error
+		switch repo.Format {
+		case outputFormatNone:
+			err = restoreTree(filename, dest, repo, repos)
+		case outputFormatZip:
+			if err = verifySHA256(filename, repo.SHA256); err == nil {
+				err = extractZip(filename, dest, limits)
+			}
+		default:
+			if _, ok := archiveFormats[repo.Format]; !ok {
+				return fmt.Errorf("Unsupported format '%s' of %s in the index", repo.Format, repo.ClonePath())
+			}
+			if err = verifySHA256(filename, repo.SHA256); err == nil {
+				err = extractArchive(filename, dest, limits, nil, func(string) bool { return true })
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to restore %s from '%s': %w", repo.ClonePath(), filename, err)
+		}
+		restored++
+	}
+	log.Printf("Restored %d repositories from %d files to '%s'", restored, restored, dest)
+	return nil
+}
+
+// restoreTree copies the directory of a repository written with output format none to
+// its clone path below dest once its tree matches the checksum of the index, leaving out
+// the files of the repositories of the index nested in it
+func restoreTree(dir string, dest string, repo ManifestRepo, repos []ManifestRepo) error {
+	nested := make(map[string]bool)
+	for _, other := range repos {
+		if rel := strings.TrimPrefix(other.Archive, repo.Archive+"/"); rel != other.Archive {
+			nested[rel] = true
+		}
+	}
+	src := osfs.New(dir)
+	sum, err := copyTree(src, "", "", nested)
+	if err != nil {
+		return err
+	}
+	if sum != repo.SHA256 {
+		return fmt.Errorf("Checksum mismatch for '%s': expected %s, got %s", dir, repo.SHA256, sum)
+	}
+	target := filepath.Join(dest, filepath.FromSlash(repo.ClonePath()))
+	if err := checkNoSymlink(dest, repo.ClonePath()); err != nil {
+		return fmt.Errorf("'%s' %w", target, err)
+	}
+	_, err = copyTree(src, "", target, nested)
+	return err
+}
+
+// extractZip writes the entries below codepack/ of a zip file written by -per-repo to
+// dest, with the checks of extractArchive on names and symlinks and within limits
+func extractZip(filename string, dest string, limits archiveLimits) error {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	limits = limits.withDefaults(info.Size())
+	if int64(len(zr.File)) > limits.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", errArchiveLimits, limits.MaxEntries)
+	}
+	if dest, err = filepath.Abs(dest); err != nil {
+		return err
+	}
+
+	type link struct {
+		name     string
+		target   string
+		linkname string
+	}
+	var links []link
+	budget := &limitedReader{n: limits.MaxTotal}
+	for _, file := range zr.File {
+		display := displayName(file.Name)
+		if path.IsAbs(file.Name) || filepath.IsAbs(file.Name) || filepath.VolumeName(file.Name) != "" {
+			return fmt.Errorf("Entry '%s' has an absolute path", display)
+		}
+		if contains(strings.Split(file.Name, "/"), "..") {
+			return fmt.Errorf("Entry '%s' is outside of the destination", display)
+		}
+		name := path.Clean(file.Name)
+		if !strings.HasPrefix(name, "codepack/") {
+			continue
+		}
+		rel := strings.TrimPrefix(name, "codepack/")
+		target := filepath.Join(dest, filepath.FromSlash(rel))
+		if !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+			return fmt.Errorf("Entry '%s' is outside of the destination", display)
+		}
+		if err := checkNoSymlink(dest, rel); err != nil {
+			return fmt.Errorf("Entry '%s' %w", display, err)
+		}
+		if int64(file.UncompressedSize64) > limits.MaxEntry {
+			return fmt.Errorf("%w: entry '%s' is larger than %d bytes", errArchiveLimits, display, limits.MaxEntry)
+		}
+
+		mode := file.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if mode&os.ModeSymlink == 0 && !mode.IsRegular() {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return err
+		}
+		budget.r = io.LimitReader(r, limits.MaxEntry+1)
+		if mode&os.ModeSymlink != 0 {
+			linkname, err := io.ReadAll(budget)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			links = append(links, link{name: file.Name, target: target, linkname: string(linkname)})
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			r.Close()
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+		if err != nil {
+			r.Close()
+			return err
+		}
+		_, err = io.Copy(out, budget)
+		r.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range links {
+		if err := checkLinkTarget(dest, filepath.Dir(l.target), l.linkname); err != nil {
+			return fmt.Errorf("Symlink '%s' to '%s' %w", displayName(l.name), displayName(l.linkname), err)
+		}
+		if err := os.MkdirAll(filepath.Dir(l.target), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(l.linkname, l.target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
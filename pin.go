@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// ManifestPin records the point a pinned repository was captured at
+type ManifestPin struct {
+	Pin string `json:"pin"`
+	// Ref is the reference the pin resolved to, empty for a commit sha
+	Ref    string `json:"ref,omitempty"`
+	Commit string `json:"commit"`
+}
+
+// resolvePin looks up pin as a tag, a branch, a full reference name or a full commit sha
+func resolvePin(s storer.Storer, pin string) (*ManifestPin, error) {
+	candidates := []plumbing.ReferenceName{
+		plumbing.NewTagReferenceName(pin),
+		plumbing.NewBranchReferenceName(pin),
+		plumbing.ReferenceName(pin),
+	}
+	for _, name := range candidates {
+		ref, err := s.Reference(name)
+		if err != nil || ref.Type() != plumbing.HashReference {
+			continue
+		}
+		commit, err := peelToCommit(s, ref.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("pin '%s' does not point at a commit: %w", pin, err)
+		}
+		return &ManifestPin{Pin: pin, Ref: name.String(), Commit: commit.String()}, nil
+	}
+
+	if len(pin) == 40 && plumbing.IsHash(pin) {
+		if commit, err := peelToCommit(s, plumbing.NewHash(pin)); err == nil {
+			return &ManifestPin{Pin: pin, Commit: commit.String()}, nil
+		}
+	}
+	return nil, fmt.Errorf("pin '%s' not found", pin)
+}
+
+func peelToCommit(s storer.Storer, hash plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		obj, err := s.EncodedObject(plumbing.AnyObject, hash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return hash, nil
+		case plumbing.TagObject:
+			tag, err := object.DecodeTag(s, obj)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			hash = tag.Target
+		default:
+			return plumbing.ZeroHash, fmt.Errorf("%s is a %s", hash, obj.Type())
+		}
+	}
+}
+
+// applyPin verifies the pin of repo resolves in the cloned mirror. With pin_only every
+// other reference is removed, HEAD is pointed at the pin and the objects are repacked
+// so only the pinned history is kept
+func applyPin(s *filesystem.Storage, repo Repository) error {
+	pin, err := resolvePin(s, repo.Pin)
+	if err != nil {
+		return err
+	}
+	if !repo.PinOnly {
+		return nil
+	}
+
+	head := plumbing.NewHashReference(plumbing.HEAD, plumbing.NewHash(pin.Commit))
+	if pin.Ref != "" && plumbing.ReferenceName(pin.Ref).IsBranch() {
+		head = plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.ReferenceName(pin.Ref))
+	}
+	if err := s.SetReference(head); err != nil {
+		return err
+	}
+
+	refs, err := s.IterReferences()
+	if err != nil {
+		return err
+	}
+	var others []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD && ref.Name().String() != pin.Ref {
+			others = append(others, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range others {
+		if err := s.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+
+	r, err := git.Open(s, nil)
+	if err != nil {
+		return err
+	}
+	return r.RepackObjects(&git.RepackConfig{OnlyDeletePacksOlderThan: time.Now().Add(time.Second)})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// destination kinds of a destination rule besides the URL schemes of remote destinations,
+// local for a path and encrypted for any destination of an archive encrypted with -recipient.
+// unknown is any other URL, no rule can allow it
+const (
+	destinationLocal     = "local"
+	destinationEncrypted = "encrypted"
+	destinationUnknown   = "unknown"
+)
+
+// Policy constrains what a run may contact and archive where, read from -policy-file so
+// it can be kept apart from the configuration. The patterns are matched with path.Match
+type Policy struct {
+	// AllowedHosts are the host patterns repositories may be cloned from, like *.example.com,
+	// empty allows every host
+	AllowedHosts []string `yaml:"allowed_hosts" json:"allowed_hosts"`
+	// DeniedRepos are patterns of the host and path of repositories that must never be
+	// archived, like github.com/acme/secret-*, matching the whole path or its leading elements
+	DeniedRepos []string `yaml:"denied_repos" json:"denied_repos"`
+	// DestinationRules restrict where the repositories they select may be written to
+	DestinationRules []DestinationRule `yaml:"destination_rules" json:"destination_rules"`
+}
+
+// DestinationRule selects repositories having any of Tags or matching any of Repos, and only
+// lets them be written to destinations of a kind in Allow: local, encrypted or a scheme like
+// sftp or gs
+type DestinationRule struct {
+	Tags  []string `yaml:"tags" json:"tags"`
+	Repos []string `yaml:"repos" json:"repos"`
+	Allow []string `yaml:"allow" json:"allow"`
+}
+
+// ManifestPolicy is the policy a run was checked against
+type ManifestPolicy struct {
+	File string `json:"file"`
+	// SHA256 is the checksum of the policy as JSON, the same for any formatting of the file
+	SHA256 string `json:"sha256"`
+}
+
+// policyDestinationKinds are the kinds destination rules accept
+var policyDestinationKinds = []string{destinationLocal, destinationEncrypted, "sftp", "gs", "azblob", "oci", "exec"}
+
+// PolicyFromFile reads and checks a policy
+func PolicyFromFile(filename string) (*Policy, *ManifestPolicy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := new(Policy)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(p); err != nil {
+		return nil, nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, nil, err
+	}
+	normalized, err := json.Marshal(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(normalized)
+	return p, &ManifestPolicy{File: filename, SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+func (p *Policy) validate() error {
+	var patterns []string
+	patterns = append(patterns, p.AllowedHosts...)
+	patterns = append(patterns, p.DeniedRepos...)
+	for i, rule := range p.DestinationRules {
+		if len(rule.Tags) == 0 && len(rule.Repos) == 0 {
+			return fmt.Errorf("Destination rule %d of the policy selects no repositories, set tags or repos", i+1)
+		}
+		if len(rule.Allow) == 0 {
+			return fmt.Errorf("Destination rule %d of the policy allows no destination", i+1)
+		}
+		for _, kind := range rule.Allow {
+			if !contains(policyDestinationKinds, kind) {
+				return fmt.Errorf("Invalid destination kind '%s' of destination rule %d, use %s", kind, i+1, strings.Join(policyDestinationKinds, ", "))
+			}
+		}
+		if err := validTags(rule.Tags); err != nil {
+			return fmt.Errorf("Destination rule %d of the policy: %w", i+1, err)
+		}
+		patterns = append(patterns, rule.Repos...)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("Invalid pattern '%s' of the policy", pattern)
+		}
+	}
+	return nil
+}
+
+// policyRepoPath is the lower case host and path of a repository URL the patterns of a policy
+// match, like github.com/acme/tool, empty for a local source
+func policyRepoPath(rawURL string) string {
+	fields := parseRepoURL(rawURL)
+	if fields.Host == "" {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(path.Join(fields.Host, fields.Owner, fields.Name), "/"))
+}
+
+// matchRepoPattern matches pattern against repoPath element by element, a pattern with
+// fewer elements matching the repositories below it
+func matchRepoPattern(pattern string, repoPath string) bool {
+	patterns, elements := strings.Split(strings.ToLower(strings.Trim(pattern, "/")), "/"), strings.Split(repoPath, "/")
+	if repoPath == "" || len(patterns) > len(elements) {
+		return false
+	}
+	for i, p := range patterns {
+		if ok, _ := path.Match(p, elements[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// selects reports whether the rule applies to repo
+func (rule DestinationRule) selects(repo Repository, repoPath string) bool {
+	for _, tag := range rule.Tags {
+		if contains(repo.Tags, tag) {
+			return true
+		}
+	}
+	for _, pattern := range rule.Repos {
+		if matchRepoPattern(pattern, repoPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationKind is the scheme of a remote destination, local for a path, or unknown for a
+// URL of any other scheme
+func destinationKind(target string) string {
+	if !strings.Contains(target, "://") {
+		return destinationLocal
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == destinationLocal || u.Scheme == destinationEncrypted || !contains(policyDestinationKinds, u.Scheme) {
+		return destinationUnknown
+	}
+	return u.Scheme
+}
+
+// allowsHost reports whether rawURL is on a host of AllowedHosts, a URL without a host is
+// always allowed
+func (p *Policy) allowsHost(rawURL string) (string, bool) {
+	host := strings.ToLower(parseRepoURL(rawURL).Host)
+	if host == "" || len(p.AllowedHosts) == 0 {
+		return host, true
+	}
+	for _, pattern := range p.AllowedHosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return host, true
+		}
+	}
+	return host, false
+}
+
+// check lists every violation of the policy by the repositories and destinations of a run,
+// encrypted being set for an archive encrypted with -recipient
+func (p *Policy) check(repos []Repository, dests []Destination, encrypted bool) []string {
+	var violations []string
+	for _, repo := range repos {
+		repoPath := policyRepoPath(repo.URL)
+		name := path.Join(repo.Path, repo.Name)
+		if host, ok := p.allowsHost(repo.URL); !ok {
+			violations = append(violations, fmt.Sprintf("%s (%s): the host %s is not allowed", name, sanitizeURL(repo.URL), host))
+		}
+		for _, pattern := range p.DeniedRepos {
+			if matchRepoPattern(pattern, repoPath) {
+				violations = append(violations, fmt.Sprintf("%s (%s): denied by '%s'", name, sanitizeURL(repo.URL), pattern))
+				break
+			}
+		}
+		for i, rule := range p.DestinationRules {
+			if !rule.selects(repo, repoPath) {
+				continue
+			}
+			for _, dest := range dests {
+				kind := destinationKind(dest.URL)
+				if kind == destinationUnknown {
+					violations = append(violations, fmt.Sprintf("%s to %s: destination rule %d does not allow destinations of an unknown kind", name, sanitizeURL(dest.URL), i+1))
+					continue
+				}
+				if contains(rule.Allow, kind) || encrypted && contains(rule.Allow, destinationEncrypted) {
+					continue
+				}
+				violations = append(violations, fmt.Sprintf("%s to %s: destination rule %d only allows %s", name, sanitizeURL(dest.URL), i+1, strings.Join(rule.Allow, ", ")))
+			}
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// checkPolicy fails the run with a configuration error listing every violation of p
+func checkPolicy(p *Policy, filename string, repos []Repository, dests []Destination, encrypted bool) error {
+	if p == nil {
+		return nil
+	}
+	violations := p.check(repos, dests, encrypted)
+	if len(violations) == 0 {
+		return nil
+	}
+	return configError(fmt.Errorf("%d violation(s) of the policy '%s':\n  %s", len(violations), filename, strings.Join(violations, "\n  ")))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+// progressLine matches the percentage of the sideband progress messages of a git server,
+// like "Counting objects:  42% (21/50)" or "Compressing objects: 100% (50/50), done."
+var progressLine = regexp.MustCompile(`^(?:remote: )?([A-Za-z ]+):\s+(\d+)%`)
+
+// cloneProgress is the progress of a single clone, it is never shared between clones so
+// the messages of concurrent clones cannot interleave. Every interval it logs the bytes
+// written to the clone, as "Clone progress team/repo: 42% 1.2 GiB", with the percentage
+// of the expected size when an earlier run recorded it and otherwise the phase the server
+// is in while it prepares the pack, servers report nothing while the pack is received
+type cloneProgress struct {
+	path     string
+	fs       billy.Filesystem
+	expected int64
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	pending []byte
+	phase   string
+	percent int
+}
+
+// startProgress starts logging the progress of the clone of clonePath into fs, it returns
+// nil when -clone-progress is disabled
+func (opts CloneOptions) startProgress(clonePath string, fs billy.Filesystem) *cloneProgress {
+	if opts.ProgressInterval <= 0 {
+		return nil
+	}
+	p := &cloneProgress{
+		path:     clonePath,
+		fs:       fs,
+		expected: opts.ExpectedSizes[clonePath],
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run(opts.ProgressInterval)
+	return p
+}
+
+func (p *cloneProgress) run(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.log()
+		}
+	}
+}
+
+func (p *cloneProgress) log() {
+	size := dirSize(p.fs, "objects")
+	p.mu.Lock()
+	phase, percent := p.phase, p.percent
+	p.mu.Unlock()
+
+	switch {
+	case p.expected > 0:
+		percent := size * 100 / p.expected
+		if percent > 99 {
+			percent = 99
+		}
+		log.Printf("Clone progress %s: %d%% %s", p.path, percent, formatBytes(size))
+	case phase != "" && percent < 100:
+		log.Printf("Clone progress %s: %d%% %s (%s)", p.path, percent, formatBytes(size), phase)
+	default:
+		log.Printf("Clone progress %s: %s received", p.path, formatBytes(size))
+	}
+}
+
+// Stop ends the progress of a finished clone
+func (p *cloneProgress) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+}
+
+// sideband is the sink of the server progress messages passed to go-git, nil asks
+// the server not to send any
+func (p *cloneProgress) sideband() sideband.Progress {
+	if p == nil {
+		return nil
+	}
+	return p
+}
+
+// Write receives sideband messages, which end with \r while a phase is still updating
+func (p *cloneProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, b...)
+	for {
+		i := bytes.IndexAny(p.pending, "\r\n")
+		if i < 0 {
+			break
+		}
+		if m := progressLine.FindSubmatch(p.pending[:i]); m != nil {
+			p.phase = string(m[1])
+			p.percent, _ = strconv.Atoi(string(m[2]))
+		}
+		p.pending = p.pending[i+1:]
+	}
+	return len(b), nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progressSchema is the version of the events of -progress-fd and -progress-file. It is
+// raised when a field is removed or changes its meaning, fields are added without raising it.
+//
+// Every event is one JSON object on a line of its own with these fields, set for the events
+// listed:
+//
+//	schema            every event, the version of the schema
+//	event             every event, run_started, repo_started, repo_finished, phase_changed or run_finished
+//	time              every event, RFC 3339 with nanoseconds in UTC
+//	run_id            every event
+//	kind              run_started, full, watch or manual
+//	total             run_started, the number of repositories of the run
+//	codepack_version  run_started
+//	url               repo_started and repo_finished, without credentials
+//	path              repo_started and repo_finished, the path of the repository in the archive
+//	status            repo_finished, the status of the repository like cloned or failed,
+//	                  run_finished, SUCCESS or FAILURE
+//	duration_seconds  repo_finished, the time the clone took
+//	error             repo_finished and run_finished, without credentials
+//	category          repo_finished, the kind of failure like auth or network
+//	phase             phase_changed, what the process does, as the status of -listen
+//	statuses          run_finished, the number of repositories by status
+//	dropped           run_finished, the number of events dropped before it
+const progressSchema = 1
+
+// progressBuffer is the number of events queued for a consumer not reading them, further
+// events are dropped
+const progressBuffer = 1024
+
+// progressEvent is an event of progressSchema
+type progressEvent struct {
+	Schema          int                `json:"schema"`
+	Event           string             `json:"event"`
+	Time            string             `json:"time"`
+	RunID           string             `json:"run_id,omitempty"`
+	Kind            string             `json:"kind,omitempty"`
+	Total           *int               `json:"total,omitempty"`
+	CodePackVersion string             `json:"codepack_version,omitempty"`
+	URL             string             `json:"url,omitempty"`
+	Path            string             `json:"path,omitempty"`
+	Status          string             `json:"status,omitempty"`
+	DurationSeconds *float64           `json:"duration_seconds,omitempty"`
+	Error           string             `json:"error,omitempty"`
+	Category        string             `json:"category,omitempty"`
+	Phase           string             `json:"phase,omitempty"`
+	Statuses        map[repoStatus]int `json:"statuses,omitempty"`
+	Dropped         *int64             `json:"dropped,omitempty"`
+}
+
+// progressEvents is the stream of -progress-fd or -progress-file, nil unless one is given
+var progressEvents *eventStream
+
+// eventStream writes events to a file from a goroutine of its own, so a consumer that stops
+// reading never blocks the run, the events it cannot take are dropped and counted
+type eventStream struct {
+	file    *os.File
+	queue   chan []byte
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// openEventStream opens the stream of -progress-fd, or -progress-file when fd is negative,
+// which is appended to so runs of -watch write to the same file
+func openEventStream(fd int, filename string) (*eventStream, error) {
+	var file *os.File
+	if fd >= 0 {
+		file = os.NewFile(uintptr(fd), fmt.Sprintf("-progress-fd %d", fd))
+		if file == nil {
+			return nil, configError(fmt.Errorf("Invalid -progress-fd %d", fd))
+		}
+		if _, err := file.Stat(); err != nil {
+			return nil, configError(fmt.Errorf("Invalid -progress-fd %d: %w", fd, err))
+		}
+	} else {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot open the -progress-file: %w", err)
+		}
+		file = f
+	}
+	s := &eventStream{file: file, queue: make(chan []byte, progressBuffer), done: make(chan struct{})}
+	go s.run()
+	return s, nil
+}
+
+func (s *eventStream) run() {
+	defer close(s.done)
+	failed := false
+	for line := range s.queue {
+		if failed {
+			s.dropped.Add(1)
+			continue
+		}
+		// the file is not buffered, every event is written as it happens
+		if _, err := s.file.Write(line); err != nil {
+			log.Println("WARNING: cannot write the progress events, no further event is written:", err)
+			failed = true
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// emit queues event, or drops it when the queue is full. A nil *eventStream emits nothing
+func (s *eventStream) emit(event progressEvent) {
+	if s == nil {
+		return
+	}
+	event.Schema = progressSchema
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	event.RunID = runID
+	line, err := json.Marshal(event)
+	if err != nil {
+		s.dropped.Add(1)
+		return
+	}
+	select {
+	case s.queue <- append(line, '\n'):
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// RunStarted emits run_started for report
+func (s *eventStream) RunStarted(report *runReport) {
+	total := report.Total
+	s.emit(progressEvent{Event: "run_started", Kind: report.Kind, Total: &total, CodePackVersion: VERSION})
+}
+
+// RepoStarted emits repo_started for the clone of url to clonePath
+func (s *eventStream) RepoStarted(url string, clonePath string) {
+	s.emit(progressEvent{Event: "repo_started", URL: sanitizeURL(url), Path: clonePath})
+}
+
+// RepoFinished emits repo_finished for the clone of url to clonePath, which ended with
+// status and err after d
+func (s *eventStream) RepoFinished(url string, clonePath string, status repoStatus, err error, d time.Duration) {
+	seconds := d.Seconds()
+	event := progressEvent{Event: "repo_finished", URL: sanitizeURL(url), Path: clonePath, Status: string(status), DurationSeconds: &seconds}
+	if err != nil {
+		event.Error = sanitizeText(err.Error())
+		event.Category = classifyCloneError(err)
+	}
+	s.emit(event)
+}
+
+// Phase emits phase_changed
+func (s *eventStream) Phase(phase string) {
+	s.emit(progressEvent{Event: "phase_changed", Phase: phase})
+}
+
+// RunFinished emits run_finished for report, ended with err
+func (s *eventStream) RunFinished(report *runReport, err error) {
+	if s == nil {
+		return
+	}
+	dropped := s.dropped.Load()
+	event := progressEvent{Event: "run_finished", Status: "SUCCESS", Statuses: report.statusCounts(), Dropped: &dropped}
+	if err != nil {
+		event.Status, event.Error = "FAILURE", sanitizeText(err.Error())
+	}
+	s.emit(event)
+}
+
+// Close writes the queued events, waiting a few seconds for a slow consumer, and logs the
+// number of dropped events
+func (s *eventStream) Close(error) {
+	close(s.queue)
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		log.Printf("WARNING: the consumer of the progress events stopped reading, %d events are not written", len(s.queue))
+	}
+	if dropped := s.dropped.Load(); dropped > 0 {
+		log.Printf("WARNING: %d progress events were dropped, the consumer did not keep up", dropped)
+	}
+}
+
+// statusOf is the status the report recorded for the repository at clonePath, or the
+// status of err without a report
+func (r *runReport) statusOf(clonePath string, err error) repoStatus {
+	if r != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for i := len(r.Repos) - 1; i >= 0; i-- {
+			if r.Repos[i].Path == clonePath {
+				return r.Repos[i].Status
+			}
+		}
+	}
+	if err != nil {
+		return cloneErrorStatus(err)
+	}
+	return statusCloned
+}
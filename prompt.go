@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"golang.org/x/term"
+)
+
+// hostCredentials resolves credentials per scheme and git host, asking on the terminal the
+// first time a host requires authentication and reusing the answer for the rest of the run.
+// Credentials entered for https:// are never reused for http:// on the same host.
+// Prompted credentials are kept in memory only, they are never logged or written to a file.
+// A nil *hostCredentials never prompts
+type hostCredentials struct {
+	mu    sync.Mutex
+	hosts map[string]*http.BasicAuth
+}
+
+// newHostCredentials returns nil unless stdin and stderr are both terminals, so runs from
+// cron or with a piped configuration keep failing instead of waiting for input
+func newHostCredentials() *hostCredentials {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+	return &hostCredentials{hosts: make(map[string]*http.BasicAuth)}
+}
+
+// credentialHost is the scheme and host of rawURL the credentials are kept for
+func credentialHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host)
+}
+
+// Get returns the credentials already entered for the host of rawURL
+func (c *hostCredentials) Get(rawURL string) *http.BasicAuth {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hosts[credentialHost(rawURL)]
+}
+
+// Prompt asks for the username and password or token of the host of rawURL unless they
+// were entered before, the password is read without echo
+func (c *hostCredentials) Prompt(rawURL string) (*http.BasicAuth, error) {
+	if c == nil {
+		return nil, nil
+	}
+	host := credentialHost(rawURL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if auth, ok := c.hosts[host]; ok {
+		return auth, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Username for %s: ", host)
+	username, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Password or token for %s: ", host)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	auth := &http.BasicAuth{Username: strings.TrimSpace(username), Password: string(password)}
+	c.hosts[host] = auth
+	return auth, nil
+}
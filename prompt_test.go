@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+func TestHostCredentials(t *testing.T) {
+	auth := &http.BasicAuth{Username: "user", Password: "secret"}
+	c := &hostCredentials{hosts: map[string]*http.BasicAuth{credentialHost("https://Git.Example.com/team/app.git"): auth}}
+	for _, tc := range []struct {
+		url   string
+		found bool
+	}{
+		{"https://git.example.com/team/lib.git", true},
+		{"HTTPS://git.example.com/other/app", true},
+		{"http://git.example.com/team/lib.git", false},
+		{"https://git.example.com:8443/team/lib.git", false},
+		{"https://other.example.com/team/lib.git", false},
+		{"git@git.example.com:team/lib.git", false},
+	} {
+		if found := c.Get(tc.url) != nil; found != tc.found {
+			t.Errorf("%s: credentials found %v, expected %v", tc.url, found, tc.found)
+		}
+	}
+
+	allowed := true
+	for _, tc := range []struct {
+		repo Repository
+		err  bool
+	}{
+		{repo: Repository{URL: "https://git.example.com/team/app.git"}},
+		{repo: Repository{URL: "http://git.example.com/team/app.git"}, err: true},
+		{repo: Repository{URL: "http://git.example.com/team/app.git", Auth: &RepoAuth{}}, err: true},
+		{repo: Repository{URL: "http://git.example.com/team/app.git", AllowInsecureHTTP: &allowed}},
+	} {
+		if err := checkPromptedHTTP(tc.repo); (err != nil) != tc.err {
+			t.Errorf("%s: error %v, expected one %v", tc.repo.URL, err, tc.err)
+		}
+	}
+
+	opts := CloneOptions{Credentials: c}
+	if repoAuth(Repository{URL: "http://git.example.com/team/lib.git"}, opts) != nil {
+		t.Errorf("credentials for https:// were used over http://")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitReserve is the number of requests left at which the API of a host is
+	// paused until its limit resets, kept for the requests already in flight
+	rateLimitReserve = 5
+	// rateLimitRetries is the number of times a request refused by a rate limit is sent again
+	rateLimitRetries = 3
+	// rateLimitBackoff is the first wait after a secondary rate limit without a Retry-After,
+	// doubled for every further attempt as the GitHub documentation asks
+	rateLimitBackoff = time.Minute
+)
+
+// hostRateLimits tracks the rate limit the API of each host reported, so that every
+// request to a host waits once the limit is nearly used up instead of being refused
+type hostRateLimits struct {
+	mu    sync.Mutex
+	reset map[string]time.Time
+	waits map[string]rateLimitWaits
+}
+
+// rateLimitWaits are the times the requests to the API of a host waited for its rate limit
+type rateLimitWaits struct {
+	Count    int
+	Duration time.Duration
+}
+
+var apiRateLimits = &hostRateLimits{reset: make(map[string]time.Time), waits: make(map[string]rateLimitWaits)}
+
+// observe notes the rate limit headers of a response of host, X-RateLimit-* of GitHub
+// and RateLimit-* of GitLab
+func (l *hostRateLimits) observe(host string, header nethttp.Header) {
+	remaining, err := strconv.Atoi(rateLimitHeader(header, "Remaining"))
+	if err != nil || remaining > rateLimitReserve {
+		return
+	}
+	reset, err := strconv.ParseInt(rateLimitHeader(header, "Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reset[host] = time.Unix(reset, 0)
+}
+
+// wait blocks until the rate limit of host resets when it is nearly used up, failing
+// when ctx ends before that
+func (l *hostRateLimits) wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	reset := l.reset[host]
+	l.mu.Unlock()
+	d := time.Until(reset)
+	if d <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(reset) {
+		return fmt.Errorf("API rate limit of %s is used up until %s", host, reset.Format(time.RFC3339))
+	}
+	log.Printf("API rate limit of %s is nearly used up, waiting %s until it resets", host, d.Round(time.Second))
+	l.waited(host, d)
+	return sleepContext(ctx, d)
+}
+
+// waited records a wait of d for the rate limit of host
+func (l *hostRateLimits) waited(host string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	waits := l.waits[host]
+	waits.Count++
+	waits.Duration += d
+	l.waits[host] = waits
+}
+
+// waitsByHost returns the waits recorded for the API of every host
+func (l *hostRateLimits) waitsByHost() map[string]rateLimitWaits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	waits := make(map[string]rateLimitWaits, len(l.waits))
+	for host, w := range l.waits {
+		waits[host] = w
+	}
+	return waits
+}
+
+func rateLimitHeader(header nethttp.Header, name string) string {
+	if value := header.Get("X-RateLimit-" + name); value != "" {
+		return value
+	}
+	return header.Get("RateLimit-" + name)
+}
+
+// rateLimitWait returns how long to wait before sending a request again that resp refused
+// for a rate limit, false when resp is not a rate limit. A 403 is only a rate limit with a
+// Retry-After, a used up limit or a message saying so, the body of resp is read for it
+func rateLimitWait(resp *nethttp.Response, attempt int) (time.Duration, bool) {
+	if resp.StatusCode != nethttp.StatusForbidden && resp.StatusCode != nethttp.StatusTooManyRequests {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if rateLimitHeader(resp.Header, "Remaining") == "0" {
+		if reset, err := strconv.ParseInt(rateLimitHeader(resp.Header, "Reset"), 10, 64); err == nil {
+			return time.Until(time.Unix(reset, 0)) + time.Second, true
+		}
+	}
+	if resp.StatusCode == nethttp.StatusForbidden {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if !strings.Contains(strings.ToLower(string(body)), "rate limit") {
+			return 0, false
+		}
+	}
+	return rateLimitBackoff << attempt, true
+}
+
+// sleepContext waits for d or until ctx ends
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
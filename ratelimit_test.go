@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitWait(t *testing.T) {
+	reset := fmt.Sprint(time.Now().Add(time.Hour).Unix())
+	for _, tc := range []struct {
+		name    string
+		status  int
+		header  map[string]string
+		body    string
+		attempt int
+		limited bool
+		// wait is the expected wait, checked to the minute for a reset
+		wait time.Duration
+	}{
+		{name: "not found", status: nethttp.StatusNotFound},
+		{name: "forbidden", status: nethttp.StatusForbidden, body: `{"message": "Resource not accessible"}`},
+		{name: "retry after", status: nethttp.StatusTooManyRequests, header: map[string]string{"Retry-After": "30"}, limited: true, wait: 30 * time.Second},
+		{name: "secondary with retry after", status: nethttp.StatusForbidden, header: map[string]string{"Retry-After": "5"}, limited: true, wait: 5 * time.Second},
+		{name: "used up", status: nethttp.StatusForbidden, header: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": reset}, limited: true, wait: time.Hour},
+		{name: "used up gitlab", status: nethttp.StatusTooManyRequests, header: map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": reset}, limited: true, wait: time.Hour},
+		{name: "secondary", status: nethttp.StatusForbidden, body: `{"message": "You have exceeded a secondary rate limit"}`, limited: true, wait: rateLimitBackoff},
+		{name: "secondary backoff", status: nethttp.StatusForbidden, body: "API rate limit exceeded", attempt: 2, limited: true, wait: 4 * rateLimitBackoff},
+		{name: "too many requests", status: nethttp.StatusTooManyRequests, attempt: 1, limited: true, wait: 2 * rateLimitBackoff},
+	} {
+		resp := &nethttp.Response{StatusCode: tc.status, Header: make(nethttp.Header), Body: io.NopCloser(strings.NewReader(tc.body))}
+		for name, value := range tc.header {
+			resp.Header.Set(name, value)
+		}
+		wait, limited := rateLimitWait(resp, tc.attempt)
+		if limited != tc.limited {
+			t.Errorf("%s: limited %v, expected %v", tc.name, limited, tc.limited)
+			continue
+		}
+		if wait.Round(time.Minute) != tc.wait.Round(time.Minute) || (tc.wait < time.Minute && wait != tc.wait) {
+			t.Errorf("%s: waits %s, expected %s", tc.name, wait, tc.wait)
+		}
+	}
+}
+
+func TestHostRateLimitsWait(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		remaining string
+		reset     time.Duration
+		deadline  time.Duration
+		waits     bool
+		err       bool
+	}{
+		{name: "plenty left", remaining: "100", reset: time.Hour},
+		{name: "reset passed", remaining: "0", reset: -time.Minute},
+		{name: "nearly used up", remaining: "3", reset: 2 * time.Second, waits: true},
+		{name: "reset after the deadline", remaining: "0", reset: time.Hour, deadline: time.Minute, err: true},
+	} {
+		limits := &hostRateLimits{reset: make(map[string]time.Time), waits: make(map[string]rateLimitWaits)}
+		header := make(nethttp.Header)
+		header.Set("X-RateLimit-Remaining", tc.remaining)
+		header.Set("X-RateLimit-Reset", fmt.Sprint(time.Now().Add(tc.reset).Unix()))
+		limits.observe("api.example.com", header)
+
+		ctx := context.Background()
+		if tc.deadline != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tc.deadline)
+			defer cancel()
+		}
+		err := limits.wait(ctx, "api.example.com")
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, expected one %v", tc.name, err, tc.err)
+		}
+		if waited := limits.waitsByHost()["api.example.com"].Count > 0; waited != tc.waits {
+			t.Errorf("%s: waited %v, expected %v", tc.name, waited, tc.waits)
+		}
+		if err := limits.wait(ctx, "other.example.com"); err != nil {
+			t.Errorf("%s: the limit of another host waits: %v", tc.name, err)
+		}
+	}
+}
+
+// fakeAPI answers the requests of a test with responses in turn, the last one repeated,
+// each a status, the headers of the rate limit and a body
+func fakeAPI(t *testing.T, responses ...func(w nethttp.ResponseWriter)) (endpoint string, requests func() int) {
+	n := 0
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		respond := responses[len(responses)-1]
+		if n < len(responses) {
+			respond = responses[n]
+		}
+		n++
+		respond(w)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/api/repos/team/app", func() int { return n }
+}
+
+func TestRequestJSONRateLimits(t *testing.T) {
+	ok := func(w nethttp.ResponseWriter) {
+		w.Header().Set("X-RateLimit-Remaining", "4000")
+		fmt.Fprint(w, `{"name": "app"}`)
+	}
+	retryAfter := func(status int, body string) func(w nethttp.ResponseWriter) {
+		return func(w nethttp.ResponseWriter) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		}
+	}
+	forbidden := func(w nethttp.ResponseWriter) {
+		w.WriteHeader(nethttp.StatusForbidden)
+		fmt.Fprint(w, `{"message": "Must have admin rights"}`)
+	}
+	for _, tc := range []struct {
+		name      string
+		responses []func(w nethttp.ResponseWriter)
+		requests  int
+		status    int
+	}{
+		{name: "success", responses: []func(w nethttp.ResponseWriter){ok}, requests: 1},
+		{name: "too many requests", responses: []func(w nethttp.ResponseWriter){retryAfter(nethttp.StatusTooManyRequests, ""), ok}, requests: 2},
+		{name: "secondary rate limit", responses: []func(w nethttp.ResponseWriter){
+			retryAfter(nethttp.StatusForbidden, `{"message": "You have exceeded a secondary rate limit"}`),
+			retryAfter(nethttp.StatusForbidden, `{"message": "You have exceeded a secondary rate limit"}`),
+			ok,
+		}, requests: 3},
+		{name: "gives up", responses: []func(w nethttp.ResponseWriter){retryAfter(nethttp.StatusTooManyRequests, "")}, requests: rateLimitRetries + 1, status: nethttp.StatusTooManyRequests},
+		{name: "forbidden", responses: []func(w nethttp.ResponseWriter){forbidden}, requests: 1, status: nethttp.StatusForbidden},
+	} {
+		endpoint, requests := fakeAPI(t, tc.responses...)
+		var v struct{ Name string }
+		err := requestJSON(context.Background(), nethttp.MethodGet, endpoint, "Authorization", "token secret", nil, &v)
+		var apiErr *apiError
+		switch {
+		case tc.status == 0 && err != nil:
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		case tc.status == 0 && v.Name != "app":
+			t.Errorf("%s: decoded %+v", tc.name, v)
+		case tc.status != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != tc.status):
+			t.Errorf("%s: error %v, expected the status %d", tc.name, err, tc.status)
+		}
+		if requests() != tc.requests {
+			t.Errorf("%s: %d requests, expected %d", tc.name, requests(), tc.requests)
+		}
+	}
+}
+
+func TestRequestJSONWaitsForReset(t *testing.T) {
+	reset := time.Now().Add(1500 * time.Millisecond)
+	endpoint, requests := fakeAPI(t, func(w nethttp.ResponseWriter) {
+		w.Header().Set("X-RateLimit-Remaining", "1")
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset.Unix()))
+	})
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := requestJSON(context.Background(), nethttp.MethodGet, endpoint, "", "", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Now().Before(time.Unix(reset.Unix(), 0)) {
+		t.Errorf("the second request was sent before the limit reset")
+	}
+	if requests() != 2 || apiRateLimits.waitsByHost()[u.Host].Count != 1 {
+		t.Errorf("%d requests and %d waits, expected 2 and 1", requests(), apiRateLimits.waitsByHost()[u.Host].Count)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	apiRateLimits.observe(u.Host, nethttp.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {fmt.Sprint(time.Now().Add(time.Hour).Unix())}})
+	if err := requestJSON(ctx, nethttp.MethodGet, endpoint, "", "", nil, nil); err == nil || requests() != 2 {
+		t.Errorf("a used up limit past the deadline sent a request: %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// reflinkFile fails, files are not reflinked on this platform
+func reflinkFile(src string, dst string) error {
+	return errors.New("reflinks are only supported on Linux")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// configFetchTimeout bounds fetching a remote configuration
+const configFetchTimeout = 2 * time.Minute
+
+// configAllowInsecureHTTP lets the credentials be sent over a plain http:// git URL of
+// -config, set by -config-allow-insecure-http
+var configAllowInsecureHTTP bool
+
+// ConfigSource records where a remote configuration was fetched from
+type ConfigSource struct {
+	URL string `json:"url"`
+	// Commit is the commit of the configuration repository the file was read from
+	Commit string `json:"commit,omitempty"`
+	// ETag is the entity tag of a configuration fetched over https
+	ETag string `json:"etag,omitempty"`
+}
+
+// isRemoteConfig reports whether -config names a configuration to fetch, an https:// URL
+// or a git repository URL with a #path/to/codepack.yaml fragment
+func isRemoteConfig(location string) bool {
+	return strings.HasPrefix(location, "https://") || strings.Contains(location, "://") && strings.Contains(location, "#")
+}
+
+// loadConfig reads the configuration at location, fetching it first when it is remote.
+// The returned source is nil for local files
+func loadConfig(location string, format string, auth *http.BasicAuth) (*Config, *ConfigSource, error) {
+	if !isRemoteConfig(location) {
+		config, err := ConfigFromFile(location, format)
+		return config, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configFetchTimeout)
+	defer cancel()
+
+	var data []byte
+	var name string
+	var source *ConfigSource
+	var err error
+	if repoURL, file, ok := strings.Cut(location, "#"); ok {
+		name = file
+		data, source, err = fetchGitConfig(ctx, repoURL, file, auth)
+	} else {
+		name = location
+		if u, err := url.Parse(location); err == nil {
+			name = u.Path
+		}
+		data, source, err = fetchHTTPConfig(ctx, location)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot fetch configuration: %w", err)
+	}
+
+	if format == "" {
+		format = configFormat(name)
+	}
+	config, err := ConfigFromReader(bytes.NewReader(data), format)
+	return config, source, err
+}
+
+// fetchHTTPConfig downloads a configuration, sending CODEPACK_CONFIG_TOKEN as a bearer token when set
+func fetchHTTPConfig(ctx context.Context, location string) ([]byte, *ConfigSource, error) {
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, location, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if token := os.Getenv("CODEPACK_CONFIG_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := nethttp.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, nil, fmt.Errorf("GET %s: %s", sanitizeURL(location), resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &ConfigSource{URL: sanitizeURL(location), ETag: resp.Header.Get("ETag")}, nil
+}
+
+// fetchGitConfig reads file from a shallow in-memory clone of the default branch of repoURL
+func fetchGitConfig(ctx context.Context, repoURL string, file string, auth *http.BasicAuth) ([]byte, *ConfigSource, error) {
+	if isPlainHTTP(repoURL) && (auth != nil || embeddedSecret(repoURL)) {
+		if !configAllowInsecureHTTP {
+			return nil, nil, fmt.Errorf("Refusing to send credentials in cleartext over http:// to %s, use https:// or -config-allow-insecure-http", sanitizeURL(repoURL))
+		}
+		log.Printf("WARNING: INSECURE: credentials for %s are sent in cleartext over http://, allowed by -config-allow-insecure-http", sanitizeURL(repoURL))
+	}
+	fs := memfs.New()
+	repo, err := git.CloneContext(ctx, memory.NewStorage(), fs, &git.CloneOptions{
+		URL:          repoURL,
+		Auth:         auth,
+		Depth:        1,
+		SingleBranch: true,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("clone %s: %w", sanitizeURL(repoURL), err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := util.ReadFile(fs, path.Clean("/"+file))
+	if err != nil {
+		return nil, nil, fmt.Errorf("read '%s' from %s: %w", file, sanitizeURL(repoURL), err)
+	}
+	return data, &ConfigSource{URL: sanitizeURL(repoURL) + "#" + file, Commit: head.Hash().String()}, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+// remoteSpec is a remote -add-remote adds to every restored mirror, URL is a template
+// rendered with restoredURL for each repository
+type remoteSpec struct {
+	Name string
+	URL  *template.Template
+}
+
+// parseRemoteSpecs parses the name=url-template values of -add-remote
+func parseRemoteSpecs(values []string) ([]remoteSpec, error) {
+	var specs []remoteSpec
+	for _, value := range values {
+		name, text, ok := strings.Cut(value, "=")
+		if !ok || name == "" || text == "" {
+			return nil, fmt.Errorf("Invalid -add-remote '%s', use name=url-template", value)
+		}
+		for _, spec := range specs {
+			if spec.Name == name {
+				return nil, fmt.Errorf("Remote '%s' is added more than once", name)
+			}
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid URL template of remote '%s': %w", name, err)
+		}
+		specs = append(specs, remoteSpec{Name: name, URL: tmpl})
+	}
+	return specs, nil
+}
+
+// addRemotes adds remotes to the mirror of every repository of m restored to dest. A remote
+// that exists already is replaced with force and fails the repository otherwise, the
+// other repositories still get their remotes and every failure is returned
+func addRemotes(m *Manifest, dest string, remotes []remoteSpec, force bool) error {
+	var errs []error
+	done := make(map[string]bool)
+	for _, repo := range m.Repos {
+		if repo.Skipped != "" || done[repo.ClonePath()] {
+			continue
+		}
+		done[repo.ClonePath()] = true
+		if repo.Export != nil && !repo.Export.restoresStream() {
+			log.Printf("Not adding remotes to %s, it was exported as a worktree without git", repo.ClonePath())
+			continue
+		}
+		if err := addRepoRemotes(filepath.Join(dest, filepath.FromSlash(repo.ClonePath())), repo, remotes, force); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", repo.ClonePath(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Cannot add remotes to %d repositories: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// addRepoRemotes sets remotes in the config of the mirror at dir, nothing is written when one fails
+func addRepoRemotes(dir string, repo ManifestRepo, remotes []remoteSpec, force bool) error {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return err
+	}
+	for _, remote := range remotes {
+		url, err := restoredURL(remote.URL, repo)
+		if err != nil {
+			return fmt.Errorf("cannot render the URL of remote '%s': %w", remote.Name, err)
+		}
+		if _, ok := cfg.Remotes[remote.Name]; ok && !force {
+			return fmt.Errorf("remote '%s' exists, use -force-remotes to replace it", remote.Name)
+		}
+		cfg.Remotes[remote.Name] = &config.RemoteConfig{Name: remote.Name, URLs: []string{url}}
+	}
+	if err := r.SetConfig(cfg); err != nil {
+		return err
+	}
+	for _, remote := range remotes {
+		log.Printf("Set remote %s of %s to %s", remote.Name, repo.ClonePath(), sanitizeURL(cfg.Remotes[remote.Name].URLs[0]))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// fdsPerClone is the estimated number of file descriptors a clone worker holds open at
+// once: the connection to the remote, the packfile and index being written, loose objects
+// and the files the archiver reads while compressing
+const fdsPerClone = 16
+
+// reservedFDs are the file descriptors kept free for the log, the destinations and the
+// standard streams when the open file limit is exceeded
+const reservedFDs = 64
+
+// resourceUsage is a reading of the memory and open files of the process
+type resourceUsage struct {
+	// RSS is the resident set size in bytes
+	RSS int64
+	// FDs is the number of open file descriptors
+	FDs int
+}
+
+func (u resourceUsage) String() string {
+	return fmt.Sprintf("RSS %s, %d open files", formatBytes(u.RSS), u.FDs)
+}
+
+// limitWorkers lowers workers when workers times fdsPerClone does not fit the open file
+// limit of the process, limit reports the soft limit and false when it is unknown
+func limitWorkers(workers int, limit func() (uint64, bool)) int {
+	max, ok := limit()
+	if !ok || uint64(workers*fdsPerClone+reservedFDs) <= max {
+		return workers
+	}
+	fit := 1
+	if max > reservedFDs+fdsPerClone {
+		fit = int((max - reservedFDs) / fdsPerClone)
+	}
+	log.Printf("WARNING: %d workers may need %d open files, the limit is %d (ulimit -n), using %d workers", workers, workers*fdsPerClone+reservedFDs, max, fit)
+	return fit
+}
+
+// logResources logs the memory and open files of the process every interval, nothing
+// when the platform does not report them
+func logResources(interval time.Duration, read func() (resourceUsage, bool)) {
+	if _, ok := read(); !ok {
+		log.Println("WARNING: -resource-interval is not supported on this platform")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if usage, ok := read(); ok {
+				log.Println("Resources:", usage)
+			}
+		}
+	}()
+}
+
+// memoryGuard pauses dispatching new clones while the RSS of the process is above
+// Limit, until the clones in flight finished and released their memory
+type memoryGuard struct {
+	// Limit is the RSS in bytes above which no clone is started
+	Limit int64
+	// Read returns the resource usage of the process, false when it is unknown
+	Read func() (resourceUsage, bool)
+	// Poll is how often the RSS is read again while paused
+	Poll time.Duration
+}
+
+// wait blocks while the RSS is above the limit and inFlight reports running clones,
+// a nil *memoryGuard never blocks. Once no clone is running the next one is started
+// whatever the RSS, so a run always makes progress
+func (g *memoryGuard) wait(inFlight func() int) {
+	if g == nil {
+		return
+	}
+	usage, ok := g.Read()
+	if !ok || usage.RSS <= g.Limit || inFlight() == 0 {
+		return
+	}
+	log.Printf("Memory guard: RSS %s is above -max-memory %s, pausing new clones until running ones finish", formatBytes(usage.RSS), formatBytes(g.Limit))
+	start := time.Now()
+	for {
+		time.Sleep(g.Poll)
+		usage, ok = g.Read()
+		running := inFlight()
+		if !ok || usage.RSS <= g.Limit || running == 0 {
+			log.Printf("Memory guard: resuming after %s with RSS %s and %d clones running", time.Since(start).Round(time.Millisecond), formatBytes(usage.RSS), running)
+			return
+		}
+	}
+}
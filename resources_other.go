@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+// openFileLimit is unknown, this platform has no RLIMIT_NOFILE
+func openFileLimit() (uint64, bool) {
+	return 0, false
+}
+
+// readResources reports nothing, the RSS and open files are not read on this platform
+func readResources() (resourceUsage, bool) {
+	return resourceUsage{}, false
+}
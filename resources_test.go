@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitWorkers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		workers  int
+		limit    uint64
+		known    bool
+		expected int
+	}{
+		{name: "unknown limit", workers: 100, expected: 100},
+		{name: "fits", workers: 10, limit: 1024, known: true, expected: 10},
+		{name: "exactly fits", workers: 10, limit: 10*fdsPerClone + reservedFDs, known: true, expected: 10},
+		{name: "reduced", workers: 100, limit: 1024, known: true, expected: (1024 - reservedFDs) / fdsPerClone},
+		{name: "tiny limit", workers: 10, limit: 32, known: true, expected: 1},
+	} {
+		got := limitWorkers(tc.workers, func() (uint64, bool) { return tc.limit, tc.known })
+		if got != tc.expected {
+			t.Errorf("%s: %d workers with the limit %d became %d, expected %d", tc.name, tc.workers, tc.limit, got, tc.expected)
+		}
+	}
+}
+
+// fakeReadings returns the RSS of readings in turn, repeating the last one
+func fakeReadings(readings ...int64) (read func() (resourceUsage, bool), count func() int) {
+	n := 0
+	return func() (resourceUsage, bool) {
+			rss := readings[len(readings)-1]
+			if n < len(readings) {
+				rss = readings[n]
+			}
+			n++
+			return resourceUsage{RSS: rss}, true
+		}, func() int {
+			return n
+		}
+}
+
+func TestMemoryGuard(t *testing.T) {
+	const limit = 1 << 30
+	for _, tc := range []struct {
+		name     string
+		readings []int64
+		// inFlight are the running clones reported after each reading
+		inFlight []int
+		reads    int
+	}{
+		{name: "below the limit", readings: []int64{limit / 2}, inFlight: []int{3}, reads: 1},
+		{name: "above with nothing running", readings: []int64{2 * limit}, inFlight: []int{0}, reads: 1},
+		{name: "paused until the RSS drops", readings: []int64{2 * limit, 2 * limit, 2 * limit, limit / 2}, inFlight: []int{3, 3, 2, 2}, reads: 4},
+		{name: "paused until the clones finish", readings: []int64{2 * limit}, inFlight: []int{3, 2, 1, 0}, reads: 4},
+	} {
+		read, reads := fakeReadings(tc.readings...)
+		calls := 0
+		inFlight := func() int {
+			i := calls
+			if i >= len(tc.inFlight) {
+				i = len(tc.inFlight) - 1
+			}
+			calls++
+			return tc.inFlight[i]
+		}
+		guard := &memoryGuard{Limit: limit, Read: read, Poll: time.Millisecond}
+		done := make(chan struct{})
+		go func() {
+			guard.wait(inFlight)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the guard never resumed", tc.name)
+		}
+		if reads() != tc.reads {
+			t.Errorf("%s: read the RSS %d times, expected %d", tc.name, reads(), tc.reads)
+		}
+	}
+	var guard *memoryGuard
+	guard.wait(func() int { return 1 })
+}
@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// openFileLimit is the soft RLIMIT_NOFILE of the process
+func openFileLimit() (uint64, bool) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, false
+	}
+	return uint64(limit.Cur), true
+}
+
+// readResources reads the RSS and open files of the process from /proc, false on
+// platforms without it
+func readResources() (resourceUsage, bool) {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return resourceUsage{}, false
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return resourceUsage{}, false
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return resourceUsage{}, false
+	}
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return resourceUsage{}, false
+	}
+	// one of the descriptors is the directory being read
+	return resourceUsage{RSS: pages * int64(os.Getpagesize()), FDs: len(fds) - 1}, true
+}
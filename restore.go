@@ -0,0 +1,475 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	manifestPtr := flags.String("manifest", "", "manifest of the backup to restore, the archives are read from the same directory")
+	destPtr := flags.String("dest", "codepack", "directory the repositories are restored to")
+	addRemote := &stringsFlag{}
+	flags.Var(addRemote, "add-remote", "remote added to every restored mirror as name=url-template, the template receives {{ .name }} and {{ .path }}, repeat it to add several remotes")
+	forceRemotesPtr := flags.Bool("force-remotes", false, "replace remotes of -add-remote that exist already instead of failing the repository")
+	checkoutPtr := flags.String("checkout", "", "also check out a working copy of the branch HEAD points at of every restored mirror to the same path below this directory, the suggested head for an unborn or dangling HEAD")
+	fromPtr := flags.String("from", "", "oci:// reference the archive of the manifest was pushed to, pulled instead of read from the directory of the manifest")
+	ociPlainHTTPPtr := flags.Bool("oci-plain-http", false, "use plain http for the oci:// registry of -from")
+	limits := archiveLimitFlags(flags)
+	loadIdentities := identityFlags(flags)
+	parseFlags(flags, args)
+
+	if *manifestPtr == "" {
+		return fmt.Errorf("restore requires -manifest")
+	}
+	if err := loadIdentities(); err != nil {
+		return err
+	}
+	remotes, err := parseRemoteSpecs(addRemote.values)
+	if err != nil {
+		return err
+	}
+	m, err := ManifestFromFile(*manifestPtr)
+	if err != nil {
+		return err
+	}
+	archiveDir := filepath.Dir(*manifestPtr)
+	if *fromPtr != "" {
+		pulled, err := pullManifestArchive(m, archiveDir, *fromPtr, *ociPlainHTTPPtr)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(pulled)
+		archiveDir = pulled
+	}
+	if err := restoreBackup(m, archiveDir, *destPtr, limits()); err != nil {
+		return err
+	}
+	if err := importStreams(m, *destPtr); err != nil {
+		return err
+	}
+	if err := linkAliases(m, *destPtr); err != nil {
+		return fmt.Errorf("Cannot link the repositories merged by URL: %w", err)
+	}
+	if len(remotes) > 0 {
+		if err := addRemotes(m, *destPtr, remotes, *forceRemotesPtr); err != nil {
+			return err
+		}
+	}
+	if *checkoutPtr == "" {
+		return nil
+	}
+	return checkoutRestored(m, *destPtr, *checkoutPtr, remotes, *forceRemotesPtr)
+}
+
+// pullManifestArchive pulls the archive of m from the oci:// reference from to a temporary
+// directory and links the earlier archives of its chain from archiveDir next to it, the
+// directory is returned for restoreBackup to read them from
+func pullManifestArchive(m *Manifest, archiveDir string, from string, plainHTTP bool) (string, error) {
+	reference, ok := strings.CutPrefix(from, "oci://")
+	if !ok {
+		return "", fmt.Errorf("-from must be an oci:// reference, not '%s'", from)
+	}
+	if m.PerRepo {
+		return "", fmt.Errorf("-from pulls a single archive, a -per-repo backup is a directory")
+	}
+	if m.Archive == "" || m.Archive != filepath.Base(m.Archive) {
+		return "", fmt.Errorf("Invalid archive '%s' in the manifest", m.Archive)
+	}
+	dir, err := os.MkdirTemp("", "codepack-restore")
+	if err != nil {
+		return "", err
+	}
+	if err := pullOCIArchive(reference, plainHTTP, filepath.Join(dir, m.Archive)); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	for _, a := range m.Chain {
+		if a.Archive == m.Archive || a.Archive != filepath.Base(a.Archive) {
+			continue
+		}
+		parent, err := filepath.Abs(filepath.Join(archiveDir, a.Archive))
+		if err == nil {
+			err = os.Symlink(parent, filepath.Join(dir, a.Archive))
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("Cannot link archive '%s' of the chain: %w", a.Archive, err)
+		}
+	}
+	return dir, nil
+}
+
+func consolidateCommand(args []string) error {
+	flags := flag.NewFlagSet("consolidate", flag.ExitOnError)
+	manifestPtr := flags.String("manifest", "", "manifest of the incremental backup to consolidate")
+	outFilePtr := flags.String("out", "", "Output filename for the full tarball")
+	formatPtr := flags.String("format", formatGzip, "archive format of the full tarball: gzip, xz, bzip2, zstd, or tar for an uncompressed tarball")
+	compressionLevelPtr := flags.Int("compression-level", 0, "compression level from 1 (fastest) to 9 (smallest), 0 is the default of the format")
+	limits := archiveLimitFlags(flags)
+	recipients := &stringsFlag{}
+	flags.Var(recipients, "recipient", recipientUsage)
+	loadIdentities := identityFlags(flags)
+	parseFlags(flags, args)
+
+	if *manifestPtr == "" || *outFilePtr == "" {
+		return fmt.Errorf("consolidate requires -manifest and -out")
+	}
+	encryptTo, err := parseRecipients(recipients.values)
+	if err != nil {
+		return fmt.Errorf("Invalid -recipient: %w", err)
+	}
+	if err := loadIdentities(); err != nil {
+		return err
+	}
+	format, err := lookupFormat(*formatPtr)
+	if err != nil {
+		return err
+	}
+	if err := validCompressionLevel(*compressionLevelPtr); err != nil {
+		return err
+	}
+	m, err := ManifestFromFile(*manifestPtr)
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := os.MkdirTemp(os.TempDir(), "codepack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := restoreBackup(m, filepath.Dir(*manifestPtr), tempDir, limits()); err != nil {
+		return err
+	}
+
+	full := newManifest(archiveName(*outFilePtr))
+	full.Encryption = encryptTo.manifest()
+	full.Aliases = m.Aliases
+	repoPaths := make(map[string]bool)
+	for _, repo := range m.Repos {
+		if repo.Skipped != "" {
+			full.Repos = append(full.Repos, repo)
+			continue
+		}
+		repo.Archive = full.Archive
+		repo.Format, repo.SHA256 = "", ""
+		// the consolidated archive holds the restored files under their original names
+		repo.Renamed = nil
+		full.Repos = append(full.Repos, repo)
+		repoPaths[repo.ClonePath()] = true
+	}
+
+	staging := osfs.New(tempDir)
+	if err := writeStagingManifest(staging, full); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	_, err = writeToDestination(*outFilePtr, DestinationOptions{Format: format}, func(w io.Writer) error {
+		return encryptTo.encrypt(io.MultiWriter(w, hash), func(w io.Writer) error {
+			log.Println("Compressing files...")
+			a, err := newArchiver(staging, w, repoPaths, archiveOptions{Format: format, Level: *compressionLevelPtr})
+			if err != nil {
+				return err
+			}
+			for _, repo := range full.Repos {
+				if err := a.Add(repo.ClonePath()); err != nil {
+					return err
+				}
+			}
+			if err := a.Add(manifestName); err != nil {
+				return err
+			}
+			return a.Close()
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	full.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	manifestPath := defaultManifestPath(*outFilePtr)
+	log.Printf("Consolidated %d repositories from %d archives into '%s', manifest '%s'", len(full.Repos), len(m.Chain)+1, *outFilePtr, manifestPath)
+	return full.WriteFile(manifestPath)
+}
+
+// restoreFromManifest extracts every repository of m from the archive recorded for
+// it, following the chain of an incremental backup. The checksum of each archive
+// is verified before anything is extracted from it
+func restoreFromManifest(m *Manifest, archiveDir string, dest string, limits archiveLimits) error {
+	owners := make(map[string]string)
+	renamed := make(map[string]string)
+	var archives []string
+	for _, repo := range m.Repos {
+		if repo.Skipped != "" {
+			log.Printf("Not restoring %s, it was skipped: %s", repo.URL, repo.Skipped)
+			continue
+		}
+		if _, ok := owners[repo.ClonePath()]; ok {
+			continue
+		}
+		owners[repo.ClonePath()] = repo.Archive
+		for _, rename := range repo.Renamed {
+			original, err := unescapeName(rename.Original)
+			if err != nil {
+				return fmt.Errorf("Invalid original name '%s' of entry '%s': %w", rename.Original, rename.Entry, err)
+			}
+			renamed[rename.Entry] = original
+		}
+		if !contains(archives, repo.Archive) {
+			archives = append(archives, repo.Archive)
+		}
+	}
+	sort.Strings(archives)
+
+	for _, archive := range archives {
+		sum, ok := m.ArchiveSHA256(archive)
+		if !ok {
+			return fmt.Errorf("No checksum recorded for archive '%s'", archive)
+		}
+		filename := filepath.Join(archiveDir, archive)
+		if err := verifySHA256(filename, sum); err != nil {
+			return err
+		}
+
+		log.Printf("Restoring from '%s'", filename)
+		err := extractArchive(filename, dest, limits, renamed, func(rel string) bool {
+			return owningRepo(owners, rel) == archive
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to extract '%s': %w", filename, err)
+		}
+	}
+
+	log.Printf("Restored %d repositories from %d archives to '%s'", len(owners), len(archives), dest)
+	return nil
+}
+
+// owningRepo returns the archive of the repository with the longest clone path containing rel
+func owningRepo(owners map[string]string, rel string) string {
+	for p := rel; p != "."; p = path.Dir(p) {
+		if archive, ok := owners[p]; ok {
+			return archive
+		}
+	}
+	return ""
+}
+
+func verifySHA256(filename string, expected string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("Checksum mismatch for '%s': expected %s, got %s", filename, expected, actual)
+	}
+	return nil
+}
+
+// extractArchive writes the entries of a codepack archive accepted by want to dest,
+// want receives the slash separated path of the entry below the codepack directory.
+// Entries in renamed, keyed by that path, are written to the original name it maps to.
+// Archives may come from elsewhere or be tampered with in storage, so entries with
+// absolute names or escaping dest are rejected, nothing is written through a symlink
+// and symlinks are only created once the whole archive is written, after their target
+// is checked to stay inside dest. Reading stops once the archive exceeds limits
+func extractArchive(filename string, dest string, limits archiveLimits, renamed map[string]string, want func(rel string) bool) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tr, err := openArchive(f, info.Size(), limits)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	// the owners of the archive only apply when restoring as root, like tar does
+	chown := func(target string, header *tar.Header) error {
+		if os.Geteuid() != 0 {
+			return nil
+		}
+		return os.Lchown(target, header.Uid, header.Gid)
+	}
+
+	type link struct {
+		header *tar.Header
+		target string
+	}
+	var links []link
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		display := displayName(header.Name)
+		if path.IsAbs(header.Name) || filepath.IsAbs(header.Name) || filepath.VolumeName(header.Name) != "" {
+			return fmt.Errorf("Entry '%s' has an absolute path", display)
+		}
+		name := path.Clean(header.Name)
+		if contains(strings.Split(header.Name, "/"), "..") {
+			return fmt.Errorf("Entry '%s' is outside of the destination", display)
+		}
+		if !strings.HasPrefix(name, "codepack/") {
+			continue
+		}
+		rel := strings.TrimPrefix(name, "codepack/")
+		if !want(rel) {
+			continue
+		}
+		if original, ok := renamed[rel]; ok {
+			rel = original
+			if path.IsAbs(rel) || contains(strings.Split(rel, "/"), "..") {
+				return fmt.Errorf("Entry '%s' is renamed outside of the destination", display)
+			}
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(rel))
+		if !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+			return fmt.Errorf("Entry '%s' is outside of the destination", display)
+		}
+		if err := checkNoSymlink(dest, rel); err != nil {
+			return fmt.Errorf("Entry '%s' %w", display, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if err := chown(target, header); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+			if err := chown(target, header); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links = append(links, link{header: header, target: target})
+		case tar.TypeLink:
+			return fmt.Errorf("Entry '%s' is a hard link, which codepack archives never hold", display)
+		}
+	}
+
+	for _, l := range links {
+		header, target := l.header, l.target
+		if err := checkLinkTarget(dest, filepath.Dir(target), header.Linkname); err != nil {
+			return fmt.Errorf("Symlink '%s' to '%s' %w", displayName(header.Name), displayName(header.Linkname), err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+		if err := chown(target, header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNoSymlink fails when rel or one of its parents below dest is a symlink, writing
+// the entry would follow it
+func checkNoSymlink(dest string, rel string) error {
+	current := dest
+	for _, name := range strings.Split(rel, "/") {
+		current = filepath.Join(current, name)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("would be written through the symlink '%s'", current)
+		}
+	}
+	return nil
+}
+
+// checkLinkTarget fails when the symlink target linkname, relative to the directory dir
+// of the link, leaves dest. Every .. must leave an existing directory rather than a
+// symlink, so the target resolves to the same place on disk as it does lexically
+func checkLinkTarget(dest string, dir string, linkname string) error {
+	if path.IsAbs(linkname) || filepath.IsAbs(linkname) || filepath.VolumeName(linkname) != "" {
+		return fmt.Errorf("has an absolute target")
+	}
+	current := dir
+	for _, name := range strings.Split(filepath.ToSlash(linkname), "/") {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			info, err := os.Lstat(current)
+			if err != nil || !info.IsDir() {
+				return fmt.Errorf("steps out of '%s', which is not an existing directory", current)
+			}
+			if current == dest {
+				return fmt.Errorf("points outside of the destination")
+			}
+			current = filepath.Dir(current)
+		default:
+			current = filepath.Join(current, name)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
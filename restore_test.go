@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeHostileArchive writes a tar.gz of headers to filename, each regular file with its
+// Size in bytes of content unless content is shorter
+func writeHostileArchive(t *testing.T, filename string, headers []*tar.Header, content []byte) {
+	t.Helper()
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, header := range headers {
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg && header.Size > 0 {
+			data := content
+			if int64(len(data)) > header.Size {
+				data = data[:header.Size]
+			}
+			if _, err := tw.Write(data); err != nil && !errors.Is(err, tar.ErrWriteTooLong) {
+				t.Fatal(err)
+			}
+		}
+	}
+	// a header declaring more than was written cannot be closed properly, which is the point
+	tw.Flush()
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchiveRejectsHostileEntries(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers []*tar.Header
+		// prepare runs in the directory holding dest before extracting
+		prepare func(t *testing.T, dir string, dest string)
+		err     string
+	}{
+		{
+			name:    "dot-dot entry",
+			headers: []*tar.Header{{Name: "codepack/../../evil", Typeflag: tar.TypeReg, Size: 5}},
+			err:     "outside of the destination",
+		},
+		{
+			name:    "dot-dot below codepack",
+			headers: []*tar.Header{{Name: "codepack/team/../../../evil", Typeflag: tar.TypeReg, Size: 5}},
+			err:     "outside of the destination",
+		},
+		{
+			name:    "absolute name",
+			headers: []*tar.Header{{Name: "/tmp/evil", Typeflag: tar.TypeReg, Size: 5}},
+			err:     "absolute path",
+		},
+		{
+			name: "symlink leaving the destination",
+			headers: []*tar.Header{
+				{Name: "codepack/team/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "codepack/team/link", Typeflag: tar.TypeSymlink, Linkname: "../../evil"},
+			},
+			err: "points outside of the destination",
+		},
+		{
+			name:    "absolute symlink",
+			headers: []*tar.Header{{Name: "codepack/team/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+			err:     "absolute target",
+		},
+		{
+			name: "symlink then write through it",
+			headers: []*tar.Header{
+				{Name: "codepack/team/link", Typeflag: tar.TypeSymlink, Linkname: ".."},
+				{Name: "codepack/team/link/evil", Typeflag: tar.TypeReg, Size: 5},
+			},
+			err: "",
+		},
+		{
+			name:    "write through an existing symlink",
+			headers: []*tar.Header{{Name: "codepack/team/evil", Typeflag: tar.TypeReg, Size: 5}},
+			prepare: func(t *testing.T, dir string, dest string) {
+				if err := os.MkdirAll(dest, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(dir, filepath.Join(dest, "team")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: "would be written through the symlink",
+		},
+		{
+			name:    "hard link",
+			headers: []*tar.Header{{Name: "codepack/team/passwd", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}},
+			err:     "is a hard link",
+		},
+		{
+			name:    "huge declared size",
+			headers: []*tar.Header{{Name: "codepack/team/huge", Typeflag: tar.TypeReg, Size: 1 << 40}},
+			err:     errArchiveLimits.Error(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := filepath.Join(dir, "hostile.tar.gz")
+			writeHostileArchive(t, archive, tc.headers, []byte("evil\n"))
+			dest := filepath.Join(dir, "nested", "restored")
+			if tc.prepare != nil {
+				tc.prepare(t, dir, dest)
+			}
+			err := extractArchive(archive, dest, archiveLimits{}, nil, func(string) bool { return true })
+			switch {
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("expected an error containing %q, got %v", tc.err, err)
+			case tc.err == "" && err == nil:
+				t.Error("the archive was extracted without an error")
+			}
+			// nothing may land next to the archive or outside of dir
+			for _, outside := range []string{filepath.Join(dir, "evil"), filepath.Join(dir, "nested", "evil"), filepath.Join(filepath.Dir(dir), "evil")} {
+				if _, err := os.Lstat(outside); !os.IsNotExist(err) {
+					t.Errorf("'%s' was written outside of the destination", outside)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExtractArchiveOwners(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "owned.tar.gz")
+	writeHostileArchive(t, archive, []*tar.Header{
+		{Name: "codepack/team/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1234, Gid: 1235},
+		{Name: "codepack/team/HEAD", Typeflag: tar.TypeReg, Size: 5, Uid: 1234, Gid: 1235},
+	}, []byte("main\n"))
+	dest := filepath.Join(dir, "restored")
+	if err := extractArchive(archive, dest, archiveLimits{}, nil, func(string) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	// the owners of the archive only apply as root, other users keep their own silently
+	uid, gid := uint32(os.Geteuid()), uint32(os.Getegid())
+	if uid == 0 {
+		uid, gid = 1234, 1235
+	}
+	for _, name := range []string{"team", "team/HEAD"} {
+		info, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != uid || stat.Gid != gid {
+			t.Errorf("%s is owned by %d:%d, expected %d:%d", name, stat.Uid, stat.Gid, uid, gid)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+const stateFormatVersion = 1
+
+// runState records the staging directory of a run and the repositories cloned into it,
+// so an interrupted run can continue with -resume instead of starting over.
+// A nil *runState records nothing
+type runState struct {
+	FormatVersion   int      `json:"format_version"`
+	CodePackVersion string   `json:"codepack_version"`
+	Staging         string   `json:"staging"`
+	Completed       []string `json:"completed"`
+
+	path    string
+	resumed bool
+	mu      sync.Mutex
+	done    map[string]bool
+}
+
+func newRunState(path string, staging string) *runState {
+	return &runState{
+		FormatVersion:   stateFormatVersion,
+		CodePackVersion: VERSION,
+		Staging:         staging,
+		path:            path,
+		done:            make(map[string]bool),
+	}
+}
+
+// loadRunState reads the state file of an interrupted run, rejecting files written
+// by another version of CodePack or pointing at a missing staging directory
+func loadRunState(path string) (*runState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := newRunState(path, "")
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("Corrupt state file '%s', delete it to start a fresh run: %w", path, err)
+	}
+	if s.FormatVersion != stateFormatVersion || s.CodePackVersion != VERSION {
+		return nil, fmt.Errorf("State file '%s' was written by CodePack %s (format %d), this is %s (format %d), delete it to start a fresh run",
+			path, s.CodePackVersion, s.FormatVersion, VERSION, stateFormatVersion)
+	}
+	if info, err := os.Stat(s.Staging); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("Staging directory '%s' of state file '%s' no longer exists, delete the state file to start a fresh run", s.Staging, path)
+	}
+	for _, p := range s.Completed {
+		s.done[p] = true
+	}
+	s.resumed = true
+	return s, nil
+}
+
+// defaultStatePath is where the state of a run writing target is kept when -state is not set
+func defaultStatePath(target string) string {
+	if strings.Contains(target, "://") {
+		return archiveName(target) + ".state.json"
+	}
+	return target + ".state.json"
+}
+
+// Resumed reports whether the state was loaded from an interrupted run
+func (s *runState) Resumed() bool {
+	return s != nil && s.resumed
+}
+
+// Done reports whether clonePath was cloned completely by an earlier attempt
+func (s *runState) Done(clonePath string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[clonePath]
+}
+
+// MarkDone records clonePath as cloned and rewrites the state file
+func (s *runState) MarkDone(clonePath string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done[clonePath] = true
+	s.Completed = s.Completed[:0]
+	for p := range s.done {
+		s.Completed = append(s.Completed, p)
+	}
+	sort.Strings(s.Completed)
+	return s.write()
+}
+
+func (s *runState) write() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Remove deletes the state file once the run succeeded
+func (s *runState) Remove() error {
+	if s == nil {
+		return nil
+	}
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removePartialClone deletes what an interrupted clone left in repoFS, only the
+// git entries are removed so repositories nested below this one are kept
+func removePartialClone(repoFS billy.Filesystem) error {
+	for _, name := range []string{"HEAD", "config", "description", "packed-refs", "shallow", "objects", "refs", "hooks", "info"} {
+		if err := removeAll(repoFS, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeAll(fs billy.Filesystem, name string) error {
+	info, err := fs.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeAll(fs, filepath.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Remove(name)
+}
+
+// verifyClone checks that HEAD and every reference of a resumed clone resolve to stored objects
+func verifyClone(repoFS billy.Filesystem) error {
+	storage := filesystem.NewStorage(repoFS, cache.NewObjectLRUDefault())
+	if _, err := storage.Reference(plumbing.HEAD); err != nil {
+		return fmt.Errorf("HEAD: %w", err)
+	}
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return err
+	}
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		if err := storage.HasEncodedObject(ref.Hash()); err != nil {
+			return fmt.Errorf("%s: %w", ref.Name(), err)
+		}
+		return nil
+	})
+}
+
+// resumeOrClone clones repo to clonePath of staging, whose directory is fs, unless an
+// interrupted run already cloned it. A repository already at clonePath, like a mirror an
+// earlier run left in the cache or a clone an interrupted run did not record, is fetched in
+// to when it is complete, removed with -force-reclone, and fails the clone otherwise. What
+// an interrupted clone of repo left behind is always removed
+func resumeOrClone(ctx context.Context, staging billy.Filesystem, repo Repository, clonePath string, fs billy.Filesystem, cacheSize int64, opts CloneOptions, alt *alternateSource) error {
+	if opts.State.Done(clonePath) {
+		if !opts.VerifyResumed {
+			log.Printf("Already cloned %s to path %s, skipping", repo.URL, clonePath)
+			return nil
+		}
+		err := verifyClone(fs)
+		if err == nil {
+			log.Printf("Already cloned %s to path %s, verified", repo.URL, clonePath)
+			return nil
+		}
+		log.Printf("Clone of %s at path %s is broken, cloning again: %v", repo.URL, clonePath, err)
+	}
+	if holdsRepository(fs) && !opts.ForceReclone {
+		var reason error = git.ErrRepositoryAlreadyExists
+		if opts.Cache != nil || opts.State.Resumed() {
+			if reason = errIncompleteMirror; cachedMirror(fs) {
+				if reason = verifyClone(fs); reason == nil {
+					return updateCachedMirror(ctx, staging, repo, clonePath, fs, cacheSize, opts)
+				}
+			}
+		}
+		// an interrupted run may have left it, it is cloned again like a partial clone
+		if !opts.State.Resumed() {
+			return &stagingConflictError{path: path.Join(opts.StagingDir, clonePath), err: reason}
+		}
+	}
+	if holdsRepository(fs) {
+		if opts.ForceReclone {
+			log.Printf("Removing the repository at path %s to clone %s again", clonePath, repo.URL)
+		}
+		if err := removePartialClone(fs); err != nil {
+			return fmt.Errorf("Cannot remove partial clone at '%s': %w", clonePath, err)
+		}
+	}
+	return cloneStaged(staging, clonePath, opts.RepoSizeLimit, func(tmp billy.Filesystem) error {
+		return cloneWithRetries(ctx, repo, tmp, cacheSize, opts, alt)
+	})
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"golang.org/x/crypto/hkdf"
+)
+
+// openPGPKeyID and openPGPFingerprint match the key IDs and fingerprints -remove-recipient
+// takes for the OpenPGP keys of a manifest
+var (
+	openPGPKeyID       = regexp.MustCompile(`^(0[xX])?[0-9A-Fa-f]{16}$`)
+	openPGPFingerprint = regexp.MustCompile(`^[0-9A-Fa-f]{40}$|^[0-9A-Fa-f]{64}$`)
+)
+
+// rewrapCommand changes the recipients of an encrypted archive in place. Only the header
+// holding the key of the archive encrypted to every recipient is written again, the
+// encrypted content is copied as it is, and the sidecar manifest and the chains of the
+// manifests next to the archive are updated to the new recipients and checksum
+func rewrapCommand(args []string) error {
+	flags := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	manifestPtr := flags.String("manifest", "", "manifest of the archive (default <archive>.manifest.json)")
+	addRecipients := &stringsFlag{}
+	flags.Var(addRecipients, "add-recipient", "encrypt the archive to this age public key (age1...) or to the age recipients or OpenPGP public keys of this file as well, repeat it to add several")
+	removeRecipients := &stringsFlag{}
+	flags.Var(removeRecipients, "remove-recipient", "no longer encrypt the archive to this age public key, OpenPGP key ID or fingerprint, or to the keys of this file, repeat it to remove several")
+	loadIdentities := identityFlags(flags)
+	// the archive may come before the flags, like codepack rewrap backup.tar.gz.age -add-recipient age1...
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append(append([]string{}, args[1:]...), args[0])
+	}
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("rewrap requires the archive, like codepack rewrap <archive> -identity key.txt -add-recipient age1...")
+	}
+	if len(addRecipients.values) == 0 && len(removeRecipients.values) == 0 {
+		return fmt.Errorf("rewrap requires -add-recipient or -remove-recipient")
+	}
+	archive := flags.Arg(0)
+	added, err := parseRecipients(addRecipients.values)
+	if err != nil {
+		return fmt.Errorf("Invalid -add-recipient: %w", err)
+	}
+	removed, err := parseRemovals(removeRecipients.values)
+	if err != nil {
+		return fmt.Errorf("Invalid -remove-recipient: %w", err)
+	}
+	if err := loadIdentities(); err != nil {
+		return err
+	}
+	manifestPath := *manifestPtr
+	if manifestPath == "" {
+		manifestPath = defaultManifestPath(archive)
+	}
+	m, err := ManifestFromFile(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	oldHash := sha256.New()
+	br := bufio.NewReader(io.TeeReader(in, oldHash))
+	format := encryptedFormat(br)
+	switch {
+	case format == "":
+		return fmt.Errorf("'%s' is not an encrypted archive", archive)
+	case added != nil && added.format != format:
+		return fmt.Errorf("'%s' is encrypted with %s, -add-recipient must be %s keys as well", archive, format, format)
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(archive), ".codepack-rewrap-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	newHash := sha256.New()
+	w := io.MultiWriter(out, newHash)
+
+	var encryption *ManifestEncryption
+	if format == encryptionAge {
+		encryption, err = rewrapAge(br, w, m.Encryption, added, removed)
+	} else {
+		encryption, err = rewrapOpenPGP(br, w, m.Encryption, added, removed)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot rewrap '%s': %w", archive, err)
+	}
+	// the encrypted content is the same, only the header before it changed
+	if _, err := io.Copy(w, br); err != nil {
+		return err
+	}
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	oldSHA256, newSHA256 := hex.EncodeToString(oldHash.Sum(nil)), hex.EncodeToString(newHash.Sum(nil))
+	if m.SHA256 != "" && m.SHA256 != oldSHA256 {
+		return fmt.Errorf("'%s' does not match the checksum of its manifest '%s'", archive, manifestPath)
+	}
+	if err := os.Rename(out.Name(), archive); err != nil {
+		return err
+	}
+	for _, recipient := range encryption.Recipients {
+		log.Printf("Recipient of '%s': %s", archive, recipientLabel(recipient))
+	}
+
+	// the manifest embedded in the archive is encrypted with it and keeps the recipients it was written for
+	m.Encryption = encryption
+	m.SHA256 = newSHA256
+	log.Println("Writing manifest:", manifestPath)
+	if err := m.WriteFile(manifestPath); err != nil {
+		return err
+	}
+	return updateChains(filepath.Dir(archive), manifestPath, m.Archive, oldSHA256, newSHA256)
+}
+
+func recipientLabel(r ManifestRecipient) string {
+	switch {
+	case r.Recipient != "":
+		return r.Recipient
+	case r.Fingerprint != "":
+		return fmt.Sprintf("%s (key %s)", r.Fingerprint, r.KeyID)
+	}
+	return "key " + r.KeyID
+}
+
+// updateChains records the new checksum of archive in the chains of the other manifests of
+// dir, the backups restoring repositories from it verify it by that checksum
+func updateChains(dir string, skip string, archive string, oldSHA256 string, newSHA256 string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.manifest.json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if same, _ := sameFile(p, skip); same {
+			continue
+		}
+		m, err := ManifestFromFile(p)
+		if err != nil {
+			log.Printf("WARNING: cannot update the chain of '%s': %v", p, err)
+			continue
+		}
+		changed := false
+		for i := range m.Chain {
+			if m.Chain[i].Archive == archive && m.Chain[i].SHA256 == oldSHA256 {
+				m.Chain[i].SHA256 = newSHA256
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		log.Println("Updating the chain of manifest:", p)
+		if err := m.WriteFile(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameFile(a string, b string) (bool, error) {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(ai, bi), nil
+}
+
+// recipientRemovals are the keys of -remove-recipient, each OpenPGP value by the key IDs
+// of its keys or the fingerprint the manifest maps to a key ID
+type recipientRemovals struct {
+	ageKeys map[string]bool
+	pgp     []openPGPRemoval
+}
+
+type openPGPRemoval struct {
+	value       string
+	fingerprint string
+	keyIDs      map[uint64]bool
+}
+
+func parseRemovals(values []string) (*recipientRemovals, error) {
+	r := &recipientRemovals{ageKeys: map[string]bool{}}
+	for _, value := range values {
+		removal := openPGPRemoval{value: value, keyIDs: map[uint64]bool{}}
+		switch {
+		case openPGPKeyID.MatchString(value):
+			id, _ := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 64)
+			removal.keyIDs[id] = true
+		case openPGPFingerprint.MatchString(value):
+			removal.fingerprint = strings.ToUpper(value)
+		default:
+			keys, err := parseRecipients([]string{value})
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range keys.ageKeys {
+				r.ageKeys[key] = true
+			}
+			if keys.format == encryptionAge {
+				continue
+			}
+			for _, entity := range keys.pgp {
+				removal.keyIDs[entity.PrimaryKey.KeyId] = true
+				for _, subkey := range entity.Subkeys {
+					removal.keyIDs[subkey.PublicKey.KeyId] = true
+				}
+			}
+		}
+		r.pgp = append(r.pgp, removal)
+	}
+	return r, nil
+}
+
+// rewrapAge reads the age header from r and writes it to w with the file key wrapped for
+// the recipients of the manifest without the removed ones and with the added ones. An age
+// stanza does not name its recipient, so the manifest is what knows the current ones
+func rewrapAge(r *bufio.Reader, w io.Writer, current *ManifestEncryption, added *archiveRecipients, removed *recipientRemovals) (*ManifestEncryption, error) {
+	if current == nil || current.Format != encryptionAge {
+		return nil, fmt.Errorf("the manifest records no age recipients, they cannot be rewrapped")
+	}
+	if len(removed.pgp) > 0 {
+		return nil, fmt.Errorf("the archive is encrypted with age, -remove-recipient takes age public keys")
+	}
+	if identities == nil || len(identities.age) == 0 {
+		return nil, fmt.Errorf("rewrap needs the -identity of an age recipient of the archive")
+	}
+	header, err := readAgeHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	var fileKey []byte
+	for _, identity := range identities.age {
+		fileKey, err = identity.Unwrap(header.stanzas)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, age.ErrIncorrectIdentity) {
+			return nil, err
+		}
+	}
+	if fileKey == nil {
+		return nil, fmt.Errorf("no -identity is a recipient of the archive")
+	}
+	if !hmac.Equal(header.mac, ageHeaderMAC(fileKey, header.marshalWithoutMAC())) {
+		return nil, fmt.Errorf("the age header fails its MAC")
+	}
+
+	keys := &archiveRecipients{format: encryptionAge}
+	found := map[string]bool{}
+	for _, recipient := range current.Recipients {
+		if removed.ageKeys[recipient.Recipient] {
+			found[recipient.Recipient] = true
+			continue
+		}
+		if err := keys.addAge(recipient.Recipient); err != nil {
+			return nil, err
+		}
+	}
+	for key := range removed.ageKeys {
+		if !found[key] {
+			return nil, fmt.Errorf("'%s' is not a recipient of the archive", key)
+		}
+	}
+	if added != nil {
+		for _, key := range added.ageKeys {
+			if !contains(keys.ageKeys, key) {
+				keys.addAge(key)
+			}
+		}
+	}
+	if len(keys.age) == 0 {
+		return nil, fmt.Errorf("removing every recipient would leave nobody able to decrypt the archive")
+	}
+
+	rewrapped := &ageHeader{}
+	for _, recipient := range keys.age {
+		stanzas, err := recipient.Wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		rewrapped.stanzas = append(rewrapped.stanzas, stanzas...)
+	}
+	withoutMAC := rewrapped.marshalWithoutMAC()
+	rewrapped.mac = ageHeaderMAC(fileKey, withoutMAC)
+	if _, err := w.Write(withoutMAC); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, " %s\n", base64.RawStdEncoding.EncodeToString(rewrapped.mac)); err != nil {
+		return nil, err
+	}
+	return keys.manifest(), nil
+}
+
+// ageHeader is the header of an age file, the recipient stanzas wrapping the file key and
+// the MAC of the header by the file key
+type ageHeader struct {
+	stanzas []*age.Stanza
+	mac     []byte
+}
+
+// ageColumns is the length of the base64 lines of a stanza body, a shorter line ends it
+const ageColumns = 64
+
+func readAgeHeader(r *bufio.Reader) (*ageHeader, error) {
+	line, err := r.ReadString('\n')
+	if err != nil || line != string(ageIntro) {
+		return nil, fmt.Errorf("invalid age header")
+	}
+	h := &ageHeader{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid age header: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if strings.HasPrefix(line, "--- ") {
+			if h.mac, err = base64.RawStdEncoding.DecodeString(line[4:]); err != nil {
+				return nil, fmt.Errorf("invalid age header MAC: %w", err)
+			}
+			return h, nil
+		}
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 || fields[0] != "->" {
+			return nil, fmt.Errorf("invalid age stanza '%s'", line)
+		}
+		stanza := &age.Stanza{Type: fields[1], Args: fields[2:]}
+		var body strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return nil, fmt.Errorf("invalid age stanza body: %w", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			body.WriteString(line)
+			if len(line) < ageColumns {
+				break
+			}
+		}
+		if stanza.Body, err = base64.RawStdEncoding.DecodeString(body.String()); err != nil {
+			return nil, fmt.Errorf("invalid age stanza body: %w", err)
+		}
+		h.stanzas = append(h.stanzas, stanza)
+	}
+}
+
+// marshalWithoutMAC is the header up to the --- the MAC covers
+func (h *ageHeader) marshalWithoutMAC() []byte {
+	var b bytes.Buffer
+	b.Write(ageIntro)
+	for _, stanza := range h.stanzas {
+		b.WriteString("-> " + strings.Join(append([]string{stanza.Type}, stanza.Args...), " ") + "\n")
+		body := base64.RawStdEncoding.EncodeToString(stanza.Body)
+		for len(body) >= ageColumns {
+			b.WriteString(body[:ageColumns] + "\n")
+			body = body[ageColumns:]
+		}
+		b.WriteString(body + "\n")
+	}
+	b.WriteString("---")
+	return b.Bytes()
+}
+
+// ageHeaderMAC is the HMAC-SHA256 of header by the key age derives from the file key for it
+func ageHeaderMAC(fileKey []byte, header []byte) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, fileKey, nil, []byte("header")), key); err != nil {
+		panic(err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// rewrapOpenPGP reads the public key encrypted session key packets from r and writes those
+// of the recipients that are not removed to w, followed by new ones for the added keys
+func rewrapOpenPGP(r *bufio.Reader, w io.Writer, current *ManifestEncryption, added *archiveRecipients, removed *recipientRemovals) (*ManifestEncryption, error) {
+	if len(removed.ageKeys) > 0 {
+		return nil, fmt.Errorf("the archive is encrypted with OpenPGP, -remove-recipient takes OpenPGP keys")
+	}
+	fingerprints := map[uint64]string{}
+	if current != nil {
+		for _, recipient := range current.Recipients {
+			if id, err := strconv.ParseUint(recipient.KeyID, 16, 64); err == nil {
+				fingerprints[id] = recipient.Fingerprint
+				for _, removal := range removed.pgp {
+					if removal.fingerprint == recipient.Fingerprint {
+						removal.keyIDs[id] = true
+					}
+				}
+			}
+		}
+	}
+	isRemoved := func(id uint64) bool {
+		for _, removal := range removed.pgp {
+			if removal.keyIDs[id] {
+				return true
+			}
+		}
+		return false
+	}
+
+	type sessionKeyPacket struct {
+		raw []byte
+		key *packet.EncryptedKey
+	}
+	var kept []sessionKeyPacket
+	var session *packet.EncryptedKey
+	removedIDs := map[uint64]bool{}
+	for {
+		raw, err := readSessionKeyPacket(r)
+		if err != nil {
+			return nil, err
+		}
+		if raw == nil {
+			break
+		}
+		p, err := packet.Read(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenPGP session key packet: %w", err)
+		}
+		ek, ok := p.(*packet.EncryptedKey)
+		if !ok {
+			return nil, fmt.Errorf("invalid OpenPGP session key packet")
+		}
+		if session == nil && added != nil && identities != nil {
+			for _, key := range identities.pgp.KeysById(ek.KeyId) {
+				if key.PrivateKey == nil || key.PrivateKey.Encrypted {
+					continue
+				}
+				if err := ek.Decrypt(key.PrivateKey, nil); err == nil {
+					session = ek
+					break
+				}
+			}
+		}
+		if isRemoved(ek.KeyId) {
+			removedIDs[ek.KeyId] = true
+			continue
+		}
+		kept = append(kept, sessionKeyPacket{raw: raw, key: ek})
+	}
+	for _, removal := range removed.pgp {
+		matched := false
+		for id := range removal.keyIDs {
+			matched = matched || removedIDs[id]
+		}
+		if !matched {
+			return nil, fmt.Errorf("'%s' is not a recipient of the archive", removal.value)
+		}
+	}
+
+	encryption := &ManifestEncryption{Format: encryptionOpenPGP}
+	for _, p := range kept {
+		if _, err := w.Write(p.raw); err != nil {
+			return nil, err
+		}
+		id := fmt.Sprintf("%016X", p.key.KeyId)
+		encryption.Recipients = append(encryption.Recipients, ManifestRecipient{Fingerprint: fingerprints[p.key.KeyId], KeyID: id})
+	}
+	if added != nil {
+		if session == nil {
+			return nil, fmt.Errorf("rewrap needs the -identity of an OpenPGP recipient of the archive to add recipients")
+		}
+		for _, entity := range added.pgp {
+			key, _ := entity.EncryptionKey(time.Now())
+			if err := packet.SerializeEncryptedKey(w, key.PublicKey, session.CipherFunc, session.Key, nil); err != nil {
+				return nil, err
+			}
+			encryption.Recipients = append(encryption.Recipients, openPGPRecipient(entity))
+		}
+	}
+	if len(encryption.Recipients) == 0 {
+		return nil, fmt.Errorf("removing every recipient would leave nobody able to decrypt the archive")
+	}
+	return encryption, nil
+}
+
+// readSessionKeyPacket reads the next packet of r when it is a public key encrypted
+// session key, tag 1, and returns nil leaving r at the packet otherwise
+func readSessionKeyPacket(r *bufio.Reader) ([]byte, error) {
+	head, err := r.Peek(2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenPGP message: %w", err)
+	}
+	var tag byte
+	var headerLen, bodyLen int
+	if head[0]&0x40 != 0 {
+		tag = head[0] & 0x3f
+		switch l := int(head[1]); {
+		case l < 192:
+			headerLen, bodyLen = 2, l
+		case l < 224:
+			b, err := r.Peek(3)
+			if err != nil {
+				return nil, err
+			}
+			headerLen, bodyLen = 3, (l-192)<<8+int(b[2])+192
+		case l == 255:
+			b, err := r.Peek(6)
+			if err != nil {
+				return nil, err
+			}
+			headerLen, bodyLen = 6, int(binary.BigEndian.Uint32(b[2:]))
+		default:
+			// a partial length is only used by data packets
+			return nil, nil
+		}
+	} else {
+		tag = (head[0] >> 2) & 0x0f
+		switch head[0] & 3 {
+		case 0:
+			headerLen, bodyLen = 2, int(head[1])
+		case 1:
+			b, err := r.Peek(3)
+			if err != nil {
+				return nil, err
+			}
+			headerLen, bodyLen = 3, int(binary.BigEndian.Uint16(b[1:]))
+		case 2:
+			b, err := r.Peek(5)
+			if err != nil {
+				return nil, err
+			}
+			headerLen, bodyLen = 5, int(binary.BigEndian.Uint32(b[1:]))
+		default:
+			return nil, nil
+		}
+	}
+	if tag != 1 {
+		return nil, nil
+	}
+	raw := make([]byte, headerLen+bodyLen)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, fmt.Errorf("invalid OpenPGP session key packet: %w", err)
+	}
+	return raw, nil
+}
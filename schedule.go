@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+)
+
+// dispatchOrder returns the indexes of config.Repos in the order they are handed to the
+// clone workers. Repositories with a higher priority go first, then the largest
+// repositories by expected size so a long clone does not start after the others finished.
+// With shuffle set the order is random within each priority instead
+func dispatchOrder(config *Config, expectedSizes map[string]int64, shuffle bool) []int {
+	order := make([]int, len(config.Repos))
+	for i := range order {
+		order[i] = i
+	}
+	if shuffle {
+		rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+
+	size := func(i int) int64 {
+		repo := config.Repos[i]
+		return expectedSizes[path.Join(repo.Path, repo.Name)]
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := config.Repos[order[i]], config.Repos[order[j]]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if shuffle {
+			return false
+		}
+		return size(order[i]) > size(order[j])
+	})
+	return order
+}
+
+// expectedSizes returns the object store size recorded for each repository of an earlier manifest
+func expectedSizes(m *Manifest) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, repo := range m.Repos {
+		if repo.Size > 0 {
+			sizes[repo.ClonePath()] = repo.Size
+		}
+	}
+	return sizes
+}
+
+func logDispatchOrder(config *Config, order []int, expectedSizes map[string]int64) {
+	if len(order) == 0 {
+		return
+	}
+	names := make([]string, len(order))
+	for n, i := range order {
+		clonePath := path.Join(config.Repos[i].Path, config.Repos[i].Name)
+		names[n] = clonePath
+		if size, ok := expectedSizes[clonePath]; ok {
+			names[n] += " (" + formatBytes(size) + ")"
+		}
+	}
+	log.Println("Clone order:", strings.Join(names, ", "))
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// secretsWarn, secretsExclude and secretsFail are what the secrets setting of a repository
+// does when -scan-secrets finds secrets in it: log them, leave the repository out of the
+// backup or fail the run
+const (
+	secretsWarn    = "warn"
+	secretsExclude = "exclude"
+	secretsFail    = "fail"
+)
+
+// maxSecretFindings is the number of findings listed for a repository, the count covers all of them
+const maxSecretFindings = 50
+
+// binaryProbe is the number of leading bytes searched for a NUL byte to skip binary files, like git does
+const binaryProbe = 8000
+
+var (
+	// errSecretsExcluded leaves a repository with secrets out of the backup, see secrets: exclude
+	errSecretsExcluded = errors.New("secrets found, the repository is excluded from the backup")
+	// errSecretsBudget stops the scan of a repository that took longer than -secrets-budget
+	errSecretsBudget = errors.New("secrets budget exceeded")
+)
+
+// secretRule is a built in detector, Group is the submatch holding the secret, 0 for the whole match
+type secretRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Group   int
+}
+
+var secretRules = []secretRule{
+	{Name: "aws-access-key-id", Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{Name: "aws-secret-access-key", Pattern: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`), Group: 1},
+	{Name: "private-key", Pattern: regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`)},
+	{Name: "github-token", Pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{Name: "gitlab-token", Pattern: regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20}\b`)},
+	{Name: "slack-token", Pattern: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{Name: "generic-token", Pattern: regexp.MustCompile(`(?i)(?:api[_-]?key|secret|token|passw(?:or)?d)["']?\s*[:=]\s*["']([A-Za-z0-9_\-/+=.]{16,})["']`), Group: 1},
+}
+
+// secretFinding is a match of a rule, the secret itself is never recorded
+type secretFinding struct {
+	Rule string `json:"rule"`
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// secretScan is the outcome of -scan-secrets for a repository
+type secretScan struct {
+	Policy   string          `json:"policy"`
+	Findings int             `json:"findings"`
+	List     []secretFinding `json:"list,omitempty"`
+	// Commit is the commit HEAD pointed at, the files of its tree are scanned
+	Commit string `json:"commit,omitempty"`
+	// SkippedLarge counts the files above -secrets-max-file that were not scanned
+	SkippedLarge int `json:"skipped_large,omitempty"`
+	// Incomplete is set when the scan stopped at -secrets-budget
+	Incomplete string `json:"incomplete,omitempty"`
+}
+
+// rules names the rules that matched, in the order of secretRules
+func (s *secretScan) rules() []string {
+	matched := make(map[string]bool)
+	for _, finding := range s.List {
+		matched[finding.Rule] = true
+	}
+	var names []string
+	for _, rule := range secretRules {
+		if matched[rule.Name] {
+			names = append(names, rule.Name)
+		}
+	}
+	return names
+}
+
+// secretAllowlist suppresses false positives of -scan-secrets
+type secretAllowlist struct {
+	// paths are gitignore patterns of files that are not scanned
+	paths []gitignore.Pattern
+	// values are expressions matching the whole of a secret that is not one, like an example key
+	values []*regexp.Regexp
+	// rules are turned off
+	rules map[string]bool
+}
+
+// readSecretAllowlist reads the allowlist file of -secrets-allowlist, every line is
+// path:<gitignore pattern>, value:<regular expression> or rule:<rule name>
+func readSecretAllowlist(filename string) (*secretAllowlist, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	allow := &secretAllowlist{rules: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch kind {
+		case "path":
+			allow.paths = append(allow.paths, gitignore.ParsePattern(value, nil))
+		case "value":
+			re, err := regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value on line %d of '%s': %w", n, filename, err)
+			}
+			allow.values = append(allow.values, re)
+		case "rule":
+			if !knownSecretRule(value) {
+				return nil, fmt.Errorf("Unknown rule '%s' on line %d of '%s'", value, n, filename)
+			}
+			allow.rules[value] = true
+		default:
+			return nil, fmt.Errorf("Invalid line %d of '%s', use path:, value: or rule:", n, filename)
+		}
+	}
+	return allow, scanner.Err()
+}
+
+func knownSecretRule(name string) bool {
+	for _, rule := range secretRules {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsFile reports whether the file at name is not scanned, a nil *secretAllowlist allows none
+func (a *secretAllowlist) allowsFile(name string) bool {
+	return a != nil && len(a.paths) > 0 && gitignore.NewMatcher(a.paths).Match(strings.Split(name, "/"), false)
+}
+
+// allows reports whether the match value of rule is not a secret, a nil *secretAllowlist allows none
+func (a *secretAllowlist) allows(rule string, value []byte) bool {
+	if a == nil {
+		return false
+	}
+	if a.rules[rule] {
+		return true
+	}
+	for _, re := range a.values {
+		if re.Match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretScanner runs -scan-secrets on every mirror once it is cloned
+type secretScanner struct {
+	// MaxFile is the size in bytes above which a file is not scanned
+	MaxFile int64
+	// Budget is the time the scan of a single repository may take
+	Budget time.Duration
+	// CacheSize is the size in bytes of the object cache used while reading the repository
+	CacheSize int64
+	Allowlist *secretAllowlist
+
+	mu       sync.Mutex
+	excluded map[string]bool
+}
+
+// check scans the files at HEAD of the mirror of repo and applies its secrets policy: the
+// error is nil to archive it, errSecretsExcluded to leave it out of the backup or the
+// failure of the run. The scan is nil for a nil *secretScanner and exports
+func (s *secretScanner) check(repo Repository, clonePath string, repoFS billy.Filesystem) (*secretScan, error) {
+	if s == nil || repo.exported() {
+		return nil, nil
+	}
+	scan, err := s.scan(repoFS)
+	if err != nil {
+		if repo.secretsPolicy() == secretsWarn {
+			log.Printf("WARNING: cannot scan %s for secrets: %v", clonePath, err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Cannot scan '%s' for secrets: %w", clonePath, err)
+	}
+	scan.Policy = repo.secretsPolicy()
+	if scan.Incomplete != "" {
+		log.Printf("WARNING: secret scan of %s is incomplete, %s", clonePath, scan.Incomplete)
+	}
+	if scan.Findings == 0 {
+		return scan, nil
+	}
+	log.Printf("WARNING: %d secrets found in %s at %s (%s)", scan.Findings, clonePath, scan.Commit, strings.Join(scan.rules(), ", "))
+	for _, finding := range scan.List {
+		log.Printf("  %s:%d %s", finding.File, finding.Line, finding.Rule)
+	}
+	switch scan.Policy {
+	case secretsExclude:
+		return scan, errSecretsExcluded
+	case secretsFail:
+		return scan, fmt.Errorf("%d secrets found in '%s', its secrets setting is fail", scan.Findings, clonePath)
+	}
+	return scan, nil
+}
+
+// scan matches the rules against the files of the tree HEAD points at, reading the
+// repository without writing to it and stopping once Budget is spent
+func (s *secretScanner) scan(repoFS billy.Filesystem) (*secretScan, error) {
+	deadline := time.Now().Add(s.Budget)
+	storage := filesystem.NewStorage(repoFS, cache.NewObjectLRU(cache.FileSize(s.CacheSize)))
+	defer storage.Close()
+	scan := &secretScan{}
+	commit, err := headCommit(storage)
+	if commit == nil || err != nil {
+		return scan, err
+	}
+	scan.Commit = commit.Hash.String()
+	tree, err := commit.Tree()
+	if err != nil {
+		return scan, err
+	}
+
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if time.Now().After(deadline) {
+			return errSecretsBudget
+		}
+		if !f.Mode.IsFile() || s.Allowlist.allowsFile(f.Name) {
+			return nil
+		}
+		if f.Size > s.MaxFile {
+			scan.SkippedLarge++
+			return nil
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		s.scanFile(f.Name, content, scan)
+		return nil
+	})
+	if errors.Is(err, errSecretsBudget) {
+		scan.Incomplete = fmt.Sprintf("stopped after the -secrets-budget of %s", s.Budget)
+		err = nil
+	}
+	sort.Slice(scan.List, func(i, j int) bool {
+		if scan.List[i].File != scan.List[j].File {
+			return scan.List[i].File < scan.List[j].File
+		}
+		return scan.List[i].Line < scan.List[j].Line
+	})
+	return scan, err
+}
+
+// scanFile adds the matches in the content of the file at name to scan, binary files are skipped
+func (s *secretScanner) scanFile(name string, content []byte, scan *secretScan) {
+	probe := content
+	if len(probe) > binaryProbe {
+		probe = probe[:binaryProbe]
+	}
+	if bytes.IndexByte(probe, 0) >= 0 {
+		return
+	}
+	for _, rule := range secretRules {
+		for _, match := range rule.Pattern.FindAllSubmatchIndex(content, -1) {
+			start, end := match[2*rule.Group], match[2*rule.Group+1]
+			if s.Allowlist.allows(rule.Name, content[start:end]) {
+				continue
+			}
+			scan.Findings++
+			if len(scan.List) < maxSecretFindings {
+				line := bytes.Count(content[:start], []byte("\n")) + 1
+				scan.List = append(scan.List, secretFinding{Rule: rule.Name, File: name, Line: line})
+			}
+		}
+	}
+}
+
+// excludes reports whether the clone failure err is a repository left out of the backup
+// for its secrets, a nil *secretScanner excludes none
+func (s *secretScanner) excludes(err error) bool {
+	return s != nil && errors.Is(err, errSecretsExcluded)
+}
+
+func (s *secretScanner) add(clonePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.excluded == nil {
+		s.excluded = make(map[string]bool)
+	}
+	s.excluded[clonePath] = true
+}
+
+// resolve records the repositories of config excluded for their secrets in manifest as
+// skipped, removes their mirror from staging and returns the configuration of the rest
+func (s *secretScanner) resolve(config *Config, manifest *Manifest, staging billy.Filesystem) (*Config, error) {
+	present := s.filter(config)
+	if present == config {
+		return config, nil
+	}
+	for _, repo := range config.Repos {
+		clonePath := path.Join(repo.Path, repo.Name)
+		if !s.excluded[clonePath] {
+			continue
+		}
+		log.Printf("WARNING: %s has secrets, it is not in the backup", sanitizeURL(repo.URL))
+		manifest.Repos = append(manifest.Repos, ManifestRepo{Name: repo.Name, Path: repo.Path, URL: sanitizeURL(repo.URL), Skipped: "secrets found"})
+		repoFS, err := staging.Chroot(clonePath)
+		if err != nil {
+			return nil, err
+		}
+		// the repositories nested below it stay
+		if err := removePartialClone(repoFS); err != nil {
+			return nil, fmt.Errorf("Cannot remove the mirror of '%s': %w", clonePath, err)
+		}
+		staging.Remove(clonePath)
+	}
+	return present, nil
+}
+
+// filter returns config without the excluded repositories, config itself when none are excluded
+func (s *secretScanner) filter(config *Config) *Config {
+	if s == nil {
+		return config
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.excluded) == 0 {
+		return config
+	}
+	present := *config
+	present.Repos = nil
+	for _, repo := range config.Repos {
+		if !s.excluded[path.Join(repo.Path, repo.Name)] {
+			present.Repos = append(present.Repos, repo)
+		}
+	}
+	return &present
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// startService does nothing, Windows services only exist on Windows
+func startService(cancel func()) func(err error) {
+	return func(error) {}
+}
@@ -0,0 +1,67 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceHandler answers the Windows service control manager, a stop or shutdown request
+// cancels the run in flight like SIGTERM and the service stops once the run exited
+type serviceHandler struct {
+	cancel func()
+	// exited is sent the outcome of the run once it exited
+	exited chan error
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	accepts := svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case err := <-h.exited:
+			status <- svc.Status{State: svc.StopPending}
+			if err != nil {
+				return false, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Println("Stop requested by the service control manager, cancelling the run")
+				status <- svc.Status{State: svc.StopPending}
+				h.cancel()
+			}
+		}
+	}
+}
+
+// startService runs the service control handler when CodePack is started as a Windows
+// service, installed with sc.exe, cancel is called on a stop request. The returned function
+// reports the outcome of the run and waits for the service to be stopped
+func startService(cancel func()) func(err error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Println("WARNING: cannot tell whether CodePack runs as a Windows service:", err)
+	}
+	if !isService {
+		return func(error) {}
+	}
+	handler := &serviceHandler{cancel: cancel, exited: make(chan error, 1)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the name is ignored for a service running in its own process
+		if err := svc.Run("codepack", handler); err != nil {
+			log.Println("WARNING: cannot run the Windows service handler:", err)
+		}
+	}()
+	return func(err error) {
+		handler.exited <- err
+		<-done
+	}
+}
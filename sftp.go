@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPOptions are the connection settings used for sftp:// output destinations
+type SFTPOptions struct {
+	KeyFile    string
+	KnownHosts string
+	Insecure   bool
+}
+
+// sftpUploader streams the archive to an sftp://user@host/path destination
+type sftpUploader struct {
+	target *url.URL
+	opts   SFTPOptions
+	// verifyFullMax is the size up to which Verify reads back the whole file
+	verifyFullMax int64
+}
+
+func newSFTPUploader(u *url.URL, opts DestinationOptions) (*sftpUploader, error) {
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return nil, fmt.Errorf("sftp destination '%s' must include a file name", u.String())
+	}
+	return &sftpUploader{target: u, opts: opts.SFTP, verifyFullMax: opts.VerifyFullMax}, nil
+}
+
+// Upload streams the archive to the destination and writes its checksum next to it to a
+// <archive>.sha256 file in the format of sha256sum. A failed upload removes both
+func (s *sftpUploader) Upload(r io.Reader) error {
+	client, err := sftpDial(s.target, s.opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sidecar := s.target.Path + ".sha256"
+	fail := func(err error) error {
+		client.Remove(s.target.Path)
+		client.Remove(sidecar)
+		return err
+	}
+	f, err := client.Create(s.target.Path)
+	if err != nil {
+		return fmt.Errorf("Cannot create remote file '%s': %w", s.target.Path, err)
+	}
+	hash := sha256.New()
+	if _, err := f.ReadFrom(io.TeeReader(r, hash)); err != nil {
+		f.Close()
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		return fail(err)
+	}
+	sum, err := client.Create(sidecar)
+	if err != nil {
+		return fail(fmt.Errorf("Cannot create remote file '%s': %w", sidecar, err))
+	}
+	_, err = fmt.Fprintf(sum, "%s  %s\n", hex.EncodeToString(hash.Sum(nil)), path.Base(s.target.Path))
+	if closeErr := sum.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fail(fmt.Errorf("Cannot write remote file '%s': %w", sidecar, err))
+	}
+	return nil
+}
+
+// Probe connects and creates and removes a file next to the destination
+func (s *sftpUploader) Probe() error {
+	client, err := sftpDial(s.target, s.opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	dir := path.Dir(s.target.Path)
+	probe := path.Join(dir, ".codepack-probe-"+runID)
+	f, err := client.Create(probe)
+	if err != nil {
+		return fmt.Errorf("Cannot write to remote directory '%s': %w", dir, err)
+	}
+	f.Close()
+	return client.Remove(probe)
+}
+
+// Verify reads the uploaded file back, sftp servers report no checksum of a file
+func (s *sftpUploader) Verify(d *streamDigest) (string, error) {
+	client, err := sftpDial(s.target, s.opts)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	f, err := client.Open(s.target.Path)
+	if err != nil {
+		return "", fmt.Errorf("Cannot open remote file '%s': %w", s.target.Path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := d.checkSize(info.Size()); err != nil {
+		return "", err
+	}
+	return d.checkRead(f, s.verifyFullMax)
+}
+
+func sftpDial(u *url.URL, opts SFTPOptions) (*sftp.Client, error) {
+	username := u.User.Username()
+	if username == "" {
+		username = os.Getenv("CODEPACK_SFTP_USER")
+	}
+	if username == "" {
+		return nil, fmt.Errorf("No sftp username, use sftp://user@host/... or CODEPACK_SFTP_USER")
+	}
+
+	authMethods, err := sftpAuthMethods(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := sftpHostKeyCallback(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to '%s': %w", addr, err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Cannot start sftp session on '%s': %w", addr, err)
+	}
+	return client, nil
+}
+
+func sftpAuthMethods(opts SFTPOptions) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if opts.KeyFile != "" {
+		key, err := os.ReadFile(opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read sftp key file: %w", err)
+		}
+		var signer ssh.Signer
+		if passphrase := os.Getenv("CODEPACK_SFTP_KEY_PASS"); passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse sftp key file '%s': %w", opts.KeyFile, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if pass := os.Getenv("CODEPACK_SFTP_PASS"); pass != "" {
+		methods = append(methods, ssh.Password(pass))
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("No sftp credentials, use -sftp-key or CODEPACK_SFTP_PASS")
+	}
+	return methods, nil
+}
+
+func sftpHostKeyCallback(opts SFTPOptions) (ssh.HostKeyCallback, error) {
+	if opts.Insecure {
+		log.Println("WARNING: sftp host key verification is disabled")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	knownHostsFile := opts.KnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot locate known_hosts file: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load known_hosts file '%s': %w", knownHostsFile, err)
+	}
+	return callback, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newFakeSFTP serves sftp on the local filesystem to the user codepack with the password
+// secret and returns its address and a known_hosts file holding its host key
+func newFakeSFTP(t *testing.T) (string, string) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "codepack" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSFTP(conn, config)
+		}
+	}()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, signer.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return listener.Addr().String(), knownHosts
+}
+
+func serveFakeSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+func TestSFTPUploadWritesChecksum(t *testing.T) {
+	addr, knownHosts := newFakeSFTP(t)
+	t.Setenv("CODEPACK_SFTP_PASS", "secret")
+	dir := t.TempDir()
+	target, err := url.Parse("sftp://codepack@" + addr + filepath.ToSlash(filepath.Join(dir, "backup.tar.gz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader, err := newSFTPUploader(target, DestinationOptions{SFTP: SFTPOptions{KnownHosts: knownHosts}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := bytes.Repeat([]byte("codepack archive\n"), 4096)
+	if err := uploader.Upload(bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := os.ReadFile(filepath.Join(dir, "backup.tar.gz"))
+	if err != nil || !bytes.Equal(uploaded, archive) {
+		t.Fatalf("the archive was not uploaded: %v", err)
+	}
+	sum := sha256.Sum256(archive)
+	sidecar, err := os.ReadFile(filepath.Join(dir, "backup.tar.gz.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := hex.EncodeToString(sum[:]) + "  backup.tar.gz\n"; string(sidecar) != expected {
+		t.Errorf("the checksum file holds %q, expected %q", sidecar, expected)
+	}
+
+	// a failed upload leaves neither the archive nor a stale checksum behind
+	failing := &failingReader{data: bytes.NewReader(archive), err: errors.New("clone failed")}
+	if err := uploader.Upload(failing); err == nil {
+		t.Fatal("the failing upload succeeded")
+	}
+	for _, name := range []string{"backup.tar.gz", "backup.tar.gz.sha256"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind by the failed upload", name)
+		}
+	}
+}
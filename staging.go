@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+)
+
+var errRepoSizeLimit = errors.New("repository exceeds the -secure-staging-max size limit")
+
+// errIncompleteMirror is the reason a repository at a clone path is not fetched in to when
+// it lacks HEAD, objects or refs
+var errIncompleteMirror = errors.New("HEAD, objects or refs are missing")
+
+// exitCodeStagingConflict is the exit status of a run failing repositories whose clone path
+// already held a repository it could neither fetch in to nor replace, so a dirty staging or
+// cache directory is told apart from failing clones
+const exitCodeStagingConflict = 6
+
+// stagingConflictError is a clone refused because its clone path already holds a repository,
+// err is why it cannot be fetched in to. It is a git.ErrRepositoryAlreadyExists
+type stagingConflictError struct {
+	path string
+	err  error
+}
+
+func (e *stagingConflictError) Error() string {
+	return fmt.Sprintf("'%s' already holds a repository (%v), remove it or run with -force-reclone to clone it again", e.path, e.err)
+}
+
+func (e *stagingConflictError) Unwrap() error {
+	return e.err
+}
+
+func (e *stagingConflictError) Is(target error) bool {
+	return target == git.ErrRepositoryAlreadyExists
+}
+
+// holdsRepository reports whether fs holds any of the git entries of a repository, complete
+// or not. The directories of repositories nested below it do not count
+func holdsRepository(fs billy.Filesystem) bool {
+	for _, name := range []string{"HEAD", "objects", "refs", "packed-refs"} {
+		if _, err := fs.Lstat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// stagingSuffix ends the name of the directory a repository is cloned in to, next to its
+// clone path, what the clone wrote only moves to the clone path once it succeeded, so the
+// staging directory never holds a partial repository to archive. The name is the one of
+// the clone path between a dot and a random number, like .app.123456.tmp for app
+const stagingSuffix = ".tmp"
+
+// createCloneDirs creates the directory of every repository before the clones start, so
+// concurrent clones of nested paths like team/a and team/a/b never race creating their parents
+func createCloneDirs(staging billy.Filesystem, config *Config) error {
+	for _, repo := range config.Repos {
+		if err := staging.MkdirAll(path.Join(repo.Path, repo.Name), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneStaged runs clone in to a staging directory next to clonePath, with writes limited to
+// limit bytes, and moves what it wrote to clonePath once it succeeded. A failed clone is
+// removed along with the directory of clonePath, unless repositories nested below it keep it
+func cloneStaged(staging billy.Filesystem, clonePath string, limit int64, clone func(fs billy.Filesystem) error) error {
+	if err := removeStagedClones(staging, clonePath); err != nil {
+		return err
+	}
+	tmp, err := stagingDir(staging, clonePath)
+	if err != nil {
+		return err
+	}
+	tmpFS, err := staging.Chroot(tmp)
+	if err != nil {
+		return err
+	}
+	if err := clone(newSizeLimitFS(tmpFS, limit)); err != nil {
+		if rmErr := removeAll(staging, tmp); rmErr != nil {
+			log.Printf("WARNING: cannot remove the failed clone at '%s': %v", tmp, rmErr)
+		}
+		// fails when not empty, like for a repository nested below it
+		staging.Remove(clonePath)
+		return err
+	}
+	return moveInto(staging, tmp, clonePath)
+}
+
+// stagingDir creates the directory clonePath is cloned in to, in the directory of clonePath
+// with a name no other entry has
+func stagingDir(staging billy.Filesystem, clonePath string) (string, error) {
+	dir, name := path.Split(clonePath)
+	pattern := "." + name + ".*" + stagingSuffix
+	if m, ok := staging.(*modeFS); ok {
+		return m.mkdirTemp(dir, pattern)
+	}
+	return mkdirTemp(staging, dir, pattern)
+}
+
+// mkdirTemp creates a directory in dir of fs, its name is pattern with the * replaced by the
+// first number from 1 no entry has
+func mkdirTemp(fs billy.Filesystem, dir, pattern string) (string, error) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	for i := 1; ; i++ {
+		name := path.Join(dir, prefix+strconv.Itoa(i)+suffix)
+		if _, err := fs.Lstat(name); os.IsNotExist(err) {
+			return name, fs.MkdirAll(name, 0755)
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// removeStagedClones removes the staging directories of clonePath an interrupted run left
+func removeStagedClones(staging billy.Filesystem, clonePath string) error {
+	dir := path.Dir(clonePath)
+	entries, err := staging.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if !entry.IsDir() || !stagedClone(name, map[string]bool{clonePath: true}) {
+			continue
+		}
+		if err := removeAll(staging, name); err != nil {
+			return fmt.Errorf("Cannot remove partial clone at '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// moveInto moves dir to target and removes dir. An empty target is replaced with a single
+// rename of dir, otherwise every file below dir is renamed to the same path below target
+// and directories are merged with those target already holds, like the directories of
+// repositories nested below it. memfs cannot rename directories, only their files
+func moveInto(fs billy.Filesystem, dir string, target string) error {
+	if m, ok := fs.(*modeFS); !ok || m.root != "" {
+		// fails when not empty, like for a repository nested below it
+		if err := fs.Remove(target); err == nil || os.IsNotExist(err) {
+			if err := fs.Rename(dir, target); err != nil {
+				return fmt.Errorf("Cannot move '%s' to '%s': %w", dir, target, err)
+			}
+			return nil
+		}
+	}
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from, to := path.Join(dir, entry.Name()), path.Join(target, entry.Name())
+		if entry.IsDir() {
+			if err := moveInto(fs, from, to); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fs.Rename(from, to); err != nil {
+			return fmt.Errorf("Cannot move '%s' to '%s': %w", from, to, err)
+		}
+	}
+	return fs.Remove(dir)
+}
+
+// stagedClone reports whether name is a staging directory of one of repoPaths
+func stagedClone(name string, repoPaths map[string]bool) bool {
+	dir, base := path.Split(name)
+	base, ok := strings.CutSuffix(base, stagingSuffix)
+	if !ok || !strings.HasPrefix(base, ".") {
+		return false
+	}
+	i := strings.LastIndex(base, ".")
+	if i <= 0 {
+		return false
+	}
+	if _, err := strconv.ParseUint(base[i+1:], 10, 64); err != nil {
+		return false
+	}
+	return repoPaths[path.Join(dir, base[1:i])]
+}
+
+// sizeLimitFS fails file writes once the total bytes written through it pass limit,
+// used to keep a single in-memory clone from exhausting the process memory
+type sizeLimitFS struct {
+	billy.Filesystem
+	limit   int64
+	written *atomic.Int64
+}
+
+// newSizeLimitFS wraps fs with a write limit, a limit of zero or less disables it
+func newSizeLimitFS(fs billy.Filesystem, limit int64) billy.Filesystem {
+	if limit <= 0 {
+		return fs
+	}
+	return &sizeLimitFS{Filesystem: fs, limit: limit, written: new(atomic.Int64)}
+}
+
+// resetSizeLimit forgets the bytes written through fs, used when a failed clone is removed before retrying
+func resetSizeLimit(fs billy.Filesystem) {
+	if s, ok := fs.(*sizeLimitFS); ok {
+		s.written.Store(0)
+	}
+}
+
+func (s *sizeLimitFS) Create(filename string) (billy.File, error) {
+	return s.wrap(s.Filesystem.Create(filename))
+}
+
+func (s *sizeLimitFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	return s.wrap(s.Filesystem.OpenFile(filename, flag, perm))
+}
+
+func (s *sizeLimitFS) TempFile(dir, prefix string) (billy.File, error) {
+	return s.wrap(s.Filesystem.TempFile(dir, prefix))
+}
+
+func (s *sizeLimitFS) Chroot(path string) (billy.Filesystem, error) {
+	fs, err := s.Filesystem.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sizeLimitFS{Filesystem: fs, limit: s.limit, written: s.written}, nil
+}
+
+func (s *sizeLimitFS) wrap(f billy.File, err error) (billy.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &sizeLimitFile{File: f, fs: s}, nil
+}
+
+type sizeLimitFile struct {
+	billy.File
+	fs *sizeLimitFS
+}
+
+func (f *sizeLimitFile) Write(p []byte) (int, error) {
+	if f.fs.written.Add(int64(len(p))) > f.fs.limit {
+		return 0, errRepoSizeLimit
+	}
+	return f.File.Write(p)
+}
+
+// runFile is a file the run writes outside of the archive and the flag naming it
+type runFile struct {
+	flag string
+	path string
+	// opened is set for a file the run created before the staging directory was known,
+	// like the log, which is removed when it is inside so a resumed run does not archive it
+	opened bool
+}
+
+// checkOutsideStaging fails with a configuration error when a file of files resolves to a
+// path inside the staging directory dir, where it would be archived with the repositories
+// and removed with the directory at the end of the run
+func checkOutsideStaging(dir string, files []runFile) error {
+	root, err := resolvePath(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		if !insideRoots(resolveFilePath(file.path), []string{root}) {
+			continue
+		}
+		if file.opened {
+			os.Remove(file.path)
+		}
+		return configError(fmt.Errorf("-%s '%s' is inside the staging directory '%s', it would be archived and then removed with it, write it somewhere else", file.flag, file.path, dir))
+	}
+	return nil
+}
+
+// resolveFilePath is the absolute path of a file the run writes with the symlinks of its
+// directory resolved, so a relative path or a link like /tmp to /private/tmp is compared by
+// where it is written, for a file that does not exist yet
+func resolveFilePath(name string) string {
+	if resolved, err := resolvePath(name); err == nil {
+		return resolved
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return name
+	}
+	if dir, err := resolvePath(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs))
+	}
+	return abs
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestStagedClone(t *testing.T) {
+	repoPaths := map[string]bool{"team/app": true, "app": true}
+	for name, staged := range map[string]bool{
+		"team/.app.123456.tmp": true,
+		".app.1.tmp":           true,
+		"team/app.tmp":         false,
+		"team/.app.tmp":        false,
+		"team/.app.x1.tmp":     false,
+		"team/.other.1.tmp":    false,
+		"other/.app.1.tmp":     false,
+	} {
+		if got := stagedClone(name, repoPaths); got != staged {
+			t.Errorf("stagedClone(%q) = %v, expected %v", name, got, staged)
+		}
+	}
+}
+
+func TestCloneStaged(t *testing.T) {
+	for name, newStaging := range map[string]func(t *testing.T) billy.Filesystem{
+		"disk": func(t *testing.T) billy.Filesystem {
+			dir := t.TempDir()
+			return newModeFS(osfs.New(dir), dir)
+		},
+		"memory": func(t *testing.T) billy.Filesystem { return newModeFS(memfs.New(), "") },
+	} {
+		staging := newStaging(t)
+		for file, content := range map[string]string{
+			"team/app.tmp/HEAD":          "ref: refs/heads/main\n",
+			"team/.app.42.tmp/HEAD":      "partial\n",
+			"team/app/nested/HEAD":       "ref: refs/heads/main\n",
+			"team/app/nested/refs/heads": "",
+		} {
+			if err := util.WriteFile(staging, file, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := cloneStaged(staging, "team/app", 0, func(fs billy.Filesystem) error {
+			return util.WriteFile(fs, "objects/pack/pack-1.pack", []byte("pack"), 0644)
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, file := range []string{"team/app/objects/pack/pack-1.pack", "team/app/nested/HEAD", "team/app.tmp/HEAD"} {
+			if _, err := staging.Lstat(file); err != nil {
+				t.Errorf("%s: %s is missing: %v", name, file, err)
+			}
+		}
+		entries, err := staging.ReadDir("team")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if stagedClone(path.Join("team", entry.Name()), map[string]bool{"team/app": true}) {
+				t.Errorf("%s: the staging directory %s was left", name, entry.Name())
+			}
+		}
+
+		if err := cloneStaged(staging, "solo", 0, func(fs billy.Filesystem) error {
+			return util.WriteFile(fs, "HEAD", []byte("ref: refs/heads/main\n"), 0644)
+		}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if info, err := staging.Lstat("solo"); err != nil || !info.IsDir() || info.Mode().Perm() != 0755 {
+			t.Errorf("%s: the clone path is not a directory of mode 0755: %v %v", name, info, err)
+		}
+
+		failed := errors.New("clone failed")
+		err = cloneStaged(staging, "team/other", 0, func(fs billy.Filesystem) error {
+			util.WriteFile(fs, "HEAD", []byte("partial\n"), 0644)
+			return failed
+		})
+		if !errors.Is(err, failed) {
+			t.Errorf("%s: a failed clone returned %v", name, err)
+		}
+		if _, err := staging.Lstat("team/other"); !os.IsNotExist(err) {
+			t.Errorf("%s: a failed clone left its clone path: %v", name, err)
+		}
+		if entries, _ := staging.ReadDir("team"); len(entries) != 2 {
+			t.Errorf("%s: a failed clone left %d entries in team, expected app and app.tmp", name, len(entries))
+		}
+	}
+}
+
+func TestHoldsRepository(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files []string
+		holds bool
+	}{
+		{name: "empty"},
+		{name: "nested repository", files: []string{"nested/HEAD", "nested/refs/heads/main"}},
+		{name: "description only", files: []string{"description"}},
+		{name: "HEAD", files: []string{"HEAD"}, holds: true},
+		{name: "packed-refs", files: []string{"packed-refs"}, holds: true},
+		{name: "objects", files: []string{"objects/pack/pack-1.pack"}, holds: true},
+	} {
+		fs := memfs.New()
+		for _, file := range tc.files {
+			if err := util.WriteFile(fs, file, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if holds := holdsRepository(fs); holds != tc.holds {
+			t.Errorf("%s: holds a repository %v, expected %v", tc.name, holds, tc.holds)
+		}
+	}
+
+	err := error(&stagingConflictError{path: "/srv/cache/team/app", err: errIncompleteMirror})
+	if !errors.Is(err, git.ErrRepositoryAlreadyExists) || !errors.Is(err, errIncompleteMirror) {
+		t.Errorf("%v is not a git.ErrRepositoryAlreadyExists wrapping its reason", err)
+	}
+	if expected := "'/srv/cache/team/app' already holds a repository (HEAD, objects or refs are missing), remove it or run with -force-reclone to clone it again"; err.Error() != expected {
+		t.Errorf("message %q, expected %q", err, expected)
+	}
+}
+
+func TestResumeOrCloneExisting(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	repo := newTestRepo(t, src, [2]string{"README.md", "one\n"})
+	// the mirror is cloned before the second commit, fetching in to it picks that up
+	mirror := t.TempDir()
+	if _, err := git.PlainClone(mirror, true, &git.CloneOptions{URL: src, Mirror: true}); err != nil {
+		t.Fatal(err)
+	}
+	head := commitTestFile(t, repo, "README.md", []byte("two\n"))
+
+	complete := func(t *testing.T, fs billy.Filesystem) {
+		err := filepath.WalkDir(mirror, func(name string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(mirror, name)
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			return util.WriteFile(fs, filepath.ToSlash(rel), data, 0644)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	incomplete := func(t *testing.T, fs billy.Filesystem) {
+		if err := util.WriteFile(fs, "HEAD", []byte("ref: refs/heads/main\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resumed := &runState{resumed: true, done: map[string]bool{}}
+	for _, tc := range []struct {
+		name     string
+		existing func(t *testing.T, fs billy.Filesystem)
+		opts     CloneOptions
+		fetched  bool
+		err      error
+	}{
+		{name: "no repository", opts: CloneOptions{}},
+		{name: "complete without cache or resume", existing: complete, err: git.ErrRepositoryAlreadyExists},
+		{name: "cache fetches", existing: complete, opts: CloneOptions{Cache: &mirrorCache{}}, fetched: true},
+		{name: "resume fetches", existing: complete, opts: CloneOptions{State: resumed}, fetched: true},
+		{name: "cache incomplete", existing: incomplete, opts: CloneOptions{Cache: &mirrorCache{}}, err: errIncompleteMirror},
+		{name: "resume incomplete", existing: incomplete, opts: CloneOptions{State: resumed}},
+		{name: "force-reclone", existing: complete, opts: CloneOptions{ForceReclone: true}},
+		{name: "force-reclone incomplete", existing: incomplete, opts: CloneOptions{Cache: &mirrorCache{}, ForceReclone: true}},
+	} {
+		dir := t.TempDir()
+		staging := newModeFS(osfs.New(dir), dir)
+		if err := staging.MkdirAll("team", 0755); err != nil {
+			t.Fatal(err)
+		}
+		fs, err := staging.Chroot("team/app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.existing != nil {
+			tc.existing(t, fs)
+		}
+		tc.opts.StagingDir = dir
+		err = resumeOrClone(context.Background(), staging, Repository{URL: src}, "team/app", fs, 0, tc.opts, nil)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) || !errors.Is(err, git.ErrRepositoryAlreadyExists) || !strings.Contains(err.Error(), filepath.ToSlash(filepath.Join(dir, "team/app"))) {
+				t.Errorf("%s: error %v, expected a conflict at the clone path for %v", tc.name, err, tc.err)
+			}
+			if _, statErr := os.Stat(filepath.Join(dir, "team", "app", "HEAD")); statErr != nil {
+				t.Errorf("%s: the conflicting repository was removed: %v", tc.name, statErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		cloned, err := git.PlainOpen(filepath.Join(dir, "team", "app"))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		ref, err := cloned.Reference(plumbing.NewBranchReferenceName("main"), true)
+		if err != nil || ref.Hash() != head {
+			t.Errorf("%s: main is at %v (%v), expected %s", tc.name, ref, err, head)
+		}
+		// a fetch keeps the objects of the earlier clone in their own pack
+		if packs, _ := os.ReadDir(filepath.Join(dir, "team", "app", "objects", "pack")); tc.fetched != (len(packs) > 2) {
+			t.Errorf("%s: %d pack files, fetched %v", tc.name, len(packs), tc.fetched)
+		}
+	}
+}
+
+func TestStagingConflictRun(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	config := "repos:\n  - name: app\n    path: team\n    url: " + filepath.Join(dir, "src") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a repository left in the cache without its objects and refs
+	if err := os.MkdirAll(filepath.Join(dir, "cache", "team", "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cache", "team", "app", "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-config", "codepack.yaml", "-cache-dir", "cache", "-out", "backup.tar.gz", "-no-catalog"}
+	out, code := runCodePack(t, dir, nil, args...)
+	if code != exitCodeStagingConflict {
+		t.Fatalf("exited with %d, expected %d:\n%s", code, exitCodeStagingConflict, out)
+	}
+	for _, expected := range []string{
+		filepath.ToSlash(filepath.Join(dir, "cache", "team", "app")) + "' already holds a repository (HEAD, objects or refs are missing)",
+		"run with -force-reclone",
+		"1 at clone paths already holding a repository",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("%q is missing from:\n%s", expected, out)
+		}
+	}
+
+	out, code = runCodePack(t, dir, nil, append(args, "-force-reclone")...)
+	if code != 0 {
+		t.Fatalf("-force-reclone exited with %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "Removing the repository at path team/app") {
+		t.Errorf("-force-reclone did not log the removal:\n%s", out)
+	}
+
+	out, code = runCodePack(t, dir, nil, args...)
+	if code != 0 || !strings.Contains(out, "Fetching "+filepath.Join(dir, "src")+" in to the mirror already at path team/app") {
+		t.Errorf("the complete mirror was not fetched in to, exited with %d:\n%s", code, out)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// repoStatus is the outcome of a repository in a run, recorded in the JSON report, the
+// manifest and the inventory. -fail-on names the statuses that fail the run
+type repoStatus string
+
+const (
+	// statusCloned is a repository cloned by the run the parent manifest does not hold
+	statusCloned repoStatus = "cloned"
+	// statusUpdated is a repository of the parent manifest that changed and was cloned again
+	statusUpdated repoStatus = "updated"
+	// statusUnchanged is a repository carried from an earlier archive of the chain
+	statusUnchanged repoStatus = "unchanged"
+	// statusSkipped is a disabled repository or one excluded for its secrets
+	statusSkipped repoStatus = "skipped"
+	// statusEmpty is a repository whose remote has no references
+	statusEmpty  repoStatus = "empty"
+	statusFailed repoStatus = "failed"
+	// statusMissing is a repository the remote reported as not found, archived or not
+	// from its last known copy
+	statusMissing repoStatus = "missing"
+)
+
+// repoStatuses are the statuses in the order the summary counts them
+var repoStatuses = []repoStatus{statusCloned, statusUpdated, statusUnchanged, statusSkipped, statusEmpty, statusFailed, statusMissing}
+
+func (s repoStatus) known() bool {
+	for _, status := range repoStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// exitCodeFailOn is the exit status of a run that wrote its backup with a repository of
+// a -fail-on status like unchanged, which only fails once everything else succeeded
+const exitCodeFailOn = 4
+
+// cloneErrorStatus is the status of a repository whose clone failed with err
+func cloneErrorStatus(err error) repoStatus {
+	switch {
+	case errors.Is(err, transport.ErrEmptyRemoteRepository):
+		return statusEmpty
+	case classifyCloneError(err) == categoryNotFound:
+		return statusMissing
+	}
+	return statusFailed
+}
+
+// failOnPolicy are the statuses of -fail-on that fail the run
+type failOnPolicy map[repoStatus]bool
+
+// defaultFailOn is the policy without -fail-on, -fail-on-missing=false leaves out missing
+func defaultFailOn(failOnMissing bool) failOnPolicy {
+	policy := failOnPolicy{statusFailed: true, statusEmpty: true}
+	if failOnMissing {
+		policy[statusMissing] = true
+	}
+	return policy
+}
+
+// parseFailOn parses the comma separated statuses of -fail-on, which must include failed
+// as a failed clone leaves nothing to archive
+func parseFailOn(value string) (failOnPolicy, error) {
+	policy := make(failOnPolicy)
+	for _, field := range strings.Split(value, ",") {
+		status := repoStatus(strings.TrimSpace(field))
+		if status == "" {
+			continue
+		}
+		if !status.known() {
+			return nil, fmt.Errorf("Invalid -fail-on status '%s', use %s", status, statusNames(repoStatuses))
+		}
+		policy[status] = true
+	}
+	if !policy[statusFailed] {
+		return nil, fmt.Errorf("-fail-on must include failed, a failed clone leaves nothing to archive")
+	}
+	return policy, nil
+}
+
+// tolerates reports whether a clone failing with err leaves the repository out of the
+// backup instead of failing the run
+func (p failOnPolicy) tolerates(err error) bool {
+	status := cloneErrorStatus(err)
+	return status != statusFailed && !p[status]
+}
+
+func statusNames(statuses []repoStatus) string {
+	names := make([]string, len(statuses))
+	for i, status := range statuses {
+		names[i] = string(status)
+	}
+	return strings.Join(names, ",")
+}
+
+// check returns the error a run fails with once its backup is written, when report has
+// repositories of a status of the policy. Failed, empty and missing repositories of the
+// policy already failed the clone
+func (p failOnPolicy) check(report *runReport) error {
+	counts := report.statusCounts()
+	var found []string
+	for _, status := range repoStatuses {
+		if p[status] && counts[status] > 0 {
+			found = append(found, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	if p[failOnIncomplete] {
+		if n := report.incompleteCount(); n > 0 {
+			found = append(found, fmt.Sprintf("%d with an incomplete history", n))
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return &exitCodeError{
+		err:  fmt.Errorf("Repositories of a -fail-on status: %s", strings.Join(found, ", ")),
+		code: exitCodeFailOn,
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+func TestCloneErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		expected repoStatus
+	}{
+		{"empty remote", fmt.Errorf("clone: %w", transport.ErrEmptyRemoteRepository), statusEmpty},
+		{"not found", transport.ErrRepositoryNotFound, statusMissing},
+		{"auth", transport.ErrAuthenticationRequired, statusFailed},
+		{"other", errors.New("something else"), statusFailed},
+	} {
+		if status := cloneErrorStatus(tc.err); status != tc.expected {
+			t.Errorf("%s: status %q, expected %q", tc.name, status, tc.expected)
+		}
+	}
+}
+
+func TestParseFailOn(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected failOnPolicy
+		err      bool
+	}{
+		{value: "failed", expected: failOnPolicy{statusFailed: true}},
+		{value: "missing, failed", expected: failOnPolicy{statusFailed: true, statusMissing: true}},
+		{value: "failed,,unchanged", expected: failOnPolicy{statusFailed: true, statusUnchanged: true}},
+		{value: "missing", err: true},
+		{value: "", err: true},
+		{value: "failed,broken", err: true},
+		{value: "failed,incomplete", err: true},
+	} {
+		policy, err := parseFailOn(tc.value)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v, expected one %v", tc.value, err, tc.err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(policy, tc.expected) {
+			t.Errorf("%q: policy %v, expected %v", tc.value, policy, tc.expected)
+		}
+	}
+}
+
+func TestFailOnTolerates(t *testing.T) {
+	empty := transport.ErrEmptyRemoteRepository
+	notFound := transport.ErrRepositoryNotFound
+	failed := errors.New("something else")
+	for _, tc := range []struct {
+		name     string
+		policy   failOnPolicy
+		err      error
+		expected bool
+	}{
+		{"default missing", defaultFailOn(true), notFound, false},
+		{"default empty", defaultFailOn(true), empty, false},
+		{"without -fail-on-missing", defaultFailOn(false), notFound, true},
+		{"without -fail-on-missing empty", defaultFailOn(false), empty, false},
+		{"failed", failOnPolicy{statusFailed: true}, failed, false},
+		{"only failed, missing", failOnPolicy{statusFailed: true}, notFound, true},
+		{"only failed, empty", failOnPolicy{statusFailed: true}, empty, true},
+	} {
+		if tolerates := tc.policy.tolerates(tc.err); tolerates != tc.expected {
+			t.Errorf("%s: tolerates %v, expected %v", tc.name, tolerates, tc.expected)
+		}
+	}
+}
+
+func TestRunReportStatuses(t *testing.T) {
+	report := newRunReport(nil, runKindFull, 7)
+	report.RecordParent(&Manifest{Repos: []ManifestRepo{
+		{Name: "updated", Path: "team"},
+		{Name: "unchanged", Path: "team"},
+	}})
+	repo := Repository{URL: "https://example.com/team/repo.git"}
+	report.Record(repo, "team/cloned", nil)
+	report.Record(repo, "team/updated", nil)
+	report.Record(repo, "team/failed", errors.New("something else"))
+	report.RecordMissing(repo, "team/empty", transport.ErrEmptyRemoteRepository)
+	report.RecordMissing(repo, "team/missing", transport.ErrRepositoryNotFound)
+	report.RecordManifest(&Manifest{Archive: "backup.tar.gz", Repos: []ManifestRepo{
+		{Name: "cloned", Path: "team", Archive: "backup.tar.gz"},
+		{Name: "updated", Path: "team", Archive: "backup.tar.gz"},
+		{Name: "unchanged", Path: "team", Archive: "parent.tar.gz"},
+		{Name: "disabled", Path: "team", Skipped: "disabled"},
+	}})
+
+	expected := map[string]repoStatus{
+		"team/cloned":    statusCloned,
+		"team/updated":   statusUpdated,
+		"team/unchanged": statusUnchanged,
+		"team/disabled":  statusSkipped,
+		"team/failed":    statusFailed,
+		"team/empty":     statusEmpty,
+		"team/missing":   statusMissing,
+	}
+	for _, entry := range report.Repos {
+		if entry.Status != expected[entry.Path] {
+			t.Errorf("%s: status %q, expected %q", entry.Path, entry.Status, expected[entry.Path])
+		}
+		delete(expected, entry.Path)
+	}
+	if len(expected) != 0 {
+		t.Errorf("no entries for %v", expected)
+	}
+	counts := report.statusCounts()
+	for _, status := range repoStatuses {
+		if counts[status] != 1 {
+			t.Errorf("%d %s repositories counted, expected 1", counts[status], status)
+		}
+	}
+}
+
+func TestFailOnCheck(t *testing.T) {
+	report := newRunReport(nil, runKindFull, 3)
+	report.RecordParent(&Manifest{Repos: []ManifestRepo{{Name: "unchanged", Path: "team"}}})
+	report.Record(Repository{}, "team/cloned", nil)
+	report.RecordManifest(&Manifest{Archive: "backup.tar.gz", Repos: []ManifestRepo{
+		{Name: "cloned", Path: "team", Archive: "backup.tar.gz"},
+		{Name: "unchanged", Path: "team", Archive: "parent.tar.gz"},
+		{Name: "disabled", Path: "team", Skipped: "disabled"},
+	}})
+	for _, tc := range []struct {
+		name   string
+		policy failOnPolicy
+		err    string
+	}{
+		{name: "default", policy: defaultFailOn(true)},
+		{name: "unchanged", policy: failOnPolicy{statusFailed: true, statusUnchanged: true}, err: "Repositories of a -fail-on status: 1 unchanged"},
+		{name: "skipped and cloned", policy: failOnPolicy{statusFailed: true, statusSkipped: true, statusCloned: true}, err: "Repositories of a -fail-on status: 1 cloned, 1 skipped"},
+		{name: "incomplete", policy: failOnPolicy{statusFailed: true, failOnIncomplete: true}},
+	} {
+		err := tc.policy.check(report)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		var exitErr *exitCodeError
+		if !errors.As(err, &exitErr) || exitErr.code != exitCodeFailOn || err.Error() != tc.err {
+			t.Errorf("%s: error %v, expected %q with the exit status %d", tc.name, err, tc.err, exitCodeFailOn)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// statusPage is the server of -listen, nil unless it is given
+var statusPage *statusServer
+
+// statusServer serves the state of the process over HTTP for -listen: /healthz for load
+// balancer checks, /status as JSON, /metrics in the Prometheus text format and, with a
+// token, POST /run starting a manual backup of -watch. Nothing it serves holds a repository
+// URL, errors have their credentials removed
+type statusServer struct {
+	mu      sync.Mutex
+	started time.Time
+	phase   string
+	// report is the run in progress in this process, nil for -watch between deltas
+	report *runReport
+	last   *runSummary
+	// lastSuccess is the end of the last successful run, zero before one
+	lastSuccess time.Time
+	// metrics are the -metrics-file of the last delta of -watch
+	metrics []byte
+	// healthyWithin is the time a successful run is expected within, 0 does not check it
+	healthyWithin time.Duration
+	// token is the bearer token of POST /run, which is not served without it
+	token string
+	// trigger starts a manual backup, nil unless -watch runs
+	trigger func(source string) (string, bool, error)
+	server  *http.Server
+}
+
+// runSummary is the outcome of the last run of the process or delta of -watch
+type runSummary struct {
+	RunID    string `json:"run_id,omitempty"`
+	Kind     string `json:"kind"`
+	Status   string `json:"status"`
+	Started  string `json:"started"`
+	Finished string `json:"finished"`
+	Archive  string `json:"archive,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Repos    int    `json:"repos"`
+	Failed   int    `json:"failed"`
+	Error    string `json:"error,omitempty"`
+}
+
+// runProgress are the counters of the run in progress
+type runProgress struct {
+	RunID    string `json:"run_id"`
+	Started  string `json:"started"`
+	Total    int    `json:"total"`
+	Cloned   int    `json:"cloned"`
+	Failed   int    `json:"failed"`
+	Missing  int    `json:"missing"`
+	Excluded int    `json:"excluded"`
+}
+
+// startStatusServer listens on addr and serves the status of the process until the
+// returned function shuts it down
+func startStatusServer(addr string, healthyWithin time.Duration, token string) (*statusServer, func(error), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot listen on '%s': %w", addr, err)
+	}
+	s := &statusServer{started: time.Now(), phase: "starting", healthyWithin: healthyWithin, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.serveHealth)
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/run", s.serveRun)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Println("WARNING: the -listen server stopped:", err)
+		}
+	}()
+	log.Printf("Serving the status on http://%s", listener.Addr())
+	stop := func(error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.server.Shutdown(ctx); err != nil {
+			log.Println("WARNING: cannot shut down the -listen server:", err)
+		}
+	}
+	return s, stop, nil
+}
+
+// SetPhase records what the process is doing, a nil *statusServer records nothing
+func (s *statusServer) SetPhase(phase string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phase
+}
+
+// SetReport records the report of the run starting in this process
+func (s *statusServer) SetReport(r *runReport) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report = r
+}
+
+// SetTrigger sets the function POST /run starts a manual backup with
+func (s *statusServer) SetTrigger(trigger func(source string) (string, bool, error)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trigger = trigger
+}
+
+// RecordRun records the outcome of a run, with the metrics it wrote for a delta of -watch
+func (s *statusServer) RecordRun(summary runSummary, metrics []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary.Error = sanitizeText(summary.Error)
+	s.last = &summary
+	if summary.Status == "SUCCESS" {
+		s.lastSuccess = time.Now()
+	}
+	if metrics != nil {
+		s.metrics = metrics
+	}
+}
+
+// healthy is false when the last run failed or no run succeeded within healthyWithin of
+// now, counted from the start of the process before the first run
+func (s *statusServer) healthy(now time.Time) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil && s.last.Status != "SUCCESS" {
+		return false, "the last run failed"
+	}
+	since := s.started
+	if !s.lastSuccess.IsZero() {
+		since = s.lastSuccess
+	}
+	if s.healthyWithin > 0 && now.Sub(since) > s.healthyWithin {
+		return false, fmt.Sprintf("no successful run since %s", since.UTC().Format(time.RFC3339))
+	}
+	return true, "ok"
+}
+
+func (s *statusServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	ok, reason := s.healthy(time.Now())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, reason)
+}
+
+func (s *statusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	ok, _ := s.healthy(time.Now())
+	s.mu.Lock()
+	status := struct {
+		Version string       `json:"codepack_version"`
+		Started string       `json:"started"`
+		Phase   string       `json:"phase"`
+		Healthy bool         `json:"healthy"`
+		Run     *runProgress `json:"run,omitempty"`
+		LastRun *runSummary  `json:"last_run,omitempty"`
+	}{VERSION, s.started.UTC().Format(time.RFC3339), s.phase, ok, s.report.progress(), s.last}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
+
+// serveMetrics serves the metrics of -metrics-file, of the run in progress or the last
+// delta of -watch
+func (s *statusServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	report, metrics := s.report, s.metrics
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if report != nil {
+		w.Write([]byte(report.hostMetrics()))
+		return
+	}
+	w.Write(metrics)
+}
+
+// serveRun starts a manual backup for a POST with the bearer token, answering its run ID or
+// 409 Conflict while another backup is running
+func (s *statusServer) serveRun(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	trigger := s.trigger
+	s.mu.Unlock()
+	if trigger == nil || s.token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to start a run", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	var reply struct {
+		RunID  string `json:"run_id,omitempty"`
+		Queued bool   `json:"queued,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}
+	code := http.StatusAccepted
+	id, queued, err := trigger("POST /run from " + r.RemoteAddr)
+	reply.RunID, reply.Queued = id, queued
+	if err != nil {
+		reply.Error = err.Error()
+		code = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// progress copies the counters of the report, nil for a nil *runReport
+func (r *runReport) progress() *runProgress {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &runProgress{RunID: r.RunID, Started: r.Started, Total: r.Total, Cloned: r.Cloned, Failed: r.Failed, Missing: r.Missing, Excluded: r.Excluded}
+}
+
+// childSummary is the summary of a run of -watch of kind started at started that wrote its
+// manifest to manifestPath, unless it failed with err
+func childSummary(kind string, id string, started time.Time, manifestPath string, err error) runSummary {
+	summary := runSummary{
+		RunID:    id,
+		Kind:     kind,
+		Status:   "SUCCESS",
+		Started:  started.UTC().Format(time.RFC3339),
+		Finished: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		summary.Status, summary.Error = "FAILURE", err.Error()
+		return summary
+	}
+	m, err := ManifestFromFile(manifestPath)
+	if err != nil {
+		return summary
+	}
+	summary.RunID, summary.Archive, summary.SHA256 = m.RunID, m.Archive, m.SHA256
+	for _, repo := range m.Repos {
+		switch {
+		case repo.Status == statusFailed:
+			summary.Failed++
+		case repo.Skipped == "":
+			summary.Repos++
+		}
+	}
+	return summary
+}
+
+// readMetrics reads the -metrics-file of a delta, nil when it cannot be read
+func readMetrics(filename string) []byte {
+	if filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+var urlInText = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s'"]+`)
+
+// sanitizeText removes the credentials of every URL of text
+func sanitizeText(text string) string {
+	return urlInText.ReplaceAllStringFunc(text, sanitizeURL)
+}
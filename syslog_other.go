@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// newSyslogSink fails, syslog is not available on this platform
+func newSyslogSink(address string, facility string, tag string) (logSink, error) {
+	return nil, fmt.Errorf("syslog output is not supported on %s, use -log instead", runtime.GOOS)
+}
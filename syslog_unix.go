@@ -0,0 +1,123 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL, "daemon": syslog.LOG_DAEMON,
+	"auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG, "lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS,
+	"uucp": syslog.LOG_UUCP, "cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5, "local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// syslogSeverities maps the levels of the log lines to syslog severities
+var syslogSeverities = map[logLevel]syslog.Priority{
+	levelInfo:    syslog.LOG_INFO,
+	levelWarning: syslog.LOG_WARNING,
+	levelError:   syslog.LOG_ERR,
+	levelSummary: syslog.LOG_NOTICE,
+}
+
+// newSyslogSink sends log lines to the syslog at address, "local" is the local syslog
+// socket and uses journald with structured fields when systemd runs it, otherwise
+// address is host:port over udp or a udp:// or tcp:// URL
+func newSyslogSink(address string, facility string, tag string) (logSink, error) {
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility '%s'", facility)
+	}
+	network, raddr := "", ""
+	switch {
+	case address == "local":
+		if _, err := os.Stat(journalSocket); err == nil {
+			return newJournalSink(fac, tag)
+		}
+	case strings.HasPrefix(address, "udp://"), strings.HasPrefix(address, "tcp://"):
+		network, raddr = address[:3], address[len("udp://"):]
+	default:
+		network, raddr = "udp", address
+	}
+	w, err := syslog.Dial(network, raddr, fac|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) Log(level logLevel, line string) error {
+	line = strings.TrimPrefix(line, "DEBUG ")
+	switch syslogSeverities[level] {
+	case syslog.LOG_WARNING:
+		return s.w.Warning(line)
+	case syslog.LOG_ERR:
+		return s.w.Err(line)
+	case syslog.LOG_NOTICE:
+		return s.w.Notice(line)
+	}
+	return s.w.Info(line)
+}
+
+// journalSink writes to journald with its native protocol, adding the run ID and the
+// repository a line is about as the CODEPACK_RUN_ID and CODEPACK_REPO journal fields
+type journalSink struct {
+	conn     *net.UnixConn
+	facility syslog.Priority
+	tag      string
+}
+
+func newJournalSink(facility syslog.Priority, tag string) (logSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalSink{conn: conn, facility: facility, tag: tag}, nil
+}
+
+// repoURL finds the repository URL a log line is about
+var repoURL = regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^\s'"]+`)
+
+func (j *journalSink) Log(level logLevel, line string) error {
+	msg := line
+	if i := strings.Index(line, "] "); i >= 0 && strings.HasPrefix(line, "DEBUG [") {
+		msg = line[i+2:]
+	}
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", msg)
+	journalField(&b, "PRIORITY", fmt.Sprint(int(syslogSeverities[level])))
+	journalField(&b, "SYSLOG_FACILITY", fmt.Sprint(int(j.facility>>3)))
+	journalField(&b, "SYSLOG_IDENTIFIER", j.tag)
+	journalField(&b, "CODEPACK_RUN_ID", runID)
+	if repo := repoURL.FindString(msg); repo != "" {
+		journalField(&b, "CODEPACK_REPO", repo)
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+// journalField appends a field, values spanning lines use the length prefixed form
+func journalField(b *bytes.Buffer, key string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+	b.WriteString(key + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
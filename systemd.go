@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdSocket is the notification socket of the systemd unit running CodePack,
+// empty when not started by systemd with Type=notify
+var systemdSocket = os.Getenv("NOTIFY_SOCKET")
+
+// sdNotify sends state to systemd, like READY=1 or STATUS=..., it does nothing
+// outside of a Type=notify unit
+func sdNotify(state string) {
+	if systemdSocket == "" {
+		return
+	}
+	addr := &net.UnixAddr{Name: systemdSocket, Net: "unixgram"}
+	if systemdSocket[0] == '@' {
+		// abstract socket namespace
+		addr.Name = "\x00" + systemdSocket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		log.Println("WARNING: cannot notify systemd:", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Println("WARNING: cannot notify systemd:", err)
+	}
+}
+
+// sdStatus reports the current phase of the run as the status line of the unit and the
+// phase of the -listen status
+func sdStatus(format string, a ...any) {
+	statusPage.SetPhase(fmt.Sprintf(format, a...))
+	progressEvents.Phase(fmt.Sprintf(format, a...))
+	if systemdSocket == "" {
+		return
+	}
+	sdNotify("STATUS=" + fmt.Sprintf(format, a...))
+}
+
+// startSystemd tells systemd the run started and pings the watchdog at half of
+// WatchdogSec when the unit sets one, the returned function stops the pings
+func startSystemd() func(err error) {
+	if systemdSocket == "" {
+		return func(error) {}
+	}
+	sdNotify("READY=1")
+	stop := make(chan struct{})
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		go func() {
+			ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					sdNotify("WATCHDOG=1")
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	return func(err error) {
+		close(stop)
+		if err != nil {
+			sdNotify("STOPPING=1\nSTATUS=failed: " + strings.ReplaceAll(err.Error(), "\n", " "))
+			return
+		}
+		sdNotify("STOPPING=1\nSTATUS=complete")
+	}
+}
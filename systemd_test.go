@@ -0,0 +1,89 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenNotify stands in for systemd, a unixgram socket systemdSocket points to
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	previous := systemdSocket
+	systemdSocket = name
+	t.Cleanup(func() { systemdSocket = previous })
+	return conn
+}
+
+// readNotify returns the next datagram sent to conn
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSystemdNotify(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		err     error
+		stopped string
+	}{
+		{name: "complete", stopped: "STOPPING=1\nSTATUS=complete"},
+		{name: "failed", err: errors.New("clone failed\nfor 2 repositories"), stopped: "STOPPING=1\nSTATUS=failed: clone failed for 2 repositories"},
+	} {
+		conn := listenNotify(t)
+		t.Setenv("WATCHDOG_USEC", "")
+		stop := startSystemd()
+		if got := readNotify(t, conn); got != "READY=1" {
+			t.Errorf("%s: sent %q at start, expected READY=1", tc.name, got)
+		}
+		sdStatus("cloning %d/%d", 42, 300)
+		if got := readNotify(t, conn); got != "STATUS=cloning 42/300" {
+			t.Errorf("%s: sent %q for the phase", tc.name, got)
+		}
+		stop(tc.err)
+		if got := readNotify(t, conn); got != tc.stopped {
+			t.Errorf("%s: sent %q at exit, expected %q", tc.name, got, tc.stopped)
+		}
+	}
+}
+
+func TestSystemdWatchdog(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", "")
+	stop := startSystemd()
+	defer stop(nil)
+	if got := readNotify(t, conn); got != "READY=1" {
+		t.Fatalf("sent %q at start, expected READY=1", got)
+	}
+	for i := 0; i < 2; i++ {
+		if got := readNotify(t, conn); got != "WATCHDOG=1" {
+			t.Fatalf("sent %q, expected a watchdog ping", got)
+		}
+	}
+}
+
+func TestSystemdNotifyOutsideUnit(t *testing.T) {
+	previous := systemdSocket
+	systemdSocket = ""
+	defer func() { systemdSocket = previous }()
+	// nothing to send to, neither may block or fail
+	startSystemd()(nil)
+	sdNotify("READY=1")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tagsPlaceholder is replaced by the label of the tag selection in -out, the destinations
+// of the configuration and -metrics-file, so runs of different tags write different files
+const tagsPlaceholder = "{{tags}}"
+
+// validTag keeps tags usable in file names and metric labels
+var validTag = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func validTags(tags []string) error {
+	for _, tag := range tags {
+		if !validTag.MatchString(tag) {
+			return fmt.Errorf("invalid tag '%s', use letters, digits, '.', '_' and '-'", tag)
+		}
+	}
+	return nil
+}
+
+// tagSelection is the repositories taking part in a run by their tags, those having any
+// of Tags or all of them with All. An empty selection takes every repository
+type tagSelection struct {
+	Tags []string
+	All  bool
+}
+
+// parseTagSelection reads the comma separated list of -tags
+func parseTagSelection(list string, all bool) (tagSelection, error) {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if err := validTags(tags); err != nil {
+		return tagSelection{}, err
+	}
+	if all && len(tags) == 0 {
+		return tagSelection{}, fmt.Errorf("-tags-all needs -tags")
+	}
+	sort.Strings(tags)
+	return tagSelection{Tags: tags, All: all}, nil
+}
+
+func (s tagSelection) matches(repo Repository) bool {
+	if len(s.Tags) == 0 {
+		return true
+	}
+	has := make(map[string]bool, len(repo.Tags))
+	for _, tag := range repo.Tags {
+		has[tag] = true
+	}
+	for _, tag := range s.Tags {
+		if has[tag] && !s.All {
+			return true
+		}
+		if !has[tag] && s.All {
+			return false
+		}
+	}
+	return s.All
+}
+
+// Label names the selection in file names and metrics, the tags joined by - for any of
+// them and by + for all of them, or all for an empty selection
+func (s tagSelection) Label() string {
+	if len(s.Tags) == 0 {
+		return "all"
+	}
+	if s.All {
+		return strings.Join(s.Tags, "+")
+	}
+	return strings.Join(s.Tags, "-")
+}
+
+// expand replaces the {{tags}} placeholder of name by the label of the selection
+func (s tagSelection) expand(name string) string {
+	return strings.ReplaceAll(name, tagsPlaceholder, s.Label())
+}
+
+// selectTagged leaves the repositories not matching the selection out of config, they do
+// not take part in the run at all and are neither cloned nor listed as skipped
+func selectTagged(config *Config, s tagSelection) (*Config, error) {
+	if len(s.Tags) == 0 {
+		return config, nil
+	}
+	selected := *config
+	selected.Repos = nil
+	for _, repo := range config.Repos {
+		if s.matches(repo) {
+			selected.Repos = append(selected.Repos, repo)
+		}
+	}
+	mode := "any"
+	if s.All {
+		mode = "all"
+	}
+	if len(selected.Repos) == 0 {
+		return nil, fmt.Errorf("No repository has %s of the tags %s", mode, strings.Join(s.Tags, ", "))
+	}
+	log.Printf("Selected %d of %d repositories with %s of the tags %s", len(selected.Repos), len(config.Repos), mode, strings.Join(s.Tags, ", "))
+	return &selected, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of a run, without -otel it is the no-op tracer which
+// records nothing and starts no goroutines
+var tracer = trace.NewNoopTracerProvider().Tracer("codepack")
+
+// tracing reports whether spans are exported, so span attributes that are costly to
+// compute, like repository sizes, are skipped otherwise
+var tracing bool
+
+// runContext carries the root span of the run to the clone and archive phases
+var runContext = context.Background()
+
+// startTracing exports spans over OTLP to the endpoint of the standard OTEL_EXPORTER_OTLP_*
+// variables, with grpc or http/protobuf (the default) as selected by OTEL_EXPORTER_OTLP_PROTOCOL.
+// It starts the root span of the run, which is ended and flushed by the returned function
+func startTracing() (func(err error), error) {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	var client otlptrace.Client
+	switch protocol {
+	case "", "http/protobuf":
+		client = otlptracehttp.NewClient()
+	case "grpc":
+		client = otlptracegrpc.NewClient()
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol '%s', use grpc or http/protobuf", protocol)
+	}
+	exporter, err := otlptrace.New(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "codepack"),
+			attribute.String("service.version", VERSION),
+		)),
+	)
+	tracer = provider.Tracer("codepack")
+	tracing = true
+
+	ctx, span := tracer.Start(context.Background(), "codepack.run", trace.WithAttributes(attribute.String("codepack.run_id", runID)))
+	runContext = ctx
+	return func(err error) {
+		endSpan(span, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Println("WARNING: cannot flush traces:", err)
+		}
+	}, nil
+}
+
+// endSpan records the outcome of a phase on span and ends it, cancellation is recorded as an error
+func endSpan(span trace.Span, err error) {
+	result := "success"
+	if errors.Is(err, context.Canceled) {
+		result = "cancelled"
+	}
+	if err != nil {
+		if result != "cancelled" {
+			result = "failure"
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.String("codepack.result", result))
+	span.End()
+}
+
+// startCloneSpan starts the span of the clone of repo
+func startCloneSpan(ctx context.Context, repo Repository, clonePath string) (context.Context, trace.Span) {
+	if !tracing {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	host := ""
+	if u, err := url.Parse(repo.URL); err == nil {
+		host = u.Host
+	}
+	return tracer.Start(ctx, "codepack.clone", trace.WithAttributes(
+		attribute.String("codepack.repo", clonePath),
+		attribute.String("url.host", host),
+	))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errRunInProgress rejects a manual backup requested while another backup of -watch runs
+var errRunInProgress = errors.New("a backup is already running, request the run again once it finished or start -watch with -queue-triggers")
+
+// runGate lets one backup of -watch run at a time. A delta waits for the running backup, a
+// manual backup is rejected while one runs unless queue is set
+type runGate struct {
+	running chan struct{}
+	queue   bool
+}
+
+func newRunGate(queue bool) *runGate {
+	return &runGate{running: make(chan struct{}, 1), queue: queue}
+}
+
+func (g *runGate) acquire() {
+	g.running <- struct{}{}
+}
+
+func (g *runGate) release() {
+	<-g.running
+}
+
+// trigger starts a manual backup of the whole configuration requested by source and
+// returns its run ID, queued when it waits for the running backup
+func (g *runGate) trigger(ctx context.Context, source string, opts watchOptions) (string, bool, error) {
+	queued := false
+	select {
+	case g.running <- struct{}{}:
+	default:
+		if !g.queue {
+			log.Printf("WARNING: rejecting the manual run requested by %s: %v", source, errRunInProgress)
+			return "", false, errRunInProgress
+		}
+		queued = true
+	}
+	id := newRunID(clock())
+	if queued {
+		log.Printf("Manual run %s requested by %s, it starts once the running backup finished", id, source)
+	} else {
+		log.Printf("Manual run %s requested by %s", id, source)
+	}
+	go func() {
+		if queued {
+			select {
+			case g.running <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		defer g.release()
+		if err := runManual(ctx, id, opts); err != nil {
+			log.Printf("WARNING: manual run %s failed: %v", id, err)
+			return
+		}
+		log.Printf("Manual run %s complete", id)
+	}()
+	return id, queued, nil
+}
+
+// runManual backs up every repository of the configuration of -watch with the run ID id
+func runManual(ctx context.Context, id string, opts watchOptions) error {
+	config, err := ConfigFromFile(opts.config, opts.format)
+	if err != nil {
+		err = fmt.Errorf("Failed to open Configuration file '%s': %w", opts.config, err)
+		statusPage.RecordRun(childSummary(runKindManual, id, time.Now(), "", err), nil)
+		return err
+	}
+	return runChild(ctx, config, opts, runKindManual, id)
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// notifyTriggerSignal does nothing, there is no SIGUSR1 on this platform
+func notifyTriggerSignal(trigger func(source string) (string, bool, error)) func() {
+	return func() {}
+}
@@ -0,0 +1,31 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyTriggerSignal starts a manual backup with trigger on every SIGUSR1 until the
+// returned function is called
+func notifyTriggerSignal(trigger func(source string) (string, bool, error)) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				trigger("SIGUSR1")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
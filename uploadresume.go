@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumableUploader is an Uploader that sends a file in chunks and records the chunks the
+// destination holds in an uploadState, so an upload that failed continues where it stopped
+type resumableUploader interface {
+	UploadFile(f *os.File, state *uploadState) error
+}
+
+// uploadState is the sidecar state of a resumable upload of the -local-copy, written next
+// to it as <local copy>.upload.json and removed once the upload is complete
+type uploadState struct {
+	FormatVersion int       `json:"format_version"`
+	URL           string    `json:"url"`
+	LocalCopy     string    `json:"local_copy"`
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"mod_time"`
+	ChunkSize     int64     `json:"chunk_size"`
+	Started       time.Time `json:"started"`
+	// Session is the resumable upload session of a gs:// destination
+	Session string `json:"session,omitempty"`
+	// Blocks are the chunks staged to an azblob:// destination
+	Blocks []int `json:"blocks,omitempty"`
+
+	path string
+	mu   sync.Mutex
+}
+
+const uploadStateSuffix = ".upload.json"
+
+func uploadStatePath(localCopy string) string {
+	return localCopy + uploadStateSuffix
+}
+
+// newUploadState starts the state of uploading the file of info at localCopy to target,
+// continuing the one on disk when it is for the same file, destination and chunk size
+func newUploadState(target string, localCopy string, info os.FileInfo, chunkSize int64) *uploadState {
+	state := &uploadState{
+		FormatVersion: stateFormatVersion,
+		URL:           sanitizeURL(target),
+		LocalCopy:     localCopy,
+		Size:          info.Size(),
+		ModTime:       info.ModTime().UTC(),
+		ChunkSize:     chunkSize,
+		Started:       time.Now().UTC(),
+		path:          uploadStatePath(localCopy),
+	}
+	previous, err := loadUploadState(localCopy)
+	if err != nil {
+		return state
+	}
+	if previous.URL != state.URL || previous.Size != state.Size || !previous.ModTime.Equal(state.ModTime) || previous.ChunkSize != chunkSize {
+		log.Printf("WARNING: upload state '%s' is for another archive or destination, starting the upload over", state.path)
+		return state
+	}
+	log.Printf("Continuing the upload of '%s' to '%s' started %s", localCopy, state.URL, previous.Started.Format(time.RFC3339))
+	return previous
+}
+
+// loadUploadState reads the sidecar state of the upload of localCopy
+func loadUploadState(localCopy string) (*uploadState, error) {
+	path := uploadStatePath(localCopy)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &uploadState{path: path}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Corrupt upload state '%s', delete it to upload from the start: %w", path, err)
+	}
+	if state.FormatVersion != stateFormatVersion {
+		return nil, fmt.Errorf("Upload state '%s' has format %d, this is format %d", path, state.FormatVersion, stateFormatVersion)
+	}
+	return state, nil
+}
+
+// chunks is the number of chunks of the upload, the last one shorter unless the size fills it
+func (s *uploadState) chunks() int {
+	return int((s.Size + s.ChunkSize - 1) / s.ChunkSize)
+}
+
+// chunk returns the offset and length of chunk i
+func (s *uploadState) chunk(i int) (int64, int64) {
+	offset := int64(i) * s.ChunkSize
+	if s.Size-offset < s.ChunkSize {
+		return offset, s.Size - offset
+	}
+	return offset, s.ChunkSize
+}
+
+// setSession records the resumable upload session of the destination and rewrites the state
+func (s *uploadState) setSession(session string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Session = session
+	return s.write()
+}
+
+// markBlock records chunk i as staged and rewrites the state
+func (s *uploadState) markBlock(i int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Blocks = append(s.Blocks, i)
+	return s.write()
+}
+
+func (s *uploadState) write() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Remove deletes the state file once the upload is complete
+func (s *uploadState) Remove() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// retryChunk runs send until it succeeds, at most retries times more with a doubling wait
+func retryChunk(retries int, what string, send func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = send(); err == nil || attempt >= retries {
+			return err
+		}
+		wait := time.Second << attempt
+		log.Printf("WARNING: sending %s failed, retrying in %s (%d/%d): %v", what, wait, attempt+1, retries, err)
+		if err := sleepContext(runContext, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// pruneUploadStates removes the upload states next to localCopy that were started more
+// than maxAge ago, cancelling their gs:// sessions. The destinations drop the chunks of
+// an abandoned upload on their own, Azure after a week and GCS once the session expires
+func pruneUploadStates(localCopy string, maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(filepath.Dir(localCopy), "*"+uploadStateSuffix))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		state, err := loadUploadState(strings.TrimSuffix(name, uploadStateSuffix))
+		if err != nil || time.Since(state.Started) < maxAge {
+			continue
+		}
+		if state.Session != "" {
+			cancelGCSSession(state.Session)
+		}
+		log.Printf("Removing upload state '%s' of an upload to '%s' abandoned since %s", name, state.URL, state.Started.Format(time.RFC3339))
+		if err := state.Remove(); err != nil {
+			log.Println("WARNING: cannot remove the upload state:", err)
+		}
+	}
+}
+
+// resumeUpload continues the interrupted upload of the -local-copy of an earlier run to
+// its destination for -resume-upload, without cloning anything. The manifest is read
+// from the archive, which is read once for it, its checksum and -verify-uploads
+func resumeUpload(dests []Destination, opts DestinationOptions, manifestPath string, statePath string, catalog bool) error {
+	if opts.LocalCopy == "" || len(dests) != 1 {
+		return fmt.Errorf("-resume-upload needs -local-copy and a single destination")
+	}
+	target := dests[0].URL
+	uploader, err := newUploader(target, opts)
+	if err != nil {
+		return err
+	}
+	if _, ok := uploader.(resumableUploader); !ok {
+		return fmt.Errorf("-resume-upload supports gs:// and azblob:// destinations, not '%s'", sanitizeURL(target))
+	}
+	state, err := loadUploadState(opts.LocalCopy)
+	if err != nil {
+		return fmt.Errorf("No upload of '%s' to resume: %w", opts.LocalCopy, err)
+	}
+	if state.URL != sanitizeURL(target) {
+		return fmt.Errorf("Upload state '%s' is for '%s', not '%s'", state.path, state.URL, sanitizeURL(target))
+	}
+
+	log.Printf("Reading '%s' to resume its upload", opts.LocalCopy)
+	digest := newStreamDigest()
+	manifest, sum, err := archiveManifest(opts.LocalCopy, digest)
+	if err != nil {
+		return err
+	}
+	manifest.SHA256 = sum
+	verifier, _ := uploader.(uploadVerifier)
+	if !opts.VerifyUploads || verifier == nil {
+		digest = nil
+	}
+
+	start := time.Now()
+	result := destinationResult{URL: sanitizeURL(target), Required: true, Status: "SUCCESS", Bytes: state.Size, SHA256: sum}
+	for attempt := 0; ; attempt++ {
+		result.Verified, err = uploadLocalCopy(target, opts, uploader, verifier, digest)
+		if err == nil || attempt >= opts.UploadRetries {
+			break
+		}
+		log.Printf("WARNING: %v, uploading again (%d/%d)", err, attempt+1, opts.UploadRetries)
+	}
+	if err != nil {
+		return err
+	}
+	result.Duration = time.Since(start).Round(time.Millisecond).String()
+
+	// the staging directory the failed run kept for -resume is no longer needed
+	if runState, err := loadRunState(statePath); err == nil {
+		os.RemoveAll(runState.Staging)
+		runState.Remove()
+	}
+	return finishArchive(manifest, manifestPath, target, []destinationResult{result}, catalog)
+}
+
+// archiveManifest reads the manifest embedded in the archive at name and its sha256,
+// writing the archive to digest as it is read
+func archiveManifest(name string, digest io.Writer) (*Manifest, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.New()
+	tr, err := openArchive(io.TeeReader(f, io.MultiWriter(hash, digest)), info.Size(), archiveLimits{}.withDefaults(info.Size()))
+	if err != nil {
+		return nil, "", fmt.Errorf("Cannot read the compression header of '%s': %w", name, err)
+	}
+	defer tr.Close()
+	var manifest *Manifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("Corrupt archive '%s': %w", name, err)
+		}
+		if strings.TrimPrefix(header.Name, "codepack/") != manifestName {
+			continue
+		}
+		manifest = &Manifest{}
+		if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+			return nil, "", fmt.Errorf("Corrupt manifest '%s': %w", header.Name, err)
+		}
+	}
+	if err := tr.Drain(); err != nil {
+		return nil, "", fmt.Errorf("Corrupt compressed stream of '%s': %w", name, err)
+	}
+	if _, err := io.Copy(io.MultiWriter(hash, digest), f); err != nil {
+		return nil, "", err
+	}
+	if manifest == nil {
+		return nil, "", fmt.Errorf("Archive '%s' has no %s", name, manifestName)
+	}
+	return manifest, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// stagedEntry is the type and size of a file the archive must hold
+type stagedEntry struct {
+	typeflag byte
+	size     int64
+}
+
+// stagedEntries lists what the archiver writes for config from staging: every entry of
+// every repository and the manifest, keyed by the name inside the archive below codepack/
+func stagedEntries(staging billy.Filesystem, config *Config) (map[string]stagedEntry, error) {
+	repoPaths := make(map[string]bool)
+	for _, repo := range config.Repos {
+		repoPaths[path.Join(repo.Path, repo.Name)] = true
+	}
+	entries := make(map[string]stagedEntry)
+	add := func(name string, info fs.FileInfo) {
+		entry := stagedEntry{typeflag: tar.TypeReg, size: info.Size()}
+		switch {
+		case info.IsDir():
+			entry = stagedEntry{typeflag: tar.TypeDir}
+		case info.Mode()&fs.ModeSymlink != 0:
+			entry = stagedEntry{typeflag: tar.TypeSymlink}
+		}
+		entries[filepath.ToSlash(name)] = entry
+	}
+	for clonePath := range repoPaths {
+		err := util.Walk(staging, clonePath, func(name string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && name != clonePath && repoPaths[filepath.ToSlash(name)] {
+				return filepath.SkipDir
+			}
+			add(name, info)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	info, err := staging.Lstat(manifestName)
+	if err != nil {
+		return nil, err
+	}
+	add(manifestName, info)
+	return entries, nil
+}
+
+// verifyArchive reads the tarball at name back, checking that the compressed stream and every
+// header are intact, that it holds every entry of expected with the same size, that the
+// embedded manifest lists repos repositories and that the whole file matches checksum.
+// Reading stops once the archive exceeds limits
+func verifyArchive(name string, checksum string, expected map[string]stagedEntry, repos int, limits archiveLimits) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	tr, err := openArchive(io.TeeReader(f, hash), info.Size(), limits)
+	if err != nil {
+		return fmt.Errorf("Cannot read the compression header: %w", err)
+	}
+	defer tr.Close()
+	found := make(map[string]bool)
+	count := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Corrupt entry after %d entries: %w", count, err)
+		}
+		count++
+		entryName := strings.TrimPrefix(header.Name, "codepack/")
+		var data []byte
+		if entryName == manifestName {
+			data, err = io.ReadAll(tr)
+		} else {
+			_, err = io.Copy(io.Discard, tr)
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read '%s': %w", displayName(header.Name), err)
+		}
+
+		want, ok := expected[entryName]
+		if !ok {
+			continue
+		}
+		if header.Typeflag != want.typeflag || (want.typeflag == tar.TypeReg && header.Size != want.size) {
+			return fmt.Errorf("Entry '%s' has type %c and %d bytes, the staging directory has type %c and %d bytes",
+				displayName(header.Name), header.Typeflag, header.Size, want.typeflag, want.size)
+		}
+		found[entryName] = true
+		if data != nil {
+			var embedded Manifest
+			if err := json.Unmarshal(data, &embedded); err != nil {
+				return fmt.Errorf("Corrupt manifest '%s': %w", header.Name, err)
+			}
+			if len(embedded.Repos) != repos {
+				return fmt.Errorf("Manifest '%s' lists %d repositories, expected %d", header.Name, len(embedded.Repos), repos)
+			}
+		}
+	}
+	// the checksum of a compressed stream is only verified once it is read to its end
+	if err := tr.Drain(); err != nil {
+		return fmt.Errorf("Corrupt compressed stream: %w", err)
+	}
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+
+	if len(found) != len(expected) {
+		var missing []string
+		for entryName := range expected {
+			if !found[entryName] {
+				missing = append(missing, entryName)
+			}
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("%d entries of the staging directory are missing, like '%s'", len(missing), displayName(missing[0]))
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != checksum {
+		return fmt.Errorf("sha256 is %s, the manifest records %s", sum, checksum)
+	}
+	log.Printf("Verified '%s': %d entries, sha256 %s", name, count, checksum)
+	return nil
+}
+
+// verifyArchives verifies every local archive written by a run, remote destinations cannot
+// be read back and are skipped with a warning. An archive failing verification is deleted
+func verifyArchives(results []destinationResult, dests []Destination, opts DestinationOptions, staging billy.Filesystem, config *Config, manifest *Manifest, limits archiveLimits) error {
+	expected, err := stagedEntries(staging, config)
+	if err != nil {
+		return fmt.Errorf("Cannot list the staging directory: %w", err)
+	}
+	// entries renamed by -rename-invalid are expected under their archive name
+	for _, repo := range manifest.Repos {
+		for _, rename := range repo.Renamed {
+			original, err := unescapeName(rename.Original)
+			if err != nil {
+				return err
+			}
+			if entry, ok := expected[original]; ok {
+				delete(expected, original)
+				expected[rename.Entry] = entry
+			}
+		}
+	}
+	var local []string
+	for i, result := range results {
+		if result.Status != "SUCCESS" {
+			continue
+		}
+		if uploader, _ := newUploader(dests[i].URL, opts); uploader != nil {
+			if opts.LocalCopy == "" {
+				log.Printf("WARNING: cannot verify '%s', only local archives are read back", result.URL)
+			}
+			continue
+		}
+		local = append(local, dests[i].URL)
+	}
+	if opts.LocalCopy != "" {
+		local = append(local, opts.LocalCopy)
+	}
+
+	for _, name := range local {
+		if err := verifyArchive(name, manifest.SHA256, expected, len(manifest.Repos), limits); err != nil {
+			log.Printf("Deleting '%s', it failed verification", name)
+			if err := os.Remove(name); err != nil {
+				log.Println("WARNING: cannot delete the archive:", err)
+			}
+			return fmt.Errorf("Verification of '%s' failed: %w", name, err)
+		}
+	}
+	return nil
+}
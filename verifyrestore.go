@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// restoredURL renders the -against template for a repository, the template receives
+// the name, path and url of the repository as {{ .name }}, {{ .path }} and {{ .url }},
+// also accepted as {{ .Name }}, {{ .Path }} and {{ .URL }} like the fields of the manifest
+func restoredURL(tmpl *template.Template, repo ManifestRepo) (string, error) {
+	var url strings.Builder
+	err := tmpl.Execute(&url, map[string]string{
+		"name": repo.Name,
+		"path": repo.Path,
+		"url":  repo.URL,
+		"Name": repo.Name,
+		"Path": repo.Path,
+		"URL":  repo.URL,
+	})
+	return url.String(), err
+}
+
+func verifyRestoreCommand(args []string) error {
+	flags := flag.NewFlagSet("verify-restore", flag.ExitOnError)
+	manifestPtr := flags.String("manifest", "", "manifest of the backup that was restored")
+	againstPtr := flags.String("against", "", "URL template of the restored repositories, like https://new-host/{{ .path }}/{{ .name }}.git")
+	cacheDirPtr := flags.String("cache-dir", "", "compare the mirrors of this -cache-dir instead of restored repositories, checking their references resolve to stored objects, -manifest defaults to the manifest of its last run")
+	workersPtr := flags.Int("workers", 10, "Number of concurrent remote listings")
+	parseFlags(flags, args)
+
+	if *cacheDirPtr != "" {
+		if *againstPtr != "" {
+			return fmt.Errorf("verify-restore takes -against or -cache-dir, not both")
+		}
+		if *manifestPtr == "" {
+			*manifestPtr = filepath.Join(*cacheDirPtr, manifestName)
+		}
+	} else if *manifestPtr == "" || *againstPtr == "" {
+		return fmt.Errorf("verify-restore requires -manifest and -against, or -cache-dir")
+	}
+	m, err := ManifestFromFile(*manifestPtr)
+	if err != nil {
+		return err
+	}
+	workers = *workersPtr
+
+	var results []remoteRefsResult
+	if *cacheDirPtr != "" {
+		results = compareRemotes(m, func(repo ManifestRepo) (string, error) {
+			return filepath.Join(*cacheDirPtr, filepath.FromSlash(repo.ClonePath())), nil
+		}, cacheRefs)
+	} else {
+		tmpl, err := template.New("against").Option("missingkey=error").Parse(*againstPtr)
+		if err != nil {
+			return fmt.Errorf("Invalid -against template: %w", err)
+		}
+		results = compareRemotes(m, func(repo ManifestRepo) (string, error) { return restoredURL(tmpl, repo) }, listRemoteRefs(envAuth()))
+	}
+
+	// Only references missing from or different on the restored remote fail the
+	// verification, references added since the restore are reported but allowed
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.err != nil:
+			failed++
+			log.Printf("%s: cannot list references of %s: %v", result.repo.ClonePath(), sanitizeURL(result.url), result.err)
+		case len(result.diff.Deleted) > 0 || len(result.diff.Changed) > 0:
+			failed++
+			log.Printf("%s: %d missing, %d mismatched on %s", result.repo.ClonePath(), len(result.diff.Deleted), len(result.diff.Changed), sanitizeURL(result.url))
+			for _, name := range result.diff.Deleted {
+				log.Printf("  missing %s", name)
+			}
+			for _, name := range result.diff.Changed {
+				log.Printf("  mismatched %s", name)
+			}
+		case len(result.diff.Added) > 0:
+			log.Printf("%s: restored, %d references not in the backup", result.repo.ClonePath(), len(result.diff.Added))
+		}
+	}
+
+	log.Printf("%d of %d repositories restored with every captured reference", len(results)-failed, len(results))
+	if failed > 0 {
+		return fmt.Errorf("%d repositories are missing references of the backup", failed)
+	}
+	return nil
+}
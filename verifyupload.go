@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// uploadBlockSize is the size of the blocks of an upload whose CRC32C is kept, so a
+	// sample of them can be read back and compared without the local data
+	uploadBlockSize = 4 * 1024 * 1024
+	// uploadSampleBlocks is the number of blocks read back from a destination that cannot
+	// report a checksum, the last block is always one of them
+	uploadSampleBlocks = 8
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// uploadVerifier is an Uploader that can check the object it uploaded against the
+// digest of the stream it was sent, returning what it compared
+type uploadVerifier interface {
+	Verify(d *streamDigest) (string, error)
+}
+
+// streamDigest sums the stream sent to an upload while it is sent: its size, MD5, CRC32C
+// and the CRC32C of every block of uploadBlockSize
+type streamDigest struct {
+	Size   int64
+	md5    hash.Hash
+	crc    uint32
+	blocks []uint32
+	block  uint32
+	filled int
+}
+
+func newStreamDigest() *streamDigest {
+	return &streamDigest{md5: md5.New()}
+}
+
+func (d *streamDigest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.Size += int64(n)
+	d.md5.Write(p)
+	d.crc = crc32.Update(d.crc, castagnoli, p)
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > uploadBlockSize-d.filled {
+			chunk = chunk[:uploadBlockSize-d.filled]
+		}
+		d.block = crc32.Update(d.block, castagnoli, chunk)
+		d.filled += len(chunk)
+		p = p[len(chunk):]
+		if d.filled == uploadBlockSize {
+			d.blocks = append(d.blocks, d.block)
+			d.block, d.filled = 0, 0
+		}
+	}
+	return n, nil
+}
+
+// MD5 and CRC32C are the sums of the whole stream
+func (d *streamDigest) MD5() []byte    { return d.md5.Sum(nil) }
+func (d *streamDigest) CRC32C() uint32 { return d.crc }
+
+// blockSums are the CRC32C of every block, the last one shorter unless the stream fills it
+func (d *streamDigest) blockSums() []uint32 {
+	if d.filled > 0 {
+		return append(d.blocks[:len(d.blocks):len(d.blocks)], d.block)
+	}
+	return d.blocks
+}
+
+// checkSize fails when the destination holds size bytes instead of the ones sent
+func (d *streamDigest) checkSize(size int64) error {
+	if size != d.Size {
+		return fmt.Errorf("the destination holds %d bytes, %d were uploaded", size, d.Size)
+	}
+	return nil
+}
+
+// checkRead reads the object back through readAt, in full when it is at most fullMax bytes
+// and as a sample of uploadSampleBlocks blocks otherwise, and compares the CRC32C of what
+// it read with the one sent
+func (d *streamDigest) checkRead(readAt io.ReaderAt, fullMax int64) (string, error) {
+	sums := d.blockSums()
+	if d.Size <= fullMax || len(sums) == 0 {
+		crc := crc32.New(castagnoli)
+		if _, err := io.Copy(crc, io.NewSectionReader(readAt, 0, d.Size)); err != nil {
+			return "", fmt.Errorf("cannot read back the upload: %w", err)
+		}
+		if crc.Sum32() != d.crc {
+			return "", fmt.Errorf("the CRC32C read back is %08x, %08x was uploaded", crc.Sum32(), d.crc)
+		}
+		return fmt.Sprintf("all %d bytes read back", d.Size), nil
+	}
+
+	sample := rand.Perm(len(sums) - 1)
+	if len(sample) > uploadSampleBlocks-1 {
+		sample = sample[:uploadSampleBlocks-1]
+	}
+	sample = append(sample, len(sums)-1)
+	sort.Ints(sample)
+	buf := make([]byte, uploadBlockSize)
+	for _, i := range sample {
+		offset := int64(i) * uploadBlockSize
+		n, err := readAt.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("cannot read back block %d of the upload: %w", i, err)
+		}
+		expected := int64(uploadBlockSize)
+		if remaining := d.Size - offset; remaining < expected {
+			expected = remaining
+		}
+		if int64(n) != expected || crc32.Checksum(buf[:n], castagnoli) != sums[i] {
+			return "", fmt.Errorf("block %d at offset %d read back differs from the one uploaded", i, offset)
+		}
+	}
+	return fmt.Sprintf("%d of %d blocks read back", len(sample), len(sums)), nil
+}
+
+// checkMD5 fails when the MD5 a destination reports differs from the one sent, an empty
+// md5 is not checked
+func (d *streamDigest) checkMD5(sum []byte) error {
+	if len(sum) > 0 && !bytes.Equal(sum, d.MD5()) {
+		return fmt.Errorf("the destination reports MD5 %x, %x was uploaded", sum, d.MD5())
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchOptions configure -watch, args are the command line the backups are started with
+type watchOptions struct {
+	config   string
+	format   string
+	outs     *stringsFlag
+	debounce time.Duration
+	args     []string
+	// metricsFile is the -metrics-file of the deltas, read by the -listen server
+	metricsFile string
+	// queueTriggers runs a manual backup requested during another backup after it
+	queueTriggers bool
+}
+
+// watchConfig backs up the repositories added or changed in the configuration every time
+// the file changes, until ctx is cancelled. Each delta is written by a separate run of
+// CodePack with a configuration of only those repositories to a timestamped archive next to
+// every output destination, the run report of a delta has the kind watch
+func watchConfig(ctx context.Context, opts watchOptions) error {
+	if isRemoteConfig(opts.config) || opts.config == "-" {
+		return fmt.Errorf("-watch requires a local configuration file")
+	}
+	previous, err := ConfigFromFile(opts.config, opts.format)
+	if err != nil {
+		return configError(fmt.Errorf("Failed to open Configuration file '%s': %w", opts.config, err))
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// the directory is watched as sync tools often replace the file by renaming a new one over it
+	if err := watcher.Add(filepath.Dir(opts.config)); err != nil {
+		return err
+	}
+	log.Printf("Watching '%s' for changes", opts.config)
+	sdStatus("watching %s", opts.config)
+
+	runs := newRunGate(opts.queueTriggers)
+	trigger := func(source string) (string, bool, error) {
+		return runs.trigger(ctx, source, opts)
+	}
+	statusPage.SetTrigger(trigger)
+	defer notifyTriggerSignal(trigger)()
+
+	target, _ := filepath.Abs(opts.config)
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			log.Println("WARNING: watching the configuration:", err)
+		case event := <-watcher.Events:
+			if name, _ := filepath.Abs(event.Name); name != target || event.Op == fsnotify.Chmod {
+				continue
+			}
+			debounce = time.After(opts.debounce)
+		case <-debounce:
+			debounce = nil
+			current, err := ConfigFromFile(opts.config, opts.format)
+			if err != nil {
+				log.Printf("WARNING: ignoring the change of '%s', it cannot be loaded: %v", opts.config, err)
+				continue
+			}
+			delta := changedRepos(previous, current)
+			previous = current
+			if len(delta.Repos) == 0 {
+				log.Printf("Configuration '%s' changed without added or changed repositories", opts.config)
+				continue
+			}
+			runs.acquire()
+			err = runChild(ctx, delta, opts, runKindWatch, "")
+			runs.release()
+			if err != nil {
+				log.Println("WARNING: delta backup failed:", err)
+			}
+		}
+	}
+}
+
+// changedRepos returns current with only the repositories that are new or whose settings
+// differ from previous, keyed by their clone path
+func changedRepos(previous *Config, current *Config) *Config {
+	before := make(map[string]string)
+	for _, repo := range previous.Repos {
+		before[path.Join(repo.Path, repo.Name)] = repoFingerprint(repo)
+	}
+	delta := *current
+	delta.Repos = nil
+	for _, repo := range current.Repos {
+		fingerprint, ok := before[path.Join(repo.Path, repo.Name)]
+		if !ok || fingerprint != repoFingerprint(repo) {
+			delta.Repos = append(delta.Repos, repo)
+		}
+	}
+	return &delta
+}
+
+func repoFingerprint(repo Repository) string {
+	data, _ := json.Marshal(repo)
+	return string(data)
+}
+
+// runName is the archive of a backup of -watch next to out, label is delta for the
+// repositories of a change of the configuration with the time as stamp, or manual for a
+// triggered backup with its run ID, as two can be requested in the same second
+func runName(out string, label string, stamp string) string {
+	exts := []string{".tgz"}
+	for _, format := range archiveFormats {
+		exts = append(exts, format.extension)
+	}
+	// .tar is a suffix of the compressed extensions
+	sort.Slice(exts, func(i, j int) bool { return len(exts[i]) > len(exts[j]) })
+	for _, ext := range exts {
+		if strings.HasSuffix(out, ext) {
+			return strings.TrimSuffix(out, ext) + "-" + label + "-" + stamp + ext
+		}
+	}
+	return out + "-" + label + "-" + stamp
+}
+
+// runChild backs up the repositories of delta with a run of CodePack of kind, watch for a
+// delta or manual for a triggered backup of the whole configuration, with the run ID id
+// unless it is empty. The configuration is handed over as JSON in a temporary file
+func runChild(ctx context.Context, delta *Config, opts watchOptions, kind string, id string) error {
+	f, err := os.CreateTemp("", "codepack-delta-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	// the delta destinations are handed over in the configuration, the -out of the
+	// command line would replace them
+	var dests []Destination
+	now := clock()
+	label, stamp := "delta", now.UTC().Format("20060102T150405Z")
+	if kind == runKindManual {
+		label, stamp = runKindManual, id
+	}
+	for _, dest := range outputDestinations(opts.outs, delta) {
+		dest.URL = runName(dest.URL, label, stamp)
+		dests = append(dests, dest)
+	}
+	delta.Destinations = dests
+	// the repositories have the defaults applied already, the run loading them again would
+	// prepend a default path_prefix twice
+	delta.Defaults = RepoDefaults{}
+	if err := json.NewEncoder(f).Encode(delta); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	out := dests[0].URL
+	if kind == runKindManual {
+		log.Printf("Backing up all %d repositories to '%s' for manual run %s", len(delta.Repos), sanitizeURL(out), id)
+	} else {
+		log.Printf("Backing up %d added or changed repositories to '%s'", len(delta.Repos), sanitizeURL(out))
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// later flags take precedence, so the delta settings are appended to the original command
+	// line, the -listen server stays with the watching process
+	args := append(withoutFlag(withoutFlag(opts.args, "out"), "listen"),
+		"-watch=false", "-config", f.Name(), "-config-format", "json",
+		"-manifest", defaultManifestPath(out), "-state", defaultStatePath(out), "-run-kind", kind)
+	if id != "" {
+		args = append(args, "-run-id", id)
+	}
+	if opts.metricsFile != "" {
+		args = append(args, "-metrics-file", opts.metricsFile)
+	}
+	if progressEvents != nil {
+		// the run writes its events to the stream of the watching process, the first of ExtraFiles
+		args = append(withoutFlag(withoutFlag(args, "progress-fd"), "progress-file"), "-progress-fd", "3")
+	}
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if progressEvents != nil {
+		cmd.ExtraFiles = []*os.File{progressEvents.file}
+	}
+	// the run is not the process systemd supervises
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "NOTIFY_SOCKET=") && !strings.HasPrefix(env, flagEnv(flag.CommandLine, "out")+"=") && !strings.HasPrefix(env, flagEnv(flag.CommandLine, "listen")+"=") && !strings.HasPrefix(env, flagEnv(flag.CommandLine, "progress-file")+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	statusPage.SetPhase(fmt.Sprintf("backing up %d repositories to %s", len(delta.Repos), archiveName(out)))
+	progressEvents.Phase(fmt.Sprintf("backing up %d repositories to %s", len(delta.Repos), archiveName(out)))
+	err = cmd.Run()
+	statusPage.RecordRun(childSummary(kind, id, now, defaultManifestPath(out), err), readMetrics(opts.metricsFile))
+	statusPage.SetPhase("watching " + opts.config)
+	progressEvents.Phase("watching " + opts.config)
+	return err
+}
+
+// withoutFlag is a copy of args without every occurrence of the flag name and its value
+func withoutFlag(args []string, name string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(kept, args[i:]...)
+		}
+		flagName := strings.TrimLeft(arg, "-")
+		if len(arg)-len(flagName) == 0 || len(arg)-len(flagName) > 2 {
+			kept = append(kept, arg)
+			continue
+		}
+		if flagName == name {
+			// the value is the next argument
+			i++
+			continue
+		}
+		if strings.HasPrefix(flagName, name+"=") {
+			continue
+		}
+		kept = append(kept, arg)
+	}
+	return kept
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChangedReposKeepsSettings(t *testing.T) {
+	previous := &Config{Repos: []Repository{{Name: "a", URL: "https://example.com/a.git"}, {Name: "b", URL: "https://example.com/b.git"}}}
+	current := &Config{
+		Repos: []Repository{
+			{Name: "a", URL: "https://example.com/a.git"},
+			{Name: "b", URL: "https://example.com/b.git", Region: "eu-west-1"},
+			{Name: "c", URL: "https://example.com/c.git"},
+		},
+		Notify:            &NotifyConfig{},
+		Destinations:      []Destination{{URL: "exec://store/backup.tar.gz"}},
+		PathTemplate:      "{{ .host }}",
+		Plugins:           map[string]ExecPlugin{"store": {Command: []string{"true"}}},
+		Hosts:             map[string]HostTransport{"example.com": {}},
+		HostAuth:          map[string]RepoAuth{"example.com": {}},
+		HostAuthUnmatched: hostAuthFail,
+	}
+	delta := changedRepos(previous, current)
+	var names []string
+	for _, repo := range delta.Repos {
+		names = append(names, repo.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"b", "c"}) {
+		t.Errorf("delta has the repositories %v, expected the changed b and added c", names)
+	}
+	delta.Repos = current.Repos
+	if !reflect.DeepEqual(delta, current) {
+		t.Errorf("delta lost settings of the configuration:\n%+v\n%+v", delta, current)
+	}
+}
+
+func TestWatchDeltaPluginDestination(t *testing.T) {
+	dir := t.TempDir()
+	newTestRepo(t, filepath.Join(dir, "src"), [2]string{"README.md", "app\n"})
+	config := `defaults:
+  path_prefix: team
+plugins:
+  store:
+    command: ["sh", "-c", "cat > '` + dir + `/{{ .archive }}'"]
+destinations:
+  - url: exec://store/backup.tar.gz
+repos:
+  - name: app
+    url: ` + filepath.Join(dir, "src") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "codepack.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	// the runs of the deltas start the test binary, which runs main with it set
+	t.Setenv("CODEPACK_TEST_MAIN", "1")
+
+	current, err := ConfigFromFile("codepack.yaml", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := watchOptions{config: "codepack.yaml", outs: newStringsFlag("unused.tar.gz"), args: []string{"-no-catalog"}}
+	// every delta of -watch is a run of its own, the second must find the plugin as the first did
+	for i := 0; i < 2; i++ {
+		delta := changedRepos(&Config{}, current)
+		if err := runChild(context.Background(), delta, opts, runKindWatch, ""); err != nil {
+			t.Fatalf("delta %d: %v", i+1, err)
+		}
+	}
+	archives, err := filepath.Glob(filepath.Join(dir, "backup-delta-*.tar.gz"))
+	if err != nil || len(archives) == 0 {
+		t.Fatalf("the plugin received no delta archive: %v", err)
+	}
+	readArchiveEntry(t, archives[0], "codepack/team/app/HEAD")
+}